@@ -0,0 +1,125 @@
+use anyhow::{bail, Result};
+use hammer_core::Logger;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+
+use crate::branding::write;
+
+// Expectations on the content of the image, in tests/*.test next to hammer.yaml, one
+// assertion per line:
+//
+//   file /etc/hammer/hammer.toml      exists
+//   absent /etc/ssh/ssh_host_rsa_key  does not exist
+//   package hammer                    is installed
+//   no-package apt-listchanges        is not installed
+//   service hammer-update.timer enabled   (or disabled)
+//   command hammer --version          exits 0, run with sh -c
+//
+// They run in the finished chroot as live-build's last hook, so a failed one stops the
+// build before the ISO is assembled. The results are left in the chroot for the builder.
+
+pub const TESTS_DIR: &str = "tests";
+/// Results inside the chroot, "PASS ..." or "FAIL ..." per assertion; removed when all pass
+pub const RESULT: &str = "tmp/hammer-tests.result";
+const HOOK: &str = "hooks/normal/9999-hammer-tests.hook.chroot";
+
+const PRELUDE: &str = r#"#!/bin/sh
+# Written by hammer-builder from tests/: image content assertions
+RESULT=/tmp/hammer-tests.result
+: > "$RESULT"
+failed=0
+installed() { dpkg-query -W -f='${Status}' "$1" 2>/dev/null | grep -q 'ok installed'; }
+enabled() { [ "$(systemctl is-enabled "$1" 2>/dev/null)" = enabled ]; }
+not() { ! "$@"; }
+check() {
+    name=$1; shift
+    if "$@" >/dev/null 2>&1; then
+        echo "PASS $name" >> "$RESULT"
+    else
+        echo "FAIL $name" >> "$RESULT"
+        failed=$((failed + 1))
+    fi
+}
+"#;
+
+const EPILOGUE: &str = r#"cat "$RESULT"
+if [ "$failed" -gt 0 ]; then
+    echo "$failed image test(s) failed"
+    exit 1
+fi
+rm -f "$RESULT"
+"#;
+
+fn quote(s: &str) -> String {
+    format!("'{}'", s.replace('\'', "'\\''"))
+}
+
+/// The shell command of one assertion line; None for blank and comment lines
+fn assertion(line: &str) -> Result<Option<String>> {
+    let line = line.trim();
+    if line.is_empty() || line.starts_with('#') {
+        return Ok(None);
+    }
+    let (kind, rest) = line.split_once(char::is_whitespace).map(|(k, r)| (k, r.trim())).unwrap_or((line, ""));
+    if rest.is_empty() {
+        bail!("'{}' needs an argument", kind);
+    }
+    let command = match kind {
+        "file" => format!("test -e {}", quote(rest)),
+        "absent" => format!("not test -e {}", quote(rest)),
+        "package" => format!("installed {}", quote(rest)),
+        "no-package" => format!("not installed {}", quote(rest)),
+        "service" => match rest.split_whitespace().collect::<Vec<_>>()[..] {
+            [unit, "enabled"] => format!("enabled {}", quote(unit)),
+            [unit, "disabled"] => format!("not enabled {}", quote(unit)),
+            _ => bail!("expected 'service UNIT enabled' or 'service UNIT disabled'"),
+        },
+        "command" => format!("sh -c {}", quote(rest)),
+        _ => bail!("unknown assertion '{}' (file, absent, package, no-package, service, command)", kind),
+    };
+    Ok(Some(command))
+}
+
+/// Writes the assertions of `dir` as the last chroot hook; false when there are none
+pub fn apply(dir: &Path, config: &Path) -> Result<bool> {
+    let mut files: Vec<PathBuf> = fs::read_dir(dir)
+    .map(|entries| entries.flatten().map(|e| e.path()).filter(|p| p.extension().is_some_and(|x| x == "test")).collect())
+    .unwrap_or_default();
+    if files.is_empty() {
+        let _ = fs::remove_file(config.join(HOOK));
+        return Ok(false);
+    }
+    files.sort();
+
+    let mut script = PRELUDE.to_string();
+    let mut count = 0;
+    for file in &files {
+        let name = file.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+        for (number, line) in fs::read_to_string(file)?.lines().enumerate() {
+            let command = match assertion(line) {
+                Ok(Some(command)) => command,
+                Ok(None) => continue,
+                Err(e) => bail!("{}:{}: {}", file.display(), number + 1, e),
+            };
+            script.push_str(&format!("check {} {}\n", quote(&format!("{}:{} {}", name, number + 1, line.trim())), command));
+            count += 1;
+        }
+    }
+    script.push_str(EPILOGUE);
+
+    let hook_path = config.join(HOOK);
+    write(&hook_path, &script)?;
+    fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o755))?;
+    Logger::info(&format!("{} image assertion(s) from {} will run in the chroot", count, dir.display()));
+    Ok(true)
+}
+
+/// The failed assertions a run left in the live-build `chroot`
+pub fn failures(chroot: &Path) -> Vec<String> {
+    fs::read_to_string(chroot.join(RESULT))
+    .unwrap_or_default()
+    .lines()
+    .filter_map(|l| l.strip_prefix("FAIL ").map(str::to_string))
+    .collect()
+}
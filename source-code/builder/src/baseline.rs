@@ -0,0 +1,51 @@
+use anyhow::Result;
+use hammer_core::Logger;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::Path;
+
+use crate::branding::write;
+
+// What the image ships, recorded in the finished chroot for `hammer deviations` to compare
+// an installed system against. It runs as live-build's second to last hook, before the
+// image tests, and lands in /usr/lib, which no package owns, so updates keep it:
+//
+//   image.json   {"format": 1, "image": "hackeros", "built": "...", "builder": "..."}
+//   packages     name<TAB>version of every installed package
+//   manual       packages installed on purpose rather than as dependencies
+//   etc.sha256   sha256sum of every file in /etc
+
+pub const DIR: &str = "/usr/lib/HackerOS/hammer/image";
+const FORMAT: u32 = 1;
+const HOOK: &str = "hooks/normal/9998-hammer-baseline.hook.chroot";
+
+/// Writes the hook recording the baseline of `image` into the live-build `config` directory
+pub fn apply(config: &Path, image: &str) -> Result<()> {
+    let info = serde_json::json!({
+        "format": FORMAT,
+        "image": image,
+        "built": chrono::Utc::now().to_rfc3339(),
+        "builder": env!("CARGO_PKG_VERSION"),
+    });
+    let hook = format!(
+        r#"#!/bin/sh
+# Written by hammer-builder: what the image ships, the baseline of `hammer deviations`
+set -e
+dir={dir}
+mkdir -p "$dir"
+dpkg-query -W -f '${{Package}}\t${{Version}}\n' | sort > "$dir/packages"
+apt-mark showmanual | sort > "$dir/manual"
+find /etc -xdev -type f -print0 | sort -z | xargs -0 -r sha256sum > "$dir/etc.sha256"
+cat > "$dir/image.json" <<'EOF'
+{info}
+EOF
+"#,
+        dir = DIR,
+        info = info
+    );
+    let hook_path = config.join(HOOK);
+    write(&hook_path, &hook)?;
+    fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o755))?;
+    Logger::info(&format!("Image baseline for hammer deviations: {}", DIR));
+    Ok(())
+}
@@ -0,0 +1,182 @@
+use anyhow::{bail, Context, Result};
+use hammer_core::{run_command, Logger};
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+
+use crate::manifest;
+
+// A theme directory applied to the ISO boot menu, the installer and the installed system.
+// It is declared in hammer.yaml next to ./config:
+//
+//   branding:
+//     theme: ./theme
+//     name: hackeros
+//
+// and may hold, all optional:
+//   wallpaper.png   desktop background
+//   splash.png      background of the ISO boot menu (GRUB and isolinux)
+//   plymouth/       boot splash; the directory with NAME.plymouth in it
+//   grub/           GRUB theme of the installed system, with theme.txt
+//   logos/          logo.png (installer banner, pixmaps) and any further logos
+
+/// Bootloader templates live-build uses when config/bootloaders has none
+const LB_BOOTLOADERS: &str = "/usr/share/live/build/bootloaders";
+
+pub struct Branding {
+    theme: PathBuf,
+    name: String,
+}
+
+impl Branding {
+    /// The branding declared in `file`; None when the file or its branding section is missing
+    pub fn load(file: &Path) -> Result<Option<Branding>> {
+        let Some(branding) = manifest::load(file)?.and_then(|m| m.get("branding").cloned()).filter(|b| !b.entries().is_empty()) else {
+            return Ok(None);
+        };
+        let Some(theme) = branding.str("theme") else {
+            bail!("{}: branding needs a theme directory", file.display());
+        };
+        // Relative to the file, like everything else in it
+        let theme = file.parent().unwrap_or(Path::new(".")).join(theme);
+        if !theme.is_dir() {
+            bail!("Theme directory {} does not exist", theme.display());
+        }
+        let name = branding.str("name").unwrap_or("hackeros").to_string();
+        if name.is_empty() || !name.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-') {
+            bail!("{}: branding name '{}' must be a-z, 0-9 and -", file.display(), name);
+        }
+        Ok(Some(Branding { theme, name }))
+    }
+
+    fn asset(&self, name: &str) -> Option<PathBuf> {
+        Some(self.theme.join(name)).filter(|p| p.exists())
+    }
+
+    /// Writes includes, hooks and bootloader files into the live-build `config` directory
+    pub fn apply(&self, config: &Path) -> Result<()> {
+        Logger::info(&format!("Applying branding '{}' from {}", self.name, self.theme.display()));
+        let chroot = config.join("includes.chroot");
+        let mut hook = vec!["#!/bin/sh".to_string(), "# Written by hammer-builder from hammer.yaml branding".to_string(), "set -e".to_string()];
+        let mut packages = Vec::new();
+
+        if let Some(wallpaper) = self.asset("wallpaper.png") {
+            let dest = format!("usr/share/backgrounds/{}/wallpaper.png", self.name);
+            copy(&wallpaper, &chroot.join(&dest))?;
+            // GNOME and other GSettings desktops pick the default from the schema override
+            let uri = format!("file:///{}", dest);
+            write(
+                &chroot.join(format!("usr/share/glib-2.0/schemas/90_{}-branding.gschema.override", self.name)),
+                &format!("[org.gnome.desktop.background]\npicture-uri='{uri}'\npicture-uri-dark='{uri}'\n\n[org.gnome.desktop.screensaver]\npicture-uri='{uri}'\n", uri = uri),
+            )?;
+            hook.push("if command -v glib-compile-schemas >/dev/null; then glib-compile-schemas /usr/share/glib-2.0/schemas; fi".to_string());
+        }
+
+        if let Some(plymouth) = self.asset("plymouth") {
+            let dest = chroot.join(format!("usr/share/plymouth/themes/{}", self.name));
+            copy_dir(&plymouth, &dest)?;
+            if !fs::read_dir(&dest)?.flatten().any(|e| e.path().extension().is_some_and(|x| x == "plymouth")) {
+                bail!("{} has no .plymouth file", plymouth.display());
+            }
+            packages.push("plymouth");
+            hook.push(format!("plymouth-set-default-theme {}", self.name));
+            hook.push("update-initramfs -u -k all".to_string());
+        }
+
+        let mut grub_defaults = Vec::new();
+        if packages.contains(&"plymouth") {
+            grub_defaults.push("GRUB_CMDLINE_LINUX_DEFAULT=\"$GRUB_CMDLINE_LINUX_DEFAULT quiet splash\"".to_string());
+        }
+        if let Some(grub) = self.asset("grub") {
+            if !grub.join("theme.txt").exists() {
+                bail!("{} has no theme.txt", grub.display());
+            }
+            copy_dir(&grub, &chroot.join(format!("boot/grub/themes/{}", self.name)))?;
+            grub_defaults.push(format!("GRUB_THEME=/boot/grub/themes/{}/theme.txt", self.name));
+        }
+        if let Some(splash) = self.asset("splash.png") {
+            grub_defaults.push(format!("GRUB_BACKGROUND=/usr/share/images/{}/splash.png", self.name));
+            copy(&splash, &chroot.join(format!("usr/share/images/{}/splash.png", self.name)))?;
+            self.apply_iso_splash(&splash, config)?;
+        }
+        if !grub_defaults.is_empty() {
+            write(
+                &chroot.join(format!("etc/default/grub.d/{}-branding.cfg", self.name)),
+                &format!("# Written by hammer-builder from hammer.yaml branding\n{}\n", grub_defaults.join("\n")),
+            )?;
+        }
+
+        if let Some(logos) = self.asset("logos") {
+            copy_dir(&logos, &chroot.join(format!("usr/share/pixmaps/{}", self.name)))?;
+            if let Some(logo) = Some(logos.join("logo.png")).filter(|p| p.exists()) {
+                // The installer shows this file as its banner
+                copy(&logo, &config.join("includes.installer/usr/share/graphics/logo_debian.png"))?;
+                copy(&logo, &config.join("includes.installer/usr/share/graphics/logo_debian_dark.png"))?;
+            }
+        }
+
+        let hook_path = config.join("hooks/normal/9000-hammer-branding.hook.chroot");
+        write(&hook_path, &(hook.join("\n") + "\n"))?;
+        fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o755))?;
+        if !packages.is_empty() {
+            write(&config.join("package-lists/hammer-branding.list.chroot"), &(packages.join("\n") + "\n"))?;
+        }
+        Ok(())
+    }
+
+    /// The ISO boot menus come from live-build's templates; copied once, the splash replaced
+    fn apply_iso_splash(&self, splash: &Path, config: &Path) -> Result<()> {
+        for name in ["grub-pc", "isolinux"] {
+            let Some(dir) = bootloader(config, name)? else {
+                Logger::warn(&format!("No live-build template for {}; its boot menu keeps the default splash", name));
+                continue;
+            };
+            // A splash.svg would be rendered instead of the png
+            let _ = fs::remove_file(dir.join("splash.svg"));
+            copy(splash, &dir.join("splash.png"))?;
+        }
+        Ok(())
+    }
+}
+
+/// config/bootloaders/NAME, copied from live-build's template the first time it is
+/// changed; None when neither exists
+pub(crate) fn bootloader(config: &Path, name: &str) -> Result<Option<PathBuf>> {
+    let dir = config.join("bootloaders").join(name);
+    if !dir.exists() {
+        let template = Path::new(LB_BOOTLOADERS).join(name);
+        if !template.exists() {
+            return Ok(None);
+        }
+        copy_dir(&template, &dir)?;
+    }
+    Ok(Some(dir))
+}
+
+fn copy(from: &Path, to: &Path) -> Result<()> {
+    if let Some(dir) = to.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    fs::copy(from, to).with_context(|| format!("Copying {}", from.display()))?;
+    Ok(())
+}
+
+fn copy_dir(from: &Path, to: &Path) -> Result<()> {
+    if to.exists() {
+        fs::remove_dir_all(to)?;
+    }
+    if let Some(dir) = to.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    // cp -rL resolves the symlinks live-build's templates use
+    run_command("cp", &["-rL", &from.to_string_lossy(), &to.to_string_lossy()], "Copy Theme Files")?;
+    Ok(())
+}
+
+pub(crate) fn write(path: &Path, content: &str) -> Result<()> {
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    fs::write(path, content).with_context(|| format!("Writing {}", path.display()))?;
+    Ok(())
+}
@@ -0,0 +1,159 @@
+use anyhow::{bail, Result};
+use hammer_core::output;
+use hammer_core::{run_command, Logger};
+use std::fs;
+use std::path::Path;
+
+use crate::manifest::{self, Value};
+
+// Image bloat caught when it happens, not a release later. hammer.yaml sets the largest
+// ISO and uncompressed root filesystem a build may produce, for all builds or per variant:
+//
+//   size:
+//     iso: 2.5G
+//     rootfs: 8G
+//     enforce: true        # false only warns
+//   variants:
+//     server:
+//       config: ./variants/server
+//       size:
+//         iso: 900M
+
+pub struct Budget {
+    iso: Option<u64>,
+    rootfs: Option<u64>,
+    enforce: bool,
+}
+
+/// "2.5G", "700M", "4GiB" or plain bytes; binary units
+fn parse_size(value: &str) -> Option<u64> {
+    let value = value.trim();
+    let split = value.find(|c: char| !c.is_ascii_digit() && c != '.').unwrap_or(value.len());
+    let (number, unit) = value.split_at(split);
+    let number: f64 = number.parse().ok()?;
+    let factor: u64 = match unit.trim().trim_end_matches("iB").trim_end_matches('B').to_ascii_uppercase().as_str() {
+        "" => 1,
+        "K" => 1 << 10,
+        "M" => 1 << 20,
+        "G" => 1 << 30,
+        "T" => 1 << 40,
+        _ => return None,
+    };
+    Some((number * factor as f64) as u64)
+}
+
+pub fn human(bytes: u64) -> String {
+    let mut value = bytes as f64;
+    for unit in ["B", "KiB", "MiB", "GiB"] {
+        if value < 1024.0 {
+            return format!("{:.1} {}", value, unit);
+        }
+        value /= 1024.0;
+    }
+    format!("{:.1} TiB", value)
+}
+
+impl Budget {
+    /// The budget of `variant`, or of every build, declared in `file`; None without one
+    pub fn load(file: &Path, variant: Option<&str>) -> Result<Option<Budget>> {
+        let Some(manifest) = manifest::load(file)? else {
+            return Ok(None);
+        };
+        let section = variant
+        .and_then(|v| manifest.get("variants")?.get(v)?.get("size"))
+        .or_else(|| manifest.get("size"));
+        let Some(section @ Value::Map(_)) = section else {
+            return Ok(None);
+        };
+        let size = |key: &str| -> Result<Option<u64>> {
+            match section.str(key) {
+                Some(value) => match parse_size(value) {
+                    Some(bytes) => Ok(Some(bytes)),
+                    None => bail!("{}: size {} '{}' is not a size like 2.5G or 700M", file.display(), key, value),
+                },
+                None => Ok(None),
+            }
+        };
+        let enforce = !matches!(section.str("enforce"), Some("false" | "no"));
+        Ok(Some(Budget { iso: size("iso")?, rootfs: size("rootfs")?, enforce }))
+    }
+
+    /// Compares `iso` and the live-build `chroot` with the budget; over it, shows where the
+    /// space went and fails unless the budget only warns
+    pub fn check(&self, iso: &Path, chroot: &Path) -> Result<()> {
+        let mut over = Vec::new();
+        if let Some(limit) = self.iso {
+            let size = fs::metadata(iso)?.len();
+            Logger::info(&format!("ISO: {} of {}", human(size), human(limit)));
+            if size > limit {
+                over.push(format!("ISO is {} over its budget of {}", human(size - limit), human(limit)));
+            }
+        }
+        if let Some(limit) = self.rootfs {
+            let out = run_command("du", &["-sx", "--block-size=1", &chroot.to_string_lossy()], "Measure Root Filesystem")?;
+            let size: u64 = out.split_whitespace().next().and_then(|s| s.parse().ok()).unwrap_or(0);
+            Logger::info(&format!("Root filesystem: {} of {}", human(size), human(limit)));
+            if size > limit {
+                over.push(format!("root filesystem is {} over its budget of {}", human(size - limit), human(limit)));
+            }
+        }
+        if over.is_empty() {
+            return Ok(());
+        }
+        breakdown(chroot);
+        if self.enforce {
+            bail!("Size budget exceeded: {}", over.join("; "));
+        }
+        for problem in over {
+            Logger::warn(&format!("Size budget exceeded: {}", problem));
+        }
+        Ok(())
+    }
+}
+
+/// The ten largest packages and directories of the root filesystem
+fn breakdown(chroot: &Path) {
+    let root = chroot.to_string_lossy();
+    let packages = run_command("chroot", &[&root, "dpkg-query", "-W", "-f=${Installed-Size}\t${Package}\n"], "List Package Sizes").unwrap_or_default();
+    let mut packages: Vec<(u64, String)> = packages
+    .lines()
+    .filter_map(|l| {
+        let (kib, name) = l.split_once('\t')?;
+        Some((kib.trim().parse::<u64>().ok()? * 1024, name.to_string()))
+    })
+    .collect();
+    packages.sort_by(|a, b| b.cmp(a));
+
+    let dirs = run_command("du", &["-x", "--max-depth=3", "--block-size=1", &root], "Measure Directories").unwrap_or_default();
+    let mut dirs: Vec<(u64, String)> = dirs
+    .lines()
+    .filter_map(|l| {
+        let (bytes, path) = l.split_once('\t')?;
+        let path = path.strip_prefix(root.as_ref())?;
+        // Deeper directories only, so / and /usr do not crowd out what is in them
+        if path.matches('/').count() < 2 {
+            return None;
+        }
+        Some((bytes.parse().ok()?, path.to_string()))
+    })
+    .collect();
+    dirs.sort_by(|a, b| b.cmp(a));
+
+    let mut rows = vec![vec!["LARGEST PACKAGES".to_string(), "SIZE".to_string(), "LARGEST DIRECTORIES".to_string(), "SIZE".to_string()]];
+    for i in 0..10 {
+        let (p, ps) = packages.get(i).map(|(s, n)| (n.clone(), human(*s))).unwrap_or_default();
+        let (d, ds) = dirs.get(i).map(|(s, n)| (n.clone(), human(*s))).unwrap_or_default();
+        if p.is_empty() && d.is_empty() {
+            break;
+        }
+        rows.push(vec![p, ps, d, ds]);
+    }
+    if Logger::json() {
+        for row in &rows[1..] {
+            Logger::info(&format!("Large: package {} {}, directory {} {}", row[0], row[1], row[2], row[3]));
+        }
+    } else {
+        println!();
+        output::print_table(&rows);
+    }
+}
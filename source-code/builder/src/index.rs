@@ -0,0 +1,141 @@
+use anyhow::{bail, Result};
+use hammer_core::{run_change, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::{release_notes, report};
+
+// The release index: the fleet manifest that `hammer update --auto` reads ([fleet]
+// manifest_url), with the images of each release next to its ring dates. Each release is
+// published into its own directory, and the index sits above them:
+//
+//   releases/                        served from --base-url
+//     releases.json                  the index
+//     releases.json.asc              its gpg signature, checked against [fleet] keyring
+//     2026.10/hackeros/hackeros.iso  hammer-builder publish --to releases/2026.10
+//
+// `index releases/2026.10` adds that release, named after its directory; releases already
+// in the index are kept and one with the same id is replaced.
+//
+//   {"releases": [{"id": "2026.10", "mirror_snapshot": "20261015T080000Z",
+//     "rings": {"canary": "2026-10-15", "broad": "2026-10-22"},
+//     "images": [{"name": "hackeros", "url": ".../hackeros/hackeros.iso", "sha256": "...",
+//       "size": 2147483648, "zsync": "...", "release_notes": "..."}]}]}
+
+pub const INDEX: &str = "releases.json";
+
+/// What `index` was asked for
+pub struct Release<'a> {
+    /// The name of the release directory by default
+    pub id: Option<&'a str>,
+    /// Ring name -> date it opens, as given to --ring canary=2026-10-15
+    pub rings: &'a [String],
+    /// snapshot.debian.org timestamp; the start of the earliest build by default
+    pub mirror_snapshot: Option<&'a str>,
+    /// Where the directory above the releases is served from
+    pub base_url: &'a str,
+    /// gpg key to sign with; gpg's default key otherwise
+    pub key: Option<&'a str>,
+}
+
+/// Image entries and the earliest start of the successful builds under `dir`
+fn images(dir: &Path, base_url: &str, id_dir: &str) -> Result<(Vec<serde_json::Value>, Option<chrono::DateTime<chrono::FixedOffset>>)> {
+    let mut builds: Vec<PathBuf> = fs::read_dir(dir)?.flatten().map(|e| e.path()).filter(|p| p.join(report::MANIFEST).exists()).collect();
+    builds.sort();
+    let mut images = Vec::new();
+    let mut earliest: Option<chrono::DateTime<chrono::FixedOffset>> = None;
+    for build in builds {
+        let name = build.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+        let manifest: serde_json::Value = serde_json::from_str(&fs::read_to_string(build.join(report::MANIFEST))?)?;
+        if manifest["status"] != "succeeded" {
+            Logger::warn(&format!("Skipping {}: its build failed", name));
+            continue;
+        }
+        if let Some(started) = manifest["started"].as_str().and_then(|s| chrono::DateTime::parse_from_rfc3339(s).ok()) {
+            earliest = Some(earliest.map_or(started, |e| e.min(started)));
+        }
+        let url = |file: &str| format!("{}/{}/{}/{}", base_url.trim_end_matches('/'), id_dir, name, file);
+        for entry in fs::read_dir(&build)?.flatten() {
+            let file = entry.file_name().to_string_lossy().to_string();
+            if !file.ends_with(".iso") {
+                continue;
+            }
+            let Some(sha256) = fs::read_to_string(build.join(format!("{}.sha256", file)))
+            .ok()
+            .and_then(|s| s.split_whitespace().next().map(str::to_string))
+            else {
+                bail!("{}/{} has no checksum; publish builds of hammer-builder build", name, file);
+            };
+            let optional = |file: String| build.join(&file).exists().then(|| url(&file));
+            images.push(serde_json::json!({
+                "name": name,
+                "url": url(&file),
+                "sha256": sha256,
+                "size": entry.metadata()?.len(),
+                "zsync": optional(format!("{}.zsync", file)),
+                "release_notes": optional(release_notes::JSON.to_string()),
+            }));
+        }
+    }
+    Ok((images, earliest))
+}
+
+/// Adds the release published to `dir` to the index above it and signs the index
+pub fn write(dir: &Path, release: Release) -> Result<()> {
+    let dir = dir.canonicalize().map_err(|e| anyhow::anyhow!("{}: {}", dir.display(), e))?;
+    let id_dir = dir.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+    let id = release.id.unwrap_or(&id_dir);
+    let mut rings = serde_json::Map::new();
+    for ring in release.rings {
+        let Some((name, date)) = ring.split_once('=') else {
+            bail!("--ring takes RING=DATE, e.g. canary=2026-10-15, not '{}'", ring);
+        };
+        if !["canary", "early", "broad"].contains(&name) {
+            bail!("Unknown ring '{}' (canary, early, broad)", name);
+        }
+        rings.insert(name.to_string(), date.into());
+    }
+    if rings.is_empty() {
+        bail!("A release needs at least one --ring, or no machine will ever install it");
+    }
+
+    let (images, earliest) = images(&dir, release.base_url, &id_dir)?;
+    if images.is_empty() {
+        bail!("No published images in {}; run hammer-builder publish first", dir.display());
+    }
+    let mirror_snapshot = match (release.mirror_snapshot, earliest) {
+        (Some(ts), _) => ts.to_string(),
+        (None, Some(started)) => started.with_timezone(&chrono::Utc).format("%Y%m%dT%H%M%SZ").to_string(),
+        (None, None) => bail!("No build start time in the build manifests; pass --mirror-snapshot"),
+    };
+
+    let path = dir.parent().unwrap_or(Path::new("/")).join(INDEX);
+    let mut index: serde_json::Value = match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content).map_err(|e| anyhow::anyhow!("{}: {}", path.display(), e))?,
+        Err(_) => serde_json::json!({ "releases": [] }),
+    };
+    let Some(releases) = index["releases"].as_array_mut() else {
+        bail!("{} has no releases list", path.display());
+    };
+    let count = images.len();
+    releases.retain(|r| r["id"] != id);
+    releases.push(serde_json::json!({
+        "id": id,
+        "mirror_snapshot": mirror_snapshot,
+        "rings": rings,
+        "images": images,
+    }));
+    fs::write(&path, serde_json::to_string_pretty(&index)? + "\n")?;
+    Logger::info(&format!("Release {} with {} image(s), mirror snapshot {}", id, count, mirror_snapshot));
+
+    let signature = path.with_extension("json.asc");
+    let mut args = vec!["--batch", "--yes", "--armor", "--detach-sign"];
+    if let Some(key) = release.key {
+        args.extend(["--local-user", key]);
+    }
+    let (path_str, signature_str) = (path.to_string_lossy(), signature.to_string_lossy());
+    args.extend(["--output", &signature_str, &path_str]);
+    run_change("gpg", &args, "Sign Release Index")?;
+    Logger::success(&format!("Signed release index: {}", path.display()));
+    Ok(())
+}
@@ -0,0 +1,179 @@
+use anyhow::{bail, Result};
+use hammer_core::{create_spinner, run_command, Logger};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+// A misspelled or missing package only fails live-build deep in the chroot stage, after
+// the bootstrap. Every package of config/package-lists is looked up beforehand in the
+// indexes of the suite, architecture and mirrors the build will use, fetched with apt
+// into a throwaway directory that never touches the host's apt state.
+
+/// `KEY="value"` settings of live-build's config files
+fn lb_settings(config: &Path) -> BTreeMap<String, String> {
+    let mut settings = BTreeMap::new();
+    for file in ["common", "bootstrap", "chroot", "binary"] {
+        for line in fs::read_to_string(config.join(file)).unwrap_or_default().lines() {
+            if let Some((key, value)) = line.split_once('=') {
+                if key.starts_with("LB_") {
+                    settings.insert(key.to_string(), value.trim_matches('"').to_string());
+                }
+            }
+        }
+    }
+    settings
+}
+
+/// (list file, package) of every package list, without version, suite or architecture
+fn requested(config: &Path) -> Vec<(String, String)> {
+    let mut lists: Vec<PathBuf> = fs::read_dir(config.join("package-lists"))
+    .map(|entries| entries.flatten().map(|e| e.path()).collect())
+    .unwrap_or_default();
+    lists.sort();
+    let mut packages = Vec::new();
+    for list in lists {
+        let name = list.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+        if !name.contains(".list") {
+            continue;
+        }
+        for line in fs::read_to_string(&list).unwrap_or_default().lines() {
+            // "#if"/"#include" and "! command" lines are live-build's, not packages
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') || line.starts_with('!') {
+                continue;
+            }
+            for package in line.split_whitespace() {
+                let package = package.split(['=', '/', ':']).next().unwrap_or(package);
+                packages.push((name.clone(), package.to_string()));
+            }
+        }
+    }
+    packages
+}
+
+/// Edit distance, for suggesting the package a misspelled name meant
+fn distance(a: &str, b: &str) -> usize {
+    let b: Vec<char> = b.chars().collect();
+    let mut row: Vec<usize> = (0..=b.len()).collect();
+    for (i, ca) in a.chars().enumerate() {
+        let mut prev = row[0];
+        row[0] = i + 1;
+        for j in 0..b.len() {
+            let cur = row[j + 1];
+            row[j + 1] = (prev + usize::from(ca != b[j])).min(row[j] + 1).min(cur + 1);
+            prev = cur;
+        }
+    }
+    row[b.len()]
+}
+
+/// apt options of the throwaway index directory `dir`
+fn apt_options(dir: &Path, arch: &str, proxy: Option<&str>) -> Vec<String> {
+    let d = dir.to_string_lossy();
+    let mut options = vec![
+        format!("-oDir::Etc={}/etc", d),
+        format!("-oDir::State={}/state", d),
+        format!("-oDir::State::status={}/status", d),
+        format!("-oDir::Cache={}/cache", d),
+        format!("-oAPT::Architecture={}", arch),
+        "-oAPT::Architectures=".to_string(),
+        // Keys of extra archives are the chroot's business; names are all that is read here
+        "-oAcquire::AllowInsecureRepositories=true".to_string(),
+        "-oAcquire::Check-Valid-Until=false".to_string(),
+        "-oDebug::NoLocking=true".to_string(),
+    ];
+    if let Some(proxy) = proxy {
+        options.push(format!("-oAcquire::http::Proxy={}", proxy));
+    }
+    options
+}
+
+/// Fails with the unavailable packages and likely meant names, before the build starts
+pub fn check(config: &Path, work: &Path, proxy: Option<&str>) -> Result<()> {
+    let settings = lb_settings(config);
+    let setting = |key: &str, default: &str| settings.get(key).filter(|v| !v.is_empty()).cloned().unwrap_or_else(|| default.to_string());
+    let suite = setting("LB_DISTRIBUTION", "bookworm");
+    let arch = setting("LB_ARCHITECTURE", "amd64");
+    let areas = setting("LB_ARCHIVE_AREAS", "main");
+    let mirror = setting("LB_MIRROR_CHROOT", &setting("LB_MIRROR_BOOTSTRAP", "http://deb.debian.org/debian/"));
+
+    let packages = requested(config);
+    if packages.is_empty() {
+        return Ok(());
+    }
+    Logger::info(&format!("Checking {} package(s) against {} {} ({})", packages.len(), suite, arch, areas));
+
+    if work.exists() {
+        fs::remove_dir_all(work)?;
+    }
+    for dir in ["etc/sources.list.d", "etc/preferences.d", "state/lists/partial", "cache/archives/partial"] {
+        fs::create_dir_all(work.join(dir))?;
+    }
+    fs::write(work.join("status"), "")?;
+    let mut sources = vec![format!("deb {} {} {}", mirror, suite, areas)];
+    if settings.get("LB_UPDATES").is_some_and(|v| v == "true") {
+        sources.push(format!("deb {} {}-updates {}", mirror, suite, areas));
+    }
+    if settings.get("LB_SECURITY").is_some_and(|v| v == "true") {
+        let security = setting("LB_MIRROR_CHROOT_SECURITY", "http://security.debian.org/debian-security/");
+        sources.push(format!("deb {} {}-security {}", security, suite, areas));
+    }
+    // Extra archives of the image
+    for entry in fs::read_dir(config.join("archives")).into_iter().flatten().flatten() {
+        let name = entry.file_name().to_string_lossy().to_string();
+        if name.ends_with(".list.chroot") || name.ends_with(".list") {
+            sources.extend(fs::read_to_string(entry.path()).unwrap_or_default().lines().filter(|l| l.trim_start().starts_with("deb ")).map(str::to_string));
+        }
+    }
+    fs::write(work.join("etc/sources.list"), sources.join("\n") + "\n")?;
+
+    let options = apt_options(work, &arch, proxy);
+    let mut args: Vec<&str> = options.iter().map(String::as_str).collect();
+    args.extend(["-q", "update"]);
+    let spinner = create_spinner("Fetching package indexes...");
+    let fetched = run_command("apt-get", &args, "Fetch Package Indexes");
+    spinner.finish_and_clear();
+    fetched?;
+
+    let mut args: Vec<&str> = options.iter().map(String::as_str).collect();
+    args.push("pkgnames");
+    let available: BTreeSet<String> = run_command("apt-cache", &args, "List Packages")?.lines().map(str::to_string).collect();
+
+    let mut missing: BTreeMap<String, Vec<String>> = BTreeMap::new();
+    for (list, package) in &packages {
+        if available.contains(package) {
+            continue;
+        }
+        // A virtual package is fine as long as something provides it
+        let mut args: Vec<&str> = options.iter().map(String::as_str).collect();
+        args.extend(["showpkg", package.as_str()]);
+        let provided = run_command("apt-cache", &args, "Look Up Package")
+        .unwrap_or_default()
+        .split("Reverse Provides:")
+        .nth(1)
+        .is_some_and(|p| !p.trim().is_empty());
+        if !provided {
+            missing.entry(package.clone()).or_default().push(list.clone());
+        }
+    }
+    fs::remove_dir_all(work)?;
+
+    if missing.is_empty() {
+        Logger::success("All requested packages are available.");
+        return Ok(());
+    }
+    for (package, lists) in &missing {
+        let mut close: Vec<(usize, &String)> = available
+        .iter()
+        .map(|a| (distance(package, a), a))
+        .filter(|(d, _)| *d <= 2)
+        .collect();
+        close.sort();
+        let hint = match close.first() {
+            Some((_, name)) => format!("; did you mean {}?", name),
+            None => String::new(),
+        };
+        Logger::error(&format!("{} ({}) is not in {} {}{}", package, lists.join(", "), suite, arch, hint));
+    }
+    bail!("{} package(s) cannot be installed; fix config/package-lists or pass --skip-lint", missing.len());
+}
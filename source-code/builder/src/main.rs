@@ -1,14 +1,38 @@
 use anyhow::{Result};
-use clap::{Parser, Subcommand};
-use hammer_core::{create_spinner, run_command, Logger};
+use clap::{Parser, Subcommand, ValueEnum};
+use hammer_core::exec::{self, Exec};
+use hammer_core::{caps, create_spinner, overrides, run_change, run_command, Logger};
 use owo_colors::OwoColorize;
-use nix::unistd::Uid;
 use std::path::{Path, PathBuf};
 use std::fs;
 
+mod assertions;
+mod baseline;
+mod branding;
+mod budget;
+mod index;
+mod lint;
+mod manifest;
+mod netboot;
+mod oobe;
+mod proxy;
+mod publish;
+mod release_notes;
+mod report;
+mod stack;
+mod unattended;
+mod update_image;
+mod users;
+mod variants;
+
 #[derive(Parser)]
 #[command(name = "hammer-builder")]
 struct Cli {
+    /// text, or json for pipelines: one event per line, no spinners, live-build output to build.log;
+    /// HAMMER_JSON=1 selects json too
+    #[arg(long, global = true, value_enum, default_value_t = LogFormat::Text)]
+    log_format: LogFormat,
+
     #[command(subcommand)]
     command: Commands,
 }
@@ -16,7 +40,19 @@ struct Cli {
 #[derive(Subcommand)]
 enum Commands {
     /// Initialize a build directory
-    Init,
+    Init {
+        /// Locale of the image, e.g. pl_PL.UTF-8
+        #[arg(long)]
+        locale: Option<String>,
+
+        /// Time zone, e.g. Europe/Warsaw
+        #[arg(long)]
+        timezone: Option<String>,
+
+        /// Keyboard layout, optionally with a variant: pl, de:nodeadkeys
+        #[arg(long)]
+        keyboard: Option<String>,
+    },
     /// Build an ISO image using live-build
     Build {
         /// Name of the output ISO file
@@ -26,6 +62,154 @@ enum Commands {
         /// Path to source configuration directory (will be copied to ./config)
         #[arg(long)]
         config: Option<String>,
+
+        /// Ask for the first user, locale and network on the first boot of the installed
+        /// system instead of in the installer (appliance images)
+        #[arg(long)]
+        oobe: bool,
+
+        /// Directory the image, its checksum and build-manifest.json go to, under the image name
+        #[arg(long, default_value = "artifacts")]
+        artifacts: String,
+
+        /// Leave hammer's units, configuration, polkit rules and image baseline out of the image
+        #[arg(long)]
+        bare: bool,
+
+        /// Do not check the package lists against the archive before building (offline builds)
+        #[arg(long)]
+        skip_lint: bool,
+
+        /// Boot into an installer that wipes the target disk and installs without questions
+        #[arg(long, requires = "target_disk")]
+        unattended: bool,
+
+        /// Disk --unattended installs to: a device or shell pattern, e.g. /dev/nvme0n1 or /dev/sd*
+        #[arg(long)]
+        target_disk: Option<String>,
+
+        /// iso, or netboot for kernel, initrd, squashfs and boot scripts for PXE/iPXE
+        #[arg(long, value_enum, default_value_t = ImageFormat::Iso)]
+        format: ImageFormat,
+
+        /// HTTP URL the netboot files are served from; baked into the boot scripts
+        #[arg(long)]
+        netboot_url: Option<String>,
+
+        /// Debian mirror the image is built from; the installed system keeps the default
+        #[arg(long)]
+        mirror: Option<String>,
+
+        /// apt caching proxy for every download, e.g. http://127.0.0.1:3142/ of apt-cacher-ng,
+        /// or auto to start one of the builder's own
+        #[arg(long)]
+        proxy: Option<String>,
+
+        /// Build from what --proxy auto cached earlier, without the network
+        #[arg(long)]
+        offline: bool,
+
+        /// Project manifest with branding, users and variants
+        #[arg(long, default_value = manifest::BUILD_FILE)]
+        manifest: String,
+
+        /// Build every variant of the manifest, each in its own work directory
+        #[arg(long, conflicts_with_all = ["config", "oobe"])]
+        all: bool,
+
+        /// Variants built at the same time with --all
+        #[arg(long, default_value_t = 1, requires = "all")]
+        jobs: usize,
+
+        /// Parent of the per-variant work directories of --all
+        #[arg(long, default_value = "work", requires = "all")]
+        work: String,
+
+        /// Artifact directory of the previous release, for release notes of what changed since
+        #[arg(long, conflicts_with = "all")]
+        previous: Option<String>,
+
+        /// Variant of the manifest being built, for its size budget; set by --all
+        #[arg(long, hide = true, conflicts_with = "all")]
+        variant: Option<String>,
+    },
+    /// Apply the branding declared in hammer.yaml to ./config (build does this too)
+    Branding {
+        /// Build settings file with a branding section
+        #[arg(long, default_value = manifest::BUILD_FILE)]
+        file: String,
+    },
+    /// Write the users, groups and SSH keys declared in hammer.yaml into ./config (build does this too)
+    Users {
+        /// Build settings file with a users section
+        #[arg(long, default_value = manifest::BUILD_FILE)]
+        file: String,
+    },
+    /// Check that every package of ./config/package-lists exists in the suite and architecture
+    Lint,
+    /// Upgrade the packages of a built ISO into a point-release image, without a rebuild
+    UpdateImage {
+        /// ISO built by hammer-builder build
+        input: String,
+
+        /// Updated ISO; INPUT with -update before .iso by default
+        #[arg(long)]
+        output: Option<String>,
+
+        /// Scratch directory for the unpacked root filesystem
+        #[arg(long, default_value = "work/update-image")]
+        work: String,
+
+        /// Keep the scratch directory, e.g. to look at the upgraded root filesystem
+        #[arg(long)]
+        keep_work: bool,
+    },
+    /// Copy the image, checksum, zsync metadata and build manifest of a build to a release directory
+    Publish {
+        /// Artifact directory of the build, e.g. artifacts/hackeros
+        dir: String,
+
+        /// Release directory, local or rsync's [user@]host:path; the build goes to DEST/NAME
+        #[arg(long)]
+        to: String,
+
+        /// Show what would be copied without copying it
+        #[arg(long)]
+        dry_run: bool,
+    },
+    /// Add a release published with `publish` to the signed release index hammer's fleet rollouts read
+    Index {
+        /// Directory the release was published to, e.g. releases/2026.10; the index goes above it
+        dir: String,
+
+        /// Release id; the name of DIR by default
+        #[arg(long)]
+        id: Option<String>,
+
+        /// Date a ring may install the release from, e.g. canary=2026-10-15 (repeatable)
+        #[arg(long = "ring", required = true)]
+        rings: Vec<String>,
+
+        /// snapshot.debian.org timestamp the release was built against; the start of its
+        /// earliest build by default
+        #[arg(long)]
+        mirror_snapshot: Option<String>,
+
+        /// URL the directory above DIR is served from
+        #[arg(long)]
+        base_url: String,
+
+        /// gpg key to sign the index with; gpg's default key otherwise
+        #[arg(long)]
+        key: Option<String>,
+    },
+    /// Write release notes of a build against the previous release: packages and image size
+    ReleaseNotes {
+        /// Artifact directory of the previous release
+        previous: String,
+
+        /// Artifact directory of the new build
+        current: String,
     },
     /// Generate static deltas for OSTree repository
     Delta {
@@ -35,105 +219,156 @@ enum Commands {
     },
 }
 
+/// Throwaway apt directory of the package list check
+const LINT_DIR: &str = "work/lint";
+
+#[derive(Clone, Copy, PartialEq, ValueEnum)]
+enum ImageFormat {
+    Iso,
+    Netboot,
+}
+
+#[derive(Clone, Copy, PartialEq, ValueEnum)]
+enum LogFormat {
+    Text,
+    Json,
+}
+
 fn main() -> Result<()> {
     let cli = Cli::parse();
-    
+    if overrides::dry_run() {
+        exec::set_dry_run();
+    }
+    if cli.log_format == LogFormat::Json || overrides::json() {
+        Logger::use_json();
+    }
+
     match cli.command {
-        Commands::Init => {
+        Commands::Init { locale, timezone, keyboard } => {
             Logger::info("Initializing build environment...");
-            // Create lb config
-            run_command("lb", &["config"], "Live Build Config")?;
+            let localization = Localization::new(locale, timezone, keyboard)?;
+
+            // Create lb config; the live system reads its settings from the kernel command line
+            let bootappend = localization.bootappend_live();
+            let mut args = vec!["config"];
+            if !bootappend.is_empty() {
+                args.extend(["--bootappend-live", bootappend.as_str()]);
+            }
+            run_change("lb", &args, "Live Build Config")?;
+            localization.write_config(Path::new("config"))?;
             Logger::success("Build environment initialized. Edit ./config to customize.");
         }
-        Commands::Build { output, config } => {
+        Commands::Build {
+            output, config, oobe, bare, skip_lint, unattended, target_disk, artifacts, format, netboot_url,
+            mirror, proxy, offline, manifest, all, jobs, work, previous, variant,
+        } => {
             require_root()?;
-            Logger::section("BUILDING LIVE ISO");
-
-            // 1. Handle Configuration
-            if let Some(cfg_path) = config {
-                let src_path = PathBuf::from(&cfg_path);
-                let dest_path = PathBuf::from("config");
-
-                if !src_path.exists() {
-                    Logger::error(&format!("Config path does not exist: {}", cfg_path));
-                    std::process::exit(1);
+            if offline && proxy.as_deref() != Some("auto") {
+                anyhow::bail!("--offline builds from the cache of --proxy auto");
+            }
+            // Outlives the build; stopped when it goes out of scope
+            let caching = match proxy.as_deref() {
+                Some("auto") => Some(proxy::CachingProxy::start(offline)?),
+                _ => None,
+            };
+            let proxy = caching.as_ref().map(|c| c.url()).or(proxy);
+            if all {
+                Logger::section("BUILDING VARIANTS");
+                let mut passed = Vec::new();
+                if let Some(mirror) = &mirror {
+                    passed.extend(["--mirror".to_string(), mirror.clone()]);
                 }
-
-                Logger::info(&format!("Using custom config from: {}", cfg_path.cyan()));
-
-                // Clean existing config to avoid mixing
-                if dest_path.exists() {
-                    Logger::info("Removing old ./config...");
-                    fs::remove_dir_all(&dest_path)?;
+                if let Some(proxy) = &proxy {
+                    passed.extend(["--proxy".to_string(), proxy.clone()]);
                 }
-
-                // Copy new config
-                // Using cp -r is safer/easier than recursive fs::copy implementation
-                run_command("cp", &["-r", cfg_path.as_str(), "config"], "Copy Config")?;
-            }
-
-            if !Path::new("config").exists() {
-                Logger::warn("No ./config directory found. Running default 'lb config'...");
-                run_command("lb", &["config"], "Default Config")?;
-            }
-
-            // 2. Clean previous build artifacts
-            let clean_spinner = create_spinner("Cleaning previous build environment...");
-            run_command("lb", &["clean"], "Live Build Clean")?;
-            clean_spinner.finish_with_message("Environment cleaned.");
-
-            // 3. Build
-            Logger::info("Starting build process. This may take a long time...");
-            let build_start = std::time::Instant::now();
-            
-            // Run lb build
-            // streaming output to stdout so user sees progress of apt/bootstrap
-            let status = std::process::Command::new("lb")
-                .arg("build")
-                .stdout(std::process::Stdio::inherit())
-                .stderr(std::process::Stdio::inherit())
-                .status()?;
-
-            if !status.success() {
-                Logger::error("Live Build failed.");
-                std::process::exit(1);
+                variants::build_all(Path::new(&manifest), jobs, Path::new(&work), Path::new(&artifacts), &passed)?;
+                Logger::end_section();
+                return Ok(());
             }
-
-            // 4. Handle Output
-            let duration = build_start.elapsed();
-            Logger::info(&format!("Build finished in {:.2?}.", duration));
-
-            // live-build usually outputs live-image-amd64.hybrid.iso (depends on arch)
-            // We look for any .iso file created recently or specific names
-            let possible_names = vec![
-                "live-image-amd64.hybrid.iso",
-                "live-image-amd64.iso",
-                "live-image-i386.hybrid.iso"
-            ];
-
-            let mut found = false;
-            for name in possible_names {
-                if Path::new(name).exists() {
-                    run_command("mv", &[name, &output], "Rename ISO")?;
-                    found = true;
-                    break;
+            Logger::section("BUILDING LIVE ISO");
+            let options = serde_json::json!({
+                "output": output,
+                "config": config,
+                "oobe": oobe,
+                "unattended": target_disk.as_deref().filter(|_| unattended),
+                "format": if format == ImageFormat::Netboot { "netboot" } else { "iso" },
+                "mirror": mirror,
+                "proxy": proxy,
+                "offline": offline,
+                "variant": variant,
+                "previous": previous,
+            });
+            let mut report = report::Report::new(Path::new(&artifacts), &output, options);
+            let target_disk = target_disk.filter(|_| unattended);
+            let options = BuildOptions {
+                config,
+                oobe,
+                bare,
+                skip_lint,
+                target_disk: target_disk.as_deref(),
+                netboot: (format == ImageFormat::Netboot).then(|| netboot_url.as_deref()),
+                mirror: mirror.as_deref(),
+                proxy: proxy.as_deref(),
+                manifest: Path::new(&manifest),
+                variant: variant.as_deref(),
+                previous: previous.as_deref().map(Path::new),
+            };
+            let result = build(&mut report, &output, options);
+            report.finish(result)?;
+            Logger::end_section();
+        }
+        Commands::Branding { file } => {
+            match branding::Branding::load(Path::new(&file))? {
+                Some(branding) => {
+                    branding.apply(Path::new("config"))?;
+                    Logger::success("Branding applied to ./config.");
                 }
+                None => Logger::warn(&format!("No branding section in {}.", file)),
             }
-
-            if found {
-                Logger::success(&format!("ISO generated successfully: {}", output.green().bold()));
-            } else {
-                Logger::warn("Build command succeeded, but could not auto-detect output ISO to rename.");
-                Logger::warn("Check the current directory for the generated file.");
+        }
+        Commands::Users { file } => {
+            match users::Accounts::load(Path::new(&file))? {
+                Some(accounts) => {
+                    accounts.apply(Path::new("config"))?;
+                    Logger::success("Users written to ./config.");
+                }
+                None => Logger::warn(&format!("No users or groups in {}.", file)),
             }
+        }
+        Commands::Lint => lint::check(Path::new("config"), Path::new(LINT_DIR), None)?,
+        Commands::UpdateImage { input, output, work, keep_work } => {
+            require_root()?;
+            Logger::section("UPDATING IMAGE");
+            let output = output.unwrap_or_else(|| format!("{}-update.iso", input.trim_end_matches(".iso")));
+            update_image::run(Path::new(&input), Path::new(&output), Path::new(&work), keep_work)?;
+            Logger::end_section();
+        }
+        Commands::Publish { dir, to, dry_run } => {
+            Logger::section("PUBLISHING");
+            publish::publish(Path::new(&dir), &to, dry_run)?;
             Logger::end_section();
         }
+        Commands::Index { dir, id, rings, mirror_snapshot, base_url, key } => {
+            let release = index::Release {
+                id: id.as_deref(),
+                rings: &rings,
+                mirror_snapshot: mirror_snapshot.as_deref(),
+                base_url: &base_url,
+                key: key.as_deref(),
+            };
+            index::write(Path::new(&dir), release)?;
+        }
+        Commands::ReleaseNotes { previous, current } => {
+            for file in release_notes::write(Path::new(&previous), Path::new(&current))? {
+                Logger::success(&format!("Written: {}", file.display()));
+            }
+        }
         Commands::Delta { repo } => {
             Logger::info(&format!("Generating static deltas for repo: {}", repo));
             
             let spinner = create_spinner("Calculating deltas...");
             
-            run_command("ostree", &[
+            run_change("ostree", &[
                 "static-delta", 
                 "generate", 
                 "--repo", &repo,
@@ -149,10 +384,273 @@ fn main() -> Result<()> {
     Ok(())
 }
 
+/// What `hammer-builder build` was asked for, besides the output
+struct BuildOptions<'a> {
+    config: Option<String>,
+    oobe: bool,
+    bare: bool,
+    skip_lint: bool,
+    /// Set for --unattended
+    target_disk: Option<&'a str>,
+    /// Some, with the URL if one was given, for --format netboot
+    netboot: Option<Option<&'a str>>,
+    mirror: Option<&'a str>,
+    proxy: Option<&'a str>,
+    manifest: &'a Path,
+    /// Variant of the manifest, whose size budget applies
+    variant: Option<&'a str>,
+    /// Artifact directory of the previous release, for release notes
+    previous: Option<&'a Path>,
+}
+
+/// The stages of `hammer-builder build`, each recorded in `report`
+fn build(report: &mut report::Report, output: &str, options: BuildOptions) -> Result<()> {
+    let BuildOptions { config, oobe, bare, skip_lint, target_disk, netboot, mirror, proxy, manifest, variant, previous } = options;
+
+    // 1. Handle Configuration
+    report.stage(report::Stage::Config);
+    if let Some(cfg_path) = config {
+        let src_path = PathBuf::from(&cfg_path);
+        let dest_path = PathBuf::from("config");
+
+        if !src_path.exists() {
+            anyhow::bail!("Config path does not exist: {}", cfg_path);
+        }
+
+        Logger::info(&format!("Using custom config from: {}", cfg_path.cyan()));
+
+        // Clean existing config to avoid mixing
+        if dest_path.exists() {
+            Logger::info("Removing old ./config...");
+            fs::remove_dir_all(&dest_path)?;
+        }
+
+        // Copy new config
+        // Using cp -r is safer/easier than recursive fs::copy implementation
+        run_command("cp", &["-r", cfg_path.as_str(), "config"], "Copy Config")?;
+    }
+
+    if !Path::new("config").exists() {
+        Logger::warn("No ./config directory found. Running default 'lb config'...");
+        run_change("lb", &["config"], "Default Config")?;
+    }
+    proxy::configure(Path::new("config"), mirror, proxy)?;
+
+    report.stage(report::Stage::Customize);
+    if !bare {
+        stack::apply(Path::new("config"))?;
+        let image = Path::new(output).file_stem().map(|s| s.to_string_lossy().to_string()).unwrap_or_else(|| output.to_string());
+        baseline::apply(Path::new("config"), &image)?;
+    }
+    if let Some(branding) = branding::Branding::load(manifest)? {
+        branding.apply(Path::new("config"))?;
+    }
+    let accounts = users::Accounts::load(manifest)?;
+    if let Some(accounts) = &accounts {
+        accounts.apply(Path::new("config"))?;
+    }
+    if oobe {
+        oobe::apply(Path::new("config"))?;
+    }
+    if let Some(disk) = target_disk {
+        unattended::apply(Path::new("config"), disk, accounts.is_some() || oobe)?;
+    }
+    let project = manifest.parent().filter(|p| !p.as_os_str().is_empty()).unwrap_or(Path::new("."));
+    assertions::apply(&project.join(assertions::TESTS_DIR), Path::new("config"))?;
+
+    if !skip_lint {
+        report.stage(report::Stage::Lint);
+        lint::check(Path::new("config"), Path::new(LINT_DIR), proxy)?;
+    }
+
+    // 2. Clean previous build artifacts
+    report.stage(report::Stage::Clean);
+    let clean_spinner = create_spinner("Cleaning previous build environment...");
+    run_change("lb", &["clean"], "Live Build Clean")?;
+    clean_spinner.finish_with_message("Environment cleaned.");
+
+    // 3. Build
+    report.stage(report::Stage::Build);
+    Logger::info("Starting build process. This may take a long time...");
+
+    // Run lb build
+    // streaming output to stdout so user sees progress of apt/bootstrap; with JSON logs it
+    // goes to build.log instead, so stdout stays parseable
+    let mut lb = Exec::new("lb", &["build"], "Live Build").env("DEBIAN_FRONTEND", "noninteractive").changes_system();
+    if let Some(proxy) = proxy {
+        // debootstrap reads the proxy from the environment
+        lb = lb.env("http_proxy", proxy);
+    }
+    if Logger::json() {
+        fs::create_dir_all(report.dir())?;
+        let log_path = report.dir().join("build.log");
+        lb = lb.log_to(fs::File::create(&log_path)?);
+        report.record(log_path);
+    }
+    let status = lb.status().map_err(|e| anyhow::anyhow!("{}", e))?;
+
+    if !status.success() {
+        let failed = assertions::failures(Path::new("chroot"));
+        if !failed.is_empty() {
+            report.stage(report::Stage::Test);
+            for assertion in &failed {
+                Logger::error(&format!("Image test failed: {}", assertion));
+            }
+            anyhow::bail!("{} image test(s) failed; the ISO was not assembled", failed.len());
+        }
+        anyhow::bail!("Live Build failed ({}).", status);
+    }
+
+    // live-build usually outputs live-image-amd64.hybrid.iso (depends on arch)
+    let possible_names = vec![
+        "live-image-amd64.hybrid.iso",
+        "live-image-amd64.iso",
+        "live-image-i386.hybrid.iso"
+    ];
+    let Some(name) = possible_names.into_iter().find(|n| Path::new(n).exists()) else {
+        anyhow::bail!("Build command succeeded, but no output ISO was found in the current directory.");
+    };
+    if let Some(budget) = budget::Budget::load(manifest, variant)? {
+        report.stage(report::Stage::Size);
+        budget.check(Path::new(name), Path::new("chroot"))?;
+    }
+
+    // 4. Handle Output
+    report.stage(report::Stage::Artifacts);
+    if let Some(base_url) = netboot {
+        // The ISO is only the source of the boot files
+        fs::create_dir_all(report.dir())?;
+        for file in netboot::layout(Path::new(name), report.dir(), Path::new("config"), base_url)? {
+            report.record(file);
+        }
+        fs::remove_file(name)?;
+        Logger::success(&format!("Netboot files written to {}", report.dir().display().to_string().green().bold()));
+        return Ok(());
+    }
+    let iso = report.add_artifact(Path::new(name), output)?;
+    let sum = report::checksum(&iso)?;
+    report.record(sum);
+    if let Some(zsync) = publish::zsync(&iso)? {
+        report.record(zsync);
+    }
+    // Package list of the image, named after the ISO by live-build
+    let packages = format!("{}.packages", name.trim_end_matches(".iso").trim_end_matches(".hybrid"));
+    if Path::new(&packages).exists() {
+        report.add_artifact(Path::new(&packages), "packages.txt")?;
+    }
+    if let Some(previous) = previous {
+        for file in release_notes::write(previous, report.dir())? {
+            report.record(file);
+        }
+    }
+
+    Logger::success(&format!("ISO generated successfully: {}", iso.display().to_string().green().bold()));
+    Ok(())
+}
+
+/// Language settings of the image, for the live system and the installer
+struct Localization {
+    locale: Option<String>,
+    timezone: Option<String>,
+    /// (layout, variant)
+    keyboard: Option<(String, Option<String>)>,
+}
+
+impl Localization {
+    fn new(locale: Option<String>, timezone: Option<String>, keyboard: Option<String>) -> Result<Self> {
+        // Checked against the build host, which has the same lists as the image
+        if let Some(locale) = &locale {
+            let supported = fs::read_to_string("/usr/share/i18n/SUPPORTED").unwrap_or_default();
+            if !supported.is_empty() && !supported.lines().any(|l| l.split_whitespace().next() == Some(locale.as_str())) {
+                anyhow::bail!("Unknown locale '{}' (see /usr/share/i18n/SUPPORTED)", locale);
+            }
+        }
+        if let Some(timezone) = &timezone {
+            let zoneinfo = Path::new("/usr/share/zoneinfo");
+            if zoneinfo.exists() && !zoneinfo.join(timezone).is_file() {
+                anyhow::bail!("Unknown time zone '{}' (see /usr/share/zoneinfo)", timezone);
+            }
+        }
+        let keyboard = keyboard.map(|k| match k.split_once(':') {
+            Some((layout, variant)) => (layout.to_string(), Some(variant.to_string())),
+            None => (k, None),
+        });
+        Ok(Localization { locale, timezone, keyboard })
+    }
+
+    /// live-config boot parameters
+    fn bootappend_live(&self) -> String {
+        let mut params = Vec::new();
+        if let Some(locale) = &self.locale {
+            params.push(format!("locales={}", locale));
+        }
+        if let Some(timezone) = &self.timezone {
+            params.push(format!("timezone={}", timezone));
+        }
+        if let Some((layout, variant)) = &self.keyboard {
+            params.push(format!("keyboard-layouts={}", layout));
+            if let Some(variant) = variant {
+                params.push(format!("keyboard-variants={}", variant));
+            }
+        }
+        if params.is_empty() {
+            return String::new();
+        }
+        format!("boot=live components {}", params.join(" "))
+    }
+
+    /// The locales package generates the locale into the image; the installer preseed
+    /// gives the installed system the same settings
+    fn write_config(&self, config: &Path) -> Result<()> {
+        let mut chroot = Vec::new();
+        let mut installer = Vec::new();
+        if let Some(locale) = &self.locale {
+            let charset = locale.split_once('.').map(|(_, c)| c).unwrap_or("UTF-8");
+            let mut generated = vec![format!("{} {}", locale, charset)];
+            if locale != "en_US.UTF-8" {
+                generated.push("en_US.UTF-8 UTF-8".to_string());
+            }
+            chroot.push(format!("locales locales/locales_to_be_generated multiselect {}", generated.join(", ")));
+            chroot.push(format!("locales locales/default_environment_locale select {}", locale));
+            installer.push(format!("d-i debian-installer/locale string {}", locale));
+        }
+        if let Some(timezone) = &self.timezone {
+            chroot.push(format!("tzdata tzdata/Areas select {}", timezone.split('/').next().unwrap_or(timezone)));
+            installer.push(format!("d-i time/zone string {}", timezone));
+        }
+        if let Some((layout, variant)) = &self.keyboard {
+            chroot.push(format!("keyboard-configuration keyboard-configuration/xkb-keymap select {}", layout));
+            installer.push(format!("d-i keyboard-configuration/xkb-keymap select {}", layout));
+            if let Some(variant) = variant {
+                chroot.push(format!("keyboard-configuration keyboard-configuration/variantcode string {}", variant));
+                installer.push(format!("d-i keyboard-configuration/variantcode string {}", variant));
+            }
+        }
+        if chroot.is_empty() {
+            return Ok(());
+        }
+
+        fs::create_dir_all(config.join("package-lists"))?;
+        fs::write(config.join("package-lists/hammer-locale.list.chroot"), "locales\nkeyboard-configuration\nconsole-setup\ntzdata\n")?;
+        fs::create_dir_all(config.join("preseed"))?;
+        fs::write(config.join("preseed/hammer-locale.cfg.chroot"), chroot.join("\n") + "\n")?;
+        fs::create_dir_all(config.join("includes.installer"))?;
+        let preseed = config.join("includes.installer/preseed.cfg");
+        let mut content = fs::read_to_string(&preseed).unwrap_or_default();
+        content.push_str(&format!("# Localization from hammer-builder init\n{}\n", installer.join("\n")));
+        fs::write(&preseed, content)?;
+        Logger::info(&format!("Localization written to {}/package-lists, preseed and includes.installer", config.display()));
+        Ok(())
+    }
+}
+
+/// Stops before anything starts when live-build could not run: it debootstraps, mounts
+/// and chroots
 fn require_root() -> Result<()> {
-    if !Uid::current().is_root() {
-        Logger::error("Permission denied. Building a live image requires root privileges.");
-        Logger::info(&format!("Try: sudo hammer-builder build ..."));
+    let invocation = format!("hammer-builder {}", std::env::args().skip(1).collect::<Vec<_>>().join(" "));
+    if let Some(problem) = caps::explain(caps::Profile::Full, &invocation, Some("debootstraps, mounts and chroots with live-build")) {
+        Logger::error(&problem);
+        Logger::info("Without root: hammer-builder lint, release-notes, publish and index.");
         std::process::exit(1);
     }
     Ok(())
@@ -0,0 +1,124 @@
+use anyhow::{bail, Result};
+use std::fs;
+use std::path::Path;
+
+// hammer.yaml, the build manifest next to ./config. Only the YAML the manifest needs is
+// understood: nested maps, lists of scalars ("- item" lines or "[a, b]") and plain or
+// quoted scalars. Anchors, multi-line strings and flow maps are not.
+
+/// Build manifest in the build directory
+pub const BUILD_FILE: &str = "hammer.yaml";
+
+#[derive(Debug, Clone)]
+pub enum Value {
+    Scalar(String),
+    List(Vec<String>),
+    Map(Vec<(String, Value)>),
+}
+
+impl Value {
+    pub fn get(&self, key: &str) -> Option<&Value> {
+        match self {
+            Value::Map(entries) => entries.iter().find(|(k, _)| k == key).map(|(_, v)| v),
+            _ => None,
+        }
+    }
+
+    pub fn str(&self, key: &str) -> Option<&str> {
+        match self.get(key)? {
+            Value::Scalar(s) if !s.is_empty() => Some(s),
+            _ => None,
+        }
+    }
+
+    /// A list, or a single scalar as a list of one
+    pub fn list(&self, key: &str) -> Vec<String> {
+        match self.get(key) {
+            Some(Value::List(items)) => items.clone(),
+            Some(Value::Scalar(s)) if !s.is_empty() => vec![s.clone()],
+            _ => Vec::new(),
+        }
+    }
+
+    pub fn bool(&self, key: &str) -> bool {
+        matches!(self.str(key), Some("true" | "yes"))
+    }
+
+    pub fn entries(&self) -> &[(String, Value)] {
+        match self {
+            Value::Map(entries) => entries,
+            _ => &[],
+        }
+    }
+}
+
+fn unquote(s: &str) -> String {
+    let s = s.trim();
+    for q in ['"', '\''] {
+        if s.len() >= 2 && s.starts_with(q) && s.ends_with(q) {
+            return s[1..s.len() - 1].to_string();
+        }
+    }
+    s.to_string()
+}
+
+fn scalar_or_inline_list(s: &str) -> Value {
+    match s.trim().strip_prefix('[').and_then(|s| s.strip_suffix(']')) {
+        Some(items) => Value::List(items.split(',').map(unquote).filter(|i| !i.is_empty()).collect()),
+        None => Value::Scalar(unquote(s)),
+    }
+}
+
+/// (indent, text) of the lines that carry content
+fn content_lines(text: &str) -> Vec<(usize, String)> {
+    text.lines()
+    .map(|line| line.split(" #").next().unwrap_or(""))
+    .filter(|line| !line.trim().is_empty() && !line.trim_start().starts_with('#') && line.trim() != "---")
+    .map(|line| (line.len() - line.trim_start().len(), line.trim().to_string()))
+    .collect()
+}
+
+fn parse_block(lines: &[(usize, String)], pos: &mut usize, indent: usize) -> Result<Value> {
+    if lines.get(*pos).is_some_and(|(_, text)| text.starts_with("- ") || text == "-") {
+        let mut items = Vec::new();
+        while let Some((i, text)) = lines.get(*pos) {
+            if *i != indent || !text.starts_with('-') {
+                break;
+            }
+            items.push(unquote(text.trim_start_matches('-')));
+            *pos += 1;
+        }
+        return Ok(Value::List(items));
+    }
+
+    let mut entries = Vec::new();
+    while let Some((i, text)) = lines.get(*pos) {
+        if *i < indent {
+            break;
+        }
+        if *i > indent {
+            bail!("{}: unexpected indentation in {}", text, BUILD_FILE);
+        }
+        let Some((key, rest)) = text.split_once(':') else {
+            bail!("{}: expected 'key: value' in {}", text, BUILD_FILE);
+        };
+        *pos += 1;
+        let value = match lines.get(*pos) {
+            Some((next, _)) if rest.trim().is_empty() && *next > indent => parse_block(lines, pos, *next)?,
+            _ => scalar_or_inline_list(rest),
+        };
+        entries.push((unquote(key), value));
+    }
+    Ok(Value::Map(entries))
+}
+
+/// The manifest at `file`; None when there is none
+pub fn load(file: &Path) -> Result<Option<Value>> {
+    let Ok(text) = fs::read_to_string(file) else {
+        return Ok(None);
+    };
+    let lines = content_lines(&text);
+    let mut pos = 0;
+    let value = parse_block(&lines, &mut pos, lines.first().map(|(i, _)| *i).unwrap_or(0))?;
+    Ok(Some(value))
+}
@@ -0,0 +1,93 @@
+use anyhow::{bail, Result};
+use hammer_core::{run_command, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::branding::write;
+
+// Network boot from the builder output: the kernel, initrd and root filesystem of the
+// live ISO, next to an iPXE script and a PXELINUX config. Served over HTTP from one
+// directory, live-boot downloads filesystem.squashfs itself (fetch=), so the TFTP side
+// only carries the kernel and initrd.
+//
+//   vmlinuz  initrd.img  filesystem.squashfs  boot.ipxe  pxelinux.cfg/default  SHA256SUMS
+
+/// Boot files; each is the /live file of the ISO whose name starts with it
+const FILES: &[&str] = &["vmlinuz", "initrd.img", "filesystem.squashfs"];
+
+/// Kernel command line of the live system as configured in config/binary
+fn bootappend(config: &Path) -> String {
+    fs::read_to_string(config.join("binary"))
+    .unwrap_or_default()
+    .lines()
+    .find_map(|l| l.strip_prefix("LB_BOOTAPPEND_LIVE=\"").and_then(|l| l.strip_suffix('"')).map(str::to_string))
+    .filter(|p| !p.is_empty())
+    .unwrap_or_else(|| "boot=live components".to_string())
+}
+
+/// Lays out the boot files of `iso` in `dir` for PXE and iPXE; `base_url` is where `dir`
+/// is served over HTTP. Returns the files written.
+pub fn layout(iso: &Path, dir: &Path, config: &Path, base_url: Option<&str>) -> Result<Vec<PathBuf>> {
+    let live = dir.join(".live");
+    if live.exists() {
+        fs::remove_dir_all(&live)?;
+    }
+    run_command("xorriso", &["-osirrox", "on", "-indev", &iso.to_string_lossy(), "-extract", "/live", &live.to_string_lossy()], "Extract Boot Files")?;
+
+    let mut written = Vec::new();
+    for name in FILES {
+        // live-build names the kernel with or without its version
+        let mut found: Vec<PathBuf> = fs::read_dir(&live)?
+        .flatten()
+        .map(|e| e.path())
+        .filter(|p| p.file_name().is_some_and(|n| n.to_string_lossy().starts_with(name)))
+        .collect();
+        found.sort();
+        let Some(source) = found.pop() else {
+            bail!("{} has no /live/{}*; it is not a live-build image", iso.display(), name);
+        };
+        let dest = dir.join(name);
+        fs::rename(&source, &dest)?;
+        written.push(dest);
+    }
+    fs::remove_dir_all(&live)?;
+
+    let params = bootappend(config);
+    // Without a URL the script works out where it was loaded from
+    let base = base_url.map(|u| u.trim_end_matches('/').to_string());
+    let ipxe = format!(
+        "#!ipxe\n# Written by hammer-builder --format netboot\n{}\
+        kernel ${{base-url}}/vmlinuz initrd=initrd.img {} fetch=${{base-url}}/filesystem.squashfs\n\
+        initrd ${{base-url}}/initrd.img\nboot\n",
+        match &base {
+            Some(url) => format!("set base-url {}\n", url),
+            None => "isset ${base-url} || set base-url ${cwduri}\n".to_string(),
+        },
+        params,
+    );
+    let script = dir.join("boot.ipxe");
+    write(&script, &ipxe)?;
+    written.push(script);
+
+    // PXELINUX cannot work out the HTTP side; it needs the URL
+    match &base {
+        Some(url) => {
+            let pxelinux = dir.join("pxelinux.cfg/default");
+            write(
+                &pxelinux,
+                &format!(
+                    "# Written by hammer-builder --format netboot\nDEFAULT hackeros\nLABEL hackeros\n  KERNEL vmlinuz\n  APPEND initrd=initrd.img {} fetch={}/filesystem.squashfs\n",
+                    params, url
+                ),
+            )?;
+            written.push(pxelinux);
+        }
+        None => Logger::warn("No --netboot-url; pxelinux.cfg/default is left out, boot.ipxe finds its own location"),
+    }
+
+    let sums = run_command("sh", &["-c", "cd \"$1\" && sha256sum vmlinuz initrd.img filesystem.squashfs", "sh", &dir.to_string_lossy()], "Checksum Boot Files")?;
+    let sums_path = dir.join("SHA256SUMS");
+    fs::write(&sums_path, sums)?;
+    written.push(sums_path);
+    Ok(written)
+}
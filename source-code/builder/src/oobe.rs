@@ -0,0 +1,114 @@
+use anyhow::Result;
+use hammer_core::Logger;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::Path;
+
+use crate::branding::write;
+
+// First-boot setup for appliance-style images: the installer copies the system without
+// asking for a user, locale or network, and the installed system asks on tty1 the first
+// time it boots. The marker lives in hammer's state directory, which rollbacks carry over,
+// so the wizard does not come back after one.
+
+const WIZARD: &str = "usr/lib/HackerOS/hammer/oobe";
+const SERVICE: &str = "etc/systemd/system/hammer-oobe.service";
+const HOOK: &str = "hooks/normal/9020-hammer-oobe.hook.chroot";
+
+const WIZARD_SCRIPT: &str = r#"#!/bin/sh
+# First-boot setup, written by hammer-builder --oobe
+set -u
+DONE=/var/lib/hammer/oobe-done
+
+echo "Welcome. A few settings are needed before this system is used."
+dpkg-reconfigure locales
+dpkg-reconfigure tzdata
+dpkg-reconfigure keyboard-configuration && setupcon --save || true
+if command -v nmtui >/dev/null; then
+    nmtui
+fi
+
+while :; do
+    printf 'Name of the first user: '
+    read -r name
+    adduser --comment "" "$name" && break
+done
+for group in sudo netdev; do
+    if getent group "$group" >/dev/null; then
+        adduser "$name" "$group"
+    fi
+done
+
+mkdir -p /var/lib/hammer
+touch "$DONE"
+systemctl disable hammer-oobe.service
+"#;
+
+const SERVICE_UNIT: &str = "[Unit]
+Description=Hammer first-boot setup
+ConditionPathExists=!/var/lib/hammer/oobe-done
+ConditionKernelCommandLine=!boot=live
+After=systemd-user-sessions.service plymouth-quit-wait.service
+Before=getty@tty1.service display-manager.service
+
+[Service]
+Type=oneshot
+ExecStartPre=-/bin/plymouth quit
+ExecStart=/usr/lib/HackerOS/hammer/oobe
+StandardInput=tty
+StandardOutput=tty
+TTYPath=/dev/tty1
+TTYReset=yes
+TTYVHangup=yes
+RemainAfterExit=yes
+
+[Install]
+WantedBy=multi-user.target
+";
+
+/// Calamares steps the wizard takes over; dropped from both its show and exec sequences
+const CALAMARES_STEPS: &[&str] = &["users", "locale", "localecfg", "keyboard"];
+
+/// d-i answers that keep the installer from asking what the wizard asks; values an earlier
+/// `init --locale ...` preseeded stay
+const INSTALLER_PRESEED: &[(&str, &str)] = &[
+    ("passwd/root-login", "boolean false"),
+    ("passwd/make-user", "boolean false"),
+    ("debian-installer/locale", "string en_US.UTF-8"),
+    ("keyboard-configuration/xkb-keymap", "select us"),
+    ("time/zone", "string UTC"),
+    ("netcfg/enable", "boolean false"),
+];
+
+/// Writes the wizard, its service and the installer settings into the live-build `config` directory
+pub fn apply(config: &Path) -> Result<()> {
+    Logger::info("Adding the first-boot setup wizard");
+    let chroot = config.join("includes.chroot");
+    write(&chroot.join(WIZARD), WIZARD_SCRIPT)?;
+    fs::set_permissions(chroot.join(WIZARD), fs::Permissions::from_mode(0o755))?;
+    write(&chroot.join(SERVICE), SERVICE_UNIT)?;
+
+    let steps = CALAMARES_STEPS.join("\\|");
+    let hook = format!(
+        "#!/bin/sh\n# Written by hammer-builder --oobe\nset -e\nsystemctl enable hammer-oobe.service\n\
+        if [ -f /etc/calamares/settings.conf ]; then\n    sed -i '/^ *- *\\({}\\) *$/d' /etc/calamares/settings.conf\nfi\n",
+        steps
+    );
+    let hook_path = config.join(HOOK);
+    write(&hook_path, &hook)?;
+    fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o755))?;
+    write(&config.join("package-lists/hammer-oobe.list.chroot"), "debconf\nadduser\nkbd\nconsole-setup\n")?;
+
+    let preseed = config.join("includes.installer/preseed.cfg");
+    let mut content = fs::read_to_string(&preseed).unwrap_or_default();
+    let missing: Vec<String> = INSTALLER_PRESEED
+    .iter()
+    .filter(|(key, _)| !content.lines().any(|l| l.split_whitespace().nth(1) == Some(*key)))
+    .map(|(key, value)| format!("d-i {} {}", key, value))
+    .collect();
+    if !missing.is_empty() {
+        content.push_str(&format!("# First-boot setup asks these instead (hammer-builder --oobe)\n{}\n", missing.join("\n")));
+        write(&preseed, &content)?;
+    }
+    Ok(())
+}
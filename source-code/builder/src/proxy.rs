@@ -0,0 +1,96 @@
+use anyhow::{bail, Result};
+use hammer_core::{run_change, Logger};
+use std::fs;
+use std::net::TcpStream;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+// Repeated builds download the same packages again. With --proxy every download of the
+// build goes through an apt caching proxy; --proxy auto starts an apt-cacher-ng of the
+// builder's own, on its own port and cache, next to any system instance. Its cache
+// survives builds, so --offline rebuilds from it without the network.
+
+const AUTO_PORT: u16 = 3143;
+const CACHE_DIR: &str = "/var/cache/hammer-builder/apt-cacher-ng";
+const CONF_DIR: &str = "/etc/apt-cacher-ng";
+
+/// The builder's apt-cacher-ng; stopped when dropped
+pub struct CachingProxy {
+    pid_file: PathBuf,
+}
+
+impl CachingProxy {
+    pub fn url(&self) -> String {
+        format!("http://127.0.0.1:{}/", AUTO_PORT)
+    }
+
+    /// Starts apt-cacher-ng with the builder's cache, serving only from it with `offline`
+    pub fn start(offline: bool) -> Result<CachingProxy> {
+        if !Path::new(CONF_DIR).exists() {
+            bail!("--proxy auto needs apt-cacher-ng: apt install apt-cacher-ng");
+        }
+        let log_dir = Path::new(CACHE_DIR).join("log");
+        fs::create_dir_all(&log_dir)?;
+        let pid_file = Path::new(CACHE_DIR).join("apt-cacher-ng.pid");
+        let proxy = CachingProxy { pid_file };
+        if TcpStream::connect(("127.0.0.1", AUTO_PORT)).is_ok() {
+            // Left over from a build that was killed
+            Logger::info(&format!("Reusing the caching proxy on port {}", AUTO_PORT));
+            return Ok(proxy);
+        }
+        run_change(
+            "apt-cacher-ng",
+            &[
+                "-c", CONF_DIR,
+                &format!("CacheDir={}", CACHE_DIR),
+                &format!("LogDir={}", log_dir.display()),
+                &format!("Port={}", AUTO_PORT),
+                "BindAddress=127.0.0.1",
+                &format!("PidFile={}", proxy.pid_file.display()),
+                &format!("offlinemode={}", if offline { 1 } else { 0 }),
+            ],
+            "Start Caching Proxy",
+        )?;
+        for _ in 0..50 {
+            if TcpStream::connect(("127.0.0.1", AUTO_PORT)).is_ok() {
+                Logger::info(&format!(
+                    "Caching proxy on port {}{}, cache in {}",
+                    AUTO_PORT, if offline { " (offline)" } else { "" }, CACHE_DIR
+                ));
+                return Ok(proxy);
+            }
+            std::thread::sleep(Duration::from_millis(100));
+        }
+        bail!("apt-cacher-ng did not come up on port {}; see {}", AUTO_PORT, log_dir.display());
+    }
+}
+
+impl Drop for CachingProxy {
+    fn drop(&mut self) {
+        if let Ok(pid) = fs::read_to_string(&self.pid_file) {
+            let _ = run_change("kill", &[pid.trim()], "Stop Caching Proxy");
+        }
+    }
+}
+
+/// Points the live-build config at `mirror` for bootstrap and chroot, and at `proxy` for
+/// every download. The installed system keeps the mirror of --mirror-binary.
+pub fn configure(config: &Path, mirror: Option<&str>, proxy: Option<&str>) -> Result<()> {
+    if mirror.is_none() && proxy.is_none() {
+        return Ok(());
+    }
+    if !config.join("bootstrap").exists() {
+        bail!("{} is not a live-build config", config.display());
+    }
+    let mut args = vec!["config"];
+    if let Some(mirror) = mirror {
+        args.extend(["--mirror-bootstrap", mirror, "--mirror-chroot", mirror]);
+        Logger::info(&format!("Mirror: {}", mirror));
+    }
+    if let Some(proxy) = proxy {
+        args.extend(["--apt-http-proxy", proxy]);
+        Logger::info(&format!("Proxy: {}", proxy));
+    }
+    run_change("lb", &args, "Live Build Config")?;
+    Ok(())
+}
@@ -0,0 +1,95 @@
+use anyhow::{bail, Result};
+use hammer_core::exec::Exec;
+use hammer_core::{create_spinner, run_change, run_command, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::report;
+
+// Most of an ISO is unchanged from one build to the next. NAME.iso.zsync, written next to
+// the image, lets zsync turn a previously downloaded ISO into the new one by fetching only
+// the blocks that changed:
+//
+//   zsync -i old.iso https://releases.example.org/hackeros/NAME/NAME.iso.zsync
+//
+// `publish` copies an artifact directory, image and metadata, to DEST/NAME of a release
+// directory, local or remote (rsync's host:path), the image first so that mirrors never
+// serve metadata for an image that is not there yet.
+
+/// Writes NAME.zsync next to `file`; None when zsyncmake is not installed
+pub fn zsync(file: &Path) -> Result<Option<PathBuf>> {
+    let available = Exec::new("zsyncmake", &["-V"], "Find zsyncmake").output().is_ok();
+    if !available {
+        Logger::warn("zsyncmake not found, no .zsync written: apt install zsync");
+        return Ok(None);
+    }
+    let dir = file.parent().unwrap_or(Path::new("."));
+    let name = file.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+    let spinner = create_spinner("Writing zsync metadata...");
+    // A relative URL, resolved against the .zsync's own, so the pair can be published anywhere
+    let made = run_command(
+        "sh",
+        &["-c", "cd \"$1\" && zsyncmake -u \"$2\" -o \"$2.zsync\" -- \"$2\"", "sh", &dir.to_string_lossy(), &name],
+        "Write zsync Metadata",
+    );
+    spinner.finish_and_clear();
+    made?;
+    Ok(Some(dir.join(format!("{}.zsync", name))))
+}
+
+/// Copies the artifact directory `dir` of a successful build to `dest`/NAME
+pub fn publish(dir: &Path, dest: &str, dry_run: bool) -> Result<()> {
+    let manifest = fs::read_to_string(dir.join(report::MANIFEST))
+    .map_err(|e| anyhow::anyhow!("{} is not an artifact directory of hammer-builder build: {}", dir.display(), e))?;
+    let manifest: serde_json::Value = serde_json::from_str(&manifest)?;
+    if manifest["status"] != "succeeded" {
+        bail!("{} holds a failed build (stage {}); not publishing it", dir.display(), manifest["failed_stage"].as_str().unwrap_or("-"));
+    }
+    let name = dir
+    .canonicalize()?
+    .file_name()
+    .map(|n| n.to_string_lossy().to_string())
+    .unwrap_or_default();
+
+    let mut files: Vec<PathBuf> = fs::read_dir(dir)?.flatten().map(|e| e.path()).filter(|p| p.is_file()).collect();
+    files.sort();
+    let images: Vec<&PathBuf> = files.iter().filter(|f| f.extension().is_some_and(|x| x == "iso")).collect();
+    for image in &images {
+        let sum = PathBuf::from(format!("{}.sha256", image.display()));
+        if sum.exists() {
+            let file_name = sum.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+            run_command("sh", &["-c", "cd \"$1\" && sha256sum --quiet -c -- \"$2\"", "sh", &dir.to_string_lossy(), &file_name], "Verify Image")?;
+        }
+        let zsync_file = PathBuf::from(format!("{}.zsync", image.display()));
+        if !zsync_file.exists() {
+            zsync(image)?;
+        }
+    }
+
+    let target = format!("{}/{}/", dest.trim_end_matches('/'), name);
+    Logger::info(&format!("Publishing {} to {}", dir.display(), target));
+    if !dest.contains(':') && !dry_run {
+        fs::create_dir_all(&target)?;
+    }
+    let mut args = vec!["-a", "--partial"];
+    if dry_run {
+        args.push("--dry-run");
+    }
+    let source = format!("{}/", dir.display());
+    let mut image_args = args.clone();
+    image_args.extend(["--include", "*.iso", "--exclude", "*", &source, &target]);
+    let spinner = create_spinner("Uploading image...");
+    let uploaded = run_change("rsync", &image_args, "Publish Image");
+    spinner.finish_and_clear();
+    uploaded?;
+    let mut metadata_args = args;
+    metadata_args.extend(["--exclude", "*.iso", &source, &target]);
+    run_change("rsync", &metadata_args, "Publish Metadata")?;
+
+    if dry_run {
+        Logger::info("Dry run: nothing was copied.");
+    } else {
+        Logger::success(&format!("Published {} ({} image(s)) to {}", name, images.len(), target));
+    }
+    Ok(())
+}
@@ -0,0 +1,136 @@
+use anyhow::{bail, Result};
+use hammer_core::packages::{self, PackageDiff};
+use hammer_core::{run_command, Logger};
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::budget::human;
+use crate::report;
+
+// What changed since the previous release, from the packages.txt and build-manifest.json
+// of two artifact directories. release-notes.json is for programs, hammer included, and
+// keeps its shape within a format number; release-notes.md is for the release page.
+
+pub const JSON: &str = "release-notes.json";
+pub const MARKDOWN: &str = "release-notes.md";
+const FORMAT: u32 = 1;
+
+/// name -> version of live-build's package list, "name[:arch]\tversion" per line
+fn read_packages(dir: &Path) -> Result<BTreeMap<String, String>> {
+    let file = dir.join("packages.txt");
+    let Ok(content) = fs::read_to_string(&file) else {
+        bail!("{} has no package list; was it built by hammer-builder build?", dir.display());
+    };
+    Ok(content
+    .lines()
+    .filter_map(|l| {
+        let mut fields = l.split_whitespace();
+        let name = fields.next()?.split(':').next()?.to_string();
+        Some((name, fields.next()?.to_string()))
+    })
+    .collect())
+}
+
+/// Name, start time and image size of the build in `dir`
+fn describe(dir: &Path) -> (String, Option<String>, Option<u64>) {
+    let name = dir
+    .canonicalize()
+    .ok()
+    .and_then(|d| d.file_name().map(|n| n.to_string_lossy().to_string()))
+    .unwrap_or_else(|| dir.display().to_string());
+    let manifest: serde_json::Value = fs::read_to_string(dir.join(report::MANIFEST))
+    .ok()
+    .and_then(|m| serde_json::from_str(&m).ok())
+    .unwrap_or_default();
+    let started = manifest["started"].as_str().map(str::to_string);
+    // The image itself, or what the manifest recorded when only the metadata was kept
+    let image = fs::read_dir(dir)
+    .into_iter()
+    .flatten()
+    .flatten()
+    .map(|e| e.path())
+    .find(|p| p.extension().is_some_and(|x| x == "iso"));
+    let size = image.and_then(|p| fs::metadata(p).ok()).map(|m| m.len()).or_else(|| {
+        manifest["artifacts"]
+        .as_array()?
+        .iter()
+        .find(|a| a["path"].as_str().is_some_and(|p| p.ends_with(".iso")))?["size"]
+        .as_u64()
+    });
+    (name, started, size)
+}
+
+fn newer(a: &str, b: &str) -> bool {
+    run_command("dpkg", &["--compare-versions", b, "gt", a], "Compare Versions").is_ok()
+}
+
+fn signed(delta: i64) -> String {
+    let sign = if delta < 0 { "-" } else { "+" };
+    format!("{}{}", sign, human(delta.unsigned_abs()))
+}
+
+/// Writes the release notes of the build in `current` against the one in `previous`
+pub fn write(previous: &Path, current: &Path) -> Result<Vec<PathBuf>> {
+    let diff: PackageDiff = packages::diff(&read_packages(previous)?, &read_packages(current)?);
+    let (upgraded, downgraded): (Vec<_>, Vec<_>) = diff.changed.iter().partition(|(_, old, new)| newer(old, new));
+    let (prev_name, prev_started, prev_size) = describe(previous);
+    let (name, _, size) = describe(current);
+    let size_delta = match (prev_size, size) {
+        (Some(a), Some(b)) => Some(b as i64 - a as i64),
+        _ => None,
+    };
+
+    let entry = |(name, version): &(String, String)| serde_json::json!({ "name": name, "version": version });
+    let change = |(name, from, to): &&(String, String, String)| serde_json::json!({ "name": name, "from": from, "to": to });
+    let notes = serde_json::json!({
+        "format": FORMAT,
+        "image": name,
+        "previous": { "image": prev_name, "started": prev_started, "size": prev_size },
+        "size": size,
+        "size_delta": size_delta,
+        "summary": diff.summary(),
+        "packages": {
+            "added": diff.added.iter().map(entry).collect::<Vec<_>>(),
+            "removed": diff.removed.iter().map(entry).collect::<Vec<_>>(),
+            "upgraded": upgraded.iter().map(change).collect::<Vec<_>>(),
+            "downgraded": downgraded.iter().map(change).collect::<Vec<_>>(),
+        },
+    });
+    let json_path = current.join(JSON);
+    fs::write(&json_path, serde_json::to_string_pretty(&notes)? + "\n")?;
+
+    let mut md = format!("# {}\n\nChanges since {}", name, prev_name);
+    if let Some(started) = &prev_started {
+        md.push_str(&format!(" (built {})", started.split('T').next().unwrap_or(started)));
+    }
+    md.push_str(&format!(": {} packages.\n", diff.summary()));
+    if let (Some(size), Some(delta)) = (size, size_delta) {
+        md.push_str(&format!("\nImage size: {} ({})\n", human(size), signed(delta)));
+    }
+    let sections: [(&str, Vec<String>); 4] = [
+        ("Upgraded", upgraded.iter().map(|(n, a, b)| format!("{}: {} → {}", n, a, b)).collect()),
+        ("Added", diff.added.iter().map(|(n, v)| format!("{} {}", n, v)).collect()),
+        ("Removed", diff.removed.iter().map(|(n, v)| format!("{} {}", n, v)).collect()),
+        ("Downgraded", downgraded.iter().map(|(n, a, b)| format!("{}: {} → {}", n, a, b)).collect()),
+    ];
+    for (title, lines) in sections {
+        if lines.is_empty() {
+            continue;
+        }
+        md.push_str(&format!("\n## {} ({})\n\n", title, lines.len()));
+        for line in lines {
+            md.push_str(&format!("- {}\n", line));
+        }
+    }
+    let md_path = current.join(MARKDOWN);
+    fs::write(&md_path, md)?;
+
+    Logger::info(&format!(
+        "Release notes against {}: {} packages{}",
+        prev_name,
+        diff.summary(),
+        size_delta.map(|d| format!(", image {}", signed(d))).unwrap_or_default()
+    ));
+    Ok(vec![json_path, md_path])
+}
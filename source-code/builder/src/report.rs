@@ -0,0 +1,183 @@
+use anyhow::Result;
+use hammer_core::{run_command, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+
+// What a build did, for pipelines: each stage fails with its own exit code, and every
+// build, failed or not, leaves build-manifest.json in its artifact directory
+//
+//   ARTIFACTS/NAME/NAME.iso          the image
+//   ARTIFACTS/NAME/NAME.iso.sha256   sha256sum -c compatible
+//   ARTIFACTS/NAME/NAME.iso.zsync    for zsync, when zsyncmake is installed
+//   ARTIFACTS/NAME/packages.txt      packages in the image, when live-build listed them
+//   ARTIFACTS/NAME/release-notes.*  changes since --previous, as JSON and Markdown
+//   ARTIFACTS/NAME/build.log         live-build output, with --log-format json
+//   ARTIFACTS/NAME/build-manifest.json
+
+pub const MANIFEST: &str = "build-manifest.json";
+
+#[derive(Clone, Copy, PartialEq)]
+pub enum Stage {
+    Config,
+    Customize,
+    Lint,
+    Clean,
+    Test,
+    Size,
+    Build,
+    Artifacts,
+}
+
+impl Stage {
+    pub fn name(self) -> &'static str {
+        match self {
+            Stage::Config => "config",
+            Stage::Customize => "customize",
+            Stage::Lint => "lint",
+            Stage::Clean => "clean",
+            Stage::Test => "test",
+            Stage::Size => "size",
+            Stage::Build => "build",
+            Stage::Artifacts => "artifacts",
+        }
+    }
+
+    /// 1 stays with errors outside a build and 2 with clap's usage errors
+    pub fn exit_code(self) -> i32 {
+        match self {
+            Stage::Config => 3,
+            Stage::Customize => 4,
+            Stage::Clean => 5,
+            Stage::Build => 6,
+            Stage::Artifacts => 7,
+            // Numbered last so the other stages keep the codes pipelines already check
+            Stage::Lint => 8,
+            Stage::Test => 9,
+            Stage::Size => 10,
+        }
+    }
+}
+
+pub struct Report {
+    dir: PathBuf,
+    started: chrono::DateTime<chrono::Local>,
+    clock: Instant,
+    options: serde_json::Value,
+    /// Finished stages and how long they took
+    stages: Vec<(Stage, Duration)>,
+    current: Option<(Stage, Instant)>,
+    artifacts: Vec<PathBuf>,
+}
+
+impl Report {
+    /// A report for the image `output`, kept in its directory under `artifacts`
+    pub fn new(artifacts: &Path, output: &str, options: serde_json::Value) -> Report {
+        let name = Path::new(output).file_stem().map(|s| s.to_string_lossy().to_string()).unwrap_or_else(|| output.to_string());
+        Report {
+            dir: artifacts.join(name),
+            started: chrono::Local::now(),
+            clock: Instant::now(),
+            options,
+            stages: Vec::new(),
+            current: None,
+            artifacts: Vec::new(),
+        }
+    }
+
+    /// Directory the artifacts of this build go to
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    /// Ends the running stage and starts `stage`
+    pub fn stage(&mut self, stage: Stage) {
+        self.end_stage();
+        Logger::info(&format!("Stage: {}", stage.name()));
+        self.current = Some((stage, Instant::now()));
+    }
+
+    fn end_stage(&mut self) {
+        if let Some((stage, started)) = self.current.take() {
+            self.stages.push((stage, started.elapsed()));
+        }
+    }
+
+    /// Moves `file` into the artifact directory under `name` and records it
+    pub fn add_artifact(&mut self, file: &Path, name: &str) -> Result<PathBuf> {
+        fs::create_dir_all(&self.dir)?;
+        let dest = self.dir.join(name);
+        if fs::rename(file, &dest).is_err() {
+            // Another filesystem
+            fs::copy(file, &dest)?;
+            fs::remove_file(file)?;
+        }
+        self.artifacts.push(dest.clone());
+        Ok(dest)
+    }
+
+    /// Records a file already written into the artifact directory
+    pub fn record(&mut self, file: PathBuf) {
+        self.artifacts.push(file);
+    }
+
+    /// Writes the manifest; on failure also reports the failed stage and exits with its code
+    pub fn finish(mut self, result: Result<()>) -> Result<()> {
+        let failed = result.as_ref().err().map(|e| (self.current.map(|(s, _)| s).unwrap_or(Stage::Config), format!("{:#}", e)));
+        self.end_stage();
+
+        let artifacts: Vec<serde_json::Value> = self.artifacts
+        .iter()
+        .filter(|a| a.exists())
+        .map(|a| {
+            let size = fs::metadata(a).map(|m| m.len()).unwrap_or(0);
+            serde_json::json!({ "path": a.file_name().map(|n| n.to_string_lossy().to_string()), "size": size })
+        })
+        .collect();
+        let stages: Vec<serde_json::Value> = self.stages
+        .iter()
+        .map(|(stage, took)| {
+            let status = match &failed {
+                Some((failed, _)) if failed == stage => "failed",
+                _ => "succeeded",
+            };
+            serde_json::json!({ "name": stage.name(), "status": status, "seconds": took.as_secs_f64() })
+        })
+        .collect();
+        let manifest = serde_json::json!({
+            "status": if failed.is_some() { "failed" } else { "succeeded" },
+            "failed_stage": failed.as_ref().map(|(s, _)| s.name()),
+            "error": failed.as_ref().map(|(_, e)| e),
+            "exit_code": failed.as_ref().map(|(s, _)| s.exit_code()).unwrap_or(0),
+            "started": self.started.to_rfc3339(),
+            "finished": chrono::Local::now().to_rfc3339(),
+            "seconds": self.clock.elapsed().as_secs_f64(),
+            "builder_version": env!("CARGO_PKG_VERSION"),
+            "options": self.options,
+            "stages": stages,
+            "artifacts": artifacts,
+        });
+
+        fs::create_dir_all(&self.dir)?;
+        let path = self.dir.join(MANIFEST);
+        fs::write(&path, serde_json::to_string_pretty(&manifest)? + "\n")?;
+        Logger::info(&format!("Build manifest written to {}", path.display()));
+
+        if let Some((stage, error)) = failed {
+            Logger::error(&format!("Build failed in stage {}: {}", stage.name(), error));
+            std::process::exit(stage.exit_code());
+        }
+        Ok(())
+    }
+}
+
+/// Writes NAME.sha256 next to an artifact, in the format sha256sum -c reads
+pub fn checksum(file: &Path) -> Result<PathBuf> {
+    let dir = file.parent().unwrap_or(Path::new("."));
+    let name = file.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+    // Relative names, so the pair can be checked wherever it is copied to
+    let sum = run_command("sh", &["-c", "cd \"$1\" && sha256sum -- \"$2\"", "sh", &dir.to_string_lossy(), &name], "Checksum Image")?;
+    let path = dir.join(format!("{}.sha256", name));
+    fs::write(&path, sum)?;
+    Ok(path)
+}
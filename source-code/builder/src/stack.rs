@@ -0,0 +1,65 @@
+use anyhow::Result;
+use hammer_core::Logger;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::Path;
+
+use crate::branding::write;
+
+// The hammer binary alone does not update anything: the timer, the first-boot migrations,
+// the health check, the API daemon, the apt hooks and /etc/hammer/hammer.toml make the
+// atomic-update stack. They are built into the builder from ../config, so an image gets
+// the ones of the hammer release that built it. Files the config already brings win.
+
+const FILES: &[(&str, &str)] = &[
+    ("etc/hammer/hammer.toml", include_str!("../../../config/hammer.toml")),
+    ("etc/apt/apt.conf.d/79hammer-apt-external", include_str!("../../../config/apt/79hammer-apt-external")),
+    ("etc/apt/apt.conf.d/80hammer-auto-snapshot", include_str!("../../../config/apt/80hammer-auto-snapshot")),
+    ("usr/lib/systemd/system/hammer-api.service", include_str!("../../../config/systemd/hammer-api.service")),
+    ("usr/lib/systemd/system/hammer-backup.service", include_str!("../../../config/systemd/hammer-backup.service")),
+    ("usr/lib/systemd/system/hammer-backup.timer", include_str!("../../../config/systemd/hammer-backup.timer")),
+    ("usr/lib/systemd/system/hammer-check.service", include_str!("../../../config/systemd/hammer-check.service")),
+    ("usr/lib/systemd/system/hammer-first-boot.service", include_str!("../../../config/systemd/hammer-first-boot.service")),
+    ("usr/lib/systemd/system/hammer-update.service", include_str!("../../../config/systemd/hammer-update.service")),
+    ("usr/lib/systemd/system/hammer-update.timer", include_str!("../../../config/systemd/hammer-update.timer")),
+    ("etc/polkit-1/rules.d/50-hammer.rules", POLKIT_RULES),
+];
+
+/// Backups stay off until a target is configured
+const ENABLED: &[&str] = &["hammer-update.timer", "hammer-first-boot.service", "hammer-check.service", "hammer-api.service"];
+
+/// Administrators start hammer's units (an update now, a backup) without a password prompt
+const POLKIT_RULES: &str = r#"// Written by hammer-builder
+polkit.addRule(function(action, subject) {
+    if (action.id == "org.freedesktop.systemd1.manage-units" &&
+        /^hammer-[a-z-]+\.(service|timer)$/.test(action.lookup("unit")) &&
+        subject.isInGroup("sudo") && subject.local && subject.active) {
+        return polkit.Result.YES;
+    }
+});
+"#;
+
+const HOOK: &str = "hooks/normal/9030-hammer-stack.hook.chroot";
+
+/// Writes hammer's units, configuration and polkit rules into the live-build `config` directory
+pub fn apply(config: &Path) -> Result<()> {
+    let chroot = config.join("includes.chroot");
+    let mut added = 0;
+    for (path, content) in FILES {
+        let dest = chroot.join(path);
+        if !dest.exists() {
+            write(&dest, content)?;
+            added += 1;
+        }
+    }
+    Logger::info(&format!("hammer units and configuration: {} file(s) added to {}", added, chroot.display()));
+
+    let hook = format!(
+        "#!/bin/sh\n# Written by hammer-builder: the hammer update stack, enabled\nset -e\nsystemctl enable {}\n",
+        ENABLED.join(" ")
+    );
+    let hook_path = config.join(HOOK);
+    write(&hook_path, &hook)?;
+    fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o755))?;
+    Ok(())
+}
@@ -0,0 +1,174 @@
+use anyhow::{bail, Result};
+use hammer_core::Logger;
+use std::fs;
+use std::path::Path;
+
+use crate::branding::{bootloader, write};
+
+// Provisioning images for fleets: the ISO boots straight into a preseeded debian-installer
+// that wipes the first disk matching a pattern, installs without a question and reboots.
+// The installer puts the root into @rootfs; its late_command gives the installed system
+// hammer's layout (@ and @snapshots), which is what `hroot init-system` would be asked to
+// do, and a first-boot migration removes @rootfs once it is no longer mounted.
+
+const INIT_SCRIPT: &str = "hammer-init-system.sh";
+
+/// Preseed of the installation; answers already preseeded (init --locale ...) stay
+const PRESEED: &[(&str, &str)] = &[
+    ("debian-installer/locale", "string en_US.UTF-8"),
+    ("keyboard-configuration/xkb-keymap", "select us"),
+    ("netcfg/choose_interface", "select auto"),
+    ("netcfg/get_hostname", "string hackeros"),
+    ("netcfg/get_domain", "string"),
+    ("time/zone", "string UTC"),
+    ("clock-setup/utc", "boolean true"),
+    ("passwd/root-login", "boolean false"),
+    ("passwd/make-user", "boolean false"),
+    ("partman-auto/method", "string regular"),
+    ("partman-auto/choose_recipe", "select hammer"),
+    (
+        "partman-auto/expert_recipe",
+        "string hammer :: \
+        1 1 1 free $iflabel{ gpt } $reusemethod{ } method{ biosgrub } . \
+        538 538 1075 free $iflabel{ gpt } $reusemethod{ } method{ efi } format{ } . \
+        4096 8192 -1 btrfs $primary{ } method{ format } format{ } use_filesystem{ } filesystem{ btrfs } mountpoint{ / } .",
+    ),
+    ("partman-basicfilesystems/no_swap", "boolean false"),
+    ("partman-efi/non_efi_system", "boolean true"),
+    ("partman-partitioning/confirm_write_new_label", "boolean true"),
+    ("partman/choose_partition", "select finish"),
+    ("partman/confirm", "boolean true"),
+    ("partman/confirm_nooverwrite", "boolean true"),
+    ("grub-installer/only_debian", "boolean true"),
+    ("grub-installer/bootdev", "string default"),
+    ("finish-install/reboot_in_progress", "note"),
+    ("preseed/late_command", "string sh /hammer-init-system.sh"),
+];
+
+/// Runs in the installer with the new system at /target; d-i's busybox sh
+const INIT_SYSTEM: &str = r#"#!/bin/sh
+# Written by hammer-builder --unattended: hammer's Btrfs layout for the installed system
+set -e
+dev=$(awk '$2 == "/target" { print $1 }' /proc/mounts)
+current=$(awk '$2 == "/target" { print $4 }' /proc/mounts | tr ',' '\n' | sed -n 's|^subvol=/*||p')
+pool=/tmp/hammer-pool
+mkdir -p "$pool"
+mount -t btrfs -o subvolid=5 "$dev" "$pool"
+[ -d "$pool/@snapshots" ] || btrfs subvolume create "$pool/@snapshots"
+
+if [ -n "$current" ] && [ "$current" != "@" ]; then
+    btrfs subvolume snapshot "$pool/$current" "$pool/@"
+    sed -i "s|subvol=/*$current\([,[:space:]]\)|subvol=@\1|" "$pool/@/etc/fstab"
+    new=/tmp/hammer-root
+    mkdir -p "$new"
+    mount -t btrfs -o subvol=@ "$dev" "$new"
+    for d in dev dev/pts proc sys run; do mount --bind "/$d" "$new/$d"; done
+    if [ -d /target/boot/efi ] && grep -q ' /target/boot/efi ' /proc/mounts; then
+        mount --bind /target/boot/efi "$new/boot/efi"
+    fi
+    disk=$(debconf-get grub-installer/bootdev || true)
+    [ -n "$disk" ] && [ "$disk" != default ] || disk=$(debconf-get partman-auto/disk)
+    chroot "$new" grub-install "$disk"
+    chroot "$new" update-grub
+    mkdir -p "$new/usr/lib/HackerOS/hammer/migrations"
+    cat > "$new/usr/lib/HackerOS/hammer/migrations/0000-remove-installer-root.sh" <<EOF
+#!/bin/sh
+# The installer's copy of the root, left behind by hammer-init-system.sh
+set -e
+mkdir -p /run/hammer/installer-pool
+mount -t btrfs -o subvolid=5 "\$(findmnt -no SOURCE / | sed 's/\[.*//')" /run/hammer/installer-pool
+btrfs subvolume delete "/run/hammer/installer-pool/$current" || true
+umount /run/hammer/installer-pool
+EOF
+    for d in boot/efi run sys proc dev/pts dev; do umount "$new/$d" 2>/dev/null || true; done
+    umount "$new"
+    btrfs subvolume set-default "$pool/@"
+fi
+umount "$pool"
+"#;
+
+/// Writes the preseed, the layout script and a default boot entry for the installer into
+/// the live-build `config` directory. `disk` is a shell pattern the target disk matches.
+pub fn apply(config: &Path, disk: &str, has_accounts: bool) -> Result<()> {
+    let binary = fs::read_to_string(config.join("binary")).unwrap_or_default();
+    if binary.lines().any(|l| l == "LB_DEBIAN_INSTALLER=\"none\"" || l == "LB_DEBIAN_INSTALLER=\"false\"") {
+        bail!("--unattended needs the installer in the image: lb config --debian-installer live");
+    }
+    if !has_accounts {
+        bail!("--unattended installs no user; declare users in hammer.yaml or add --oobe");
+    }
+    if disk.contains(['"', '\'', '\n', ' ']) {
+        bail!("--target-disk '{}' must be a device path or a shell pattern without quotes or spaces", disk);
+    }
+    Logger::warn(&format!("Unattended image: booting it erases the first disk matching {} without asking", disk));
+
+    let preseed = config.join("includes.installer/preseed.cfg");
+    let mut content = fs::read_to_string(&preseed).unwrap_or_default();
+    let mut lines: Vec<String> = PRESEED
+    .iter()
+    .filter(|(key, _)| !content.lines().any(|l| l.split_whitespace().nth(1) == Some(*key)))
+    .map(|(key, value)| format!("d-i {} {}", key, value))
+    .collect();
+    if !content.contains("partman/early_command") {
+        // The first disk the installer sees that matches
+        lines.push(format!(
+            "d-i partman/early_command string for d in $(list-devices disk); do case $d in {}) debconf-set partman-auto/disk $d; break;; esac; done",
+            disk
+        ));
+    }
+    if !lines.is_empty() {
+        content.push_str(&format!("# Unattended installation (hammer-builder --unattended)\n{}\n", lines.join("\n")));
+        write(&preseed, &content)?;
+    }
+    write(&config.join("includes.installer").join(INIT_SCRIPT), INIT_SYSTEM)?;
+    default_to_installer(config, disk)
+}
+
+/// Makes the unattended installation the default boot entry of the ISO, after a timeout
+fn default_to_installer(config: &Path, disk: &str) -> Result<()> {
+    let append = "auto=true priority=critical preseed/file=/preseed.cfg --- quiet";
+    let title = format!("Unattended install (erases {})", disk);
+
+    match bootloader(config, "grub-pc")? {
+        Some(dir) => {
+            let cfg = dir.join("config.cfg");
+            let mut content = fs::read_to_string(&cfg).unwrap_or_default();
+            if !content.contains("hammer-unattended") {
+                content.push_str(&format!(
+                    "\n# Written by hammer-builder --unattended\nset timeout=5\nset default=hammer-unattended\n\
+                    menuentry \"{}\" --id hammer-unattended {{\n    linux /install/vmlinuz {}\n    initrd /install/initrd.gz\n}}\n",
+                    title, append
+                ));
+                write(&cfg, &content)?;
+            }
+        }
+        None => Logger::warn("No live-build GRUB template; the unattended entry is missing from the UEFI boot menu"),
+    }
+
+    match bootloader(config, "isolinux")? {
+        Some(dir) => {
+            write(
+                &dir.join("hammer-unattended.cfg"),
+                &format!(
+                    "# Written by hammer-builder --unattended\nlabel hammer-unattended\n\tmenu label ^{}\n\tmenu default\n\
+                    \tlinux /install/vmlinuz\n\tinitrd /install/initrd.gz\n\tappend {}\n",
+                    title, append
+                ),
+            )?;
+            let menu = dir.join("menu.cfg");
+            let content = fs::read_to_string(&menu).unwrap_or_default();
+            if !content.contains("hammer-unattended.cfg") {
+                write(&menu, &format!("include hammer-unattended.cfg\n{}", content))?;
+            }
+            let isolinux = dir.join("isolinux.cfg");
+            let content = fs::read_to_string(&isolinux).unwrap_or_default();
+            let content: Vec<String> = content
+            .lines()
+            .map(|l| if l.trim() == "timeout 0" { "timeout 50".to_string() } else { l.to_string() })
+            .collect();
+            write(&isolinux, &(content.join("\n") + "\n"))?;
+        }
+        None => Logger::warn("No live-build isolinux template; the unattended entry is missing from the BIOS boot menu"),
+    }
+    Ok(())
+}
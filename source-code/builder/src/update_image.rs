@@ -0,0 +1,211 @@
+use anyhow::{bail, Result};
+use hammer_core::{create_spinner, run_change, run_command, Logger};
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+
+use crate::report;
+
+// Point releases without a rebuild: the root filesystem of a built ISO is unpacked,
+// upgraded with apt in a chroot and packed again. xorriso then writes a new ISO from the
+// old one with only the changed files replaced, replaying its boot records, so the boot
+// menus, EFI image and hybrid MBR stay as live-build made them.
+
+/// Where live-build puts the root filesystem, kernel and initrd on the ISO
+const LIVE_DIR: &str = "live";
+
+/// Bind mounts of the chroot, unmounted in reverse order however the upgrade ends
+struct Chroot {
+    root: PathBuf,
+    mounted: Vec<PathBuf>,
+}
+
+impl Chroot {
+    fn enter(root: &Path) -> Result<Chroot> {
+        let mut chroot = Chroot { root: root.to_path_buf(), mounted: Vec::new() };
+        for dir in ["proc", "sys", "dev", "dev/pts"] {
+            let target = root.join(dir);
+            fs::create_dir_all(&target)?;
+            run_change("mount", &["--bind", &format!("/{}", dir), &target.to_string_lossy()], "Bind Mount")?;
+            chroot.mounted.push(target);
+        }
+        // Name resolution of the build host for apt; the image keeps its own resolv.conf
+        let resolv = root.join("etc/resolv.conf");
+        if resolv.exists() || resolv.is_symlink() {
+            fs::rename(&resolv, root.join("etc/resolv.conf.hammer"))?;
+        }
+        fs::copy("/etc/resolv.conf", &resolv)?;
+        // No services start inside the chroot
+        let policy = root.join("usr/sbin/policy-rc.d");
+        fs::write(&policy, "#!/bin/sh\nexit 101\n")?;
+        fs::set_permissions(&policy, fs::Permissions::from_mode(0o755))?;
+        Ok(chroot)
+    }
+
+    fn run(&self, script: &str, description: &str) -> Result<String> {
+        Ok(run_change("chroot", &[&self.root.to_string_lossy(), "/bin/sh", "-c", script], description)?)
+    }
+}
+
+impl Drop for Chroot {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(self.root.join("usr/sbin/policy-rc.d"));
+        let resolv = self.root.join("etc/resolv.conf");
+        let _ = fs::remove_file(&resolv);
+        let _ = fs::rename(self.root.join("etc/resolv.conf.hammer"), &resolv);
+        for target in self.mounted.iter().rev() {
+            if run_change("umount", &[&target.to_string_lossy()], "Unmount").is_err() {
+                let _ = run_change("umount", &["-l", &target.to_string_lossy()], "Lazy Unmount");
+            }
+        }
+    }
+}
+
+/// Compression of a squashfs image, for packing it again the same way
+fn compression(squashfs: &Path) -> String {
+    run_command("unsquashfs", &["-s", &squashfs.to_string_lossy()], "Read Squashfs")
+    .unwrap_or_default()
+    .lines()
+    .find_map(|l| l.strip_prefix("Compression ").map(|c| c.trim().to_string()))
+    .unwrap_or_else(|| "xz".to_string())
+}
+
+/// Newest file in `dir` starting with `prefix`, by version order
+fn newest(dir: &Path, prefix: &str) -> Option<PathBuf> {
+    let mut names: Vec<String> = fs::read_dir(dir)
+    .ok()?
+    .flatten()
+    .map(|e| e.file_name().to_string_lossy().to_string())
+    .filter(|n| n.starts_with(prefix))
+    .collect();
+    names.sort_by_key(|n| version_key(n));
+    names.pop().map(|n| dir.join(n))
+}
+
+/// Parts of a name with their numbers compared as numbers, so 6.10 sorts after 6.9
+fn version_key(name: &str) -> Vec<(u64, String)> {
+    name.split(['.', '-', '+', '~', '_'])
+    .map(|part| {
+        let digits: String = part.chars().take_while(char::is_ascii_digit).collect();
+        (digits.parse().unwrap_or(0), part[digits.len()..].to_string())
+    })
+    .collect()
+}
+
+/// Upgrades the packages of `input` and writes the result to `output`
+pub fn run(input: &Path, output: &Path, work: &Path, keep_work: bool) -> Result<()> {
+    if !input.is_file() {
+        bail!("{} is not an ISO image", input.display());
+    }
+    if work.exists() {
+        fs::remove_dir_all(work)?;
+    }
+    fs::create_dir_all(work)?;
+    let input_str = input.to_string_lossy().to_string();
+    let live = work.join(LIVE_DIR);
+    let rootfs = work.join("rootfs");
+
+    Logger::info(&format!("Unpacking {}", input.display()));
+    run_command("xorriso", &["-osirrox", "on", "-indev", &input_str, "-extract", &format!("/{}", LIVE_DIR), &live.to_string_lossy()], "Extract ISO")?;
+    // Missing when the image was built with --checksums none
+    let _ = run_command("xorriso", &["-osirrox", "on", "-indev", &input_str, "-extract", "/md5sum.txt", &work.join("md5sum.txt").to_string_lossy()], "Extract Checksums");
+    let squashfs = live.join("filesystem.squashfs");
+    if !squashfs.exists() {
+        bail!("{} has no /{}/filesystem.squashfs; only live-build images can be updated", input.display(), LIVE_DIR);
+    }
+    let comp = compression(&squashfs);
+    let spinner = create_spinner("Unpacking the root filesystem...");
+    run_command("unsquashfs", &["-d", &rootfs.to_string_lossy(), &squashfs.to_string_lossy()], "Unpack Squashfs")?;
+    spinner.finish_with_message("Root filesystem unpacked.");
+
+    let spinner = create_spinner("Upgrading packages...");
+    let (upgraded, packages) = {
+        let chroot = Chroot::enter(&rootfs)?;
+        let log = chroot.run(
+            "export DEBIAN_FRONTEND=noninteractive; apt-get update -q && \
+            apt-get -y -q -o Dpkg::Options::=--force-confdef -o Dpkg::Options::=--force-confold full-upgrade && \
+            apt-get -y -q autoremove --purge && apt-get clean",
+            "Upgrade Image",
+        )?;
+        let packages = chroot.run("dpkg-query -W --showformat='${Package} ${Version}\\n'", "List Packages")?;
+        (log, packages)
+    };
+    spinner.finish_with_message("Packages upgraded.");
+    let summary = upgraded.lines().find(|l| l.contains("upgraded,")).unwrap_or("").trim().to_string();
+    Logger::info(&format!("apt: {}", if summary.is_empty() { "done" } else { &summary }));
+
+    // The boot files of the ISO get the newest kernel and initrd, whatever their names;
+    // the boot menus name the files, not the version
+    let mut changed = vec![format!("{}/filesystem.squashfs", LIVE_DIR)];
+    let boot = rootfs.join("boot");
+    for (prefix, source) in [("vmlinuz", newest(&boot, "vmlinuz-")), ("initrd.img", newest(&boot, "initrd.img-"))] {
+        let Some(source) = source else {
+            Logger::warn(&format!("The image has no /boot/{}-*; the ISO keeps its old one", prefix));
+            continue;
+        };
+        for entry in fs::read_dir(&live)?.flatten() {
+            let name = entry.file_name().to_string_lossy().to_string();
+            if name.starts_with(prefix) {
+                fs::copy(&source, entry.path())?;
+                changed.push(format!("{}/{}", LIVE_DIR, name));
+            }
+        }
+    }
+
+    fs::write(live.join("filesystem.packages"), packages)?;
+    changed.push(format!("{}/filesystem.packages", LIVE_DIR));
+    let size = run_command("du", &["-sx", "--block-size=1", &rootfs.to_string_lossy()], "Measure Root Filesystem")?;
+    if live.join("filesystem.size").exists() {
+        fs::write(live.join("filesystem.size"), format!("{}\n", size.split_whitespace().next().unwrap_or("0")))?;
+        changed.push(format!("{}/filesystem.size", LIVE_DIR));
+    }
+
+    let spinner = create_spinner(&format!("Packing the root filesystem ({})...", comp));
+    fs::remove_file(&squashfs)?;
+    run_change("mksquashfs", &[&rootfs.to_string_lossy(), &squashfs.to_string_lossy(), "-comp", &comp, "-noappend", "-quiet"], "Pack Squashfs")?;
+    spinner.finish_with_message("Root filesystem packed.");
+
+    // md5sum.txt lists "./path"; the changed files get new sums
+    let md5 = work.join("md5sum.txt");
+    let mut map_args: Vec<String> = Vec::new();
+    if md5.exists() {
+        let sums = fs::read_to_string(&md5)?;
+        let mut lines = Vec::new();
+        for line in sums.lines() {
+            let path = line.split_whitespace().nth(1).unwrap_or("").trim_start_matches("./");
+            if changed.iter().any(|c| c == path) {
+                let sum = run_command("md5sum", &[&work.join(path).to_string_lossy()], "Checksum File")?;
+                lines.push(format!("{}  ./{}", sum.split_whitespace().next().unwrap_or(""), path));
+            } else {
+                lines.push(line.to_string());
+            }
+        }
+        fs::write(&md5, lines.join("\n") + "\n")?;
+        map_args.extend(["-map".to_string(), md5.to_string_lossy().to_string(), "/md5sum.txt".to_string()]);
+    }
+    for path in &changed {
+        map_args.extend(["-map".to_string(), work.join(path).to_string_lossy().to_string(), format!("/{}", path)]);
+    }
+
+    if output.exists() {
+        fs::remove_file(output)?;
+    }
+    if let Some(dir) = output.parent().filter(|d| !d.as_os_str().is_empty()) {
+        fs::create_dir_all(dir)?;
+    }
+    let spinner = create_spinner("Writing the ISO...");
+    let mut args: Vec<&str> = vec!["-indev", &input_str, "-outdev"];
+    let output_str = output.to_string_lossy().to_string();
+    args.push(&output_str);
+    args.extend(map_args.iter().map(String::as_str));
+    args.extend(["-boot_image", "any", "replay"]);
+    run_change("xorriso", &args, "Write ISO")?;
+    spinner.finish_with_message("ISO written.");
+    report::checksum(output)?;
+
+    if !keep_work {
+        fs::remove_dir_all(work)?;
+    }
+    Logger::success(&format!("Updated image: {} ({} file(s) replaced)", output.display(), changed.len()));
+    Ok(())
+}
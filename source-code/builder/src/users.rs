@@ -0,0 +1,226 @@
+use anyhow::{bail, Result};
+use hammer_core::Logger;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::Path;
+
+use crate::branding::write;
+use crate::manifest::{self, Value};
+
+// Accounts of the image, declared in hammer.yaml next to ./config:
+//
+//   groups: [developers]
+//   users:
+//     hacker:
+//       password: "$y$j9T$..."     # mkpasswd -m yescrypt; plain text is refused
+//       groups: [sudo, developers]
+//       sudo: "ALL=(ALL:ALL) ALL"
+//       ssh_keys:
+//         - ssh-ed25519 AAAA... hacker@laptop
+//       live: true                 # the user of the live session
+//
+// They are created by a chroot hook, so the live system has them and the installer,
+// which copies the live filesystem, carries them over to the installed one.
+
+const HOOK: &str = "hooks/normal/9010-hammer-users.hook.chroot";
+const SUDOERS: &str = "/etc/sudoers.d/hammer-users";
+
+pub struct User {
+    name: String,
+    password: Option<String>,
+    shell: String,
+    groups: Vec<String>,
+    sudo: Option<String>,
+    ssh_keys: Vec<String>,
+    live: bool,
+}
+
+pub struct Accounts {
+    groups: Vec<String>,
+    users: Vec<User>,
+}
+
+/// Names useradd and groupadd accept without --badname
+fn valid_name(name: &str) -> bool {
+    !name.is_empty()
+    && name.len() <= 32
+    && name.starts_with(|c: char| c.is_ascii_lowercase() || c == '_')
+    && name.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '_' || c == '-')
+}
+
+/// A crypt(3) hash as mkpasswd prints it ("$id$...$hash"), or a locked password
+fn valid_hash(password: &str) -> bool {
+    if password == "!" || password == "*" {
+        return true;
+    }
+    let fields: Vec<&str> = password.split('$').collect();
+    fields.len() >= 4
+    && fields[0].is_empty()
+    && !fields[1].is_empty()
+    && password.chars().all(|c| c.is_ascii_alphanumeric() || "$./=".contains(c))
+}
+
+fn single_line(value: &str) -> bool {
+    !value.contains(['\n', '\r', '\''])
+}
+
+impl Accounts {
+    /// The accounts declared in `file`; None when it declares none
+    pub fn load(file: &Path) -> Result<Option<Accounts>> {
+        let Some(manifest) = manifest::load(file)? else {
+            return Ok(None);
+        };
+        let groups = manifest.list("groups");
+        for group in &groups {
+            if !valid_name(group) {
+                bail!("{}: group name '{}' is not valid", file.display(), group);
+            }
+        }
+
+        let mut users = Vec::new();
+        for (name, entry) in manifest.get("users").map(Value::entries).unwrap_or_default() {
+            if !valid_name(name) {
+                bail!("{}: user name '{}' is not valid", file.display(), name);
+            }
+            let password = entry.str("password").map(str::to_string);
+            if let Some(password) = &password {
+                if !valid_hash(password) {
+                    bail!(
+                        "{}: the password of '{}' is not a crypt hash; only hashed passwords go into the image (mkpasswd -m yescrypt)",
+                        file.display(), name
+                    );
+                }
+            }
+            let shell = entry.str("shell").unwrap_or("/bin/bash").to_string();
+            if !shell.starts_with('/') || !shell.chars().all(|c| c.is_ascii_alphanumeric() || "/._-".contains(c)) {
+                bail!("{}: shell '{}' of '{}' is not an absolute path", file.display(), shell, name);
+            }
+            let user_groups = entry.list("groups");
+            if let Some(group) = user_groups.iter().find(|g| !valid_name(g)) {
+                bail!("{}: group name '{}' of '{}' is not valid", file.display(), group, name);
+            }
+            let sudo = entry.str("sudo").map(str::to_string);
+            if sudo.as_deref().is_some_and(|rule| !single_line(rule) || !rule.contains('=')) {
+                bail!("{}: sudo rule of '{}' must be one 'HOSTS=(RUNAS) COMMANDS' line", file.display(), name);
+            }
+            let ssh_keys = entry.list("ssh_keys");
+            for key in &ssh_keys {
+                let kind = key.split_whitespace().next().unwrap_or("");
+                if !single_line(key) || !(kind.starts_with("ssh-") || kind.starts_with("ecdsa-") || kind.starts_with("sk-")) {
+                    bail!("{}: '{}' of '{}' is not an OpenSSH public key", file.display(), key, name);
+                }
+            }
+            users.push(User { name: name.clone(), password, shell, groups: user_groups, sudo, ssh_keys, live: entry.bool("live") });
+        }
+
+        if users.iter().filter(|u| u.live).count() > 1 {
+            bail!("{}: only one user can be the live user", file.display());
+        }
+        if groups.is_empty() && users.is_empty() {
+            return Ok(None);
+        }
+        Ok(Some(Accounts { groups, users }))
+    }
+
+    fn live_user(&self) -> Option<&User> {
+        self.users.iter().find(|u| u.live)
+    }
+
+    /// Writes the account hook and settings into the live-build `config` directory
+    pub fn apply(&self, config: &Path) -> Result<()> {
+        Logger::info(&format!("Provisioning {} user(s) and {} group(s)", self.users.len(), self.groups.len()));
+        let mut hook = vec![
+            "#!/bin/sh".to_string(),
+            "# Written by hammer-builder from hammer.yaml users".to_string(),
+            "set -e".to_string(),
+        ];
+        // Groups of users, declared or not, exist before the users join them
+        let mut groups = self.groups.clone();
+        groups.extend(self.users.iter().flat_map(|u| u.groups.iter().cloned()));
+        groups.sort();
+        groups.dedup();
+        for group in &groups {
+            hook.push(format!("getent group {g} >/dev/null || groupadd {g}", g = group));
+        }
+
+        let mut sudoers = Vec::new();
+        for user in &self.users {
+            hook.push(format!("getent passwd {u} >/dev/null || useradd --create-home --shell {s} {u}", u = user.name, s = user.shell));
+            if !user.groups.is_empty() {
+                hook.push(format!("usermod --append --groups {} {}", user.groups.join(","), user.name));
+            }
+            if let Some(password) = &user.password {
+                hook.push(format!("usermod --password '{}' {}", password, user.name));
+            }
+            if let Some(rule) = &user.sudo {
+                sudoers.push(format!("{} {}", user.name, rule));
+            }
+            if !user.ssh_keys.is_empty() {
+                let ssh = format!("/home/{}/.ssh", user.name);
+                hook.push(format!("install -d -m 0700 -o {u} -g {u} {ssh}", u = user.name, ssh = ssh));
+                hook.push(format!("cat > {}/authorized_keys <<'EOF'\n{}\nEOF", ssh, user.ssh_keys.join("\n")));
+                hook.push(format!("chown {u}:{u} {ssh}/authorized_keys && chmod 0600 {ssh}/authorized_keys", u = user.name, ssh = ssh));
+            }
+        }
+        if !sudoers.is_empty() {
+            hook.push(format!("cat > {}.new <<'EOF'\n# Written by hammer-builder from hammer.yaml users\n{}\nEOF", SUDOERS, sudoers.join("\n")));
+            hook.push(format!("chmod 0440 {s}.new && visudo -cqf {s}.new && mv {s}.new {s}", s = SUDOERS));
+        }
+
+        // Only root reads the hook; it carries the password hashes
+        let hook_path = config.join(HOOK);
+        write(&hook_path, &(hook.join("\n") + "\n"))?;
+        fs::set_permissions(&hook_path, fs::Permissions::from_mode(0o700))?;
+
+        let mut packages = vec!["passwd"];
+        if !sudoers.is_empty() {
+            packages.push("sudo");
+        }
+        if self.users.iter().any(|u| !u.ssh_keys.is_empty()) {
+            packages.push("openssh-server");
+        }
+        write(&config.join("package-lists/hammer-users.list.chroot"), &(packages.join("\n") + "\n"))?;
+
+        // The installed system keeps these accounts; the installer must not ask for another
+        let preseed = config.join("includes.installer/preseed.cfg");
+        let mut content = fs::read_to_string(&preseed).unwrap_or_default();
+        if !content.contains("passwd/make-user") {
+            content.push_str("# Accounts come from hammer.yaml users\nd-i passwd/root-login boolean false\nd-i passwd/make-user boolean false\n");
+            write(&preseed, &content)?;
+        }
+
+        if let Some(user) = self.live_user() {
+            set_boot_param(config, "username", &user.name)?;
+        }
+        Ok(())
+    }
+}
+
+/// Sets `key=value` in the live kernel command line of config/binary, replacing any earlier value
+fn set_boot_param(config: &Path, key: &str, value: &str) -> Result<()> {
+    let binary = config.join("binary");
+    let Ok(content) = fs::read_to_string(&binary) else {
+        Logger::warn(&format!("No {}; the live session keeps live-config's default user", binary.display()));
+        return Ok(());
+    };
+    let prefix = format!("{}=", key);
+    let mut found = false;
+    let lines: Vec<String> = content
+    .lines()
+    .map(|line| match line.strip_prefix("LB_BOOTAPPEND_LIVE=\"").and_then(|l| l.strip_suffix('"')) {
+        Some(params) => {
+            found = true;
+            let mut params: Vec<String> = params.split_whitespace().filter(|p| !p.starts_with(&prefix)).map(str::to_string).collect();
+            params.push(format!("{}{}", prefix, value));
+            format!("LB_BOOTAPPEND_LIVE=\"{}\"", params.join(" "))
+        }
+        None => line.to_string(),
+    })
+    .collect();
+    if !found {
+        Logger::warn(&format!("{} has no LB_BOOTAPPEND_LIVE; pass {}{} to lb config --bootappend-live", binary.display(), prefix, value));
+        return Ok(());
+    }
+    fs::write(&binary, lines.join("\n") + "\n")?;
+    Ok(())
+}
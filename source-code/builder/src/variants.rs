@@ -0,0 +1,155 @@
+use anyhow::{bail, Result};
+use hammer_core::output::{self, Tone};
+use hammer_core::exec::Exec;
+use hammer_core::Logger;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::Instant;
+
+use crate::manifest;
+use crate::report::{self, Stage};
+
+// Variants of one project, declared in hammer.yaml:
+//
+//   variants:
+//     desktop:
+//       config: ./variants/desktop    # live-build config directory
+//     server:
+//       config: ./variants/server
+//       oobe: true
+//
+// `build --all` builds each in its own work directory, WORK/NAME, by running this builder
+// there, so live-build chroots and caches never meet. Each writes its image and
+// build-manifest.json to ARTIFACTS/NAME and its log to WORK/NAME/builder.log.
+
+pub struct Variant {
+    name: String,
+    config: PathBuf,
+    oobe: bool,
+}
+
+struct Outcome {
+    name: String,
+    code: i32,
+    seconds: f64,
+}
+
+/// The variants declared in `file`, config directories resolved against it
+pub fn load(file: &Path) -> Result<Vec<Variant>> {
+    let Some(manifest) = manifest::load(file)? else {
+        bail!("{} not found; variants are declared there", file.display());
+    };
+    let base = file.parent().unwrap_or(Path::new("."));
+    let mut variants = Vec::new();
+    for (name, entry) in manifest.get("variants").map(|v| v.entries()).unwrap_or_default() {
+        if name.is_empty() || !name.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-') {
+            bail!("{}: variant name '{}' must be a-z, 0-9 and -", file.display(), name);
+        }
+        let Some(config) = entry.str("config") else {
+            bail!("{}: variant '{}' needs a config directory", file.display(), name);
+        };
+        let config = fs::canonicalize(base.join(config))
+        .map_err(|e| anyhow::anyhow!("Config of variant '{}' ({}): {}", name, config, e))?;
+        variants.push(Variant { name: name.clone(), config, oobe: entry.bool("oobe") });
+    }
+    if variants.is_empty() {
+        bail!("{} declares no variants", file.display());
+    }
+    Ok(variants)
+}
+
+/// One variant, as a child builder in its work directory
+fn build_one(variant: &Variant, manifest: &Path, work: &Path, artifacts: &Path, passed: &[String]) -> Outcome {
+    let started = Instant::now();
+    let dir = work.join(&variant.name);
+    let run = || -> Result<i32> {
+        fs::create_dir_all(&dir)?;
+        let log = fs::File::create(dir.join("builder.log"))?;
+        let exe = std::env::current_exe()?.to_string_lossy().to_string();
+        let output = format!("{}.iso", variant.name);
+        let (config, manifest, artifacts) = (variant.config.to_string_lossy(), manifest.to_string_lossy(), artifacts.to_string_lossy());
+        let mut args = vec![
+            "--log-format", "json", "build",
+            "--output", &output,
+            "--config", &config,
+            "--manifest", &manifest,
+            "--variant", &variant.name,
+            "--artifacts", &artifacts,
+        ];
+        args.extend(passed.iter().map(String::as_str));
+        if variant.oobe {
+            args.push("--oobe");
+        }
+        // The child builder skips what it would change itself in a dry run
+        let status = Exec::new(&exe, &args, "Build Variant").current_dir(&dir).log_to(log).status().map_err(|e| anyhow::anyhow!("{}", e))?;
+        Ok(status.code().unwrap_or(1))
+    };
+    let code = run().unwrap_or_else(|e| {
+        Logger::warn(&format!("{}: could not start the build: {:#}", variant.name, e));
+        1
+    });
+    Outcome { name: variant.name.clone(), code, seconds: started.elapsed().as_secs_f64() }
+}
+
+fn stage_of(code: i32) -> &'static str {
+    [Stage::Config, Stage::Customize, Stage::Lint, Stage::Clean, Stage::Build, Stage::Test, Stage::Size, Stage::Artifacts]
+    .into_iter()
+    .find(|s| s.exit_code() == code)
+    .map(|s| s.name())
+    .unwrap_or("-")
+}
+
+/// Builds every variant, `jobs` at a time, and summarizes; fails when any of them did.
+/// `passed` are build options every variant gets.
+pub fn build_all(manifest: &Path, jobs: usize, work: &Path, artifacts: &Path, passed: &[String]) -> Result<()> {
+    let variants = load(manifest)?;
+    let manifest = fs::canonicalize(manifest)?;
+    fs::create_dir_all(artifacts)?;
+    let artifacts = fs::canonicalize(artifacts)?;
+    let jobs = jobs.clamp(1, variants.len());
+    Logger::info(&format!("Building {} variant(s), {} at a time", variants.len(), jobs));
+
+    let queue = Mutex::new(variants.iter());
+    let outcomes = Mutex::new(Vec::new());
+    std::thread::scope(|scope| {
+        for _ in 0..jobs {
+            scope.spawn(|| loop {
+                let Some(variant) = queue.lock().unwrap().next() else {
+                    break;
+                };
+                Logger::info(&format!("{}: started", variant.name));
+                let outcome = build_one(variant, &manifest, work, &artifacts, passed);
+                if outcome.code == 0 {
+                    Logger::success(&format!("{}: built in {:.0}s", outcome.name, outcome.seconds));
+                } else {
+                    Logger::error(&format!("{}: failed in stage {} (exit {})", outcome.name, stage_of(outcome.code), outcome.code));
+                }
+                outcomes.lock().unwrap().push(outcome);
+            });
+        }
+    });
+
+    let mut outcomes = outcomes.into_inner().unwrap();
+    outcomes.sort_by(|a, b| a.name.cmp(&b.name));
+    if !Logger::json() {
+        let mut rows = vec![vec!["VARIANT".to_string(), "RESULT".to_string(), "STAGE".to_string(), "TIME".to_string(), "OUTPUT".to_string()]];
+        for o in &outcomes {
+            let (result, output) = if o.code == 0 {
+                (output::paint("built", Tone::Good), artifacts.join(&o.name).display().to_string())
+            } else {
+                (output::paint("failed", Tone::Bad), work.join(&o.name).join("builder.log").display().to_string())
+            };
+            rows.push(vec![o.name.clone(), result, stage_of(o.code).to_string(), format!("{:.0}s", o.seconds), output]);
+        }
+        println!();
+        output::print_table(&rows);
+    }
+
+    let failed: Vec<&str> = outcomes.iter().filter(|o| o.code != 0).map(|o| o.name.as_str()).collect();
+    if !failed.is_empty() {
+        bail!("{} of {} variant(s) failed: {}", failed.len(), outcomes.len(), failed.join(", "));
+    }
+    Logger::success(&format!("All {} variant(s) built; see {}/*/{}", outcomes.len(), artifacts.display(), report::MANIFEST));
+    Ok(())
+}
@@ -0,0 +1,817 @@
+/// Help groups, in the order they are printed
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub enum Section {
+    Applications,
+    System,
+    Security,
+    /// Single-purpose commands with stable output for scripts
+    Plumbing,
+}
+
+impl Section {
+    pub const ALL: [Section; 4] = [Section::Applications, Section::System, Section::Security, Section::Plumbing];
+
+    /// i18n key of the heading
+    pub fn title_key(&self) -> &'static str {
+        match self {
+            Section::Applications => "help.applications",
+            Section::System => "help.system",
+            Section::Security => "help.security",
+            Section::Plumbing => "help.plumbing",
+        }
+    }
+}
+
+/// One `hammer <name>` subcommand: how it is dispatched and how it is documented
+pub struct CommandDef {
+    pub name: &'static str,
+    pub aliases: &'static [&'static str],
+    /// Backend binary in BIN_DIR and the arguments placed before the user's;
+    /// empty for commands the front-end implements itself
+    pub binary: &'static str,
+    pub prefix: &'static [&'static str],
+    pub root: bool,
+    pub section: Section,
+    /// Synopsis shown in help, e.g. "status [-o FORMAT]"
+    pub usage: &'static str,
+    /// i18n key of the one-line description
+    pub help: &'static str,
+    pub flags: &'static [(&'static str, &'static str)],
+    pub examples: &'static [&'static str],
+}
+
+const OUTPUT_FLAGS: &[(&str, &str)] = &[
+    ("-o, --output FORMAT", "table, wide, json or yaml"),
+    ("--sort KEY", "id, name, created or size"),
+    ("--reverse", "Reverse the sort order"),
+];
+
+pub const COMMANDS: &[CommandDef] = &[
+    CommandDef {
+        name: "install",
+        aliases: &[],
+        binary: "hammer-containers",
+        prefix: &["install"],
+        root: false,
+        section: Section::Applications,
+        usage: "install <pkg>",
+        help: "help.install",
+        flags: &[],
+        examples: &["hammer install firefox"],
+    },
+    CommandDef {
+        name: "remove-app",
+        aliases: &[],
+        binary: "hammer-containers",
+        prefix: &["remove"],
+        root: false,
+        section: Section::Applications,
+        usage: "remove-app <pkg>",
+        help: "help.remove-app",
+        flags: &[],
+        examples: &[],
+    },
+    CommandDef {
+        name: "list-apps",
+        aliases: &[],
+        binary: "hammer-containers",
+        prefix: &["list"],
+        root: false,
+        section: Section::Applications,
+        usage: "list-apps",
+        help: "help.list-apps",
+        flags: &[],
+        examples: &[],
+    },
+    CommandDef {
+        name: "update",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["update"],
+        root: true,
+        section: Section::System,
+        usage: "update [--auto]",
+        help: "help.update",
+        flags: &[
+            ("--executor NAME", "Override the configured executor (live, chroot, nspawn, podman)"),
+            ("--auto", "Unattended run: skip on low battery or a metered connection"),
+            ("--pin-mirror TIME", "Resolve Debian mirrors from snapshot.debian.org at TIME (UTC)"),
+            ("--full", "apt full-upgrade, may remove packages (default)"),
+            ("--safe", "apt upgrade --with-new-pkgs, never removes packages"),
+            ("--frontend NAME", "DEBIAN_FRONTEND for apt (default noninteractive)"),
+            ("--preseed FILE", "Load debconf selections from FILE first"),
+            ("--conffiles POLICY", "Changed conffiles: old (keep, default), new or ask afterwards"),
+            ("--apt-option OPT", "Extra apt option, passed as -o OPT"),
+            ("--autoremove", "apt autoremove --purge afterwards, listing removed orphans"),
+            ("--simulate", "Only show the packages and download size; nothing changes"),
+        ],
+        examples: &["hammer update", "hammer update --simulate", "hammer update --executor nspawn", "hammer update --pin-mirror 20251130T200000Z"],
+    },
+    CommandDef {
+        name: "release-upgrade",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["release-upgrade"],
+        root: true,
+        section: Section::System,
+        usage: "release-upgrade --to CODENAME [-y]",
+        help: "help.release-upgrade",
+        flags: &[
+            ("--to CODENAME", "Debian release to upgrade to"),
+            ("-y, --yes", "Do not ask for confirmation"),
+        ],
+        examples: &["hammer release-upgrade --to trixie"],
+    },
+    CommandDef {
+        name: "layer",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["layer"],
+        // list works without root; hammer-updater asks for it otherwise
+        root: false,
+        section: Section::System,
+        usage: "layer <pkg>... [--deb FILE] [--atomic] | layer <add|remove|list|rollback> [pkg]...",
+        help: "help.layer",
+        flags: &[
+            ("--deb FILE", "Install a local .deb file (repeatable)"),
+            ("--atomic", "Install into a staged deployment, active after reboot"),
+            ("--to ID", "With rollback: the layer transaction to go back to"),
+        ],
+        examples: &[
+            "hammer layer htop",
+            "hammer layer --atomic --deb ./vendor-tool_1.2_amd64.deb",
+            "hammer layer add htop",
+            "hammer layer list",
+            "hammer layer rollback",
+        ],
+    },
+    CommandDef {
+        name: "status",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["status"],
+        root: false,
+        section: Section::System,
+        usage: "status [-o FORMAT] [--watch [SECS]]",
+        help: "help.status",
+        flags: &[
+            ("-o, --output FORMAT", "table, wide, json or yaml"),
+            ("--sort KEY", "id, name, created or size"),
+            ("--reverse", "Reverse the sort order"),
+            ("--watch [SECS]", "Refresh every SECS seconds (default 2) and on every event"),
+        ],
+        examples: &["hammer status -o json", "hammer status --watch"],
+    },
+    CommandDef {
+        name: "history",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["history"],
+        root: false,
+        section: Section::System,
+        usage: "history [-o FORMAT]",
+        help: "help.history",
+        flags: OUTPUT_FLAGS,
+        examples: &["hammer history", "hammer history show <id> --changelog", "hammer history correlate --outside"],
+    },
+    CommandDef {
+        name: "rollback",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["rollback"],
+        root: true,
+        section: Section::System,
+        usage: "rollback [snapshot]",
+        help: "help.rollback",
+        flags: &[("--before DATE", "Newest snapshot taken before this date")],
+        examples: &["hammer rollback", "hammer rollback --before \"2025-11-30 20:00\""],
+    },
+    CommandDef {
+        name: "recover",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["recover"],
+        root: true,
+        section: Section::System,
+        usage: "recover [--resume]",
+        help: "help.recover",
+        flags: &[
+            ("--resume", "Then start an interrupted update again"),
+            ("-y, --yes", "Do not ask for confirmation"),
+        ],
+        examples: &["hammer recover", "hammer recover --resume"],
+    },
+    CommandDef {
+        name: "diff",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["diff"],
+        root: false,
+        section: Section::System,
+        usage: "diff [snapshot]",
+        help: "help.diff",
+        flags: &[
+            ("--before DATE", "Compare against the newest snapshot before this date"),
+            ("--security", "Annotate upgraded packages with the CVEs they fix"),
+            ("--tracker", "Query the Debian Security Tracker (with --security)"),
+            ("--cached", "Use package lists from the last root run (default without root)"),
+        ],
+        examples: &["hammer diff", "hammer diff --security", "hammer diff --cached"],
+    },
+    CommandDef {
+        name: "deviations",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["deviations"],
+        root: false,
+        section: Section::System,
+        usage: "deviations",
+        help: "help.deviations",
+        flags: &[
+            ("--updates", "Also list packages at another version than the image shipped"),
+            ("--json", "Machine-readable output"),
+        ],
+        examples: &["hammer deviations", "hammer deviations --json"],
+    },
+    CommandDef {
+        name: "check",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["check"],
+        root: false,
+        section: Section::System,
+        usage: "check",
+        help: "help.check",
+        flags: &[],
+        examples: &["hammer check"],
+    },
+    CommandDef {
+        name: "stats",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["stats"],
+        root: true,
+        section: Section::System,
+        usage: "stats [--kind KIND] [--last N] [-o FORMAT]",
+        help: "help.stats",
+        flags: &[
+            ("--kind KIND", "update (default), release-upgrade, layer, ..."),
+            ("--last N", "Only the most recent N transactions (default 20)"),
+            ("-o, --output FORMAT", "table, json or yaml"),
+        ],
+        examples: &["hammer stats", "hammer stats --last 5 -o json"],
+    },
+    CommandDef {
+        name: "conffiles",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["conffiles"],
+        root: true,
+        section: Section::System,
+        usage: "conffiles [--deployment NAME] [--list]",
+        help: "help.conffiles",
+        flags: &[
+            ("--deployment NAME", "Resolve in @update or another deployment"),
+            ("--list", "Only print the conflicts"),
+        ],
+        examples: &["hammer conffiles", "hammer conffiles --list"],
+    },
+    CommandDef {
+        name: "delete",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["delete"],
+        root: true,
+        section: Section::System,
+        usage: "delete [snapshot]",
+        help: "help.delete",
+        flags: &[
+            ("--before DATE", "Newest snapshot taken before this date"),
+            ("--force", "Also delete the protected rollback target of the last update"),
+        ],
+        examples: &[],
+    },
+    CommandDef {
+        name: "snapshot",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["snapshot"],
+        root: true,
+        section: Section::System,
+        usage: "snapshot [--kind KIND]",
+        help: "help.snapshot",
+        flags: &[("--kind KIND", "Kind part of the name (default manual)")],
+        examples: &["hammer snapshot", "hammer snapshot --kind before-driver"],
+    },
+    CommandDef {
+        name: "pin",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["pin"],
+        root: true,
+        section: Section::System,
+        usage: "pin <snapshot>",
+        help: "help.pin",
+        flags: &[],
+        examples: &[],
+    },
+    CommandDef {
+        name: "unpin",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["unpin"],
+        root: true,
+        section: Section::System,
+        usage: "unpin <snapshot>",
+        help: "help.unpin",
+        flags: &[],
+        examples: &[],
+    },
+    CommandDef {
+        name: "alias",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["alias"],
+        // list works without root; hammer-updater asks for it on set and remove
+        root: false,
+        section: Section::System,
+        usage: "alias <set|remove|list> [NAME] [SNAPSHOT]",
+        help: "help.alias",
+        flags: &[],
+        examples: &["hammer alias set golden 2025-11-30-201300-pre-update", "hammer rollback golden"],
+    },
+    CommandDef {
+        name: "reboot",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["reboot"],
+        root: true,
+        section: Section::System,
+        usage: "reboot [--when W]",
+        help: "help.reboot",
+        flags: &[
+            ("--when W", "now, idle (after all sessions end) or HH:MM"),
+            ("--force", "Reboot even if nothing is pending"),
+        ],
+        examples: &["hammer reboot --when idle"],
+    },
+    CommandDef {
+        name: "apply",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["apply"],
+        root: true,
+        section: Section::System,
+        usage: "apply [--soft-reboot]",
+        help: "help.apply",
+        flags: &[
+            ("--soft-reboot", "Use systemd soft-reboot when the kernel is unchanged"),
+            ("--kexec", "kexec into the new root's kernel, skipping firmware"),
+            ("--live", "Sync the new root into the running system without rebooting"),
+        ],
+        examples: &["hammer apply --soft-reboot"],
+    },
+    CommandDef {
+        name: "clean",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["clean"],
+        root: true,
+        section: Section::System,
+        usage: "clean [--deployment NAME]",
+        help: "help.clean",
+        flags: &[("--deployment NAME", "Only empty the apt cache of @, @update, ...")],
+        examples: &["hammer clean", "hammer clean --deployment @update"],
+    },
+    CommandDef {
+        name: "kernel",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["kernel"],
+        root: true,
+        section: Section::System,
+        usage: "kernel <list|remove>",
+        help: "help.kernel",
+        flags: &[
+            ("--old", "remove: every kernel except the running and the newest one"),
+            ("--force", "remove: also kernels that snapshots still need"),
+        ],
+        examples: &["hammer kernel list", "hammer kernel remove --old"],
+    },
+    CommandDef {
+        name: "emergency",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["emergency"],
+        root: true,
+        section: Section::System,
+        usage: "emergency <list|rollback|set-default>",
+        help: "help.emergency",
+        flags: &[("--device DEV", "Root device instead of root= from the kernel command line")],
+        examples: &["hammer emergency rollback pre-update", "hammer emergency set-default @"],
+    },
+    CommandDef {
+        name: "rescue",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["rescue"],
+        root: true,
+        section: Section::System,
+        usage: "rescue <prepare|remove>",
+        help: "help.rescue",
+        flags: &[("--kernel VERSION", "prepare: kernel from /boot instead of the running one")],
+        examples: &["hammer rescue prepare"],
+    },
+    CommandDef {
+        name: "composefs",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["composefs"],
+        root: true,
+        section: Section::System,
+        usage: "composefs <seal [SNAPSHOT]|list|remove IMAGE>",
+        help: "help.composefs",
+        flags: &[],
+        examples: &["hammer composefs seal", "hammer composefs list"],
+    },
+    CommandDef {
+        name: "boot",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["boot"],
+        root: true,
+        section: Section::System,
+        usage: "boot <set-default DEPLOYMENT|set-timeout SECONDS|show>",
+        help: "help.boot",
+        flags: &[],
+        examples: &["hammer boot show", "hammer boot set-default @rescue", "hammer boot set-timeout 3"],
+    },
+    CommandDef {
+        name: "os",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["os"],
+        root: true,
+        section: Section::System,
+        usage: "os <add NAME [--from SOURCE] [--suite SUITE]|list|switch NAME>",
+        help: "help.os",
+        flags: &[],
+        examples: &["hammer os add testing --suite testing", "hammer os list", "hammer os switch testing"],
+    },
+    CommandDef {
+        name: "explain",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["explain"],
+        root: true,
+        section: Section::System,
+        usage: "explain <command> [args]",
+        help: "help.explain",
+        flags: &[],
+        examples: &["hammer explain update --safe", "hammer explain rollback --before 2025-11-30", "hammer explain clean"],
+    },
+    CommandDef {
+        name: "esp",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["esp"],
+        root: true,
+        section: Section::System,
+        usage: "esp <status|gc>",
+        help: "help.esp",
+        flags: &[],
+        examples: &[],
+    },
+    CommandDef {
+        name: "events",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["events"],
+        root: true,
+        section: Section::System,
+        usage: "events <list|install>",
+        help: "help.events",
+        flags: &[],
+        examples: &[],
+    },
+    CommandDef {
+        name: "swap",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["swap"],
+        root: true,
+        section: Section::System,
+        usage: "swap <status|relocate>",
+        help: "help.swap",
+        flags: &[],
+        examples: &[],
+    },
+    CommandDef {
+        name: "report",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["report"],
+        root: true,
+        section: Section::System,
+        usage: "report [--upload]",
+        help: "help.report",
+        flags: &[
+            ("-o, --output FILE", "Where to write the tarball"),
+            ("--upload", "Send the report to [report] upload_url"),
+        ],
+        examples: &["hammer report", "hammer report --upload"],
+    },
+    CommandDef {
+        name: "telemetry",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["telemetry"],
+        // status works without root; hammer-updater asks for it on enable and disable
+        root: false,
+        section: Section::System,
+        usage: "telemetry <status|enable|disable>",
+        help: "help.telemetry",
+        flags: &[],
+        examples: &["hammer telemetry status", "hammer telemetry enable"],
+    },
+    CommandDef {
+        name: "state",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["state"],
+        root: true,
+        section: Section::System,
+        usage: "state <export|import>",
+        help: "help.state",
+        flags: &[("--force", "import: overwrite existing config files and hooks")],
+        examples: &["hammer state export /mnt/usb/hammer-state.tar.gz", "hammer state import hammer-state.tar.gz"],
+    },
+    CommandDef {
+        name: "backup",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["backup"],
+        root: true,
+        section: Section::System,
+        usage: "backup <add|remove|list|run|restore>",
+        help: "help.backup",
+        flags: &[
+            ("--name NAME", "add: target name (default derived from the URL)"),
+            ("--keep N", "add: backups kept on the target (default 7)"),
+        ],
+        examples: &[
+            "hammer backup add /mnt/usb/hammer --keep 14",
+            "hammer backup add ssh://backup@nas/srv/btrfs/laptop",
+            "hammer backup add s3://my-bucket/laptop --name offsite",
+            "hammer backup restore offsite",
+        ],
+    },
+    CommandDef {
+        name: "export",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["export"],
+        root: true,
+        section: Section::System,
+        usage: "export <snapshot> [-o FILE] [--age KEY | --gpg KEY]",
+        help: "help.export",
+        flags: &[
+            ("-o, --output FILE", "Where to write the stream (a path or s3:// URL)"),
+            ("--age KEY", "Encrypt to an age recipient (repeatable)"),
+            ("--gpg KEY", "Encrypt to a GPG key"),
+            ("--no-compress", "Skip compression ([transfer] compressor)"),
+        ],
+        examples: &[
+            "hammer export pre-update --age age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p",
+            "hammer export 2025-11-30 -o /mnt/usb/root.btrfs.zst.gpg --gpg backup@example.org",
+            "hammer export pre-update -o s3://backups/laptop/ --gpg backup@example.org",
+        ],
+    },
+    CommandDef {
+        name: "import",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["import"],
+        root: true,
+        section: Section::System,
+        usage: "import <file|s3://bucket/key> [--identity KEYFILE]",
+        help: "help.import",
+        flags: &[("-i, --identity FILE", "age identity for .age exports")],
+        examples: &[
+            "hammer import /mnt/usb/root.btrfs.zst.gpg",
+            "hammer import s3://backups/laptop/2025-11-30-201300-pre-update.btrfs.zst.age -i key.txt",
+        ],
+    },
+    CommandDef {
+        name: "verify",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["verify"],
+        root: true,
+        section: Section::Security,
+        usage: "verify [deployment] [--deep | --record]",
+        help: "help.verify",
+        flags: &[
+            ("--deep", "Compare SHA-256 of every package file with the stage-time database"),
+            ("--record", "Create the database from the deployment as it is now"),
+        ],
+        examples: &["hammer verify", "hammer verify --deep", "hammer verify --deep 2025-11-30-201300-pre-update"],
+    },
+    CommandDef {
+        name: "dedupe",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["dedupe"],
+        root: true,
+        section: Section::System,
+        usage: "dedupe [--deployment X] [--against Y]",
+        help: "help.dedupe",
+        flags: &[
+            ("--deployment X", "@update, current, @bad-<date> or a snapshot (default: @update if staged, else @)"),
+            ("--against Y", "Deployment to share extents with (default: its parent)"),
+        ],
+        examples: &["hammer dedupe", "hammer dedupe --deployment @update"],
+    },
+    CommandDef {
+        name: "fs",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["fs"],
+        root: true,
+        section: Section::System,
+        usage: "fs <compression DEPLOYMENT [ALGO]|recompress DEPLOYMENT>",
+        help: "help.fs",
+        flags: &[
+            ("--algorithm ALGO", "recompress: zstd, lzo or zlib (default: [compression] algorithm)"),
+            ("--level N", "recompress: compression level (default: [compression] level)"),
+        ],
+        examples: &["hammer fs compression @update zstd", "hammer fs recompress current --level 9"],
+    },
+    CommandDef {
+        name: "adopt",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["adopt"],
+        root: true,
+        section: Section::System,
+        usage: "adopt <subvolume> [--kind NAME]",
+        help: "help.adopt",
+        flags: &[
+            ("--kind NAME", "Kind part of the snapshot name (default adopted)"),
+            ("--force", "Skip the root filesystem checks"),
+        ],
+        examples: &["hammer adopt @rootfs", "hammer adopt /mnt/old-root --kind pre-hammer"],
+    },
+    CommandDef {
+        name: "migrate",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["migrate"],
+        root: true,
+        section: Section::System,
+        usage: "migrate --from snapper | --to snapper",
+        help: "help.migrate",
+        flags: &[
+            ("--from snapper", "Adopt snapper snapshots from /.snapshots"),
+            ("--to snapper", "Publish hammer snapshots as snapper snapshots"),
+            ("--path DIR", "snapper snapshot directory (default /.snapshots)"),
+            ("--dry-run", "Only show what would be copied"),
+        ],
+        examples: &["hammer migrate --from snapper --dry-run", "hammer migrate --to snapper"],
+    },
+    CommandDef {
+        name: "ensure",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["ensure"],
+        root: true,
+        section: Section::System,
+        usage: "ensure [--updated]",
+        help: "help.ensure",
+        flags: &[
+            ("--updated", "Packages are up to date"),
+            ("--max-age AGE", "With --updated: skip if the last update is younger (30m, 12h, 7d, 2w)"),
+            ("--switched", "The newest deployment is running (reboots if needed)"),
+        ],
+        examples: &["hammer ensure --updated --switched --max-age 7d"],
+    },
+    CommandDef {
+        name: "serve",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["serve"],
+        root: true,
+        section: Section::System,
+        usage: "serve [--socket PATH]",
+        help: "help.serve",
+        flags: &[("--socket PATH", "Unix socket to listen on (default /run/hammer/api.sock)")],
+        examples: &["curl --unix-socket /run/hammer/api.sock http://localhost/v1/snapshots"],
+    },
+    CommandDef {
+        name: "web",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["web"],
+        root: true,
+        section: Section::System,
+        usage: "web [--listen ADDR]",
+        help: "help.web",
+        flags: &[
+            ("--listen ADDR", "Address to serve on (default 127.0.0.1:8080)"),
+            ("--socket PATH", "API socket started by 'hammer serve'"),
+        ],
+        examples: &["hammer web --listen 127.0.0.1:8080"],
+    },
+    CommandDef {
+        name: "list-snapshots",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["list-snapshots"],
+        root: false,
+        section: Section::Plumbing,
+        usage: "list-snapshots [--names-only]",
+        help: "help.list-snapshots",
+        flags: &[
+            ("--names-only", "Only the names, one per line"),
+            ("--kind KIND", "Only snapshots of this kind"),
+            ("--pinned", "Only pinned snapshots"),
+        ],
+        examples: &["hammer list-snapshots --names-only --kind pre-update"],
+    },
+    CommandDef {
+        name: "current-default",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["current-default"],
+        root: false,
+        section: Section::Plumbing,
+        usage: "current-default [--id]",
+        help: "help.current-default",
+        flags: &[("--id", "Print the subvolume ID instead of its path")],
+        examples: &["hammer current-default --id"],
+    },
+    CommandDef {
+        name: "current-booted",
+        aliases: &[],
+        binary: "hammer-updater",
+        prefix: &["current-booted"],
+        root: false,
+        section: Section::Plumbing,
+        usage: "current-booted [--id]",
+        help: "help.current-booted",
+        flags: &[("--id", "Print the subvolume ID instead of its path")],
+        examples: &["[ \"$(hammer current-booted)\" = \"$(hammer current-default)\" ] || echo reboot pending"],
+    },
+    CommandDef {
+        name: "docs",
+        aliases: &[],
+        binary: "",
+        prefix: &[],
+        root: false,
+        section: Section::System,
+        usage: "docs <man|markdown>",
+        help: "help.docs",
+        flags: &[("--out DIR", "Write hammer.1 / hammer.md into DIR instead of stdout")],
+        examples: &["hammer docs man --out /usr/share/man/man1"],
+    },
+    CommandDef {
+        name: "env",
+        aliases: &[],
+        binary: "",
+        prefix: &[],
+        root: false,
+        section: Section::System,
+        usage: "env",
+        help: "help.env",
+        flags: &[],
+        examples: &["HAMMER_JSON=1 HAMMER_ASSUME_YES=1 hammer delete old-snapshot", "HAMMER_CONFIG=./hammer.toml hammer check"],
+    },
+    CommandDef {
+        name: "plugin",
+        aliases: &[],
+        binary: "",
+        prefix: &[],
+        root: false,
+        section: Section::System,
+        usage: "plugin list",
+        help: "help.plugin",
+        flags: &[],
+        examples: &["hammer plugin list"],
+    },
+    CommandDef {
+        name: "read-only",
+        aliases: &["ro"],
+        binary: "hammer-read",
+        prefix: &[],
+        root: true,
+        section: Section::Security,
+        usage: "read-only",
+        help: "help.read-only",
+        flags: &[],
+        examples: &[],
+    },
+];
+
+pub fn find(name: &str) -> Option<&'static CommandDef> {
+    COMMANDS.iter().find(|c| c.name == name || c.aliases.contains(&name))
+}
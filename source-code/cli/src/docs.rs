@@ -0,0 +1,123 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::i18n::{tr_in, Lang};
+use hammer_core::{overrides, HammerError, Logger};
+use lexopt::{Arg, Parser, ValueExt};
+use std::fmt::Write as _;
+use std::fs;
+use std::path::PathBuf;
+
+use crate::commands::{Section, COMMANDS};
+
+/// Reference docs are always generated in English
+fn en(key: &'static str) -> &'static str {
+    tr_in(Lang::En, key)
+}
+
+/// Escapes text for roff: backslashes and leading dots/quotes
+fn roff(text: &str) -> String {
+    let text = text.replace('\\', "\\e").replace('-', "\\-");
+    if text.starts_with('.') || text.starts_with('\'') {
+        format!("\\&{}", text)
+    } else {
+        text
+    }
+}
+
+pub fn man_page(version: &str) -> String {
+    let mut out = String::new();
+    let date = chrono::Local::now().format("%Y-%m-%d");
+    let _ = writeln!(out, ".TH HAMMER 1 \"{}\" \"hammer {}\" \"HackerOS\"", date, version);
+    let _ = writeln!(out, ".SH NAME\nhammer \\- {}", roff(&en("help.subtitle").to_lowercase()));
+    let _ = writeln!(out, ".SH SYNOPSIS\n.B hammer\n.I command\n[\\fIoptions\\fR]");
+    let _ = writeln!(out, ".SH DESCRIPTION\n{}.", roff(en("help.subtitle")));
+
+    for section in Section::ALL {
+        let _ = writeln!(out, ".SH {}", roff(en(section.title_key())));
+        for cmd in COMMANDS.iter().filter(|c| c.section == section) {
+            let _ = writeln!(out, ".TP\n.B {}\n{}", roff(cmd.usage), roff(en(cmd.help)));
+            if !cmd.aliases.is_empty() {
+                let _ = writeln!(out, ".br\nAliases: {}", roff(&cmd.aliases.join(", ")));
+            }
+            for (flag, desc) in cmd.flags {
+                let _ = writeln!(out, ".RS\n.TP\n.B {}\n{}\n.RE", roff(flag), roff(desc));
+            }
+        }
+    }
+
+    let _ = writeln!(out, ".SH EXAMPLES");
+    for example in COMMANDS.iter().flat_map(|c| c.examples) {
+        let _ = writeln!(out, ".PP\n.nf\n{}\n.fi", roff(example));
+    }
+    let _ = writeln!(out, ".SH ENVIRONMENT");
+    for (name, desc) in overrides::VARS {
+        let _ = writeln!(out, ".TP\n.B {}\n{}.", name, roff(desc));
+    }
+    let _ = writeln!(out, ".SH FILES\n.TP\n/etc/hammer/hammer.toml\nConfiguration.\n.TP\n/var/log/hammer/hammer.log\nOperation log.");
+    out
+}
+
+pub fn markdown(version: &str) -> String {
+    let mut out = String::new();
+    let _ = writeln!(out, "# hammer {}\n\n{}\n", version, en("help.subtitle"));
+    let _ = writeln!(out, "```\nhammer <command> [options]\n```");
+
+    for section in Section::ALL {
+        let _ = writeln!(out, "\n## {}\n", en(section.title_key()));
+        for cmd in COMMANDS.iter().filter(|c| c.section == section) {
+            let _ = writeln!(out, "### `hammer {}`\n\n{}.", cmd.usage, en(cmd.help));
+            if cmd.root {
+                let _ = writeln!(out, "\nRequires root.");
+            }
+            if !cmd.aliases.is_empty() {
+                let _ = writeln!(out, "\nAliases: {}", cmd.aliases.iter().map(|a| format!("`{}`", a)).collect::<Vec<_>>().join(", "));
+            }
+            if !cmd.flags.is_empty() {
+                let _ = writeln!(out, "\n| Option | Description |\n|---|---|");
+                for (flag, desc) in cmd.flags {
+                    let _ = writeln!(out, "| `{}` | {} |", flag, desc.replace('|', "\\|"));
+                }
+            }
+            if !cmd.examples.is_empty() {
+                let _ = writeln!(out, "\n```\n{}\n```", cmd.examples.join("\n"));
+            }
+            out.push('\n');
+        }
+    }
+    let _ = writeln!(out, "## Environment\n\n| Variable | Effect |\n|---|---|");
+    for (name, desc) in overrides::VARS {
+        let _ = writeln!(out, "| `{}` | {} |", name, desc);
+    }
+    out
+}
+
+/// `hammer docs man|markdown [--out DIR]`
+pub fn handle_docs(args: &[String], version: &str) -> Result<()> {
+    let mut parser = Parser::from_args(args.iter());
+    let mut format: Option<String> = None;
+    let mut out_dir: Option<PathBuf> = None;
+
+    while let Some(arg) = parser.next().into_diagnostic()? {
+        match arg {
+            Arg::Long("out") => out_dir = Some(parser.value().into_diagnostic()?.into()),
+            Arg::Value(val) if format.is_none() => format = Some(val.string().into_diagnostic()?),
+            other => return Err(other.unexpected()).into_diagnostic(),
+        }
+    }
+
+    let (content, file) = match format.as_deref() {
+        Some("man") => (man_page(version), "hammer.1"),
+        Some("markdown") | Some("md") => (markdown(version), "hammer.md"),
+        _ => return Err(HammerError::ConfigError("Usage: hammer docs <man|markdown> [--out DIR]".into()).into()),
+    };
+
+    match out_dir {
+        Some(dir) => {
+            fs::create_dir_all(&dir).into_diagnostic()?;
+            let path = dir.join(file);
+            fs::write(&path, content).into_diagnostic()?;
+            Logger::success(&format!("Wrote {}", path.display()));
+        }
+        None => print!("{}", content),
+    }
+    Ok(())
+}
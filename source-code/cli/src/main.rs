@@ -1,16 +1,30 @@
 use miette::{IntoDiagnostic, Result};
+use hammer_core::i18n::tr;
+use hammer_core::output::{self, Tone};
+use hammer_core::exec::{self, Exec};
+use hammer_core::overrides;
 use hammer_core::Logger;
 use lexopt::{Arg, Parser, ValueExt};
 use nix::unistd::Uid;
-use owo_colors::OwoColorize;
+use owo_colors::Style;
 use std::env;
 use std::path::PathBuf;
-use std::process::{Command, Stdio};
+
+mod commands;
+mod docs;
+mod plugins;
+
+use commands::{Section, COMMANDS};
 
 const BIN_DIR: &str = "/usr/lib/HackerOS/hammer/bin";
+const VERSION: &str = "1.1.0";
 
 fn main() -> Result<()> {
     Logger::init()?;
+    if overrides::dry_run() {
+        // The backends inherit it and skip what they would change
+        exec::set_dry_run();
+    }
 
     let args: Vec<String> = env::args().collect();
     let mut parser = Parser::from_env();
@@ -22,27 +36,23 @@ fn main() -> Result<()> {
         Some(Arg::Value(val)) => {
             let command = val.string().into_diagnostic()?;
             match command.as_str() {
-                // CONTAINER APPS
-                "install" => run_binary("hammer-containers", &["install"], &args[2..])?,
-                "remove-app" => run_binary("hammer-containers", &["remove"], &args[2..])?,
-                "list-apps" => run_binary("hammer-containers", &["list"], &args[2..])?,
-
-                // SYSTEM UPDATES
-                "update" => require_root(|| run_binary("hammer-updater", &["update"], &args[2..]))?,
-                "layer" => require_root(|| run_binary("hammer-updater", &["layer"], &args[2..]))?,
-                "clean" => require_root(|| run_binary("hammer-updater", &["clean"], &args[2..]))?,
-                "rollback" => require_root(|| run_binary("hammer-updater", &["rollback"], &args[2..]))?,
-                
-                // UTILS
-                "read-only" | "ro" => require_root(|| run_binary("hammer-read", &[], &args[2..]))?,
-                
+                "docs" => docs::handle_docs(&args[2..], VERSION)?,
+                "plugin" => plugins::handle_plugin(&args[2..])?,
+                "env" => print_env(),
                 "help" => print_help(),
                 "version" => print_version(),
-                _ => {
-                     print_help();
-                     println!("\n{}", format!("   ERROR: Unknown command '{}'", command).black().on_red());
-                     std::process::exit(1);
-                }
+                name => match commands::find(name) {
+                    Some(def) if def.root => require_root(&args[1..], || run_binary(def.binary, def.prefix, &args[2..]))?,
+                    Some(def) => run_binary(def.binary, def.prefix, &args[2..])?,
+                    None => match plugins::find(name) {
+                        Some(plugin) => plugins::run(&plugin, &args[2..], VERSION)?,
+                        None => {
+                            print_help();
+                            println!("\n{}", output::paint_style(format!("   {} '{}'", tr("cli.unknown-command"), command), Style::new().black().on_red()));
+                            std::process::exit(1);
+                        }
+                    },
+                },
             }
         }
         Some(Arg::Long("help")) | Some(Arg::Short('h')) => print_help(),
@@ -54,25 +64,34 @@ fn main() -> Result<()> {
     Ok(())
 }
 
-fn require_root<F>(f: F) -> Result<()> 
-where F: FnOnce() -> Result<()> 
+/// Stops before a root command starts without root, with the exact command to run instead
+/// and the commands that work without
+fn require_root<F>(command: &[String], f: F) -> Result<()>
+where F: FnOnce() -> Result<()>
 {
     if !Uid::current().is_root() {
-        println!("{}", " ACCESS DENIED: Root privileges required.".red().bold());
-        println!(" Run with: {}", "sudo hammer <command>".yellow());
+        let invocation = format!("hammer {}", command.join(" "));
+        println!(" {}", output::paint_style(tr("cli.access-denied"), Style::new().red().bold()));
+        println!(" {} {}", tr("cli.run-with"), output::paint(format!("sudo {}", invocation), Tone::Warn));
+        println!(" {} {}", tr("cli.run-with-desktop"), output::paint(format!("pkexec {}", invocation), Tone::Warn));
+        let unprivileged: Vec<&str> = COMMANDS
+        .iter()
+        .filter(|c| !c.root && c.binary == "hammer-updater" && c.section != Section::Plumbing)
+        .map(|c| c.name)
+        .collect();
+        println!(" {} {}", tr("cli.without-root"), output::paint(unprivileged.join(", "), Tone::Muted));
         std::process::exit(1);
     }
     f()
 }
 
+/// Runs a backend binary on the terminal. It runs in a dry run too and skips, itself, the
+/// commands that would change the system.
 fn run_binary(binary_name: &str, prefix_args: &[&str], user_args: &[String]) -> Result<()> {
     let binary_path = PathBuf::from(BIN_DIR).join(binary_name);
-    
-    let mut final_args: Vec<String> = Vec::new();
-    for p in prefix_args {
-        final_args.push(p.to_string());
-    }
-    final_args.extend_from_slice(user_args);
+
+    let mut final_args: Vec<&str> = prefix_args.to_vec();
+    final_args.extend(user_args.iter().map(String::as_str));
 
     let cmd_to_run = if binary_path.exists() {
         binary_path.to_string_lossy().to_string()
@@ -80,15 +99,7 @@ fn run_binary(binary_name: &str, prefix_args: &[&str], user_args: &[String]) ->
         binary_name.to_string()
     };
 
-    let mut child = Command::new(cmd_to_run)
-        .args(&final_args)
-        .stdin(Stdio::inherit())
-        .stdout(Stdio::inherit())
-        .stderr(Stdio::inherit())
-        .spawn()
-        .into_diagnostic()?;
-
-    let status = child.wait().into_diagnostic()?;
+    let status = Exec::new(&cmd_to_run, &final_args, binary_name).status()?;
 
     if !status.success() {
         std::process::exit(status.code().unwrap_or(1));
@@ -98,7 +109,7 @@ fn run_binary(binary_name: &str, prefix_args: &[&str], user_args: &[String]) ->
 }
 
 fn print_help() {
-    println!("{}", r#"
+    println!("{}", output::paint_style(r#"
                                              +=======                                               
                                            +++**+#######%%                                          
                                           ++*#####**##%%%%%                                         
@@ -135,32 +146,51 @@ fn print_help() {
             @%@%++=#@@@*++*%@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@*++*@@@#+++%%%@            
            @%%%%%%%%@@@%%%%@@%@ @@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@ %%@@%%%%@@@@%%%%%%%@           
             @%@@@@@@@%@@@@@@@@  @@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@  %@@@@@@@@@@@@@@@%%            
-"#.cyan().bold());
+"#, Style::new().cyan().bold()));
    
-   println!("   {}", "NEXT-GEN SYSTEM MANAGER".black().on_magenta());
-   println!("   Atomic Updates - Btrfs Snapshots - Isolated Apps\n");
+   println!("   {}", output::paint_style(tr("help.tagline"), Style::new().black().on_magenta()));
+   println!("   {}\n", tr("help.subtitle"));
 
-    let print_cmd = |cmd: &str, desc: &str| {
-        println!("   {: <20} {}", cmd.green().bold(), desc.bright_black());
+    let print_cmd = |cmd: &str, key: &'static str| {
+        println!("   {} {}", output::paint_style(format!("{: <20}", cmd), Style::new().green().bold()), output::paint(tr(key), Tone::Muted));
     };
 
-    println!("{}", " APPLICATIONS".yellow().bold());
-    print_cmd("install <pkg>", "Install CLI/GUI app in container");
-    print_cmd("remove-app <pkg>", "Remove installed app wrapper");
-    print_cmd("list-apps", "List all containerized apps");
-
-    println!("\n{}", " SYSTEM & UPDATES".blue().bold());
-    print_cmd("update", "Atomic system update (Snapshot -> Update)");
-    print_cmd("layer <pkg>", "Install package on host via snapshot");
-    print_cmd("rollback", "Revert system to previous state");
-    print_cmd("clean", "Prune old snapshots");
+    for section in Section::ALL {
+        let title = format!(" {}", tr(section.title_key()));
+        match section {
+            Section::Applications => println!("{}", output::paint_style(title, Style::new().yellow().bold())),
+            Section::System => println!("\n{}", output::paint_style(title, Style::new().blue().bold())),
+            Section::Security => println!("\n{}", output::paint_style(title, Style::new().red().bold())),
+            Section::Plumbing => println!("\n{}", output::paint_style(title, Style::new().bright_black().bold())),
+        }
+        for cmd in COMMANDS.iter().filter(|c| c.section == section) {
+            print_cmd(cmd.usage, cmd.help);
+        }
+    }
 
-    println!("\n{}", " SECURITY".red().bold());
-    print_cmd("read-only", "Manage file system locks");
+    let plugins = plugins::discover();
+    if !plugins.is_empty() {
+        println!("\n{}", output::paint(format!(" {}", tr("help.plugins")), Tone::Heading));
+        for plugin in plugins {
+            println!("   {} {}", output::paint_style(format!("{: <20}", plugin.name), Style::new().green().bold()), output::paint(plugin.path.display(), Tone::Muted));
+        }
+    }
     
     println!();
 }
 
+/// The HAMMER_* variables every command honours, with their current values
+fn print_env() {
+    for ((name, desc), (_, value)) in overrides::VARS.iter().zip(overrides::current()) {
+        let value = match value {
+            Some(value) => output::paint(format!("={}", value), Tone::Warn),
+            None => output::paint(tr("cli.env-unset"), Tone::Muted),
+        };
+        println!("   {} {}", output::paint_style(name, Style::new().green().bold()), value);
+        println!("      {}", desc);
+    }
+}
+
 fn print_version() {
-    println!("hammer 1.1.0 (Btrfs @layout edition)");
+    println!("hammer {} (Btrfs @layout edition)", VERSION);
 }
\ No newline at end of file
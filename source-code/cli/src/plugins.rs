@@ -0,0 +1,113 @@
+use miette::Result;
+use hammer_core::exec::Exec;
+use hammer_core::overrides;
+use hammer_core::i18n::{lang, Lang};
+use hammer_core::output::{self, Tone};
+use hammer_core::{HammerError, Logger};
+use nix::unistd::Uid;
+use owo_colors::Style;
+use std::env;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::PathBuf;
+
+use crate::commands::COMMANDS;
+
+/// `hammer-<name>` on PATH becomes `hammer <name>`
+const PREFIX: &str = "hammer-";
+
+pub struct Plugin {
+    pub name: String,
+    pub path: PathBuf,
+}
+
+/// Backends shipped with hammer share the prefix but are not plugins
+fn is_internal(file_name: &str) -> bool {
+    COMMANDS.iter().any(|c| c.binary == file_name) || file_name == "hammer-builder"
+}
+
+/// Executable hammer-* files on PATH; the first one found wins, like the shell
+pub fn discover() -> Vec<Plugin> {
+    let mut plugins: Vec<Plugin> = Vec::new();
+    let path = env::var_os("PATH").unwrap_or_default();
+    for dir in env::split_paths(&path) {
+        let entries = match fs::read_dir(&dir) {
+            Ok(e) => e,
+            Err(_) => continue,
+        };
+        for entry in entries.flatten() {
+            let file_name = entry.file_name().to_string_lossy().to_string();
+            let name = match file_name.strip_prefix(PREFIX) {
+                Some(n) if !n.is_empty() && !is_internal(&file_name) => n.to_string(),
+                _ => continue,
+            };
+            let executable = entry.metadata().map(|m| m.is_file() && m.permissions().mode() & 0o111 != 0).unwrap_or(false);
+            if executable && !plugins.iter().any(|p| p.name == name) {
+                plugins.push(Plugin { name, path: entry.path() });
+            }
+        }
+    }
+    plugins.sort_by(|a, b| a.name.cmp(&b.name));
+    plugins
+}
+
+pub fn find(name: &str) -> Option<Plugin> {
+    discover().into_iter().find(|p| p.name == name)
+}
+
+/// JSON document a plugin receives on stdin
+fn context(plugin: &Plugin, args: &[String], version: &str) -> serde_json::Value {
+    let config_path = overrides::config_path();
+    let config = fs::read_to_string(&config_path)
+    .ok()
+    .and_then(|c| toml::from_str::<toml::Value>(&c).ok())
+    .and_then(|c| serde_json::to_value(c).ok())
+    .unwrap_or(serde_json::Value::Null);
+
+    serde_json::json!({
+        "api": 1,
+        "hammer_version": version,
+        "plugin": plugin.name,
+        "args": args,
+        "config_path": config_path,
+        "config": config,
+        "language": if lang() == Lang::Pl { "pl" } else { "en" },
+        "root": Uid::current().is_root(),
+        "dry_run": hammer_core::exec::dry_run(),
+    })
+}
+
+/// Runs the plugin with the user's arguments and the context on stdin
+pub fn run(plugin: &Plugin, args: &[String], version: &str) -> Result<()> {
+    Logger::log(&format!("Running plugin {} ({})", plugin.name, plugin.path.display()));
+
+    let path = plugin.path.to_string_lossy();
+    let argv: Vec<&str> = args.iter().map(String::as_str).collect();
+    let status = Exec::new(&path, &argv, &plugin.name)
+    .env("HAMMER_PLUGIN_API", "1")
+    .env(overrides::CONFIG_ENV, &overrides::config_path().to_string_lossy())
+    .input(context(plugin, args, version).to_string())
+    .status()?;
+    if !status.success() {
+        std::process::exit(status.code().unwrap_or(1));
+    }
+    Ok(())
+}
+
+/// `hammer plugin list`
+pub fn handle_plugin(args: &[String]) -> Result<()> {
+    match args.first().map(|s| s.as_str()) {
+        Some("list") | None => {
+            let plugins = discover();
+            if plugins.is_empty() {
+                println!("No plugins found (executables named {}<name> on PATH).", PREFIX);
+                return Ok(());
+            }
+            for plugin in plugins {
+                println!("   {} {}", output::paint_style(format!("{: <20}", plugin.name), Style::new().green().bold()), output::paint(plugin.path.display(), Tone::Muted));
+            }
+            Ok(())
+        }
+        Some(other) => Err(HammerError::ConfigError(format!("Unknown plugin action '{}'. Usage: hammer plugin list", other)).into()),
+    }
+}
@@ -0,0 +1,107 @@
+/* Cockpit page for hammer; talks to the API socket started by `hammer serve` */
+const http = cockpit.http("/run/hammer/api.sock", { superuser: "require" });
+
+const ENTITIES = { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" };
+
+/* Safe in text and in quoted attributes such as data-name */
+function esc(text) {
+    return String(text ?? "").replace(/[&<>"']/g, c => ENTITIES[c]);
+}
+
+function showError(id, err) {
+    document.getElementById(id).innerHTML =
+        `<span class="fail">${esc(err.message || String(err))}. Is hammer-api.service running?</span>`;
+}
+
+/* Why a job failed to start or ended in failure; stays until the next job starts */
+function showJobError(text) {
+    const el = document.getElementById("job");
+    el.textContent = text;
+    el.hidden = !text;
+}
+
+/* The API answers errors with {"error": "..."}; cockpit passes that body along */
+function apiError(err, data) {
+    let message;
+    try {
+        message = JSON.parse(data).error;
+    } catch (_) {
+        message = null;
+    }
+    return message || err.message || String(err);
+}
+
+function loadPending() {
+    http.get("/v1/pending")
+        .then(data => {
+            const pending = JSON.parse(data);
+            document.getElementById("pending").innerHTML = pending.pending
+                ? "<ul>" + pending.reasons.map(r => `<li>${esc(r)}</li>`).join("") + "</ul>"
+                : "Nothing pending.";
+            document.getElementById("apply").disabled = !pending.pending;
+        })
+        .catch(err => showError("pending", err));
+}
+
+function loadDeployments() {
+    http.get("/v1/deployments")
+        .then(data => {
+            const rows = JSON.parse(data);
+            rows.sort((a, b) => (b.created || "").localeCompare(a.created || ""));
+            document.getElementById("deployments").innerHTML =
+                "<tr><th>Name</th><th>Created</th><th>Kind</th><th>State</th><th></th></tr>" +
+                rows.map(r => `<tr><td>${esc(r.name)}</td><td>${esc(r.created)}</td><td>${esc(r.kind)}</td>` +
+                    `<td>${r.state.map(s => `<span class="tag">${esc(s)}</span>`).join("")}</td>` +
+                    `<td>${r.path.startsWith("@snapshots/") ? `<button data-name="${esc(r.name)}" class="switch">Switch</button>` : ""}</td></tr>`
+                ).join("");
+            document.querySelectorAll("button.switch").forEach(b => {
+                b.onclick = () => startJob("/v1/rollback", { snapshot: b.dataset.name });
+            });
+        })
+        .catch(err => showError("deployments", err));
+}
+
+function follow(job) {
+    const pre = document.getElementById("progress");
+    pre.hidden = false;
+    pre.textContent = "";
+    let buffer = "";
+    http.request({ method: "GET", path: `/v1/jobs/${job}/progress`, body: "" })
+        .stream(chunk => {
+            buffer += chunk;
+            const lines = buffer.split("\n");
+            buffer = lines.pop();
+            for (const line of lines.filter(Boolean)) {
+                const msg = JSON.parse(line);
+                if (msg.done) {
+                    pre.textContent += msg.success ? "\nDone." : "\nFailed.";
+                    if (!msg.success)
+                        showJobError(`Job ${job} failed; its output is above.`);
+                } else
+                    pre.textContent += msg.line.replace(/\x1b\[[0-9;]*m/g, "") + "\n";
+                pre.scrollTop = pre.scrollHeight;
+            }
+        })
+        .then(refresh)
+        .catch((err, data) => {
+            showJobError(`Lost the progress of job ${job}: ${apiError(err, data)}`);
+            refresh();
+        });
+}
+
+function startJob(path, body) {
+    showJobError("");
+    http.post(path, body)
+        .then(data => follow(JSON.parse(data).job))
+        .catch((err, data) => showJobError(`Could not start the job: ${apiError(err, data)}`));
+}
+
+function refresh() {
+    loadPending();
+    loadDeployments();
+}
+
+document.getElementById("stage").onclick = () => startJob("/v1/updates", { staged: true });
+document.getElementById("apply").onclick = () => startJob("/v1/apply", { mode: document.getElementById("mode").value });
+
+refresh();
@@ -1,6 +1,7 @@
 use miette::{IntoDiagnostic, Result};
 use clap::{Parser, Subcommand};
-use hammer_core::{create_spinner, run_command, Logger};
+use hammer_core::i18n::tr;
+use hammer_core::{create_spinner, exec, overrides, run_change, run_command, Logger};
 use owo_colors::OwoColorize;
 use dialoguer::{Select, Input, Confirm};
 use std::fs;
@@ -35,6 +36,9 @@ const DESKTOP_DIR: &str = "/usr/share/applications";
 
 fn main() -> Result<()> {
     let cli = Cli::parse();
+    if overrides::dry_run() {
+        exec::set_dry_run();
+    }
 
     match cli.command {
         Commands::Install { package } => handle_install(package)?,
@@ -53,7 +57,7 @@ fn ensure_container_exists() -> Result<()> {
         let spinner = create_spinner("Pulling base image & Creating container...");
 
         // Create an infinite loop container that we can exec into
-        run_command("podman", &[
+        run_change("podman", &[
             "run", "-d",
             "--name", CONTAINER_NAME,
             "--restart", "always",
@@ -68,12 +72,12 @@ fn ensure_container_exists() -> Result<()> {
         ], "Create Container")?;
 
         // Update apt inside
-        run_command("podman", &["exec", CONTAINER_NAME, "apt-get", "update"], "Update Container APT")?;
+        run_change("podman", &["exec", CONTAINER_NAME, "apt-get", "update"], "Update Container APT")?;
 
         spinner.finish_with_message("Container environment ready.");
     } else {
         // Ensure it's running
-        run_command("podman", &["start", CONTAINER_NAME], "Start Container")?;
+        run_change("podman", &["start", CONTAINER_NAME], "Start Container")?;
     }
     Ok(())
 }
@@ -84,10 +88,9 @@ fn handle_install(package: String) -> Result<()> {
     Logger::info(&format!("Installing {} in container...", package.cyan()));
 
     // Install in container
-    let status = std::process::Command::new("podman")
-    .args(&["exec", "-it", CONTAINER_NAME, "apt-get", "install", "-y", &package])
-    .status()
-    .into_diagnostic()?;
+    let status = exec::Exec::new("podman", &["exec", "-it", CONTAINER_NAME, "apt-get", "install", "-y", &package], "Install in Container")
+    .changes_system()
+    .status()?;
 
     if !status.success() {
         Logger::error("Failed to install package in container.");
@@ -97,14 +100,14 @@ fn handle_install(package: String) -> Result<()> {
     // Determine App Type
     let types = vec!["CLI (Command Line Tool)", "GUI (Desktop Application)"];
     let selection = Select::new()
-    .with_prompt("What type of application is this?")
+    .with_prompt(tr("prompt.app-type"))
     .items(&types)
     .default(0)
     .interact()
     .into_diagnostic()?;
 
     let bin_name: String = Input::new()
-    .with_prompt("Enter the command name to launch it (e.g. alacritty)")
+    .with_prompt(tr("prompt.app-command"))
     .with_initial_text(&package)
     .interact_text()
     .into_diagnostic()?;
@@ -182,8 +185,8 @@ fn handle_remove(package: String) -> Result<()> {
     }
 
     // Optional: Remove from container
-    if Confirm::new().with_prompt("Uninstall from container as well?").interact().into_diagnostic()? {
-        run_command("podman", &["exec", CONTAINER_NAME, "apt-get", "remove", "-y", &package], "Apt Remove")?;
+    if overrides::assume_yes() || Confirm::new().with_prompt(tr("prompt.app-uninstall")).interact().into_diagnostic()? {
+        run_change("podman", &["exec", CONTAINER_NAME, "apt-get", "remove", "-y", &package], "Apt Remove")?;
     }
 
     Ok(())
@@ -0,0 +1,159 @@
+use miette::{IntoDiagnostic, Result};
+use nix::sys::statvfs::statvfs;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::{run_command, HammerError, Logger};
+
+/// Per-snapshot kernel/initrd copies live in <esp>/hammer/<snapshot>.
+/// The layout is opt-in: it is only used when this directory exists.
+pub const ASSET_SUBDIR: &str = "hammer";
+
+/// Extra room kept free on the ESP beyond the new assets
+const ESP_MARGIN: u64 = 8 * 1024 * 1024;
+
+pub fn esp_mount() -> Option<PathBuf> {
+    for candidate in ["/boot/efi", "/efi", "/boot"] {
+        let fstype = run_command("findmnt", &["-n", "-o", "FSTYPE", candidate], "Find ESP").unwrap_or_default();
+        if fstype.trim() == "vfat" {
+            return Some(PathBuf::from(candidate));
+        }
+    }
+    None
+}
+
+fn asset_dir() -> Option<PathBuf> {
+    esp_mount().map(|esp| esp.join(ASSET_SUBDIR)).filter(|d| d.exists())
+}
+
+pub fn enabled() -> bool {
+    asset_dir().is_some()
+}
+
+fn dir_size(path: &Path) -> u64 {
+    let mut total = 0;
+    if let Ok(entries) = fs::read_dir(path) {
+        for entry in entries.flatten() {
+            match entry.metadata() {
+                Ok(m) if m.is_dir() => total += dir_size(&entry.path()),
+                Ok(m) => total += m.len(),
+                Err(_) => {}
+            }
+        }
+    }
+    total
+}
+
+pub fn free_bytes(path: &Path) -> Result<u64> {
+    let stat = statvfs(path).into_diagnostic()?;
+    Ok(stat.blocks_available() as u64 * stat.fragment_size() as u64)
+}
+
+/// Newest kernel and initrd in /boot
+fn current_assets() -> Vec<PathBuf> {
+    let mut kernels: Vec<String> = fs::read_dir("/boot")
+    .map(|entries| {
+        entries
+        .flatten()
+        .map(|e| e.file_name().to_string_lossy().to_string())
+        .filter_map(|n| n.strip_prefix("vmlinuz-").map(|v| v.to_string()))
+        .collect()
+    })
+    .unwrap_or_default();
+    kernels.sort();
+
+    match kernels.last() {
+        Some(ver) => vec![
+            PathBuf::from(format!("/boot/vmlinuz-{}", ver)),
+            PathBuf::from(format!("/boot/initrd.img-{}", ver)),
+        ],
+        None => Vec::new(),
+    }
+}
+
+/// Bytes one more set of boot assets needs on the ESP
+pub fn required_bytes() -> u64 {
+    current_assets()
+    .iter()
+    .filter_map(|p| fs::metadata(p).ok())
+    .map(|m| m.len())
+    .sum::<u64>()
+    + ESP_MARGIN
+}
+
+/// Asset directories on the ESP with their sizes
+pub fn usage() -> Vec<(String, u64)> {
+    let dir = match asset_dir() {
+        Some(d) => d,
+        None => return Vec::new(),
+    };
+    let mut usage: Vec<(String, u64)> = fs::read_dir(&dir)
+    .map(|entries| {
+        entries
+        .flatten()
+        .filter(|e| e.path().is_dir())
+        .map(|e| (e.file_name().to_string_lossy().to_string(), dir_size(&e.path())))
+        .collect()
+    })
+    .unwrap_or_default();
+    usage.sort();
+    usage
+}
+
+/// Fails early when the ESP cannot hold the assets of another snapshot
+pub fn preflight() -> Result<()> {
+    let esp = match asset_dir().as_deref().and_then(Path::parent) {
+        Some(esp) => esp.to_path_buf(),
+        None => return Ok(()),
+    };
+    let needed = required_bytes();
+    let free = free_bytes(&esp)?;
+    if free < needed {
+        return Err(HammerError::IoError(format!(
+            "ESP {} has {} MiB free but {} MiB are needed for boot assets. Run 'hammer esp gc' or 'hammer clean'.",
+            esp.display(), free / 1024 / 1024, needed / 1024 / 1024
+        )).into());
+    }
+    Ok(())
+}
+
+/// Copies the current kernel/initrd next to the snapshot it belongs to
+pub fn store_for_snapshot(name: &str) -> Result<()> {
+    let dir = match asset_dir() {
+        Some(d) => d.join(name),
+        None => return Ok(()),
+    };
+    fs::create_dir_all(&dir).into_diagnostic()?;
+    for asset in current_assets() {
+        if let Some(file) = asset.file_name() {
+            if asset.exists() {
+                fs::copy(&asset, dir.join(file)).into_diagnostic()?;
+            }
+        }
+    }
+    Logger::info(&format!("Boot assets stored on ESP for {}", name));
+    Ok(())
+}
+
+pub fn remove_for_snapshot(name: &str) -> Result<()> {
+    if let Some(dir) = asset_dir() {
+        let path = dir.join(name);
+        if path.exists() {
+            fs::remove_dir_all(path).into_diagnostic()?;
+        }
+    }
+    Ok(())
+}
+
+/// Removes asset directories whose snapshot no longer exists. Returns freed bytes.
+pub fn gc(snapshots: &[String]) -> Result<u64> {
+    let mut freed = 0;
+    for (name, size) in usage() {
+        if !snapshots.contains(&name) {
+            Logger::info(&format!("Removing orphaned boot assets of {}", name));
+            remove_for_snapshot(&name)?;
+            freed += size;
+        }
+    }
+    Ok(freed)
+}
@@ -0,0 +1,185 @@
+use std::fs;
+
+use crate::{is_root, HammerError};
+
+/// Capabilities hammer keeps for some operation; numbers from linux/capability.h
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Cap {
+    Chown = 0,
+    DacOverride = 1,
+    DacReadSearch = 2,
+    Fowner = 3,
+    Fsetid = 4,
+    SysRawio = 17,
+    SysChroot = 18,
+    SysAdmin = 21,
+}
+
+impl Cap {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Cap::Chown => "CAP_CHOWN",
+            Cap::DacOverride => "CAP_DAC_OVERRIDE",
+            Cap::DacReadSearch => "CAP_DAC_READ_SEARCH",
+            Cap::Fowner => "CAP_FOWNER",
+            Cap::Fsetid => "CAP_FSETID",
+            Cap::SysRawio => "CAP_SYS_RAWIO",
+            Cap::SysChroot => "CAP_SYS_CHROOT",
+            Cap::SysAdmin => "CAP_SYS_ADMIN",
+        }
+    }
+}
+
+/// What an operation is allowed to do once it has started.
+///
+/// - `None`: reads world-readable files (diff --cached)
+/// - `Inspect`: mounts the top level, reads snapshots and device health (status, history, diff, verify, check)
+/// - `Snapshot`: creates, deletes and sends subvolumes and rewrites files it owns (delete, pin, export, backup)
+/// - `Full`: runs apt, dpkg maintainer scripts, chroots or the bootloader; nothing is dropped
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Profile {
+    None,
+    Inspect,
+    Snapshot,
+    Full,
+}
+
+impl Profile {
+    /// Capabilities kept; None means all of them
+    pub fn caps(&self) -> Option<&'static [Cap]> {
+        match self {
+            Profile::None => Some(&[]),
+            // mount(2) and the btrfs ioctls need CAP_SYS_ADMIN; snapshots keep their owners' modes;
+            // smartctl's ATA passthrough needs CAP_SYS_RAWIO
+            Profile::Inspect => Some(&[Cap::SysAdmin, Cap::DacReadSearch, Cap::SysRawio]),
+            Profile::Snapshot => Some(&[
+                Cap::SysAdmin,
+                Cap::DacReadSearch,
+                Cap::DacOverride,
+                Cap::Fowner,
+                Cap::Chown,
+                Cap::Fsetid,
+            ]),
+            Profile::Full => None,
+        }
+    }
+
+    /// Capabilities the profile cannot work without; the rest of what it keeps only helps
+    /// (smartctl, unreadable files)
+    pub fn required(&self) -> &'static [Cap] {
+        match self {
+            Profile::None => &[],
+            Profile::Inspect => &[Cap::SysAdmin],
+            Profile::Snapshot => &[Cap::SysAdmin, Cap::DacOverride, Cap::Fowner, Cap::Chown],
+            Profile::Full => &[Cap::SysAdmin, Cap::SysChroot, Cap::DacOverride, Cap::Fowner, Cap::Chown],
+        }
+    }
+
+    /// What the profile needs its capabilities for, completing "it ..."
+    fn purpose(&self) -> &'static str {
+        match self {
+            Profile::None => "reads world-readable files",
+            Profile::Inspect => "mounts the Btrfs top level and reads snapshots",
+            Profile::Snapshot => "creates and deletes Btrfs subvolumes",
+            Profile::Full => "runs apt in chroots and changes deployments and the bootloader",
+        }
+    }
+}
+
+/// Effective capabilities of this process, as /proc/self/status shows them
+fn effective() -> u64 {
+    fs::read_to_string("/proc/self/status")
+    .ok()
+    .and_then(|s| s.lines().find_map(|l| l.strip_prefix("CapEff:").map(|v| v.trim().to_string())))
+    .and_then(|v| u64::from_str_radix(&v, 16).ok())
+    .unwrap_or(0)
+}
+
+/// Required capabilities of `profile` this process does not have
+pub fn missing(profile: Profile) -> Vec<Cap> {
+    let have = effective();
+    profile.required().iter().copied().filter(|c| have & (1 << (*c as u32)) == 0).collect()
+}
+
+/// Why `command` cannot run with the privileges of this process and what to do about it;
+/// None when it can. Checked before anything starts, instead of failing halfway on EPERM.
+/// `purpose` completes "it ..." when the profile's own reason does not fit the command.
+pub fn explain(profile: Profile, command: &str, purpose: Option<&str>) -> Option<String> {
+    let missing = missing(profile);
+    if missing.is_empty() {
+        return None;
+    }
+    let purpose = purpose.unwrap_or(profile.purpose());
+    if !is_root() {
+        return Some(format!(
+            "`{}` needs root: it {}. Run it as root:\n  sudo {}\n  pkexec {}   (from a desktop session)",
+            command, purpose, command, command
+        ));
+    }
+    let names: Vec<&str> = missing.iter().map(|c| c.name()).collect();
+    Some(format!(
+        "`{}` runs as root but without {}, which it needs because it {}. In a container, start it with --privileged \
+         or --cap-add for each; under systemd, check CapabilityBoundingSet= of the unit.",
+        command, names.join(", "), purpose
+    ))
+}
+
+const CAP_VERSION_3: u32 = 0x2008_0522;
+
+#[repr(C)]
+struct CapHeader {
+    version: u32,
+    pid: i32,
+}
+
+#[repr(C)]
+#[derive(Clone, Copy, Default)]
+struct CapData {
+    effective: u32,
+    permitted: u32,
+    inheritable: u32,
+}
+
+fn last_cap() -> u32 {
+    fs::read_to_string("/proc/sys/kernel/cap_last_cap")
+    .ok()
+    .and_then(|s| s.trim().parse().ok())
+    .unwrap_or(40)
+}
+
+/// Drops every capability the profile does not need, from the bounding set too, so
+/// commands hammer runs as root cannot regain them on exec. No-op without root or for `Full`.
+pub fn restrict(profile: Profile) -> Result<(), HammerError> {
+    let keep = match profile.caps() {
+        Some(keep) if is_root() => keep,
+        _ => return Ok(()),
+    };
+    let mask: u64 = keep.iter().fold(0, |m, c| m | 1 << (*c as u32));
+
+    // The bounding set goes first: dropping from it needs CAP_SETPCAP, which capset removes
+    for cap in 0..=last_cap() {
+        if mask & (1 << cap) == 0 {
+            // SAFETY: prctl with integer arguments only
+            let rc = unsafe { libc::prctl(libc::PR_CAPBSET_DROP, cap as libc::c_ulong, 0, 0, 0) };
+            if rc != 0 && std::io::Error::last_os_error().raw_os_error() != Some(libc::EINVAL) {
+                return Err(HammerError::IoError(format!("Dropping capability {} failed: {}", cap, std::io::Error::last_os_error())));
+            }
+        }
+    }
+    // SAFETY: as above
+    unsafe { libc::prctl(libc::PR_CAP_AMBIENT, libc::PR_CAP_AMBIENT_CLEAR_ALL as libc::c_ulong, 0, 0, 0) };
+
+    let mut header = CapHeader { version: CAP_VERSION_3, pid: 0 };
+    let low = mask as u32;
+    let high = (mask >> 32) as u32;
+    let data = [
+        CapData { effective: low, permitted: low, inheritable: 0 },
+        CapData { effective: high, permitted: high, inheritable: 0 },
+    ];
+    // SAFETY: header and data match the v3 layout the kernel expects (two CapData entries)
+    let rc = unsafe { libc::syscall(libc::SYS_capset, &mut header as *mut CapHeader, data.as_ptr()) };
+    if rc != 0 {
+        return Err(HammerError::IoError(format!("capset failed: {}", std::io::Error::last_os_error())));
+    }
+    Ok(())
+}
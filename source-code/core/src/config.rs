@@ -0,0 +1,541 @@
+use miette::{IntoDiagnostic, Result, WrapErr};
+use serde::Deserialize;
+use std::fs;
+use std::str::FromStr;
+
+use crate::HammerError;
+
+pub const CONFIG_PATH: &str = "/etc/hammer/hammer.toml";
+
+/// How the apt transaction of an update is run
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum Executor {
+    /// Upgrade the running root after a safety snapshot
+    #[default]
+    Live,
+    /// Upgrade a staged @update subvolume through chroot
+    Chroot,
+    /// Upgrade @update inside a systemd-nspawn container
+    Nspawn,
+    /// Upgrade @update inside a podman container
+    Podman,
+}
+
+impl Executor {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Executor::Live => "live",
+            Executor::Chroot => "chroot",
+            Executor::Nspawn => "nspawn",
+            Executor::Podman => "podman",
+        }
+    }
+
+    pub fn is_staged(&self) -> bool {
+        *self != Executor::Live
+    }
+}
+
+impl FromStr for Executor {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "live" => Ok(Executor::Live),
+            "chroot" => Ok(Executor::Chroot),
+            "nspawn" => Ok(Executor::Nspawn),
+            "podman" => Ok(Executor::Podman),
+            other => Err(format!("unknown executor '{}' (live, chroot, nspawn, podman)", other)),
+        }
+    }
+}
+
+/// What dpkg does with a conffile changed both locally and in the new package
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum ConffilePolicy {
+    /// Keep the local version (--force-confdef --force-confold)
+    #[default]
+    Old,
+    /// Install the package's version (--force-confdef --force-confnew)
+    New,
+    /// Keep the local version while apt runs, then ask about each conflict
+    /// (at the terminal, or later through `hammer conffiles`)
+    Ask,
+}
+
+impl FromStr for ConffilePolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "old" => Ok(ConffilePolicy::Old),
+            "new" => Ok(ConffilePolicy::New),
+            "ask" => Ok(ConffilePolicy::Ask),
+            other => Err(format!("unknown conffile policy '{}' (old, new, ask)", other)),
+        }
+    }
+}
+
+/// How apt and debconf are driven during an update
+#[derive(Debug, Deserialize, Clone)]
+#[serde(default)]
+pub struct AptConfig {
+    /// DEBIAN_FRONTEND for apt and maintainer scripts
+    pub frontend: String,
+    /// debconf-set-selections files loaded into the root before apt runs
+    pub preseed: Vec<String>,
+    pub conffiles: ConffilePolicy,
+    /// Extra apt options, each passed as -o OPTION
+    pub options: Vec<String>,
+}
+
+impl Default for AptConfig {
+    fn default() -> Self {
+        AptConfig {
+            frontend: "noninteractive".to_string(),
+            preseed: Vec::new(),
+            conffiles: ConffilePolicy::Old,
+            options: Vec::new(),
+        }
+    }
+}
+
+impl AptConfig {
+    /// apt command line options for the conffile policy and the extra options
+    pub fn apt_args(&self) -> Vec<String> {
+        // dpkg never prompts: with confold the package's version is left as .dpkg-dist
+        let dpkg = match self.conffiles {
+            ConffilePolicy::Old | ConffilePolicy::Ask => ["--force-confdef", "--force-confold"],
+            ConffilePolicy::New => ["--force-confdef", "--force-confnew"],
+        };
+        dpkg.iter()
+        .map(|o| format!("Dpkg::Options::={}", o))
+        .chain(self.options.iter().cloned())
+        .flat_map(|o| ["-o".to_string(), o])
+        .collect()
+    }
+}
+
+/// cgroup limits for the apt transaction, applied through a systemd-run scope
+#[derive(Debug, Deserialize, Default, Clone)]
+pub struct Limits {
+    /// e.g. "50%" (of one CPU; "200%" = two CPUs)
+    pub cpu_quota: Option<String>,
+    /// e.g. "2G"
+    pub memory_max: Option<String>,
+    /// 1-10000, default 100
+    pub io_weight: Option<u32>,
+    pub nice: Option<i32>,
+}
+
+impl Limits {
+    pub fn is_empty(&self) -> bool {
+        self.cpu_quota.is_none() && self.memory_max.is_none() && self.io_weight.is_none() && self.nice.is_none()
+    }
+
+    /// Arguments for `systemd-run --scope`
+    pub fn systemd_run_args(&self) -> Vec<String> {
+        let mut args = Vec::new();
+        if let Some(cpu) = &self.cpu_quota {
+            args.push(format!("--property=CPUQuota={}", cpu));
+        }
+        if let Some(mem) = &self.memory_max {
+            args.push(format!("--property=MemoryMax={}", mem));
+        }
+        if let Some(io) = self.io_weight {
+            args.push(format!("--property=IOWeight={}", io));
+        }
+        if let Some(nice) = self.nice {
+            args.push(format!("--nice={}", nice));
+        }
+        args
+    }
+}
+
+#[derive(Debug, Deserialize, Default)]
+pub struct UpdateConfig {
+    #[serde(default)]
+    pub executor: Executor,
+    #[serde(default)]
+    pub limits: Limits,
+    /// Resolve Debian mirrors from snapshot.debian.org at this time
+    #[serde(default)]
+    pub pin_mirror: Option<String>,
+    /// Never remove packages: apt upgrade --with-new-pkgs instead of full-upgrade
+    #[serde(default)]
+    pub safe_upgrade: bool,
+    #[serde(default)]
+    pub apt: AptConfig,
+    /// Run apt autoremove --purge after the upgrade and report the removed orphans
+    #[serde(default)]
+    pub autoremove: bool,
+    /// Empty the staged deployment's apt cache before switching to it
+    #[serde(default)]
+    pub clean_cache: bool,
+    /// Share extents of a staged deployment with the running root before switching (duperemove)
+    #[serde(default)]
+    pub dedupe: bool,
+    /// Switch to a staged update even if DKMS modules failed to build for its kernel
+    #[serde(default)]
+    pub allow_dkms_failures: bool,
+}
+
+impl UpdateConfig {
+    /// apt arguments after the program name for the upgrade step
+    pub fn upgrade_args(&self) -> Vec<&'static str> {
+        if self.safe_upgrade {
+            vec!["upgrade", "--with-new-pkgs", "-y"]
+        } else {
+            vec!["full-upgrade", "-y"]
+        }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct StatusConfig {
+    /// Warn when the filesystem is forecast to fill up within this many days
+    pub forecast_warn_days: u32,
+    /// Ask smartctl about the disks under / as well as the btrfs error counters
+    pub smart: bool,
+}
+
+impl Default for StatusConfig {
+    fn default() -> Self {
+        StatusConfig { forecast_warn_days: 14, smart: false }
+    }
+}
+
+/// Rollback protection for `hammer clean` and `hammer delete`
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct CleanConfig {
+    /// The snapshot an update replaced stays for at least this many days after the switch...
+    pub protect_days: u32,
+    /// ...and this many boots; 0 turns either guard off
+    pub protect_boots: u32,
+}
+
+impl Default for CleanConfig {
+    fn default() -> Self {
+        CleanConfig { protect_days: 3, protect_boots: 1 }
+    }
+}
+
+/// Clock of the timestamp at the start of snapshot names
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum NameClock {
+    /// "2025-11-30-201300-pre-update", local wall time
+    #[default]
+    Local,
+    /// "2025-11-30-191300Z-pre-update", the same everywhere, so names from machines in different zones sort together
+    Utc,
+}
+
+/// Package operations of plain apt/dpkg runs that can trigger a snapshot
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum PackageOp {
+    Install,
+    Remove,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct SnapshotsConfig {
+    pub name_clock: NameClock,
+    /// apt runs outside hammer that install or remove packages snapshot the root first
+    pub auto_snapshot_on: Vec<PackageOp>,
+    /// Automatic snapshots (kind "pkg") kept; older ones are deleted after each new one
+    pub auto_snapshot_keep: usize,
+}
+
+impl Default for SnapshotsConfig {
+    fn default() -> Self {
+        SnapshotsConfig { name_clock: NameClock::default(), auto_snapshot_on: Vec::new(), auto_snapshot_keep: 5 }
+    }
+}
+
+#[derive(Debug, Deserialize, Default)]
+#[serde(default)]
+pub struct ReportConfig {
+    /// Endpoint for `hammer report --upload` (multipart field "report")
+    pub upload_url: Option<String>,
+}
+
+/// Opt-in update statistics; nothing is sent before `hammer telemetry enable`
+#[derive(Debug, Deserialize, Default)]
+#[serde(default)]
+pub struct TelemetryConfig {
+    /// Where the queued events are posted as {"events": [...]}
+    pub endpoint: Option<String>,
+}
+
+/// Rollout ring of this machine; earlier rings get releases first
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum Ring {
+    Canary,
+    Early,
+    Broad,
+}
+
+impl Ring {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Ring::Canary => "canary",
+            Ring::Early => "early",
+            Ring::Broad => "broad",
+        }
+    }
+}
+
+/// Staged rollouts for fleets: `hammer update --auto` follows the manifest
+#[derive(Debug, Deserialize, Default)]
+#[serde(default)]
+pub struct FleetConfig {
+    pub ring: Option<Ring>,
+    /// JSON release manifest with per-ring availability dates
+    pub manifest_url: Option<String>,
+    /// gpgv keyring the manifest must be signed with (MANIFEST_URL.asc); unsigned if unset
+    pub keyring: Option<String>,
+}
+
+/// Guards for unattended runs (`hammer update --auto`)
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct AutoConfig {
+    /// Skip while on battery below `min_battery` percent
+    pub check_power: bool,
+    pub min_battery: u8,
+    /// Skip while NetworkManager reports a metered connection
+    pub check_metered: bool,
+}
+
+impl Default for AutoConfig {
+    fn default() -> Self {
+        AutoConfig { check_power: true, min_battery: 50, check_metered: true }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct GeneralConfig {
+    /// "auto" (from LANG), "en" or "pl"
+    pub language: String,
+    /// Give up capabilities an operation does not need before it starts (see caps::Profile)
+    pub drop_capabilities: bool,
+}
+
+impl Default for GeneralConfig {
+    fn default() -> Self {
+        GeneralConfig { language: "auto".to_string(), drop_capabilities: true }
+    }
+}
+
+#[derive(Debug, Deserialize, Default)]
+#[serde(default)]
+pub struct WebConfig {
+    /// Bearer token for `hammer web`; empty means a generated one in /var/lib/hammer/web-token
+    pub token: String,
+}
+
+#[derive(Debug, Deserialize, Default)]
+#[serde(default)]
+pub struct BootConfig {
+    /// Leave snapshot boot entries to grub-btrfs; unset means "if it is installed"
+    pub grub_btrfs: Option<bool>,
+}
+
+/// Which snapshot backend holds the root and its snapshots
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq, Default)]
+#[serde(rename_all = "kebab-case")]
+pub enum StorageKind {
+    /// From the filesystem / is mounted from
+    #[default]
+    Auto,
+    Btrfs,
+    /// Experimental: snapshots of the root dataset
+    Zfs,
+    /// Experimental: thin snapshots of the root logical volume
+    LvmThin,
+    /// Reduced guarantees: / is an overlay whose upper layers are copied and swapped
+    Overlay,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct StorageConfig {
+    pub driver: StorageKind,
+    /// Device holding the overlay layers (mount(8) spec); read by the initramfs script
+    pub overlay_layers: String,
+}
+
+impl Default for StorageConfig {
+    fn default() -> Self {
+        Self {
+            driver: StorageKind::default(),
+            overlay_layers: "LABEL=hammer-layers".to_string(),
+        }
+    }
+}
+
+/// Btrfs compression of deployments hammer creates
+#[derive(Debug, Deserialize, Default)]
+#[serde(default)]
+pub struct CompressionConfig {
+    /// compression property of new @update subvolumes: zstd, lzo, zlib or none; empty leaves it inherited
+    pub algorithm: String,
+    /// Level `hammer fs recompress` uses when none is given
+    pub level: Option<u32>,
+}
+
+/// Experimental: finished deployments sealed into composefs images in @composefs
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct ComposefsConfig {
+    /// Seal every staged deployment before switching to it
+    pub enabled: bool,
+    /// Images kept; older ones, their writable layers and unshared objects are removed
+    pub keep: usize,
+}
+
+impl Default for ComposefsConfig {
+    fn default() -> Self {
+        ComposefsConfig { enabled: false, keep: 5 }
+    }
+}
+
+/// Where the top-level subvolume (ID 5) holding @ and @snapshots is reached
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct PoolConfig {
+    /// Mount point of the top level; empty means an existing mount of it, else /run/hammer/btrfs-root
+    pub mount: String,
+    /// Look for an existing top-level mount (/.btrfs, /mnt/pool, ...) when `mount` is empty
+    pub autodetect: bool,
+    /// Leave hammer's own mount in place after each command
+    pub keep_mounted: bool,
+}
+
+impl Default for PoolConfig {
+    fn default() -> Self {
+        PoolConfig { mount: String::new(), autodetect: true, keep_mounted: false }
+    }
+}
+
+#[derive(Debug, Deserialize, Default)]
+#[serde(default)]
+pub struct TimeshiftConfig {
+    /// List Timeshift's snapshots in status as read-only rows instead of hiding them
+    pub adopt: bool,
+}
+
+/// S3-compatible object storage (AWS, MinIO) used by s3:// URLs
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct S3Config {
+    /// Endpoint of a non-AWS store, e.g. "https://minio.lan:9000"
+    pub endpoint_url: Option<String>,
+    pub region: Option<String>,
+    /// Named profile from ~/.aws/config
+    pub profile: Option<String>,
+    /// Static credentials; unset means AWS_* environment variables or the profile
+    pub access_key_id: Option<String>,
+    pub secret_access_key: Option<String>,
+    /// Server-side encryption: "AES256" or "aws:kms"
+    pub sse: Option<String>,
+    pub sse_kms_key_id: Option<String>,
+    /// Multipart upload part size in MiB
+    pub part_size_mib: u64,
+}
+
+impl Default for S3Config {
+    fn default() -> Self {
+        S3Config {
+            endpoint_url: None,
+            region: None,
+            profile: None,
+            access_key_id: None,
+            secret_access_key: None,
+            sse: None,
+            sse_kms_key_id: None,
+            part_size_mib: 64,
+        }
+    }
+}
+
+/// Compression and buffering of send streams (export, import, backup)
+#[derive(Debug, Deserialize)]
+#[serde(default)]
+pub struct TransferConfig {
+    /// "zstd" or "pigz"
+    pub compressor: String,
+    /// Compression level; unset means the compressor's default
+    pub level: Option<u32>,
+    /// Compression workers; 0 means one per core
+    pub threads: u32,
+    /// mbuffer size between stages when mbuffer is installed; 0 disables it
+    pub buffer_mib: u32,
+}
+
+impl Default for TransferConfig {
+    fn default() -> Self {
+        TransferConfig { compressor: "zstd".to_string(), level: None, threads: 0, buffer_mib: 256 }
+    }
+}
+
+#[derive(Debug, Deserialize, Default)]
+pub struct Config {
+    #[serde(default)]
+    pub general: GeneralConfig,
+    #[serde(default)]
+    pub update: UpdateConfig,
+    #[serde(default)]
+    pub auto: AutoConfig,
+    #[serde(default)]
+    pub web: WebConfig,
+    #[serde(default)]
+    pub fleet: FleetConfig,
+    #[serde(default)]
+    pub report: ReportConfig,
+    #[serde(default)]
+    pub telemetry: TelemetryConfig,
+    #[serde(default)]
+    pub status: StatusConfig,
+    #[serde(default)]
+    pub snapshots: SnapshotsConfig,
+    #[serde(default)]
+    pub clean: CleanConfig,
+    #[serde(default)]
+    pub boot: BootConfig,
+    #[serde(default)]
+    pub pool: PoolConfig,
+    #[serde(default)]
+    pub storage: StorageConfig,
+    #[serde(default)]
+    pub compression: CompressionConfig,
+    #[serde(default)]
+    pub composefs: ComposefsConfig,
+    #[serde(default)]
+    pub timeshift: TimeshiftConfig,
+    #[serde(default)]
+    pub s3: S3Config,
+    #[serde(default)]
+    pub transfer: TransferConfig,
+}
+
+/// Loads /etc/hammer/hammer.toml, or HAMMER_CONFIG; a missing file means defaults
+pub fn load() -> Result<Config> {
+    let path = crate::overrides::config_path();
+    if !path.exists() {
+        return Ok(Config::default());
+    }
+    let content = fs::read_to_string(&path)
+    .into_diagnostic()
+    .wrap_err(format!("Failed to read {}", path.display()))?;
+    toml::from_str(&content).map_err(|e| HammerError::ConfigError(format!("{}: {}", path.display(), e)).into())
+}
@@ -0,0 +1,84 @@
+use miette::{IntoDiagnostic, Result};
+use nix::mount::{mount, umount, MsFlags};
+use std::ffi::CString;
+use std::fs::{self, File};
+use std::os::unix::io::AsRawFd;
+use std::path::Path;
+
+use crate::HammerError;
+
+// The few operations a rollback needs, done with syscalls instead of mount(8) and
+// btrfs-progs, so the static binary works in an initramfs that only has a shell.
+// ioctl numbers and layouts from linux/btrfs.h.
+
+const BTRFS_IOC_INO_LOOKUP: libc::c_ulong = 0xC000_9412;
+const BTRFS_IOC_DEFAULT_SUBVOL: libc::c_ulong = 0x4008_9413;
+const BTRFS_IOC_SNAP_CREATE_V2: libc::c_ulong = 0x5000_9417;
+
+/// Inode number of every subvolume's root directory
+const FIRST_FREE_OBJECTID: u64 = 256;
+
+#[repr(C)]
+struct InoLookupArgs {
+    treeid: u64,
+    objectid: u64,
+    name: [u8; 4080],
+}
+
+#[repr(C)]
+struct VolArgsV2 {
+    fd: i64,
+    transid: u64,
+    flags: u64,
+    unused: [u64; 4],
+    name: [u8; 4040],
+}
+
+fn ioctl<T>(file: &File, request: libc::c_ulong, arg: *mut T, what: &str) -> Result<()> {
+    // SAFETY: `arg` points to a live value of the layout `request` expects
+    let ret = unsafe { libc::ioctl(file.as_raw_fd(), request as _, arg) };
+    if ret < 0 {
+        return Err(HammerError::BtrfsError(format!("{}: {}", what, std::io::Error::last_os_error())).into());
+    }
+    Ok(())
+}
+
+/// ID of the subvolume whose root directory is `path`
+pub fn subvolume_id(path: &Path) -> Result<u64> {
+    let dir = File::open(path).into_diagnostic()?;
+    let mut args = InoLookupArgs { treeid: 0, objectid: FIRST_FREE_OBJECTID, name: [0; 4080] };
+    ioctl(&dir, BTRFS_IOC_INO_LOOKUP, &mut args, &format!("Look up subvolume {}", path.display()))?;
+    Ok(args.treeid)
+}
+
+/// Makes subvolume `id` the one mounted when no subvol= option is given
+pub fn set_default(top: &Path, id: u64) -> Result<()> {
+    let dir = File::open(top).into_diagnostic()?;
+    let mut id = id;
+    ioctl(&dir, BTRFS_IOC_DEFAULT_SUBVOL, &mut id, "Set default subvolume")
+}
+
+/// Writable snapshot of `source` at `dest_dir`/`name`
+pub fn snapshot(source: &Path, dest_dir: &Path, name: &str) -> Result<()> {
+    if name.is_empty() || name.contains('/') || name.len() >= 4040 {
+        return Err(HammerError::BtrfsError(format!("Invalid subvolume name '{}'", name)).into());
+    }
+    let src = File::open(source).into_diagnostic()?;
+    let dest = File::open(dest_dir).into_diagnostic()?;
+    let name = CString::new(name).into_diagnostic()?;
+    let bytes = name.as_bytes_with_nul();
+    let mut args = VolArgsV2 { fd: src.as_raw_fd() as i64, transid: 0, flags: 0, unused: [0; 4], name: [0; 4040] };
+    args.name[..bytes.len()].copy_from_slice(bytes);
+    ioctl(&dest, BTRFS_IOC_SNAP_CREATE_V2, &mut args, &format!("Snapshot {}", source.display()))
+}
+
+/// Mounts the top-level subvolume (ID 5) of `device` at `target`
+pub fn mount_top_level(device: &Path, target: &Path) -> Result<()> {
+    fs::create_dir_all(target).into_diagnostic()?;
+    mount(Some(device), target, Some("btrfs"), MsFlags::empty(), Some("subvolid=5"))
+    .map_err(|e| HammerError::BtrfsError(format!("Mount {} at {}: {}", device.display(), target.display(), e)).into())
+}
+
+pub fn unmount(target: &Path) -> Result<()> {
+    umount(target).map_err(|e| HammerError::BtrfsError(format!("Unmount {}: {}", target.display(), e)).into())
+}
@@ -0,0 +1,153 @@
+use miette::{IntoDiagnostic, Result, WrapErr};
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+
+use crate::exec::Exec;
+use crate::{run_change, store, Logger};
+
+/// Executable hooks live in /etc/hammer/hooks.d/<event>.d/
+pub const HOOKS_DIR: &str = "/etc/hammer/hooks.d";
+pub const UNIT_DIR: &str = "/etc/systemd/system";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Event {
+    PreUpdate,
+    UpdateStaged,
+    UpdateFailed,
+    SnapshotCreated,
+    Switched,
+}
+
+impl Event {
+    pub const ALL: [Event; 5] = [
+        Event::PreUpdate,
+        Event::UpdateStaged,
+        Event::UpdateFailed,
+        Event::SnapshotCreated,
+        Event::Switched,
+    ];
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            Event::PreUpdate => "pre-update",
+            Event::UpdateStaged => "update-staged",
+            Event::UpdateFailed => "update-failed",
+            Event::SnapshotCreated => "snapshot-created",
+            Event::Switched => "switched",
+        }
+    }
+
+    fn description(&self) -> &'static str {
+        match self {
+            Event::PreUpdate => "Hammer system update is about to start",
+            Event::UpdateStaged => "Hammer system update finished",
+            Event::UpdateFailed => "Hammer system update failed",
+            Event::SnapshotCreated => "Hammer created a root snapshot",
+            Event::Switched => "Hammer switched the root to another snapshot",
+        }
+    }
+
+    pub fn target(&self) -> String {
+        format!("hammer-{}.target", self.name())
+    }
+}
+
+/// Recent events for `hammer status --watch`; on tmpfs, so it starts empty every boot
+pub const EVENT_LOG: &str = "/run/hammer/events.log";
+
+/// The log is cut back to this many lines once it grows past twice that
+const EVENT_LOG_LINES: usize = 100;
+
+/// Runs script hooks and starts the matching systemd target.
+/// Hooks must never break the operation that emitted the event.
+pub fn emit(event: Event, snapshot: Option<&str>) {
+    Logger::log(&format!("EVENT: {}{}", event.name(), snapshot.map(|s| format!(" ({})", s)).unwrap_or_default()));
+    append_log(event, snapshot);
+    run_hooks(event, snapshot);
+    start_target(event);
+}
+
+fn append_log(event: Event, snapshot: Option<&str>) {
+    let path = Path::new(EVENT_LOG);
+    if let Some(dir) = path.parent() {
+        let _ = fs::create_dir_all(dir);
+    }
+    let line = format!(
+        "{} {} {}\n",
+        chrono::Local::now().format("%Y-%m-%d %H:%M:%S"),
+        event.name(),
+        snapshot.unwrap_or("-")
+    );
+    let mut lines: Vec<String> = fs::read_to_string(path).unwrap_or_default().lines().map(|l| l.to_string()).collect();
+    lines.push(line.trim_end().to_string());
+    if lines.len() > 2 * EVENT_LOG_LINES {
+        lines.drain(..lines.len() - EVENT_LOG_LINES);
+    }
+    let _ = store::write(path, lines.join("\n") + "\n");
+}
+
+/// The last `n` events, oldest first
+pub fn recent(n: usize) -> Vec<String> {
+    let content = fs::read_to_string(EVENT_LOG).unwrap_or_default();
+    let lines: Vec<String> = content.lines().map(|l| l.to_string()).collect();
+    lines[lines.len().saturating_sub(n)..].to_vec()
+}
+
+/// Executable hooks of `event`, in the order they run
+pub fn hooks(event: Event) -> Vec<PathBuf> {
+    let dir = Path::new(HOOKS_DIR).join(format!("{}.d", event.name()));
+    let mut hooks: Vec<PathBuf> = fs::read_dir(&dir)
+    .map(|entries| entries.flatten().map(|e| e.path()).collect())
+    .unwrap_or_default();
+    hooks.retain(|hook| fs::metadata(hook).map(|m| m.is_file() && m.permissions().mode() & 0o111 != 0).unwrap_or(false));
+    hooks.sort();
+    hooks
+}
+
+/// Whether `install_targets` wrote a systemd target for `event`
+pub fn has_target(event: Event) -> bool {
+    Path::new(UNIT_DIR).join(event.target()).exists()
+}
+
+fn run_hooks(event: Event, snapshot: Option<&str>) {
+    for hook in hooks(event) {
+        let status = Exec::new(&hook.to_string_lossy(), &[], "Run Hook")
+        .env("HAMMER_EVENT", event.name())
+        .env("HAMMER_SNAPSHOT", snapshot.unwrap_or(""))
+        .changes_system()
+        .status();
+        match status {
+            Ok(s) if s.success() => Logger::log(&format!("Hook {} succeeded", hook.display())),
+            _ => Logger::warn(&format!("Hook {} failed", hook.display())),
+        }
+    }
+}
+
+fn start_target(event: Event) {
+    if !has_target(event) {
+        return;
+    }
+    // --no-block: units ordered after the target must not stall hammer
+    if run_change("systemctl", &["start", "--no-block", &event.target()], "Start Event Target").is_err() {
+        Logger::warn(&format!("Could not reach {}", event.target()));
+    }
+}
+
+/// Writes one target per event. Targets stop when unneeded so every emit re-triggers them.
+pub fn install_targets() -> Result<()> {
+    for event in Event::ALL {
+        let content = format!(
+            "[Unit]\nDescription={}\nStopWhenUnneeded=yes\nRefuseManualStart=no\n",
+            event.description()
+        );
+        let path = Path::new(UNIT_DIR).join(event.target());
+        fs::write(&path, content)
+        .into_diagnostic()
+        .wrap_err(format!("Failed to write {}", path.display()))?;
+
+        fs::create_dir_all(Path::new(HOOKS_DIR).join(format!("{}.d", event.name()))).into_diagnostic()?;
+    }
+    run_change("systemctl", &["daemon-reload"], "Reloading Daemon")?;
+    Ok(())
+}
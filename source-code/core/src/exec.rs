@@ -0,0 +1,265 @@
+use miette::{IntoDiagnostic, Result, WrapErr};
+use std::env;
+use std::fs::File;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Child, Command, ExitStatus, Stdio};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use crate::{HammerError, Logger};
+
+// One way of running programs for every hammer binary. The command line and how it ended
+// go to hammer.log; captured output is meant to be parsed, so those programs run with
+// LC_ALL=C; a timeout kills what hangs; in a dry run, commands marked as changing the
+// system are only logged. The TUI, written in Go, does the same in tui/internal/execx.
+
+/// Set to 1 for a dry run; inherited by every hammer program started from one
+pub const DRY_RUN_ENV: &str = "HAMMER_DRY_RUN";
+
+static DRY_RUN: AtomicBool = AtomicBool::new(false);
+
+/// Starts a dry run, for this process and the hammer programs it runs
+pub fn set_dry_run() {
+    DRY_RUN.store(true, Ordering::Relaxed);
+    env::set_var(DRY_RUN_ENV, "1");
+}
+
+pub fn dry_run() -> bool {
+    DRY_RUN.load(Ordering::Relaxed) || env::var(DRY_RUN_ENV).is_ok_and(|v| v == "1")
+}
+
+/// A program to run, e.g.
+/// `Exec::new("btrfs", &["subvolume", "delete", path], "Delete Subvolume").changes_system().output()?`
+pub struct Exec<'a> {
+    cmd: &'a str,
+    args: Vec<String>,
+    description: &'a str,
+    env: Vec<(String, String)>,
+    dir: Option<PathBuf>,
+    input: Option<Vec<u8>>,
+    stdin: Option<Stdio>,
+    stdout: Option<Stdio>,
+    stderr: Option<Stdio>,
+    log: Option<File>,
+    timeout: Option<Duration>,
+    changes_system: bool,
+}
+
+impl<'a> Exec<'a> {
+    pub fn new(cmd: &'a str, args: &[&str], description: &'a str) -> Exec<'a> {
+        Exec {
+            cmd,
+            args: args.iter().map(|a| a.to_string()).collect(),
+            description,
+            env: Vec::new(),
+            dir: None,
+            input: None,
+            stdin: None,
+            stdout: None,
+            stderr: None,
+            log: None,
+            timeout: None,
+            changes_system: false,
+        }
+    }
+
+    pub fn env(mut self, key: &str, value: &str) -> Self {
+        self.env.push((key.to_string(), value.to_string()));
+        self
+    }
+
+    pub fn current_dir(mut self, dir: &Path) -> Self {
+        self.dir = Some(dir.to_path_buf());
+        self
+    }
+
+    /// Given to `status` on stdin instead of the terminal
+    pub fn input(mut self, input: impl Into<Vec<u8>>) -> Self {
+        self.input = Some(input.into());
+        self
+    }
+
+    /// stdin for `status` and `spawn`, instead of the terminal or, for `spawn`, nothing
+    pub fn stdin(mut self, stdin: Stdio) -> Self {
+        self.stdin = Some(stdin);
+        self
+    }
+
+    /// stdout for `status` and `spawn`, instead of the terminal or, for `spawn`, a pipe
+    pub fn stdout(mut self, stdout: Stdio) -> Self {
+        self.stdout = Some(stdout);
+        self
+    }
+
+    /// stderr for `status` and `spawn`, instead of the terminal
+    pub fn stderr(mut self, stderr: Stdio) -> Self {
+        self.stderr = Some(stderr);
+        self
+    }
+
+    /// Sends what `status` prints to `log` instead of the terminal; stdin is empty
+    pub fn log_to(mut self, log: File) -> Self {
+        self.log = Some(log);
+        self
+    }
+
+    /// Kills the program when it runs longer than `timeout`
+    pub fn timeout(mut self, timeout: Duration) -> Self {
+        self.timeout = Some(timeout);
+        self
+    }
+
+    /// Skipped, only logged, in a dry run
+    pub fn changes_system(mut self) -> Self {
+        self.changes_system = true;
+        self
+    }
+
+    /// The command line as logged; a multi-line argument, a script, is shown as '<script>'
+    pub fn command_line(&self) -> String {
+        std::iter::once(self.cmd)
+        .chain(self.args.iter().map(|a| if a.contains('\n') { "'<script>'" } else { a.as_str() }))
+        .collect::<Vec<_>>()
+        .join(" ")
+    }
+
+    fn command(&self) -> Command {
+        let mut command = Command::new(self.cmd);
+        command.args(&self.args);
+        for (key, value) in &self.env {
+            command.env(key, value);
+        }
+        if let Some(dir) = &self.dir {
+            command.current_dir(dir);
+        }
+        command
+    }
+
+    /// True when the run is a dry one and this command is skipped
+    fn skipped(&self) -> bool {
+        if !(self.changes_system && dry_run()) {
+            Logger::log(&format!("Running: {}", self.command_line()));
+            return false;
+        }
+        Logger::info(&format!("Dry run, not running: {}", self.command_line()));
+        true
+    }
+
+    /// Waits for `child`, killing it once the timeout passes
+    fn wait(&self, child: &mut Child, started: Instant) -> Result<ExitStatus> {
+        let status = match self.timeout {
+            None => child.wait().into_diagnostic()?,
+            Some(timeout) => loop {
+                if let Some(status) = child.try_wait().into_diagnostic()? {
+                    break status;
+                }
+                if started.elapsed() >= timeout {
+                    let _ = child.kill();
+                    let _ = child.wait();
+                    Logger::log(&format!("Timed out after {}s: {}", timeout.as_secs(), self.command_line()));
+                    return Err(HammerError::CommandFailed(format!("{} timed out after {}s", self.description, timeout.as_secs())).into());
+                }
+                thread::sleep(Duration::from_millis(50));
+            },
+        };
+        Logger::log(&format!("Finished ({}, {:.1}s): {}", status, started.elapsed().as_secs_f64(), self.cmd));
+        Ok(status)
+    }
+
+    /// Runs the program in the C locale and returns its stdout; fails with its stderr
+    pub fn output(self) -> Result<String> {
+        if self.skipped() {
+            return Ok(String::new());
+        }
+        let started = Instant::now();
+        let mut child = self
+        .command()
+        .env("LC_ALL", "C")
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .into_diagnostic()
+        .wrap_err(format!("Failed to execute binary: {}", self.cmd))?;
+
+        // Both pipes are drained while waiting, so a chatty program cannot block on a full one
+        let drain = |pipe: Option<Box<dyn Read + Send>>| {
+            thread::spawn(move || {
+                let mut buf = Vec::new();
+                if let Some(mut pipe) = pipe {
+                    let _ = pipe.read_to_end(&mut buf);
+                }
+                String::from_utf8_lossy(&buf).to_string()
+            })
+        };
+        let stdout = drain(child.stdout.take().map(|p| Box::new(p) as Box<dyn Read + Send>));
+        let stderr = drain(child.stderr.take().map(|p| Box::new(p) as Box<dyn Read + Send>));
+
+        let status = self.wait(&mut child, started)?;
+        let stdout = stdout.join().unwrap_or_default();
+        let stderr = stderr.join().unwrap_or_default();
+
+        if !status.success() {
+            Logger::log(&format!("Command failed stderr: {}", stderr));
+            return Err(HammerError::CommandFailed(format!("{} failed: {}", self.description, stderr)).into());
+        }
+        Ok(stdout)
+    }
+
+    /// Runs the program on the terminal, or with `log_to` into a file, in the user's locale,
+    /// and returns how it ended; a skipped one "succeeds"
+    pub fn status(mut self) -> Result<ExitStatus> {
+        if self.skipped() {
+            return Ok(ExitStatus::default());
+        }
+        let started = Instant::now();
+        let mut command = self.command();
+        match &self.log {
+            Some(log) => command
+            .stdin(Stdio::null())
+            .stdout(log.try_clone().into_diagnostic()?)
+            .stderr(log.try_clone().into_diagnostic()?),
+            None => command.stdin(Stdio::inherit()).stdout(Stdio::inherit()).stderr(Stdio::inherit()),
+        };
+        if let Some(stdin) = self.stdin.take() {
+            command.stdin(stdin);
+        }
+        if let Some(stdout) = self.stdout.take() {
+            command.stdout(stdout);
+        }
+        if let Some(stderr) = self.stderr.take() {
+            command.stderr(stderr);
+        }
+        if self.input.is_some() {
+            command.stdin(Stdio::piped());
+        }
+        let mut child = command
+        .spawn()
+        .into_diagnostic()
+        .wrap_err(format!("Failed to execute binary: {}", self.cmd))?;
+        if let (Some(input), Some(mut stdin)) = (&self.input, child.stdin.take()) {
+            // A program that does not read its input may exit before taking all of it
+            let _ = stdin.write_all(input);
+        }
+        let status = self.wait(&mut child, started)?;
+        Ok(status)
+    }
+
+    /// Starts the program and leaves it to the caller, for output that is read as it
+    /// comes or piped into another program. stdin is empty and stdout a pipe unless set
+    /// otherwise; the timeout does not apply. In a dry run a command that changes the
+    /// system is not started and this fails.
+    pub fn spawn(mut self) -> Result<Child> {
+        if self.skipped() {
+            return Err(HammerError::CommandFailed(format!("{}: not started in a dry run", self.description)).into());
+        }
+        self.command()
+        .stdin(self.stdin.take().unwrap_or_else(Stdio::null))
+        .stdout(self.stdout.take().unwrap_or_else(Stdio::piped))
+        .stderr(self.stderr.take().unwrap_or_else(Stdio::inherit))
+        .spawn()
+        .into_diagnostic()
+        .wrap_err(format!("Failed to execute binary: {}", self.cmd))
+    }
+}
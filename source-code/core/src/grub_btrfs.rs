@@ -0,0 +1,30 @@
+use std::path::Path;
+
+use crate::{config, run_change, Logger};
+
+/// grub-btrfs' generator; running it rewrites /boot/grub/grub-btrfs.cfg
+const GENERATOR: &str = "/etc/grub.d/41_snapshots-btrfs";
+
+/// Whether snapshot boot entries are left to grub-btrfs.
+/// `[boot] grub_btrfs` decides; unset means "when grub-btrfs is installed".
+pub fn enabled() -> bool {
+    match config::load().ok().and_then(|c| c.boot.grub_btrfs) {
+        Some(on) => on,
+        None => Path::new(GENERATOR).exists(),
+    }
+}
+
+/// Regenerates the grub-btrfs submenu. grub-btrfsd cannot see @snapshots
+/// (it is not mounted in the running system), so hammer triggers it.
+/// Snapshot names start with their creation time and end with their kind,
+/// which is what the submenu shows. A failure only costs the menu entry.
+pub fn refresh() {
+    if !Path::new(GENERATOR).exists() {
+        Logger::warn(&format!("[boot] grub_btrfs is on but {} is missing.", GENERATOR));
+        return;
+    }
+    match run_change(GENERATOR, &[], "Regenerate grub-btrfs Menu") {
+        Ok(_) => Logger::info("grub-btrfs snapshot menu updated."),
+        Err(e) => Logger::warn(&format!("grub-btrfs menu not updated: {}", e)),
+    }
+}
@@ -0,0 +1,195 @@
+use std::env;
+use std::fmt;
+use std::sync::OnceLock;
+
+use crate::config;
+
+// English and Polish catalogs. Translated are the CLI front end and its help, the TUI,
+// confirmation prompts, the error kinds and the summary lines of update, rollback and
+// check. The step-by-step progress of each operation stays in English: it is also the
+// log and the transaction journal, which are searched and quoted in bug reports.
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Lang {
+    En,
+    Pl,
+}
+
+impl Lang {
+    fn from_code(code: &str) -> Option<Lang> {
+        // "pl_PL.UTF-8" -> "pl"
+        let code = code.split(|c| c == '_' || c == '.' || c == '@').next().unwrap_or("");
+        match code.to_lowercase().as_str() {
+            "en" | "c" | "posix" => Some(Lang::En),
+            "pl" => Some(Lang::Pl),
+            _ => None,
+        }
+    }
+}
+
+/// `[general] language` wins unless it is "auto"; then LC_ALL, LC_MESSAGES, LANG
+fn detect() -> Lang {
+    if let Ok(cfg) = config::load() {
+        if let Some(lang) = Lang::from_code(&cfg.general.language) {
+            return lang;
+        }
+    }
+    for var in ["LC_ALL", "LC_MESSAGES", "LANG"] {
+        if let Ok(value) = env::var(var) {
+            if value.is_empty() {
+                continue;
+            }
+            return Lang::from_code(&value).unwrap_or(Lang::En);
+        }
+    }
+    Lang::En
+}
+
+pub fn lang() -> Lang {
+    static LANG: OnceLock<Lang> = OnceLock::new();
+    *LANG.get_or_init(detect)
+}
+
+/// (key, English, Polish)
+const MESSAGES: &[(&str, &str, &str)] = &[
+    ("help.tagline", "NEXT-GEN SYSTEM MANAGER", "MENEDŻER SYSTEMU NOWEJ GENERACJI"),
+    ("help.subtitle", "Atomic Updates - Btrfs Snapshots - Isolated Apps", "Atomowe aktualizacje - Migawki Btrfs - Izolowane aplikacje"),
+    ("help.applications", "APPLICATIONS", "APLIKACJE"),
+    ("help.system", "SYSTEM & UPDATES", "SYSTEM I AKTUALIZACJE"),
+    ("help.security", "SECURITY", "BEZPIECZEŃSTWO"),
+    ("help.plumbing", "PLUMBING (stable output for scripts)", "NISKOPOZIOMOWE (stabilne wyjście dla skryptów)"),
+    ("help.plugins", "PLUGINS", "WTYCZKI"),
+    ("help.install", "Install CLI/GUI app in container", "Zainstaluj aplikację CLI/GUI w kontenerze"),
+    ("help.remove-app", "Remove installed app wrapper", "Usuń zainstalowaną aplikację"),
+    ("help.list-apps", "List all containerized apps", "Wyświetl aplikacje w kontenerach"),
+    ("help.update", "Atomic system update (Snapshot -> Update)", "Atomowa aktualizacja systemu (Migawka -> Aktualizacja)"),
+    ("help.release-upgrade", "Upgrade to a new Debian release in a staged deployment", "Aktualizacja do nowego wydania Debiana we wdrożeniu przygotowawczym"),
+    ("help.layer", "Install package on host via snapshot, or keep it on every new base", "Zainstaluj pakiet w systemie przez migawkę lub zachowaj go w każdej nowej bazie"),
+    ("help.status", "Root subvolumes (table, wide, json, yaml)", "Podwoluminy główne (table, wide, json, yaml)"),
+    ("help.history", "Snapshot history", "Historia migawek"),
+    ("help.rollback", "Revert system to previous state", "Przywróć poprzedni stan systemu"),
+    ("help.recover", "Clean up after an interrupted update or rollback", "Posprzątaj po przerwanej aktualizacji lub wycofaniu"),
+    ("help.diff", "Package changes since a snapshot", "Zmiany pakietów od migawki"),
+    ("help.deviations", "Packages and files changed since the installed image", "Pakiety i pliki zmienione od zainstalowanego obrazu"),
+    ("help.conffiles", "Resolve configuration files kept by an update", "Rozwiąż pliki konfiguracyjne zachowane przez aktualizację"),
+    ("help.stats", "Duration of update phases and their trend", "Czas trwania faz aktualizacji i ich trend"),
+    ("help.list-snapshots", "Snapshots, one per line", "Migawki, po jednej w wierszu"),
+    ("help.current-default", "Subvolume used on next boot", "Podwolumin używany przy następnym uruchomieniu"),
+    ("help.current-booted", "Subvolume the system booted from", "Podwolumin, z którego uruchomiono system"),
+    ("help.check", "Available updates and pending reboots (no root needed)", "Dostępne aktualizacje i oczekujące restarty (bez roota)"),
+    ("help.delete", "Delete a snapshot (partial names, --before DATE)", "Usuń migawkę (częściowe nazwy, --before DATA)"),
+    ("help.snapshot", "Snapshot the running root", "Utwórz migawkę działającego systemu"),
+    ("help.pin", "Protect a snapshot from cleanup", "Chroń migawkę przed czyszczeniem"),
+    ("help.alias", "Name a snapshot; the name works wherever a snapshot name does", "Nazwij migawkę; nazwa działa wszędzie tam, gdzie nazwa migawki"),
+    ("help.unpin", "Remove cleanup protection from a snapshot", "Zdejmij ochronę migawki przed czyszczeniem"),
+    ("help.reboot", "Reboot into pending changes (now, idle, HH:MM)", "Uruchom ponownie z oczekującymi zmianami (now, idle, GG:MM)"),
+    ("help.apply", "Activate pending changes (soft-reboot/kexec)", "Aktywuj oczekujące zmiany (soft-reboot/kexec)"),
+    ("help.clean", "Prune old snapshots", "Usuń stare migawki"),
+    ("help.kernel", "Manage kernels across snapshots and /boot", "Zarządzaj jądrami w migawkach i /boot"),
+    ("help.emergency", "Roll back from the initramfs shell", "Przywróć system z powłoki initramfs"),
+    ("help.rescue", "Recovery boot entry for repairing the default subvolume", "Awaryjny wpis rozruchowy do naprawy domyślnego podwoluminu"),
+    ("help.composefs", "Experimental: deployments sealed into composefs images", "Eksperymentalne: wdrożenia zapieczętowane w obrazach composefs"),
+    ("help.boot", "Default boot entry and menu timeout", "Domyślny wpis rozruchowy i czas oczekiwania menu"),
+    ("help.os", "Several operating systems side by side, each with its own boot entry", "Kilka systemów operacyjnych obok siebie, każdy z własnym wpisem rozruchowym"),
+    ("help.explain", "Show the commands, mounts and writes a command would run, without running it", "Pokaż polecenia, montowania i zapisy, które wykonałoby polecenie, bez uruchamiania go"),
+    ("help.esp", "ESP space and per-snapshot boot assets", "Miejsce na ESP i pliki rozruchowe migawek"),
+    ("help.events", "Hooks and systemd targets for hammer events", "Hooki i cele systemd dla zdarzeń hammer"),
+    ("help.swap", "Handle swapfiles that block snapshots", "Obsłuż pliki wymiany blokujące migawki"),
+    ("help.report", "Sanitized bug report bundle", "Zanonimizowany pakiet zgłoszenia błędu"),
+    ("help.telemetry", "Opt-in anonymous update and rollback statistics", "Opcjonalne anonimowe statystyki aktualizacji i wycofań"),
+    ("help.backup", "Scheduled incremental backups of the root", "Planowane przyrostowe kopie zapasowe systemu"),
+    ("help.export", "Export a snapshot, compressed and encrypted", "Eksportuj migawkę, skompresowaną i zaszyfrowaną"),
+    ("help.import", "Import a snapshot from an export", "Importuj migawkę z eksportu"),
+    ("help.verify", "Verify deployment files against stored hashes", "Sprawdź pliki wdrożenia z zapisanymi sumami"),
+    ("help.dedupe", "Share identical file extents between a deployment and its parent", "Współdziel identyczne ekstenty plików między wdrożeniem a jego rodzicem"),
+    ("help.fs", "Compression of deployments", "Kompresja wdrożeń"),
+    ("help.adopt", "Register an existing subvolume as a deployment", "Zarejestruj istniejący podwolumin jako wdrożenie"),
+    ("help.migrate", "Import/export snapper snapshots", "Import/eksport migawek snappera"),
+    ("help.state", "Export/import config, journal and pins", "Eksport/import konfiguracji, dziennika i przypięć"),
+    ("help.ensure", "Idempotent state for Ansible/Salt (JSON output)", "Stan idempotentny dla Ansible/Salt (wyjście JSON)"),
+    ("help.serve", "Local REST API for dashboards and scripts", "Lokalne API REST dla paneli i skryptów"),
+    ("help.web", "Browser dashboard (status, history, updates)", "Panel w przeglądarce (stan, historia, aktualizacje)"),
+    ("help.docs", "Generate the man page or markdown reference", "Wygeneruj stronę man lub dokumentację markdown"),
+    ("help.env", "Show the HAMMER_* environment variables that stand in for flags and config", "Pokaż zmienne środowiskowe HAMMER_* zastępujące flagi i konfigurację"),
+    ("help.plugin", "List hammer-<name> plugins found on PATH", "Wyświetl wtyczki hammer-<nazwa> znalezione w PATH"),
+    ("help.read-only", "Manage file system locks", "Zarządzaj blokadami systemu plików"),
+    ("cli.access-denied", "ACCESS DENIED: Root privileges required.", "ODMOWA DOSTĘPU: Wymagane uprawnienia roota."),
+    ("cli.run-with", "Run with:", "Uruchom z:"),
+    ("cli.run-with-desktop", "Or, from a desktop session:", "Lub, z sesji graficznej:"),
+    ("cli.without-root", "Read-only without root:", "Bez roota (tylko odczyt):"),
+    ("cli.env-unset", "(unset)", "(nieustawiona)"),
+    ("cli.unknown-command", "ERROR: Unknown command", "BŁĄD: Nieznane polecenie"),
+    ("error.command-failed", "Command failed", "Polecenie nie powiodło się"),
+    ("error.io", "IO Error", "Błąd wejścia/wyjścia"),
+    ("error.config", "Configuration Error", "Błąd konfiguracji"),
+    ("error.btrfs", "Btrfs Error", "Błąd Btrfs"),
+    ("prompt.proceed", "Proceed?", "Kontynuować?"),
+    ("prompt.rollback-now", "Rollback now?", "Wycofać teraz?"),
+    ("prompt.delete-snapshot", "Delete snapshot {}?", "Usunąć migawkę {}?"),
+    ("prompt.recompress", "Recompress {} with {}?", "Skompresować ponownie {} algorytmem {}?"),
+    ("prompt.upgrade-to", "Upgrade to {}?", "Zaktualizować do {}?"),
+    ("prompt.switch-to", "Switch to {}?", "Przełączyć na {}?"),
+    ("prompt.clean-up", "Clean up?", "Posprzątać?"),
+    ("prompt.hold-kernel", "Keep the current kernel for future updates ({})?", "Zachować obecne jądro przy przyszłych aktualizacjach ({})?"),
+    ("prompt.choose-snapshot", "Several snapshots match, choose one", "Pasuje kilka migawek, wybierz jedną"),
+    ("prompt.restore-snapshot", "Select snapshot to restore (+added ~changed -removed vs. current)", "Wybierz migawkę do przywrócenia (+dodane ~zmienione -usunięte względem bieżącego)"),
+    ("prompt.compare-snapshot", "Compare which snapshot with the running system?", "Którą migawkę porównać z działającym systemem?"),
+    ("prompt.delete-which", "Select snapshot to delete", "Wybierz migawkę do usunięcia"),
+    ("prompt.conffile-keep", "Keep the local version", "Zachowaj wersję lokalną"),
+    ("prompt.conffile-install", "Install the package's version (local kept as .dpkg-old)", "Zainstaluj wersję z pakietu (lokalna zostaje jako .dpkg-old)"),
+    ("prompt.conffile-later", "Decide later", "Zdecyduj później"),
+    ("prompt.app-type", "What type of application is this?", "Jakiego typu jest ta aplikacja?"),
+    ("prompt.app-command", "Enter the command name to launch it (e.g. alacritty)", "Podaj nazwę polecenia, które ją uruchamia (np. alacritty)"),
+    ("prompt.app-uninstall", "Uninstall from container as well?", "Odinstalować również z kontenera?"),
+    ("update.title", "ATOMIC SYSTEM UPDATE", "ATOMOWA AKTUALIZACJA SYSTEMU"),
+    ("update.success", "System successfully updated.", "System został zaktualizowany."),
+    ("update.apt-update-failed", "apt update failed.", "apt update nie powiodło się."),
+    ("update.upgrade-failed", "APT Upgrade failed.", "Aktualizacja APT nie powiodła się."),
+    ("update.rollback-hint", "Please run 'hammer rollback' or select snapshot at boot.", "Uruchom 'hammer rollback' lub wybierz migawkę przy rozruchu."),
+    ("update.up-to-date", "System is already up to date.", "System jest już aktualny."),
+    ("update.staged-failed", "Update failed inside @update. The running system is untouched.", "Aktualizacja w @update nie powiodła się. Działający system pozostał nietknięty."),
+    ("update.staged", "Update staged ({}). Reboot to activate it: hammer reboot", "Aktualizacja przygotowana ({}). Uruchom ponownie, aby ją aktywować: hammer reboot"),
+    ("rollback.title", "SYSTEM ROLLBACK", "WYCOFANIE SYSTEMU"),
+    ("snapshots.none", "No snapshots found in @snapshots.", "Nie znaleziono migawek w @snapshots."),
+    ("rollback.target", "Target: {}", "Cel: {}"),
+    ("rollback.reboot-required", "REBOOT IS REQUIRED IMMEDIATELY AFTER.", "ZARAZ POTEM WYMAGANE JEST PONOWNE URUCHOMIENIE."),
+    ("rollback.running", "Performing rollback...", "Wycofywanie..."),
+    ("rollback.applied", "Rollback applied.", "Wycofanie zastosowane."),
+    ("rollback.success", "Rollback successful. Please REBOOT now.", "Wycofanie powiodło się. Uruchom teraz system PONOWNIE."),
+    ("check.title", "CHECK", "SPRAWDZENIE"),
+    ("check.none", "No updates available{}.", "Brak dostępnych aktualizacji{}."),
+    ("check.available", "{} updates available{}:", "Dostępne aktualizacje: {}{}:"),
+    ("check.lists-from", " (package lists from {})", " (listy pakietów z {})"),
+    ("check.reboot-pending", "Reboot pending: {}", "Oczekuje na ponowne uruchomienie: {}"),
+];
+
+/// Message for `key` in the given language; unknown keys are returned as-is
+pub fn tr_in(lang: Lang, key: &'static str) -> &'static str {
+    match MESSAGES.iter().find(|(k, _, _)| *k == key) {
+        Some((_, en, pl)) => match lang {
+            Lang::En => en,
+            Lang::Pl => pl,
+        },
+        None => key,
+    }
+}
+
+/// Message for `key` in the user's language
+pub fn tr(key: &'static str) -> &'static str {
+    tr_in(lang(), key)
+}
+
+/// `tr(key)` with each "{}" replaced by the next of `args`
+pub fn tr_fmt(key: &'static str, args: &[&dyn fmt::Display]) -> String {
+    let mut args = args.iter();
+    let mut out = String::new();
+    for (i, part) in tr(key).split("{}").enumerate() {
+        if i > 0 {
+            if let Some(arg) = args.next() {
+                out.push_str(&arg.to_string());
+            }
+        }
+        out.push_str(part);
+    }
+    out
+}
@@ -0,0 +1,126 @@
+use miette::{IntoDiagnostic, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::Instant;
+
+use crate::packages::PackageDiff;
+use crate::state::STATE_DIR;
+use crate::store;
+use crate::HammerError;
+
+/// One record per hammer transaction (update, layer, rollback...)
+#[derive(Serialize, Deserialize, Clone, Default)]
+pub struct Transaction {
+    /// Name of the safety snapshot, which doubles as the transaction ID
+    pub id: String,
+    pub kind: String,
+    pub started: String,
+    pub finished: Option<String>,
+    pub result: String,
+    #[serde(default)]
+    pub added: Vec<(String, String)>,
+    #[serde(default)]
+    pub removed: Vec<(String, String)>,
+    #[serde(default)]
+    pub changed: Vec<(String, String, String)>,
+    /// snapshot.debian.org timestamp that reproduces the package set
+    #[serde(default)]
+    pub mirror_snapshot: Option<String>,
+    /// (phase, seconds) in the order they ran, e.g. ("apt upgrade", 84.2)
+    #[serde(default)]
+    pub phases: Vec<(String, f64)>,
+    /// The hammer process running the transaction; None for apt runs hammer only observes
+    #[serde(default)]
+    pub pid: Option<u32>,
+}
+
+impl Transaction {
+    pub fn begin(id: &str, kind: &str) -> Self {
+        Transaction {
+            id: id.to_string(),
+            kind: kind.to_string(),
+            started: now(),
+            result: "running".to_string(),
+            pid: Some(std::process::id()),
+            ..Default::default()
+        }
+    }
+
+    pub fn set_packages(&mut self, diff: &PackageDiff) {
+        self.added = diff.added.clone();
+        self.removed = diff.removed.clone();
+        self.changed = diff.changed.clone();
+    }
+
+    /// Records how long a phase took, measured from `since`. Saved right away, so an
+    /// interrupted transaction shows how far it got.
+    pub fn phase(&mut self, name: &str, since: Instant) {
+        self.phases.push((name.to_string(), since.elapsed().as_secs_f64()));
+        let _ = save(self);
+    }
+
+    /// Still running, but the hammer process running it is gone: it was killed, or the
+    /// machine crashed or lost power
+    pub fn interrupted(&self) -> bool {
+        let alive = |pid: u32| fs::read_to_string(format!("/proc/{}/comm", pid)).is_ok_and(|comm| comm.starts_with("hammer"));
+        self.result == "running" && !self.pid.is_some_and(alive)
+    }
+
+    pub fn finish(&mut self, result: &str) -> Result<()> {
+        self.finished = Some(now());
+        self.result = result.to_string();
+        save(self)
+    }
+}
+
+fn now() -> String {
+    chrono::Local::now().format("%Y-%m-%d %H:%M:%S").to_string()
+}
+
+pub fn journal_dir() -> PathBuf {
+    Path::new(STATE_DIR).join("journal")
+}
+
+fn entry_path(id: &str) -> PathBuf {
+    journal_dir().join(format!("{}.json", id))
+}
+
+/// Extra report attached to a transaction, e.g. "changelog"
+pub fn attachment_path(id: &str, name: &str) -> PathBuf {
+    journal_dir().join(format!("{}.{}", id, name))
+}
+
+pub fn save(tx: &Transaction) -> Result<()> {
+    let json = serde_json::to_string_pretty(tx).into_diagnostic()?;
+    store::write(&entry_path(&tx.id), json)
+}
+
+pub fn attach(id: &str, name: &str, content: &str) -> Result<()> {
+    store::write(&attachment_path(id, name), content)
+}
+
+pub fn load(id: &str) -> Result<Transaction> {
+    let content = fs::read_to_string(entry_path(id))
+    .map_err(|_| HammerError::ConfigError(format!("No journal entry for '{}'", id)))?;
+    serde_json::from_str(&content).into_diagnostic()
+}
+
+pub fn read_attachment(id: &str, name: &str) -> Option<String> {
+    fs::read_to_string(attachment_path(id, name)).ok()
+}
+
+/// All transactions, oldest first
+pub fn list() -> Vec<Transaction> {
+    let mut entries: Vec<Transaction> = fs::read_dir(journal_dir())
+    .map(|dir| {
+        dir.flatten()
+        .filter(|e| e.path().extension().map(|x| x == "json").unwrap_or(false))
+        .filter_map(|e| fs::read_to_string(e.path()).ok())
+        .filter_map(|c| serde_json::from_str(&c).ok())
+        .collect()
+    })
+    .unwrap_or_default();
+    entries.sort_by(|a: &Transaction, b: &Transaction| a.started.cmp(&b.started));
+    entries
+}
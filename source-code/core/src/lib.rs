@@ -1,38 +1,101 @@
-use miette::{Diagnostic, IntoDiagnostic, Result, WrapErr};
+use miette::{Diagnostic, IntoDiagnostic, Result};
 use indicatif::{ProgressBar, ProgressStyle};
-use owo_colors::OwoColorize;
 use std::fs::{self, OpenOptions};
 use std::io::{Write};
 use std::path::Path;
-use std::process::{Command, Stdio};
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::time::Duration;
 use thiserror::Error;
 
+use output::Marker;
+
+pub mod boot_assets;
+pub mod caps;
+pub mod config;
+pub mod direct;
+pub mod events;
+pub mod exec;
+pub mod grub_btrfs;
+pub mod i18n;
+pub mod journal;
+pub mod lsm;
+pub mod output;
+pub mod overrides;
+pub mod packages;
+pub mod pool;
+pub mod state;
+pub mod storage;
+pub mod store;
+pub mod swap;
+pub mod usage;
+
 pub const LOG_DIR: &str = "/var/log/hammer";
+/// Where hammer mounts the pool when the system has no mount of it; see pool::top_level
 pub const MOUNT_POINT: &str = "/run/hammer/btrfs-root";
 
 #[derive(Error, Debug, Diagnostic)]
 pub enum HammerError {
-    #[error("Command failed: {0}")]
+    #[error("{}: {}", i18n::tr("error.command-failed"), .0)]
     #[diagnostic(code(hammer::command_failed), help("Check the output log for details."))]
     CommandFailed(String),
 
-    #[error("IO Error: {0}")]
+    #[error("{}: {}", i18n::tr("error.io"), .0)]
     #[diagnostic(code(hammer::io_error))]
     IoError(String),
 
-    #[error("Configuration Error: {0}")]
+    #[error("{}: {}", i18n::tr("error.config"), .0)]
     #[diagnostic(code(hammer::config_error))]
     ConfigError(String),
 
-    #[error("Btrfs Error: {0}")]
+    #[error("{}: {}", i18n::tr("error.btrfs"), .0)]
     #[diagnostic(code(hammer::btrfs_error), help("Ensure / is a Btrfs subvolume and layout uses @."))]
     BtrfsError(String),
 }
 
 pub struct Logger;
 
+/// Set when stdout carries machine-readable output
+static LOG_TO_STDERR: AtomicBool = AtomicBool::new(false);
+
+/// Set when messages are JSON objects, one per line, for pipelines to parse
+static LOG_JSON: AtomicBool = AtomicBool::new(false);
+
+fn print_line(line: String) {
+    if LOG_TO_STDERR.load(Ordering::Relaxed) {
+        eprintln!("{}", line);
+    } else {
+        println!("{}", line);
+    }
+}
+
+/// `line` as it is, or `message` as a JSON event when Logger::use_json was called
+fn print_event(level: &str, message: &str, line: String) {
+    if !LOG_JSON.load(Ordering::Relaxed) {
+        return print_line(line);
+    }
+    let event = serde_json::json!({
+        "time": chrono::Local::now().to_rfc3339(),
+        "level": level,
+        "message": message,
+    });
+    print_line(event.to_string());
+}
+
 impl Logger {
+    /// Sends human-readable messages to stderr, keeping stdout clean for JSON/YAML
+    pub fn use_stderr() {
+        LOG_TO_STDERR.store(true, Ordering::Relaxed);
+    }
+
+    /// Prints messages as JSON events instead of marked lines
+    pub fn use_json() {
+        LOG_JSON.store(true, Ordering::Relaxed);
+    }
+
+    pub fn json() -> bool {
+        LOG_JSON.load(Ordering::Relaxed)
+    }
+
     pub fn init() -> Result<()> {
         if !Path::new(LOG_DIR).exists() {
             fs::create_dir_all(LOG_DIR).into_diagnostic()?;
@@ -51,30 +114,37 @@ impl Logger {
     }
 
     pub fn info(message: &str) {
-        println!(" {} {}", "│".blue(), message);
+        print_event("info", message, output::marked(Marker::Info, message));
         Self::log(&format!("INFO: {}", message));
     }
 
     pub fn section(title: &str) {
-        println!("\n{} {}", "┌──".magenta(), title.magenta().bold());
+        print_event("section", title, output::marked(Marker::SectionStart, title));
     }
 
     pub fn end_section() {
-        println!("{}", "└──".magenta());
+        if Self::json() {
+            return;
+        }
+        print_line(output::marked(Marker::SectionEnd, ""));
     }
 
     pub fn error(message: &str) {
-        eprintln!(" {} {}", "✖".red(), message.red());
+        if Self::json() {
+            print_event("error", message, String::new());
+        } else {
+            eprintln!("{}", output::marked(Marker::Error, message));
+        }
         Self::log(&format!("ERROR: {}", message));
     }
 
     pub fn success(message: &str) {
-        println!(" {} {}", "✓".green(), message.green());
+        print_event("success", message, output::marked(Marker::Success, message));
         Self::log(&format!("SUCCESS: {}", message));
     }
 
     pub fn warn(message: &str) {
-        println!(" {} {}", "!".yellow(), message.yellow());
+        print_event("warn", message, output::marked(Marker::Warn, message));
         Self::log(&format!("WARN: {}", message));
     }
 }
@@ -92,6 +162,11 @@ pub fn create_progress_bar(len: u64, msg: &str) -> ProgressBar {
 }
 
 pub fn create_spinner(msg: &str) -> ProgressBar {
+    // A spinner would garble JSON logs
+    if Logger::json() {
+        Logger::info(msg);
+        return ProgressBar::hidden();
+    }
     let pb = ProgressBar::new_spinner();
     pb.set_style(
         ProgressStyle::default_spinner()
@@ -104,65 +179,140 @@ pub fn create_spinner(msg: &str) -> ProgressBar {
     pb
 }
 
+/// Runs `cmd` with exec::Exec and returns its stdout (see there for locale, logging and dry runs)
 pub fn run_command(cmd: &str, args: &[&str], description: &str) -> Result<String> {
-    Logger::log(&format!("Running: {} {}", cmd, args.join(" ")));
-
-    let output = Command::new(cmd)
-    .args(args)
-    .stdout(Stdio::piped())
-    .stderr(Stdio::piped())
-    .output()
-    .into_diagnostic()
-    .wrap_err(format!("Failed to execute binary: {}", cmd))?;
+    exec::Exec::new(cmd, args, description).output()
+}
 
-    if !output.status.success() {
-        let stderr = String::from_utf8_lossy(&output.stderr).to_string();
-        Logger::log(&format!("Command failed stderr: {}", stderr));
-        return Err(HammerError::CommandFailed(format!("{} failed: {}", description, stderr)).into());
-    }
+/// run_command for a program that changes the system; in a dry run it is only logged
+pub fn run_change(cmd: &str, args: &[&str], description: &str) -> Result<String> {
+    exec::Exec::new(cmd, args, description).changes_system().output()
+}
 
-    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+/// Btrfs and apt operations need root; read-only commands fall back to cached state
+pub fn is_root() -> bool {
+    nix::unistd::Uid::effective().is_root()
 }
 
 // --- Btrfs Helpers ---
 
-/// Mounts the top-level Btrfs root (ID 5) to a temporary location
-pub fn mount_btrfs_root() -> Result<String> {
-    if !Path::new(MOUNT_POINT).exists() {
-        fs::create_dir_all(MOUNT_POINT).into_diagnostic()?;
+/// Block device / is mounted from, or HAMMER_DEVICE
+pub fn root_device() -> Result<String> {
+    if let Some(device) = overrides::device() {
+        return Ok(device);
     }
-
-    // Identify the device / is mounted on
     let output = run_command("findmnt", &["-n", "-o", "SOURCE", "/"], "Find Root Device")?;
 
     // Fix: findmnt often returns "/dev/sda2[/@]" or similar.
     // We need just "/dev/sda2" for the mount command.
     let device_raw = output.trim();
-    let device = device_raw.split('[').next().unwrap_or(device_raw);
+    Ok(device_raw.split('[').next().unwrap_or(device_raw).to_string())
+}
+
+/// Filesystem UUID of the root device (used for fstab entries)
+pub fn root_device_uuid() -> Result<String> {
+    if let Some(device) = overrides::device() {
+        let output = run_command("blkid", &["-s", "UUID", "-o", "value", &device], "Find Device UUID")?;
+        return Ok(output.trim().to_string());
+    }
+    let output = run_command("findmnt", &["-n", "-o", "UUID", "/"], "Find Root UUID")?;
+    Ok(output.trim().to_string())
+}
+
+/// A column of findmnt for the mount holding `path`
+fn mount_field(path: &Path, field: &str) -> Result<String> {
+    let output = run_command("findmnt", &["-n", "-o", field, "--target", &path.to_string_lossy()], "Inspect Mount")?;
+    Ok(output.trim().to_string())
+}
+
+/// Fails unless / (or HAMMER_DEVICE) is on Btrfs; everything hammer changes assumes it
+pub fn ensure_btrfs_root() -> Result<()> {
+    if let Some(device) = overrides::device() {
+        let fstype = run_command("blkid", &["-s", "TYPE", "-o", "value", &device], "Inspect Device")?;
+        if fstype.trim() != "btrfs" {
+            return Err(HammerError::BtrfsError(format!("{} holds {}, not Btrfs. Nothing was changed.", device, fstype.trim())).into());
+        }
+        return Ok(());
+    }
+    let fstype = mount_field(Path::new("/"), "FSTYPE")?;
+    if fstype != "btrfs" {
+        return Err(HammerError::BtrfsError(format!("/ is on {}, not Btrfs. Nothing was changed.", fstype)).into());
+    }
+    Ok(())
+}
+
+/// Fails unless `path` is a subvolume of the filesystem / lives on. Checked before
+/// subvolumes are deleted, renamed or replaced, so a plain directory that happens to be
+/// called @update, or another disk mounted in the wrong place, is never touched.
+pub fn ensure_root_subvolume(path: &Path) -> Result<()> {
+    use std::os::unix::fs::MetadataExt;
+
+    let fstype = mount_field(path, "FSTYPE")?;
+    if fstype != "btrfs" {
+        return Err(HammerError::BtrfsError(format!("{} is on {}, not Btrfs", path.display(), fstype)).into());
+    }
+    let uuid = mount_field(path, "UUID")?;
+    let root_uuid = root_device_uuid()?;
+    if uuid != root_uuid {
+        return Err(HammerError::BtrfsError(format!(
+            "{} is on filesystem {}, not on the root filesystem {}", path.display(), uuid, root_uuid
+        )).into());
+    }
+    // The root directory of every subvolume has inode 256
+    let ino = fs::symlink_metadata(path).into_diagnostic()?.ino();
+    if ino != 256 {
+        return Err(HammerError::BtrfsError(format!("{} is a plain directory, not a subvolume", path.display())).into());
+    }
+    Ok(())
+}
+
+/// Mounts the top-level Btrfs root (ID 5) at the pool path (see pool), unless it is
+/// already there and stays mounted anyway
+pub fn mount_btrfs_root() -> Result<String> {
+    ensure_btrfs_root()?;
+    let top = pool::top_level();
+    let path = top.to_string_lossy().to_string();
+    if !pool::unmount_after_use() && pool::mounted() {
+        return Ok(path);
+    }
+    if !top.exists() {
+        fs::create_dir_all(top).into_diagnostic()?;
+    }
+
+    // Identify the device / is mounted on
+    let device = root_device()?;
+    let device = device.as_str();
 
     Logger::info(&format!("Detected root device: {}", device));
 
     // Mount subvolid=5
-    let status = Command::new("mount")
-    .args(&["-t", "btrfs", "-o", "subvolid=5", device, MOUNT_POINT])
-    .output()
-    .into_diagnostic()?;
+    let mounted = exec::Exec::new("mount", &["-t", "btrfs", "-o", "subvolid=5", device, &path], "Mount Btrfs Root").output();
 
-    if !status.status.success() {
+    if mounted.is_err() {
         // Check if already mounted
         let check = run_command("mount", &[], "Check mounts")?;
-        if check.contains(MOUNT_POINT) {
-            return Ok(MOUNT_POINT.to_string());
+        if !check.contains(&path) {
+            return Err(HammerError::BtrfsError("Failed to mount Btrfs top-level root".into()).into());
         }
-        return Err(HammerError::BtrfsError("Failed to mount Btrfs top-level root".into()).into());
     }
 
-    Ok(MOUNT_POINT.to_string())
+    // Whatever is mounted there, an earlier mount included, has to be the root filesystem
+    let uuid = mount_field(top, "UUID")?;
+    let root_uuid = root_device_uuid()?;
+    if uuid != root_uuid {
+        return Err(HammerError::BtrfsError(format!(
+            "{} holds filesystem {}, not the root filesystem {}", path, uuid, root_uuid
+        )).into());
+    }
+    Ok(path)
 }
 
 pub fn umount_btrfs_root() -> Result<()> {
+    if !pool::unmount_after_use() {
+        return Ok(());
+    }
     // Attempt unmount, but don't fail hard if it fails (it might be lazy unmounted later by OS)
-    let _ = run_command("umount", &[MOUNT_POINT], "Unmount Btrfs Root");
+    let _ = run_command("umount", &[&pool::top_level().to_string_lossy()], "Unmount Btrfs Root");
     Ok(())
 }
 
@@ -170,14 +320,18 @@ pub fn btrfs_snapshot_atomic(name: &str) -> Result<()> {
     // Requires @ layout
     mount_btrfs_root()?;
 
-    let root_subvol = Path::new(MOUNT_POINT).join("@");
-    let snap_dir = Path::new(MOUNT_POINT).join("@snapshots");
+    let root_subvol = pool::top_level().join("@");
+    let snap_dir = pool::top_level().join("@snapshots");
     let snap_target = snap_dir.join(name);
 
     if !root_subvol.exists() {
         umount_btrfs_root()?;
         return Err(HammerError::BtrfsError("Subvolume @ not found. Hammer requires @ layout.".into()).into());
     }
+    if let Err(e) = ensure_root_subvolume(&root_subvol) {
+        umount_btrfs_root()?;
+        return Err(e);
+    }
 
     if !snap_dir.exists() {
         fs::create_dir_all(&snap_dir).into_diagnostic()?;
@@ -186,15 +340,32 @@ pub fn btrfs_snapshot_atomic(name: &str) -> Result<()> {
     let src = root_subvol.to_string_lossy();
     let dest = snap_target.to_string_lossy();
 
-    run_command("btrfs", &["subvolume", "snapshot", &src, &dest], "Create Snapshot")?;
+    // Active swapfiles inside @ make the snapshot fail with ETXTBSY
+    let swap_guard = match swap::suspend_blocking_swapfiles() {
+        Ok(guard) => guard,
+        Err(e) => {
+            umount_btrfs_root()?;
+            return Err(e);
+        }
+    };
+    run_change("btrfs", &["subvolume", "snapshot", &src, &dest], "Create Snapshot")?;
+    drop(swap_guard);
 
     umount_btrfs_root()?;
+    // grub-btrfs boots snapshots with their own /boot, no ESP copies needed
+    if grub_btrfs::enabled() {
+        grub_btrfs::refresh();
+    } else {
+        boot_assets::store_for_snapshot(name)?;
+    }
+    let _ = usage::record();
+    events::emit(events::Event::SnapshotCreated, Some(name));
     Ok(())
 }
 
 pub fn btrfs_list_atomic_snapshots() -> Result<Vec<String>> {
     mount_btrfs_root()?;
-    let snap_dir = Path::new(MOUNT_POINT).join("@snapshots");
+    let snap_dir = pool::top_level().join("@snapshots");
 
     let mut snaps = Vec::new();
     if snap_dir.exists() {
@@ -211,12 +382,20 @@ pub fn btrfs_list_atomic_snapshots() -> Result<Vec<String>> {
 
 pub fn btrfs_delete_atomic_snapshot(name: &str) -> Result<()> {
     mount_btrfs_root()?;
-    let snap_path = Path::new(MOUNT_POINT).join("@snapshots").join(name);
+    let snap_path = pool::top_level().join("@snapshots").join(name);
 
     if snap_path.exists() {
-        run_command("btrfs", &["subvolume", "delete", &snap_path.to_string_lossy()], "Delete Snapshot")?;
+        if let Err(e) = ensure_root_subvolume(&snap_path) {
+            umount_btrfs_root()?;
+            return Err(e);
+        }
+        run_change("btrfs", &["subvolume", "delete", &snap_path.to_string_lossy()], "Delete Snapshot")?;
     }
 
     umount_btrfs_root()?;
+    boot_assets::remove_for_snapshot(name)?;
+    if grub_btrfs::enabled() {
+        grub_btrfs::refresh();
+    }
     Ok(())
 }
@@ -0,0 +1,180 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+
+use crate::{exec, run_change, store, Logger};
+
+/// Linux Security Modules hammer knows how to keep consistent across snapshots
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Lsm {
+    AppArmor,
+    SELinux,
+}
+
+impl Lsm {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Lsm::AppArmor => "AppArmor",
+            Lsm::SELinux => "SELinux",
+        }
+    }
+
+    /// Policy directory relative to a root filesystem
+    fn policy_dir(&self) -> &'static str {
+        match self {
+            Lsm::AppArmor => "etc/apparmor.d",
+            Lsm::SELinux => "etc/selinux",
+        }
+    }
+}
+
+pub fn active_lsms() -> Vec<Lsm> {
+    let mut lsms = Vec::new();
+
+    let apparmor = fs::read_to_string("/sys/module/apparmor/parameters/enabled").unwrap_or_default();
+    if apparmor.trim() == "Y" {
+        lsms.push(Lsm::AppArmor);
+    }
+    if Path::new("/sys/fs/selinux/enforce").exists() {
+        lsms.push(Lsm::SELinux);
+    }
+    lsms
+}
+
+/// Size and mtime of every policy file, keyed by path relative to the root
+#[derive(Default)]
+pub struct PolicySnapshot {
+    files: BTreeMap<String, (u64, i64)>,
+}
+
+#[derive(Default)]
+pub struct PolicyChanges {
+    pub added: Vec<String>,
+    pub removed: Vec<String>,
+    pub modified: Vec<String>,
+}
+
+impl PolicyChanges {
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.removed.is_empty() && self.modified.is_empty()
+    }
+}
+
+fn collect_files(dir: &Path, root: &Path, out: &mut BTreeMap<String, (u64, i64)>) {
+    let entries = match fs::read_dir(dir) {
+        Ok(e) => e,
+        Err(_) => return,
+    };
+    for entry in entries.flatten() {
+        let path = entry.path();
+        let meta = match fs::symlink_metadata(&path) {
+            Ok(m) => m,
+            Err(_) => continue,
+        };
+        if meta.is_dir() {
+            collect_files(&path, root, out);
+        } else {
+            let rel = path.strip_prefix(root).unwrap_or(&path).to_string_lossy().to_string();
+            out.insert(rel, (meta.len(), meta.mtime()));
+        }
+    }
+}
+
+pub fn capture_policy(root: &Path, lsms: &[Lsm]) -> PolicySnapshot {
+    let mut snapshot = PolicySnapshot::default();
+    for lsm in lsms {
+        collect_files(&root.join(lsm.policy_dir()), root, &mut snapshot.files);
+    }
+    snapshot
+}
+
+pub fn diff_policy(before: &PolicySnapshot, after: &PolicySnapshot) -> PolicyChanges {
+    let mut changes = PolicyChanges::default();
+    for (path, meta) in &after.files {
+        match before.files.get(path) {
+            None => changes.added.push(path.clone()),
+            Some(old) if old != meta => changes.modified.push(path.clone()),
+            _ => {}
+        }
+    }
+    for path in before.files.keys() {
+        if !after.files.contains_key(path) {
+            changes.removed.push(path.clone());
+        }
+    }
+    changes
+}
+
+/// Prints policy changes as part of the update report
+pub fn report_changes(changes: &PolicyChanges) {
+    if changes.is_empty() {
+        Logger::info("No security policy changes.");
+        return;
+    }
+    Logger::info(&format!(
+        "Security policy changes: {} added, {} modified, {} removed",
+        changes.added.len(), changes.modified.len(), changes.removed.len()
+    ));
+    for path in &changes.added {
+        Logger::info(&format!("  + /{}", path));
+    }
+    for path in &changes.modified {
+        Logger::info(&format!("  ~ /{}", path));
+    }
+    for path in &changes.removed {
+        Logger::info(&format!("  - /{}", path));
+    }
+}
+
+/// Reloads changed policy into the running kernel after a live update
+pub fn reload_policy(lsms: &[Lsm], changes: &PolicyChanges) {
+    if changes.is_empty() {
+        return;
+    }
+    for lsm in lsms {
+        let result = match lsm {
+            // Profiles removed by packages stay loaded until reboot, which is harmless
+            Lsm::AppArmor => run_change("systemctl", &["reload", "apparmor.service"], "Reload AppArmor"),
+            Lsm::SELinux => run_change("restorecon", &["-R", "/etc", "/usr", "/var/lib"], "Restore SELinux Labels"),
+        };
+        match result {
+            Ok(_) => Logger::success(&format!("{} policy reloaded.", lsm.name())),
+            Err(_) => Logger::warn(&format!("{} policy reload failed. It will be applied on next boot.", lsm.name())),
+        }
+    }
+}
+
+/// Makes a freshly restored root relabel/recompile its policy on first boot.
+/// Labels and cached profiles in a snapshot may not match the policy it boots with.
+pub fn prepare_first_boot(root: &Path, lsms: &[Lsm]) {
+    for lsm in lsms {
+        match lsm {
+            Lsm::SELinux => {
+                let marker = root.join(".autorelabel");
+                if exec::dry_run() {
+                    Logger::info(&format!("Dry run, not scheduling SELinux relabel: {}", marker.display()));
+                    continue;
+                }
+                match store::write(&marker, "") {
+                    Ok(()) => Logger::info("SELinux relabel scheduled for first boot."),
+                    Err(e) => Logger::warn(&format!("SELinux relabel not scheduled: {}", e)),
+                }
+            }
+            Lsm::AppArmor => {
+                let cache = root.join("var/cache/apparmor");
+                if !cache.exists() {
+                    continue;
+                }
+                if exec::dry_run() {
+                    Logger::info(&format!("Dry run, not clearing the AppArmor profile cache: {}", cache.display()));
+                    continue;
+                }
+                match fs::remove_dir_all(&cache).and_then(|_| fs::create_dir_all(&cache)) {
+                    Ok(()) => Logger::info("AppArmor profile cache cleared; profiles recompile on first boot."),
+                    Err(e) => Logger::warn(&format!("AppArmor profile cache not cleared ({}): {}", cache.display(), e)),
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,177 @@
+use owo_colors::{OwoColorize, Style};
+use std::fmt::Display;
+use std::io::IsTerminal;
+use std::sync::OnceLock;
+
+// Everything hammer prints for people goes through here, so color and glyphs
+// follow the terminal: NO_COLOR (https://no-color.org) and TERM=dumb turn color
+// off, CLICOLOR_FORCE turns it on, and output into a pipe or file is plain.
+
+/// What a piece of text means; each tone maps to one color
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Tone {
+    Good,
+    Warn,
+    Bad,
+    Info,
+    Accent,
+    Muted,
+    Heading,
+    Strong,
+}
+
+impl Tone {
+    fn style(self) -> Style {
+        match self {
+            Tone::Good => Style::new().green(),
+            Tone::Warn => Style::new().yellow(),
+            Tone::Bad => Style::new().red(),
+            Tone::Info => Style::new().blue(),
+            Tone::Accent => Style::new().cyan(),
+            Tone::Muted => Style::new().bright_black(),
+            Tone::Heading => Style::new().magenta().bold(),
+            Tone::Strong => Style::new().bold(),
+        }
+    }
+}
+
+/// Line prefixes of the Logger
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Marker {
+    Info,
+    Success,
+    Warn,
+    Error,
+    SectionStart,
+    SectionEnd,
+}
+
+impl Marker {
+    fn glyph(self) -> &'static str {
+        match (self, fancy()) {
+            (Marker::Info, true) => "│",
+            (Marker::Success, true) => "✓",
+            (Marker::Warn, true) => "!",
+            (Marker::Error, true) => "✖",
+            (Marker::SectionStart, true) => "┌──",
+            (Marker::SectionEnd, true) => "└──",
+            (Marker::Info, false) => " ",
+            (Marker::Success, false) => "+",
+            (Marker::Warn, false) => "!",
+            (Marker::Error, false) => "x",
+            (Marker::SectionStart, false) => "==",
+            (Marker::SectionEnd, false) => "",
+        }
+    }
+
+    fn tone(self) -> Tone {
+        match self {
+            Marker::Info => Tone::Info,
+            Marker::Success => Tone::Good,
+            Marker::Warn => Tone::Warn,
+            Marker::Error => Tone::Bad,
+            Marker::SectionStart | Marker::SectionEnd => Tone::Heading,
+        }
+    }
+}
+
+fn env_set(name: &str) -> bool {
+    std::env::var_os(name).is_some_and(|v| !v.is_empty() && v != "0")
+}
+
+/// Whether escape codes are written. Decided once per process.
+pub fn color() -> bool {
+    static COLOR: OnceLock<bool> = OnceLock::new();
+    *COLOR.get_or_init(|| {
+        if env_set("NO_COLOR") {
+            false
+        } else if env_set("CLICOLOR_FORCE") {
+            true
+        } else {
+            std::env::var("TERM").map_or(true, |t| t != "dumb") && std::io::stdout().is_terminal()
+        }
+    })
+}
+
+/// Whether stdout is a terminal that gets box-drawing glyphs instead of ASCII
+pub fn fancy() -> bool {
+    static FANCY: OnceLock<bool> = OnceLock::new();
+    *FANCY.get_or_init(|| {
+        std::env::var("TERM").map_or(true, |t| t != "dumb") && std::io::stdout().is_terminal()
+    })
+}
+
+/// `text` in the color of `tone`, or unchanged when color is off
+pub fn paint(text: impl Display, tone: Tone) -> String {
+    paint_style(text, tone.style())
+}
+
+/// `text` in a one-off style (help screen, banners), or unchanged when color is off
+pub fn paint_style(text: impl Display, style: Style) -> String {
+    if color() {
+        text.style(style).to_string()
+    } else {
+        text.to_string()
+    }
+}
+
+/// `text` with the prefix of `marker`, the message itself colored for success, warnings and errors
+pub fn marked(marker: Marker, text: &str) -> String {
+    let glyph = paint(marker.glyph(), marker.tone());
+    match marker {
+        Marker::Info => format!(" {} {}", glyph, text),
+        Marker::Success | Marker::Warn | Marker::Error => format!(" {} {}", glyph, paint(text, marker.tone())),
+        Marker::SectionStart => format!("\n{} {}", glyph, paint(text, Tone::Heading)),
+        Marker::SectionEnd => glyph.to_string(),
+    }
+}
+
+/// Tone of a deployment state word as shown by status and the plumbing commands
+pub fn state_tone(state: &str) -> Tone {
+    match state {
+        "booted" => Tone::Good,
+        "default" | "staged" => Tone::Accent,
+        "pinned" => Tone::Warn,
+        "bad" | "broken" | "failed" => Tone::Bad,
+        _ => Tone::Muted,
+    }
+}
+
+/// Columns of printable width, skipping escape sequences
+fn width(cell: &str) -> usize {
+    let mut count = 0;
+    let mut escape = false;
+    for c in cell.chars() {
+        match (escape, c) {
+            (false, '\x1b') => escape = true,
+            (true, 'm') => escape = false,
+            (true, _) => {}
+            (false, _) => count += 1,
+        }
+    }
+    count
+}
+
+/// Prints `rows` as left-aligned columns; the first row is the header.
+/// Cells may already be painted, padding goes by their visible width.
+pub fn print_table(rows: &[Vec<String>]) {
+    if rows.is_empty() {
+        return;
+    }
+    let widths: Vec<usize> = (0..rows[0].len())
+    .map(|col| rows.iter().map(|r| width(&r[col])).max().unwrap_or(0))
+    .collect();
+    for (i, row) in rows.iter().enumerate() {
+        let line: Vec<String> = row
+        .iter()
+        .zip(&widths)
+        .map(|(cell, w)| format!("{}{}", cell, " ".repeat(w - width(cell))))
+        .collect();
+        let line = line.join("  ").trim_end().to_string();
+        if i == 0 {
+            println!("{}", paint(line, Tone::Strong));
+        } else {
+            println!("{}", line);
+        }
+    }
+}
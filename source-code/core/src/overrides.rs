@@ -0,0 +1,63 @@
+use std::env;
+use std::path::PathBuf;
+
+use crate::config::CONFIG_PATH;
+use crate::exec::DRY_RUN_ENV;
+
+// Environment variables that stand in for flags and hammer.toml settings, so containers
+// and CI jobs can drive every hammer binary without managing either. They win over the
+// configuration file; `hammer env` lists them with their current values.
+
+pub const CONFIG_ENV: &str = "HAMMER_CONFIG";
+pub const DEVICE_ENV: &str = "HAMMER_DEVICE";
+pub const MOUNTPOINT_ENV: &str = "HAMMER_MOUNTPOINT";
+pub const ASSUME_YES_ENV: &str = "HAMMER_ASSUME_YES";
+pub const JSON_ENV: &str = "HAMMER_JSON";
+
+/// (name, what it does), in the order `hammer env` prints them
+pub const VARS: &[(&str, &str)] = &[
+    (CONFIG_ENV, "hammer.toml to read instead of /etc/hammer/hammer.toml"),
+    (DEVICE_ENV, "Btrfs device holding the deployments, instead of the one / is mounted from"),
+    (MOUNTPOINT_ENV, "Where the top level of that device is mounted or found; overrides [pool] mount"),
+    (ASSUME_YES_ENV, "1 answers yes to every confirmation"),
+    (JSON_ENV, "1 prints JSON: -o json for commands with an output format, JSON log events for the rest"),
+    (DRY_RUN_ENV, "1 only logs the commands that would change the system"),
+];
+
+fn value(name: &str) -> Option<String> {
+    env::var(name).ok().filter(|v| !v.is_empty())
+}
+
+/// 1, true and yes switch a flag variable on
+fn flag(name: &str) -> bool {
+    value(name).is_some_and(|v| matches!(v.to_ascii_lowercase().as_str(), "1" | "true" | "yes"))
+}
+
+pub fn config_path() -> PathBuf {
+    PathBuf::from(value(CONFIG_ENV).unwrap_or_else(|| CONFIG_PATH.to_string()))
+}
+
+pub fn device() -> Option<String> {
+    value(DEVICE_ENV)
+}
+
+pub fn mountpoint() -> Option<String> {
+    value(MOUNTPOINT_ENV)
+}
+
+pub fn assume_yes() -> bool {
+    flag(ASSUME_YES_ENV)
+}
+
+pub fn json() -> bool {
+    flag(JSON_ENV)
+}
+
+pub fn dry_run() -> bool {
+    flag(DRY_RUN_ENV)
+}
+
+/// (name, value) of every variable, None when unset
+pub fn current() -> Vec<(&'static str, Option<String>)> {
+    VARS.iter().map(|(name, _)| (*name, value(name))).collect()
+}
@@ -0,0 +1,66 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::Path;
+
+/// Installed packages (name -> version) from a root's dpkg database
+pub fn installed_packages(root: &Path) -> BTreeMap<String, String> {
+    let content = fs::read_to_string(root.join("var/lib/dpkg/status")).unwrap_or_default();
+    let mut packages = BTreeMap::new();
+
+    // Paragraphs are separated by blank lines
+    for paragraph in content.split("\n\n") {
+        let mut name = None;
+        let mut version = None;
+        let mut installed = false;
+        for line in paragraph.lines() {
+            if let Some(v) = line.strip_prefix("Package: ") {
+                name = Some(v.trim().to_string());
+            } else if let Some(v) = line.strip_prefix("Version: ") {
+                version = Some(v.trim().to_string());
+            } else if let Some(v) = line.strip_prefix("Status: ") {
+                installed = v.trim().ends_with(" installed");
+            }
+        }
+        if let (Some(n), Some(v), true) = (name, version, installed) {
+            packages.insert(n, v);
+        }
+    }
+    packages
+}
+
+#[derive(Default)]
+pub struct PackageDiff {
+    pub added: Vec<(String, String)>,
+    pub removed: Vec<(String, String)>,
+    /// name, old version, new version
+    pub changed: Vec<(String, String, String)>,
+}
+
+impl PackageDiff {
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.removed.is_empty() && self.changed.is_empty()
+    }
+
+    /// Compact "+3 ~41 -0" summary
+    pub fn summary(&self) -> String {
+        format!("+{} ~{} -{}", self.added.len(), self.changed.len(), self.removed.len())
+    }
+}
+
+/// Differences going from `from` to `to`
+pub fn diff(from: &BTreeMap<String, String>, to: &BTreeMap<String, String>) -> PackageDiff {
+    let mut result = PackageDiff::default();
+    for (name, version) in to {
+        match from.get(name) {
+            None => result.added.push((name.clone(), version.clone())),
+            Some(old) if old != version => result.changed.push((name.clone(), old.clone(), version.clone())),
+            _ => {}
+        }
+    }
+    for (name, version) in from {
+        if !to.contains_key(name) {
+            result.removed.push((name.clone(), version.clone()));
+        }
+    }
+    result
+}
@@ -0,0 +1,71 @@
+use std::path::{Path, PathBuf};
+use std::sync::OnceLock;
+
+use crate::{config, overrides, root_device_uuid, run_command, MOUNT_POINT};
+
+// The pool is the top-level subvolume (ID 5) holding @, @snapshots and the other
+// deployments. Many layouts already mount it (/.btrfs, /mnt/pool); hammer then works
+// through that mount and leaves it alone. Otherwise it mounts the pool itself.
+
+struct Pool {
+    path: PathBuf,
+    /// Mounted by hammer, as opposed to a mount the system already had
+    managed: bool,
+    keep_mounted: bool,
+}
+
+/// Whether `path` is a mount point of the top level of the filesystem `uuid`
+fn is_top_level_mount(path: &Path, uuid: &str) -> bool {
+    run_command("findmnt", &["-n", "-o", "UUID,FSROOT", "--mountpoint", &path.to_string_lossy()], "Inspect Pool Mount")
+    .map(|out| out.lines().any(|l| l.split_whitespace().collect::<Vec<_>>() == [uuid, "/"]))
+    .unwrap_or(false)
+}
+
+/// An existing mount of the top level of the root filesystem, hammer's own excluded
+fn detect(uuid: &str) -> Option<PathBuf> {
+    let out = run_command("findmnt", &["-rn", "-t", "btrfs", "-o", "TARGET,UUID,FSROOT"], "Find Pool Mount").ok()?;
+    out.lines()
+    .map(|l| l.split_whitespace().collect::<Vec<_>>())
+    .find(|f| f.len() == 3 && f[1] == uuid && f[2] == "/" && f[0] != MOUNT_POINT)
+    .map(|f| PathBuf::from(f[0]))
+}
+
+fn pool() -> &'static Pool {
+    static POOL: OnceLock<Pool> = OnceLock::new();
+    POOL.get_or_init(|| {
+        let mut cfg = config::load().map(|c| c.pool).unwrap_or_default();
+        if let Some(mountpoint) = overrides::mountpoint() {
+            cfg.mount = mountpoint;
+        }
+        let uuid = root_device_uuid().unwrap_or_default();
+        let existing = |path: &Path| !uuid.is_empty() && is_top_level_mount(path, &uuid);
+        let (path, managed) = if !cfg.mount.is_empty() {
+            let path = PathBuf::from(&cfg.mount);
+            let managed = !existing(&path);
+            (path, managed)
+        } else if let Some(path) = detect(&uuid).filter(|_| cfg.autodetect) {
+            (path, false)
+        } else {
+            (PathBuf::from(MOUNT_POINT), true)
+        };
+        Pool { path, managed, keep_mounted: cfg.keep_mounted }
+    })
+}
+
+/// Where @, @snapshots/NAME and the other subvolumes are reached while the pool is mounted
+pub fn top_level() -> &'static Path {
+    &pool().path
+}
+
+/// Whether the top level of the root filesystem is mounted at the pool path
+pub fn mounted() -> bool {
+    let uuid = root_device_uuid().unwrap_or_default();
+    !uuid.is_empty() && is_top_level_mount(top_level(), &uuid)
+}
+
+/// Whether umount_btrfs_root should unmount the pool: only hammer's own mounts
+/// without keep_mounted; a mount the system made stays
+pub fn unmount_after_use() -> bool {
+    let pool = pool();
+    pool.managed && !pool.keep_mounted
+}
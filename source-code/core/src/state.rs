@@ -0,0 +1,104 @@
+use miette::{IntoDiagnostic, Result};
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::Path;
+
+use crate::{run_change, store};
+
+/// Persistent hammer state (pins, metadata). Lives inside @, so rollbacks carry it over explicitly.
+pub const STATE_DIR: &str = "/var/lib/hammer";
+
+fn pins_file() -> std::path::PathBuf {
+    Path::new(STATE_DIR).join("pinned")
+}
+
+/// Snapshots protected from cleanup
+pub fn pinned_snapshots() -> Vec<String> {
+    fs::read_to_string(pins_file())
+    .unwrap_or_default()
+    .lines()
+    .map(|l| l.trim().to_string())
+    .filter(|l| !l.is_empty())
+    .collect()
+}
+
+pub fn is_pinned(name: &str) -> bool {
+    pinned_snapshots().iter().any(|p| p == name)
+}
+
+pub fn set_pinned(name: &str, pinned: bool) -> Result<()> {
+    let mut pins = pinned_snapshots();
+    pins.retain(|p| p != name);
+    if pinned {
+        pins.push(name.to_string());
+    }
+    pins.sort();
+
+    let mut content = pins.join("\n");
+    if !content.is_empty() {
+        content.push('\n');
+    }
+    store::write(&pins_file(), content)
+}
+
+fn aliases_file() -> std::path::PathBuf {
+    Path::new(STATE_DIR).join("aliases")
+}
+
+/// Names given to snapshots with `hammer alias set`: alias -> snapshot
+pub fn aliases() -> BTreeMap<String, String> {
+    fs::read_to_string(aliases_file())
+    .unwrap_or_default()
+    .lines()
+    .filter_map(|l| l.split_once(' '))
+    .map(|(alias, snapshot)| (alias.trim().to_string(), snapshot.trim().to_string()))
+    .collect()
+}
+
+/// Points `alias` at `snapshot`, or removes it with None
+pub fn set_alias(alias: &str, snapshot: Option<&str>) -> Result<()> {
+    let mut aliases = aliases();
+    match snapshot {
+        Some(s) => aliases.insert(alias.to_string(), s.to_string()),
+        None => aliases.remove(alias),
+    };
+
+    let content: String = aliases.iter().map(|(a, s)| format!("{} {}\n", a, s)).collect();
+    store::write(&aliases_file(), content)
+}
+
+fn layer_file() -> std::path::PathBuf {
+    Path::new(STATE_DIR).join("layered")
+}
+
+/// Packages `hammer layer add` keeps installed on top of every new base deployment
+pub fn layered_packages() -> Vec<String> {
+    fs::read_to_string(layer_file())
+    .unwrap_or_default()
+    .lines()
+    .map(|l| l.trim().to_string())
+    .filter(|l| !l.is_empty())
+    .collect()
+}
+
+/// Replaces the persistent package layer with `packages`
+pub fn set_layered(packages: &[String]) -> Result<()> {
+    let mut packages = packages.to_vec();
+    packages.sort();
+    packages.dedup();
+    let content: String = packages.iter().map(|p| format!("{}\n", p)).collect();
+    store::write(&layer_file(), content)
+}
+
+/// Copies the current state into a restored root so a rollback does not rewind it
+pub fn carry_over(new_root: &Path) -> Result<()> {
+    let src = Path::new(STATE_DIR);
+    if !src.exists() {
+        return Ok(());
+    }
+    let dest = new_root.join(STATE_DIR.trim_start_matches('/'));
+    fs::create_dir_all(&dest).into_diagnostic()?;
+    // Includes subdirectories such as the journal
+    run_change("cp", &["-a", &format!("{}/.", STATE_DIR), &dest.to_string_lossy()], "Carry Over State")?;
+    Ok(())
+}
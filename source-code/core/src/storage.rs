@@ -0,0 +1,327 @@
+use miette::{IntoDiagnostic, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::config::{self, StorageKind};
+use crate::{
+    btrfs_delete_atomic_snapshot, btrfs_list_atomic_snapshots, btrfs_snapshot_atomic, ensure_root_subvolume, events, lsm,
+    mount_btrfs_root, pool, run_change, run_command, state, store, umount_btrfs_root, usage, HammerError, Logger,
+};
+
+// Snapshots of the root and switching to one of them, per backend. Btrfs is the full
+// implementation; what works on subvolumes directly (staged updates, status, diff,
+// export) stays Btrfs-only. ZFS and LVM-thin cover snapshot, list, delete and
+// rollback and are experimental. Overlay brings snapshots to ext4 and other plain
+// filesystems with weaker guarantees: a snapshot is a copy of the upper layer taken
+// while the system runs, and only the packages' changes since the base are covered.
+
+/// Name prefix and tag of the logical volumes hammer creates; other snapshots are left alone
+const LVM_PREFIX: &str = "hammer-";
+const LVM_TAG: &str = "hammer";
+
+/// Where a new ZFS boot environment is mounted to carry the hammer state into it
+const ZFS_STAGING: &str = "/run/hammer/zfs-next";
+
+/// The real root, read-only; the lower layer of / (mounted by the hammer-overlay initramfs script)
+pub const OVERLAY_LOWER: &str = "/run/hammer/lower";
+/// The layers filesystem: active/, staged/, snapshots/NAME/ and `next`
+pub const OVERLAY_LAYERS: &str = "/run/hammer/layers";
+/// Where the staged upper layer is mounted over the real root while an update runs
+const OVERLAY_STAGING: &str = "/run/hammer/overlay-next";
+/// `next` naming this boots staged/ rather than a copy of a snapshot
+const OVERLAY_NEXT_STAGED: &str = "@staged";
+
+pub enum Driver {
+    Btrfs,
+    /// `dataset` is the root filesystem, e.g. rpool/ROOT/hackeros
+    Zfs { dataset: String },
+    /// The thin root volume `vg`/`lv`
+    LvmThin { vg: String, lv: String },
+    /// / is an overlay of the real root and `layers`/active/upper
+    Overlay { layers: PathBuf },
+}
+
+impl Driver {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Driver::Btrfs => "btrfs",
+            Driver::Zfs { .. } => "zfs",
+            Driver::LvmThin { .. } => "lvm-thin",
+            Driver::Overlay { .. } => "overlay",
+        }
+    }
+
+    /// Whether the staged executors (chroot, nspawn, podman) can build a new root on it
+    pub fn supports_staging(&self) -> bool {
+        matches!(self, Driver::Btrfs | Driver::Overlay { .. })
+    }
+
+    /// Whether rollback overwrites the current root instead of keeping it (@bad-*, the old dataset)
+    pub fn replaces_root(&self) -> bool {
+        matches!(self, Driver::LvmThin { .. })
+    }
+
+    /// Snapshot of the running root called `name`
+    pub fn snapshot(&self, name: &str) -> Result<()> {
+        match self {
+            Driver::Btrfs => return btrfs_snapshot_atomic(name),
+            Driver::Zfs { dataset } => {
+                run_change("zfs", &["snapshot", &format!("{}@{}", dataset, name)], "Create ZFS Snapshot")?;
+            }
+            Driver::LvmThin { vg, lv } => {
+                run_change("lvcreate", &[
+                    "--snapshot", "--name", &format!("{}{}", LVM_PREFIX, name),
+                    "--addtag", LVM_TAG, &format!("{}/{}", vg, lv),
+                ], "Create LVM Snapshot")?;
+            }
+            Driver::Overlay { layers } => {
+                let target = layers.join("snapshots").join(name);
+                if target.exists() {
+                    return Err(HammerError::CommandFailed(format!("Snapshot {} already exists", name)).into());
+                }
+                fs::create_dir_all(&target).into_diagnostic()?;
+                let _ = run_command("sync", &[], "Sync Filesystems");
+                run_change("cp", &[
+                    "-a", "--reflink=auto",
+                    &layers.join("active/upper").to_string_lossy(),
+                    &target.join("upper").to_string_lossy(),
+                ], "Copy Overlay Layer")?;
+            }
+        }
+        let _ = usage::record();
+        events::emit(events::Event::SnapshotCreated, Some(name));
+        Ok(())
+    }
+
+    /// Snapshot names, sorted
+    pub fn list(&self) -> Result<Vec<String>> {
+        let mut names: Vec<String> = match self {
+            Driver::Btrfs => return btrfs_list_atomic_snapshots(),
+            Driver::Zfs { dataset } => {
+                let prefix = format!("{}@", dataset);
+                run_command("zfs", &["list", "-H", "-t", "snapshot", "-d", "1", "-o", "name", dataset], "List ZFS Snapshots")?
+                .lines()
+                .filter_map(|l| l.trim().strip_prefix(&prefix))
+                .map(String::from)
+                .collect()
+            }
+            Driver::LvmThin { vg, .. } => {
+                run_command("lvs", &["--noheadings", "-o", "lv_name", "--select", &format!("lv_tags={}", LVM_TAG), vg], "List LVM Snapshots")?
+                .lines()
+                .filter_map(|l| l.trim().strip_prefix(LVM_PREFIX))
+                .map(String::from)
+                .collect()
+            }
+            Driver::Overlay { layers } => {
+                fs::read_dir(layers.join("snapshots"))
+                .map(|entries| {
+                    entries.flatten()
+                    .filter(|e| e.path().join("upper").is_dir())
+                    .map(|e| e.file_name().to_string_lossy().to_string())
+                    .collect()
+                })
+                .unwrap_or_default()
+            }
+        };
+        names.sort();
+        Ok(names)
+    }
+
+    pub fn delete(&self, name: &str) -> Result<()> {
+        match self {
+            Driver::Btrfs => btrfs_delete_atomic_snapshot(name)?,
+            Driver::Zfs { dataset } => {
+                run_change("zfs", &["destroy", &format!("{}@{}", dataset, name)], "Delete ZFS Snapshot")?;
+            }
+            Driver::LvmThin { vg, .. } => {
+                run_change("lvremove", &["-y", &format!("{}/{}{}", vg, LVM_PREFIX, name)], "Delete LVM Snapshot")?;
+            }
+            Driver::Overlay { layers } => {
+                if fs::read_to_string(layers.join("next")).is_ok_and(|next| next.trim() == name) {
+                    return Err(HammerError::CommandFailed(format!("{} is the root of the next boot", name)).into());
+                }
+                fs::remove_dir_all(layers.join("snapshots").join(name)).into_diagnostic()?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Makes snapshot `name` the root of the next boot
+    pub fn rollback(&self, name: &str) -> Result<()> {
+        match self {
+            Driver::Btrfs => btrfs_rollback(name),
+            Driver::Zfs { dataset } => zfs_rollback(dataset, name),
+            Driver::LvmThin { vg, .. } => {
+                // The origin is in use, so LVM merges on its next activation, i.e. the reboot
+                run_change("lvconvert", &["--merge", &format!("{}/{}{}", vg, LVM_PREFIX, name)], "Merge LVM Snapshot")?;
+                Logger::warn("The merge takes the whole root back, hammer's pins and journal included.");
+                Ok(())
+            }
+            Driver::Overlay { layers } => {
+                if !layers.join("snapshots").join(name).join("upper").is_dir() {
+                    return Err(HammerError::CommandFailed(format!("Snapshot {} not found", name)).into());
+                }
+                store::write(&layers.join("next"), format!("{}\n", name))?;
+                Logger::info("At the next boot the active layer is kept as a snapshot and a copy of this one replaces it.");
+                Ok(())
+            }
+        }
+    }
+
+    /// Writable root for a staged update; only drivers without their own staging code (overlay)
+    pub fn stage(&self) -> Result<PathBuf> {
+        let layers = self.overlay_layers()?;
+        let staged = layers.join("staged");
+        if fs::read_to_string(layers.join("next")).is_ok_and(|next| next.trim() == OVERLAY_NEXT_STAGED) {
+            fs::remove_file(layers.join("next")).into_diagnostic()?;
+        }
+        if staged.exists() {
+            fs::remove_dir_all(&staged).into_diagnostic()?;
+        }
+        fs::create_dir_all(staged.join("work")).into_diagnostic()?;
+        let _ = run_command("sync", &[], "Sync Filesystems");
+        run_change("cp", &[
+            "-a", "--reflink=auto",
+            &layers.join("active/upper").to_string_lossy(),
+            &staged.join("upper").to_string_lossy(),
+        ], "Copy Active Layer")?;
+
+        fs::create_dir_all(OVERLAY_STAGING).into_diagnostic()?;
+        let options = format!(
+            "lowerdir={},upperdir={},workdir={}",
+            OVERLAY_LOWER,
+            staged.join("upper").display(),
+            staged.join("work").display()
+        );
+        run_change("mount", &["-t", "overlay", "overlay", "-o", &options, OVERLAY_STAGING], "Mount Staged Overlay")?;
+        Ok(PathBuf::from(OVERLAY_STAGING))
+    }
+
+    /// Drops what `stage` built
+    pub fn discard_staged(&self) -> Result<()> {
+        let layers = self.overlay_layers()?;
+        let _ = run_change("umount", &[OVERLAY_STAGING], "Unmount Staged Overlay");
+        let staged = layers.join("staged");
+        if staged.exists() {
+            fs::remove_dir_all(&staged).into_diagnostic()?;
+        }
+        Ok(())
+    }
+
+    /// Boots what `stage` built next time; the active layer is kept as a snapshot
+    pub fn promote_staged(&self) -> Result<()> {
+        let layers = self.overlay_layers()?;
+        run_change("umount", &[OVERLAY_STAGING], "Unmount Staged Overlay")?;
+        store::write(&layers.join("next"), format!("{}\n", OVERLAY_NEXT_STAGED))?;
+        Ok(())
+    }
+
+    fn overlay_layers(&self) -> Result<&Path> {
+        match self {
+            Driver::Overlay { layers } => Ok(layers),
+            _ => Err(HammerError::ConfigError(format!("The {} driver stages updates itself", self.name())).into()),
+        }
+    }
+}
+
+/// @ becomes @bad-<date> and a writable copy of the snapshot becomes @
+fn btrfs_rollback(name: &str) -> Result<()> {
+    mount_btrfs_root()?;
+    let top = pool::top_level();
+    let source = top.join("@snapshots").join(name);
+    let checked = ensure_root_subvolume(&top.join("@")).and_then(|_| ensure_root_subvolume(&source));
+    if let Err(e) = checked {
+        umount_btrfs_root()?;
+        return Err(e);
+    }
+
+    let timestamp = chrono::Local::now().format("%Y%m%d-%H%M%S");
+    let new_root = top.join("@");
+    run_change("mv", &[
+        &new_root.to_string_lossy(),
+        &top.join(format!("@bad-{}", timestamp)).to_string_lossy(),
+    ], "Rename current @")?;
+    run_change("btrfs", &[
+        "subvolume", "snapshot",
+        &source.to_string_lossy(),
+        &new_root.to_string_lossy(),
+    ], "Restore Snapshot to @")?;
+
+    lsm::prepare_first_boot(&new_root, &lsm::active_lsms());
+    state::carry_over(&new_root)?;
+    umount_btrfs_root()
+}
+
+/// A clone of the snapshot next to the root dataset becomes the pool's boot filesystem;
+/// the current dataset stays as it is
+fn zfs_rollback(dataset: &str, name: &str) -> Result<()> {
+    let parent = dataset.rsplit_once('/').map(|(p, _)| p).unwrap_or(dataset);
+    let zpool = dataset.split('/').next().unwrap_or(dataset);
+    let clone = format!("{}/{}", parent, name);
+    run_change("zfs", &[
+        "clone", "-o", "canmount=noauto", "-o", "mountpoint=/",
+        &format!("{}@{}", dataset, name), &clone,
+    ], "Clone ZFS Snapshot")?;
+
+    fs::create_dir_all(ZFS_STAGING).into_diagnostic()?;
+    run_change("mount", &["-t", "zfs", "-o", "zfsutil", &clone, ZFS_STAGING], "Mount Boot Environment")?;
+    let carried = state::carry_over(Path::new(ZFS_STAGING));
+    let _ = run_change("umount", &[ZFS_STAGING], "Unmount Boot Environment");
+    carried?;
+
+    run_change("zpool", &["set", &format!("bootfs={}", clone), zpool], "Set Boot Filesystem")?;
+    Logger::info(&format!("{} is the boot filesystem of {}; {} is kept.", clone, zpool, dataset));
+    Ok(())
+}
+
+fn root_mount() -> Result<(String, String)> {
+    let out = run_command("findmnt", &["-n", "-o", "FSTYPE,SOURCE", "/"], "Find Root Filesystem")?;
+    let mut fields = out.split_whitespace();
+    let fstype = fields.next().unwrap_or_default().to_string();
+    let source = fields.next().unwrap_or_default().to_string();
+    Ok((fstype, source))
+}
+
+/// Whether the initramfs script set up / as an overlay with the layers filesystem
+fn overlay_active() -> bool {
+    Path::new(OVERLAY_LAYERS).join("active/upper").is_dir() && Path::new(OVERLAY_LOWER).is_dir()
+}
+
+/// (VG, LV) of a device when it is a thin logical volume
+fn thin_volume(device: &str) -> Option<(String, String)> {
+    let out = run_command("lvs", &["--noheadings", "-o", "vg_name,lv_name,pool_lv", device], "Inspect Root Volume").ok()?;
+    match out.split_whitespace().collect::<Vec<_>>().as_slice() {
+        [vg, lv, _pool] => Some((vg.to_string(), lv.to_string())),
+        _ => None,
+    }
+}
+
+/// The driver `[storage] driver` names, or the one matching the root filesystem
+pub fn driver() -> Result<Driver> {
+    let kind = config::load()?.storage.driver;
+    let (fstype, source) = root_mount()?;
+    let kind = match kind {
+        StorageKind::Auto => match fstype.as_str() {
+            "zfs" => StorageKind::Zfs,
+            "overlay" if overlay_active() => StorageKind::Overlay,
+            _ if fstype != "btrfs" && thin_volume(&source).is_some() => StorageKind::LvmThin,
+            _ => StorageKind::Btrfs,
+        },
+        kind => kind,
+    };
+    match kind {
+        StorageKind::Zfs if fstype != "zfs" => {
+            Err(HammerError::ConfigError(format!("[storage] driver is zfs, but / is on {}", fstype)).into())
+        }
+        StorageKind::Zfs => Ok(Driver::Zfs { dataset: source }),
+        StorageKind::LvmThin => match thin_volume(&source) {
+            Some((vg, lv)) => Ok(Driver::LvmThin { vg, lv }),
+            None => Err(HammerError::ConfigError(format!("[storage] driver is lvm-thin, but {} is not a thin volume", source)).into()),
+        },
+        StorageKind::Overlay if fstype != "overlay" || !overlay_active() => Err(HammerError::ConfigError(
+            "[storage] driver is overlay, but / is not the hammer overlay; install the hammer-overlay initramfs script and reboot".to_string()
+        ).into()),
+        StorageKind::Overlay => Ok(Driver::Overlay { layers: PathBuf::from(OVERLAY_LAYERS) }),
+        _ => Ok(Driver::Btrfs),
+    }
+}
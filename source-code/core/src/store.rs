@@ -0,0 +1,127 @@
+use miette::{IntoDiagnostic, Result, WrapErr};
+use std::fs::{self, File, OpenOptions};
+use std::io::Write;
+use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
+use std::path::{Path, PathBuf};
+
+use crate::journal::journal_dir;
+use crate::state::STATE_DIR;
+use crate::Logger;
+
+// Crash-safe writes for hammer's state. A file is written under a temporary name next to
+// it, flushed to disk, renamed over the old one, and the rename flushed as well, so after
+// a power cut it holds either the old content or the new, never part of each. The layout
+// of /var/lib/hammer carries a schema version; `upgrade` brings state written by an older
+// hammer up to date before a command changes anything.
+
+/// Version of the state layout this hammer writes
+pub const SCHEMA_VERSION: u32 = 1;
+const SCHEMA_FILE: &str = "schema-version";
+/// Suffix of the temporary files; one left behind was cut short by a crash
+const TMP_SUFFIX: &str = ".hammer-tmp";
+
+fn tmp_path(path: &Path) -> PathBuf {
+    let name = path.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+    path.with_file_name(format!(".{}{}", name, TMP_SUFFIX))
+}
+
+/// Replaces `path` with `content` atomically, mode 0644
+pub fn write(path: &Path, content: impl AsRef<[u8]>) -> Result<()> {
+    write_mode(path, content, 0o644)
+}
+
+/// Replaces `path` with `content` atomically; the file has exactly `mode`, from the start
+pub fn write_mode(path: &Path, content: impl AsRef<[u8]>, mode: u32) -> Result<()> {
+    let dir = path.parent().unwrap_or(Path::new("/"));
+    fs::create_dir_all(dir).into_diagnostic()?;
+    let tmp = tmp_path(path);
+    let written = (|| -> std::io::Result<()> {
+        let mut file = OpenOptions::new().write(true).create(true).truncate(true).mode(mode).open(&tmp)?;
+        file.write_all(content.as_ref())?;
+        // mode() is subject to the umask
+        file.set_permissions(fs::Permissions::from_mode(mode))?;
+        file.sync_all()?;
+        fs::rename(&tmp, path)?;
+        File::open(dir)?.sync_all()
+    })();
+    if written.is_err() {
+        let _ = fs::remove_file(&tmp);
+    }
+    written.into_diagnostic().wrap_err(format!("Failed to write {}", path.display()))
+}
+
+/// Schema version of /var/lib/hammer; 0 for state from before versions were recorded
+pub fn schema_version() -> u32 {
+    fs::read_to_string(Path::new(STATE_DIR).join(SCHEMA_FILE))
+    .ok()
+    .and_then(|v| v.trim().parse().ok())
+    .unwrap_or(0)
+}
+
+/// Temporary files of writes a crash interrupted, anywhere below `dir`
+fn leftovers(dir: &Path) -> Vec<PathBuf> {
+    let mut found = Vec::new();
+    for entry in fs::read_dir(dir).into_iter().flatten().flatten() {
+        let path = entry.path();
+        if entry.file_type().is_ok_and(|t| t.is_dir()) {
+            found.extend(leftovers(&path));
+        } else if path.to_string_lossy().ends_with(TMP_SUFFIX) {
+            found.push(path);
+        }
+    }
+    found
+}
+
+/// Version 1: state is written atomically. Files the old plain writes may have cut short
+/// are moved aside as NAME.damaged, so they are reported once instead of silently read
+/// as empty, which for backup targets or the journal would lose the rest with them.
+fn upgrade_to_v1() -> Result<()> {
+    let json = |dir: PathBuf| -> Vec<PathBuf> {
+        fs::read_dir(dir)
+        .into_iter()
+        .flatten()
+        .flatten()
+        .map(|e| e.path())
+        .filter(|p| p.extension().is_some_and(|x| x == "json"))
+        .collect()
+    };
+    let mut files = json(PathBuf::from(STATE_DIR));
+    files.extend(json(journal_dir()));
+    for file in files {
+        let content = fs::read_to_string(&file).unwrap_or_default();
+        if serde_json::from_str::<serde_json::Value>(&content).is_ok() {
+            continue;
+        }
+        let damaged = PathBuf::from(format!("{}.damaged", file.display()));
+        fs::rename(&file, &damaged).into_diagnostic()?;
+        Logger::warn(&format!("{} was damaged, probably by a crash while it was written; moved to {}", file.display(), damaged.display()));
+    }
+    Ok(())
+}
+
+/// Brings /var/lib/hammer to SCHEMA_VERSION and clears what interrupted writes left.
+/// State from a newer hammer, e.g. after rolling back to an older deployment, is left as it is.
+pub fn upgrade() -> Result<()> {
+    let dir = Path::new(STATE_DIR);
+    if !dir.exists() {
+        return Ok(());
+    }
+    for tmp in leftovers(dir) {
+        Logger::log(&format!("Removing {}, left by an interrupted write", tmp.display()));
+        let _ = fs::remove_file(tmp);
+    }
+    let version = schema_version();
+    if version > SCHEMA_VERSION {
+        Logger::log(&format!("State schema {} is newer than this hammer's {}; left as it is", version, SCHEMA_VERSION));
+        return Ok(());
+    }
+    for from in version..SCHEMA_VERSION {
+        match from {
+            0 => upgrade_to_v1()?,
+            _ => unreachable!("no upgrade from state schema {}", from),
+        }
+        write(&dir.join(SCHEMA_FILE), format!("{}\n", from + 1))?;
+        Logger::log(&format!("State schema upgraded to {}", from + 1));
+    }
+    Ok(())
+}
@@ -0,0 +1,167 @@
+use miette::{IntoDiagnostic, Result};
+use std::fs;
+use std::path::Path;
+
+use crate::{mount_btrfs_root, pool, root_device_uuid, run_change, run_command, store, umount_btrfs_root, HammerError, Logger};
+
+pub const SWAP_SUBVOL: &str = "@swap";
+pub const SWAP_MOUNT: &str = "/swap";
+pub const SWAP_FILE: &str = "/swap/swapfile";
+
+/// Returns all active swap *files* (partitions and zram are ignored)
+pub fn active_swapfiles() -> Vec<String> {
+    let content = fs::read_to_string("/proc/swaps").unwrap_or_default();
+
+    // Filename Type Size Used Priority
+    content
+    .lines()
+    .skip(1)
+    .filter_map(|line| {
+        let parts: Vec<&str> = line.split_whitespace().collect();
+        if parts.len() >= 2 && parts[1] == "file" {
+            Some(parts[0].to_string())
+        } else {
+            None
+        }
+    })
+    .collect()
+}
+
+fn subvolume_id(path: &str) -> Option<String> {
+    run_command("btrfs", &["inspect-internal", "rootid", path], "Resolve Subvolume ID")
+    .ok()
+    .map(|s| s.trim().to_string())
+}
+
+/// Active swapfiles living inside the root subvolume.
+/// Btrfs refuses to snapshot a subvolume that contains an active swapfile.
+pub fn blocking_swapfiles() -> Vec<String> {
+    let root_id = match subvolume_id("/") {
+        Some(id) => id,
+        None => return Vec::new(),
+    };
+
+    active_swapfiles()
+    .into_iter()
+    .filter(|file| subvolume_id(file).as_deref() == Some(root_id.as_str()))
+    .collect()
+}
+
+/// Re-enables swapfiles that were disabled for a snapshot once dropped
+pub struct SwapGuard {
+    disabled: Vec<String>,
+}
+
+impl Drop for SwapGuard {
+    fn drop(&mut self) {
+        for file in &self.disabled {
+            match run_change("swapon", &[file], "Re-enable Swapfile") {
+                Ok(_) => Logger::info(&format!("Swapfile {} re-enabled.", file)),
+                Err(_) => Logger::error(&format!("Could not re-enable swapfile {}. Run 'swapon {}' manually.", file, file)),
+            }
+        }
+    }
+}
+
+/// Temporarily disables swapfiles that would make the root snapshot fail
+pub fn suspend_blocking_swapfiles() -> Result<SwapGuard> {
+    let mut guard = SwapGuard { disabled: Vec::new() };
+
+    for file in blocking_swapfiles() {
+        Logger::warn(&format!("Swapfile {} is inside @ and blocks snapshots. Disabling it temporarily...", file));
+
+        if run_change("swapoff", &[&file], "Disable Swapfile").is_err() {
+            // Guard drops here and re-enables anything already disabled
+            return Err(HammerError::BtrfsError(format!(
+                "Active swapfile {} blocks snapshotting and could not be disabled (not enough free memory?). \
+                 Run 'hammer swap relocate' to move it to a dedicated {} subvolume.",
+                file, SWAP_SUBVOL
+            )).into());
+        }
+        guard.disabled.push(file);
+    }
+
+    Ok(guard)
+}
+
+/// Moves swapfiles out of @ into a dedicated NOCOW @swap subvolume mounted on /swap
+pub fn relocate_swapfiles() -> Result<()> {
+    let blocking = blocking_swapfiles();
+    if blocking.is_empty() {
+        Logger::info("No swapfile inside @. Nothing to relocate.");
+        return Ok(());
+    }
+
+    // Keep the combined size of the old swapfiles
+    let total_bytes: u64 = blocking
+    .iter()
+    .filter_map(|f| fs::metadata(f).ok())
+    .map(|m| m.len())
+    .sum();
+    let size_mib = (total_bytes / 1024 / 1024).max(256);
+
+    // 1. Create @swap next to @
+    mount_btrfs_root()?;
+    let swap_subvol = pool::top_level().join(SWAP_SUBVOL);
+    if !swap_subvol.exists() {
+        Logger::info(&format!("Creating {} subvolume...", SWAP_SUBVOL));
+        run_change("btrfs", &["subvolume", "create", &swap_subvol.to_string_lossy()], "Create Swap Subvolume")?;
+    }
+    umount_btrfs_root()?;
+
+    // 2. Mount it on /swap (and persist the mount)
+    if !Path::new(SWAP_MOUNT).exists() {
+        fs::create_dir_all(SWAP_MOUNT).into_diagnostic()?;
+    }
+    if run_command("mountpoint", &["-q", SWAP_MOUNT], "Check Swap Mount").is_err() {
+        let uuid = root_device_uuid()?;
+        let opts = format!("subvol={}", SWAP_SUBVOL);
+        run_change("mount", &["-t", "btrfs", "-o", &opts, &format!("UUID={}", uuid), SWAP_MOUNT], "Mount Swap Subvolume")?;
+    }
+
+    // 3. Create the new swapfile (mkswapfile sets NOCOW and disables compression)
+    if !Path::new(SWAP_FILE).exists() {
+        Logger::info(&format!("Creating {} MiB swapfile at {}...", size_mib, SWAP_FILE));
+        run_change("btrfs", &["filesystem", "mkswapfile", "--size", &format!("{}m", size_mib), SWAP_FILE], "Create Swapfile")?;
+    }
+    run_change("swapon", &[SWAP_FILE], "Enable New Swapfile")?;
+
+    // 4. Retire the old swapfiles
+    for file in &blocking {
+        run_change("swapoff", &[file], "Disable Old Swapfile")?;
+        fs::remove_file(file).into_diagnostic()?;
+        Logger::info(&format!("Removed old swapfile {}", file));
+    }
+
+    update_fstab_for_swap(&blocking)?;
+
+    Logger::success(&format!("Swap relocated to {} ({}).", SWAP_FILE, SWAP_SUBVOL));
+    Ok(())
+}
+
+fn update_fstab_for_swap(old_files: &[String]) -> Result<()> {
+    let fstab_path = "/etc/fstab";
+    let content = fs::read_to_string(fstab_path).into_diagnostic()?;
+
+    let mut new_lines: Vec<String> = Vec::new();
+    for line in content.lines() {
+        let first = line.split_whitespace().next().unwrap_or("");
+        if old_files.iter().any(|f| f == first) {
+            continue;
+        }
+        new_lines.push(line.to_string());
+    }
+
+    if !content.contains(&format!("subvol={}", SWAP_SUBVOL)) {
+        let uuid = root_device_uuid()?;
+        new_lines.push(format!("UUID={}\t{}\tbtrfs\tsubvol={},noatime\t0\t0", uuid, SWAP_MOUNT, SWAP_SUBVOL));
+    }
+    if !content.contains(SWAP_FILE) {
+        new_lines.push(format!("{}\tnone\tswap\tdefaults\t0\t0", SWAP_FILE));
+    }
+
+    fs::write(format!("{}.bak", fstab_path), &content).into_diagnostic()?;
+    store::write(Path::new(fstab_path), new_lines.join("\n") + "\n")?;
+    Logger::success("fstab updated for relocated swap.");
+    Ok(())
+}
@@ -0,0 +1,120 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::NaiveDateTime;
+use nix::sys::statvfs::statvfs;
+use serde::{Deserialize, Serialize};
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::PathBuf;
+
+use crate::journal::journal_dir;
+
+const TIME_FORMAT: &str = "%Y-%m-%d %H:%M:%S";
+
+/// Samples older than this do not influence the forecast
+const WINDOW_DAYS: f64 = 30.0;
+
+/// Periodic callers (status) add at most one sample per interval
+const MIN_INTERVAL_SECS: i64 = 3600;
+
+/// Filesystem usage of / at one point in time
+#[derive(Serialize, Deserialize, Clone)]
+pub struct Sample {
+    pub time: String,
+    pub used: u64,
+    pub size: u64,
+    pub available: u64,
+}
+
+impl Sample {
+    fn at(&self) -> Option<NaiveDateTime> {
+        NaiveDateTime::parse_from_str(&self.time, TIME_FORMAT).ok()
+    }
+}
+
+pub struct Forecast {
+    pub bytes_per_day: f64,
+    /// None when usage is flat or shrinking
+    pub days_until_full: Option<f64>,
+}
+
+fn usage_file() -> PathBuf {
+    journal_dir().join("usage.jsonl")
+}
+
+pub fn current() -> Result<Sample> {
+    let stat = statvfs("/").into_diagnostic()?;
+    let block = stat.fragment_size() as u64;
+    let size = stat.blocks() as u64 * block;
+    let free = stat.blocks_free() as u64 * block;
+    Ok(Sample {
+        time: chrono::Local::now().format(TIME_FORMAT).to_string(),
+        used: size.saturating_sub(free),
+        size,
+        available: stat.blocks_available() as u64 * block,
+    })
+}
+
+pub fn history() -> Vec<Sample> {
+    fs::read_to_string(usage_file())
+    .unwrap_or_default()
+    .lines()
+    .filter_map(|l| serde_json::from_str(l).ok())
+    .collect()
+}
+
+fn append(sample: &Sample) -> Result<()> {
+    fs::create_dir_all(journal_dir()).into_diagnostic()?;
+    let mut file = OpenOptions::new().create(true).append(true).open(usage_file()).into_diagnostic()?;
+    writeln!(file, "{}", serde_json::to_string(sample).into_diagnostic()?).into_diagnostic()
+}
+
+/// Records the current usage; called whenever a snapshot is taken
+pub fn record() -> Result<Sample> {
+    let sample = current()?;
+    append(&sample)?;
+    Ok(sample)
+}
+
+/// Like `record`, but skipped when the last sample is recent
+pub fn record_throttled() -> Result<Sample> {
+    let sample = current()?;
+    let recent = history()
+    .last()
+    .and_then(|s| s.at())
+    .zip(sample.at())
+    .map(|(last, now)| (now - last).num_seconds() < MIN_INTERVAL_SECS)
+    .unwrap_or(false);
+    if !recent {
+        append(&sample)?;
+    }
+    Ok(sample)
+}
+
+/// Least-squares growth rate over the recent samples and the time until `available` runs out
+pub fn forecast(samples: &[Sample], latest: &Sample) -> Option<Forecast> {
+    let now = latest.at()?;
+    let points: Vec<(f64, f64)> = samples
+    .iter()
+    .filter_map(|s| Some(((s.at()? - now).num_seconds() as f64 / 86400.0, s.used as f64)))
+    .filter(|(days, _)| *days >= -WINDOW_DAYS)
+    .collect();
+
+    let span = points.iter().map(|p| p.0).fold(0.0_f64, f64::min).abs();
+    if points.len() < 3 || span < 1.0 {
+        return None;
+    }
+
+    let n = points.len() as f64;
+    let mean_x = points.iter().map(|p| p.0).sum::<f64>() / n;
+    let mean_y = points.iter().map(|p| p.1).sum::<f64>() / n;
+    let var_x: f64 = points.iter().map(|p| (p.0 - mean_x).powi(2)).sum();
+    if var_x == 0.0 {
+        return None;
+    }
+    let slope = points.iter().map(|p| (p.0 - mean_x) * (p.1 - mean_y)).sum::<f64>() / var_x;
+
+    Some(Forecast {
+        bytes_per_day: slope,
+        days_until_full: (slope > 0.0).then(|| latest.available as f64 / slope),
+    })
+}
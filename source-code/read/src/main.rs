@@ -1,6 +1,6 @@
 use miette::{miette, IntoDiagnostic, Result, WrapErr};
 use clap::{Parser, Subcommand};
-use hammer_core::{run_command, Logger};
+use hammer_core::{exec, overrides, run_change, run_command, Logger};
 use nix::unistd::Uid;
 use owo_colors::OwoColorize;
 use std::fs;
@@ -44,6 +44,9 @@ fn main() -> Result<()> {
     Logger::init()?;
 
     let cli = Cli::parse();
+    if overrides::dry_run() {
+        exec::set_dry_run();
+    }
 
     match cli.command {
         Some(Commands::Install) => install_persistence()?,
@@ -90,16 +93,16 @@ fn remount_path_via_bind(path: &str, readonly: bool) -> Result<()> {
     // If not a mountpoint, bind mount it to itself to make it one
     if check_mount.is_err() {
         Logger::info(&format!("Converting {} to bind mount...", path));
-        run_command("mount", &["--bind", path, path], "Bind Mount Self")?;
+        run_change("mount", &["--bind", path, path], "Bind Mount Self")?;
     }
 
     if readonly {
         Logger::info(&format!("Locking {} (Read-Only)...", path));
         // Note: remount,bind,ro is the correct sequence to change flags on a bind mount
-        run_command("mount", &["-o", "remount,bind,ro", path], "Remount RO")?;
+        run_change("mount", &["-o", "remount,bind,ro", path], "Remount RO")?;
     } else {
         Logger::info(&format!("Unlocking {} (Read-Write)...", path));
-        run_command("mount", &["-o", "remount,bind,rw", path], "Remount RW")?;
+        run_change("mount", &["-o", "remount,bind,rw", path], "Remount RW")?;
     }
 
     Logger::success(&format!("{} configured.", path));
@@ -115,7 +118,7 @@ fn enable_overlay_fs() -> Result<()> {
     if !overlay_base.exists() {
         fs::create_dir_all(overlay_base).into_diagnostic()?;
         // Mount tmpfs
-        run_command("mount", &["-t", "tmpfs", "tmpfs", "/run/hammer/overlay", "-o", "size=1G"], "Mount Tmpfs")?;
+        run_change("mount", &["-t", "tmpfs", "tmpfs", "/run/hammer/overlay", "-o", "size=1G"], "Mount Tmpfs")?;
     }
 
     let upper_dir = overlay_base.join("upper");
@@ -132,7 +135,7 @@ fn enable_overlay_fs() -> Result<()> {
                        work_dir.display()
     );
 
-    run_command("mount", &["-t", "overlay", "overlay", "/usr", "-o", &opts], "Mount Overlay")?;
+    run_change("mount", &["-t", "overlay", "overlay", "/usr", "-o", &opts], "Mount Overlay")?;
 
     Logger::success("Temporary unlock active. Changes to /usr are writable but will VANISH after reboot.");
     Logger::end_section();
@@ -173,8 +176,8 @@ fn install_systemd_service() -> Result<()> {
     .into_diagnostic()
     .wrap_err("Failed to write service file")?;
 
-    run_command("systemctl", &["daemon-reload"], "Reloading Daemon")?;
-    run_command("systemctl", &["enable", "hammer-readonly.service"], "Enabling Service")?;
+    run_change("systemctl", &["daemon-reload"], "Reloading Daemon")?;
+    run_change("systemctl", &["enable", "hammer-readonly.service"], "Enabling Service")?;
 
     Logger::success("Systemd service installed.");
     Ok(())
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+const configPath = "/etc/hammer/hammer.toml"
+
+// messages maps a key to its English and Polish text.
+var messages = map[string][2]string{
+	"title":            {"Hammer TUI", "Hammer TUI"},
+	"install.title":    {"Install package", "Zainstaluj pakiet"},
+	"install.desc":     {"Install a package (atomic optional)", "Zainstaluj pakiet (opcjonalnie atomowo)"},
+	"remove.title":     {"Remove package", "Usuń pakiet"},
+	"remove.desc":      {"Remove a package (atomic optional)", "Usuń pakiet (opcjonalnie atomowo)"},
+	"update.title":     {"Update", "Aktualizuj"},
+	"update.desc":      {"Update the system atomically", "Zaktualizuj system atomowo"},
+	"clean.title":      {"Clean", "Wyczyść"},
+	"clean.desc":       {"Clean up unused resources", "Usuń nieużywane zasoby"},
+	"refresh.title":    {"Refresh", "Odśwież"},
+	"refresh.desc":     {"Refresh repositories", "Odśwież repozytoria"},
+	"switch.title":     {"Switch", "Przełącz"},
+	"switch.desc":      {"Switch to a deployment (rollback if no arg)", "Przełącz na wdrożenie (bez argumentu: wycofanie)"},
+	"deploy.title":     {"Deploy", "Wdróż"},
+	"deploy.desc":      {"Create a new deployment", "Utwórz nowe wdrożenie"},
+	"status.title":     {"Status", "Stan"},
+	"status.desc":      {"Show status", "Pokaż stan"},
+	"history.title":    {"History", "Historia"},
+	"history.desc":     {"Show history", "Pokaż historię"},
+	"security.title":   {"Security review", "Przegląd bezpieczeństwa"},
+	"security.desc":    {"CVEs fixed since the last snapshot", "CVE naprawione od ostatniej migawki"},
+	"rollback.title":   {"Rollback", "Wycofaj"},
+	"rollback.desc":    {"Rollback n steps", "Wycofaj o n kroków"},
+	"build-init.title": {"Build init", "Inicjalizuj budowanie"},
+	"build-init.desc":  {"Initialize build project", "Zainicjuj projekt budowania"},
+	"build.title":      {"Build", "Zbuduj"},
+	"build.desc":       {"Build atomic ISO", "Zbuduj atomowy obraz ISO"},
+	"about.title":      {"About", "O programie"},
+	"about.desc":       {"Show tool information", "Pokaż informacje o narzędziu"},
+	"quit.title":       {"Quit", "Wyjdź"},
+	"quit.desc":        {"Exit the TUI", "Zamknij TUI"},
+	"prompt.package":   {"Enter package name", "Podaj nazwę pakietu"},
+	"prompt.atomic":    {"Atomic? (y/n)", "Atomowo? (t/n)"},
+	"running":          {"Running command...", "Wykonywanie polecenia..."},
+	"output.return":    {"Press enter or q to return", "Naciśnij enter lub q, aby wrócić"},
+	"error":            {"Error", "Błąd"},
+	"error.program":    {"Error running program:", "Błąd uruchamiania programu:"},
+	"error.root": {
+		"hammer %s needs root privileges.\n\nQuit and start the TUI as root:\n  sudo hammer tui\n  pkexec hammer tui   (from a desktop session)\n\nStatus, history, security review and about work without root.",
+		"hammer %s wymaga uprawnień roota.\n\nWyjdź i uruchom TUI jako root:\n  sudo hammer tui\n  pkexec hammer tui   (z sesji graficznej)\n\nStan, historia, przegląd bezpieczeństwa i informacje działają bez roota.",
+	},
+}
+
+// polish is chosen once at startup, like the hammer CLI does.
+var polish = detectPolish()
+
+// configLanguage reads `language` from the [general] section of hammer.toml, or of
+// HAMMER_CONFIG like the other hammer tools.
+func configLanguage() string {
+	path := configPath
+	if env := os.Getenv("HAMMER_CONFIG"); env != "" {
+		path = env
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok && section == "general" && strings.TrimSpace(key) == "language" {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return ""
+}
+
+func isPolish(code string) bool {
+	return strings.HasPrefix(strings.ToLower(code), "pl")
+}
+
+func detectPolish() bool {
+	if lang := configLanguage(); lang != "" && lang != "auto" {
+		return isPolish(lang)
+	}
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			return isPolish(value)
+		}
+	}
+	return false
+}
+
+// tr returns the message for key in the selected language.
+func tr(key string) string {
+	msg, ok := messages[key]
+	if !ok {
+		return key
+	}
+	if polish {
+		return msg[1]
+	}
+	return msg[0]
+}
+
+// isYes accepts "y"/"yes" and the Polish "t"/"tak".
+func isYes(val string) bool {
+	switch strings.ToLower(val) {
+	case "y", "yes", "t", "tak":
+		return true
+	}
+	return false
+}
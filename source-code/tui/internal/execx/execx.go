@@ -0,0 +1,123 @@
+// Package execx runs programs the way hammer_core::exec does for the Rust binaries: the
+// command line and how it ended go to hammer.log, output that is parsed is produced with
+// LC_ALL=C, a timeout kills what hangs, and in a dry run (HAMMER_DRY_RUN=1) commands that
+// change the system are only logged.
+package execx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DryRunEnv is set to 1 for a dry run and inherited by every hammer program started from one.
+const DryRunEnv = "HAMMER_DRY_RUN"
+
+// LogFile is hammer's log, shared with the Rust binaries.
+var LogFile = filepath.Join("/var/log/hammer", "hammer.log")
+
+// DryRun reports whether this is a dry run.
+func DryRun() bool {
+	return os.Getenv(DryRunEnv) == "1"
+}
+
+// SetDryRun starts a dry run, for this process and the hammer programs it runs.
+func SetDryRun() {
+	os.Setenv(DryRunEnv, "1")
+}
+
+// Cmd is a program to run.
+type Cmd struct {
+	Name string
+	Args []string
+	// Env holds extra KEY=value pairs on top of the inherited environment.
+	Env []string
+	// Parseable runs the program with LC_ALL=C, for output that is parsed rather than shown.
+	Parseable bool
+	// Timeout kills the program when it runs longer; zero means no limit.
+	Timeout time.Duration
+	// ChangesSystem skips the program in a dry run.
+	ChangesSystem bool
+}
+
+// Command returns a Cmd of name with args.
+func Command(name string, args ...string) Cmd {
+	return Cmd{Name: name, Args: args}
+}
+
+// CommandLine is the program and its arguments as one line, for logs.
+func (c Cmd) CommandLine() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+func logLine(message string) {
+	f, err := os.OpenFile(LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "[%s] %s\n", time.Now().Format("2006-01-02 15:04:05"), message)
+}
+
+// run runs c with stdout and stderr going to the given writers.
+func (c Cmd) run(stdout, stderr *bytes.Buffer) error {
+	if c.ChangesSystem && DryRun() {
+		logLine("INFO: Dry run, not running: " + c.CommandLine())
+		fmt.Fprintf(stdout, "Dry run, not running: %s\n", c.CommandLine())
+		return nil
+	}
+	logLine("Running: " + c.CommandLine())
+
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	if c.Parseable {
+		cmd.Env = append(cmd.Env, "LC_ALL=C")
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	started := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		logLine(fmt.Sprintf("Timed out after %s: %s", c.Timeout, c.CommandLine()))
+		return fmt.Errorf("%s timed out after %s", c.Name, c.Timeout)
+	}
+	status := "exit status 0"
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.String()
+	} else if err != nil {
+		return fmt.Errorf("failed to execute binary: %s: %w", c.Name, err)
+	}
+	logLine(fmt.Sprintf("Finished (%s, %.1fs): %s", status, time.Since(started).Seconds(), c.Name))
+	return err
+}
+
+// Output runs c and returns its stdout; a failure carries its stderr.
+func (c Cmd) Output() (string, error) {
+	var stdout, stderr bytes.Buffer
+	if err := c.run(&stdout, &stderr); err != nil {
+		logLine("Command failed stderr: " + stderr.String())
+		return stdout.String(), fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// CombinedOutput runs c and returns stdout and stderr interleaved, for showing to the user.
+func (c Cmd) CombinedOutput() (string, error) {
+	var out bytes.Buffer
+	err := c.run(&out, &out)
+	return out.String(), err
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/charmbracelet/bubbletea"
@@ -11,6 +10,8 @@ import (
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	"github.com/charmbracelet/lipgloss"
+
+	"hammer-tui/internal/execx"
 )
 
 type state int
@@ -29,6 +30,10 @@ type item struct {
 	command    string
 	hasPackage bool
 	hasAtomic  bool
+	// readOnly commands still run in a dry run
+	readOnly bool
+	// needsRoot commands are refused up front when the TUI runs without root
+	needsRoot bool
 }
 
 func (i item) Title() string       { return i.title }
@@ -55,27 +60,28 @@ func initialModel() model {
 	ti.Width = 30
 
 	items := []list.Item{
-		item{title: "Install package", desc: "Install a package (atomic optional)", command: "install", hasPackage: true, hasAtomic: true},
-		item{title: "Remove package", desc: "Remove a package (atomic optional)", command: "remove", hasPackage: true, hasAtomic: true},
-		item{title: "Update", desc: "Update the system atomically", command: "update", hasPackage: false, hasAtomic: false},
-		item{title: "Clean", desc: "Clean up unused resources", command: "clean", hasPackage: false, hasAtomic: false},
-		item{title: "Refresh", desc: "Refresh repositories", command: "refresh", hasPackage: false, hasAtomic: false},
-		item{title: "Switch", desc: "Switch to a deployment (rollback if no arg)", command: "switch", hasPackage: false, hasAtomic: false},
-		item{title: "Deploy", desc: "Create a new deployment", command: "deploy", hasPackage: false, hasAtomic: false},
-		item{title: "Status", desc: "Show status", command: "status", hasPackage: false, hasAtomic: false},
-		item{title: "History", desc: "Show history", command: "history", hasPackage: false, hasAtomic: false},
-		item{title: "Rollback", desc: "Rollback n steps", command: "rollback", hasPackage: false, hasAtomic: false},
-		item{title: "Build init", desc: "Initialize build project", command: "build init", hasPackage: false, hasAtomic: false},
-		item{title: "Build", desc: "Build atomic ISO", command: "build", hasPackage: false, hasAtomic: false},
-		item{title: "About", desc: "Show tool information", command: "about", hasPackage: false, hasAtomic: false},
-		item{title: "Quit", desc: "Exit the TUI", command: "quit", hasPackage: false, hasAtomic: false},
+		item{title: tr("install.title"), desc: tr("install.desc"), command: "install", hasPackage: true, hasAtomic: true},
+		item{title: tr("remove.title"), desc: tr("remove.desc"), command: "remove", hasPackage: true, hasAtomic: true},
+		item{title: tr("update.title"), desc: tr("update.desc"), command: "update", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("clean.title"), desc: tr("clean.desc"), command: "clean", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("refresh.title"), desc: tr("refresh.desc"), command: "refresh", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("switch.title"), desc: tr("switch.desc"), command: "switch", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("deploy.title"), desc: tr("deploy.desc"), command: "deploy", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("status.title"), desc: tr("status.desc"), command: "status", hasPackage: false, hasAtomic: false, readOnly: true},
+		item{title: tr("history.title"), desc: tr("history.desc"), command: "history", hasPackage: false, hasAtomic: false, readOnly: true},
+		item{title: tr("security.title"), desc: tr("security.desc"), command: "diff --security", hasPackage: false, hasAtomic: false, readOnly: true},
+		item{title: tr("rollback.title"), desc: tr("rollback.desc"), command: "rollback", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("build-init.title"), desc: tr("build-init.desc"), command: "build init", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("build.title"), desc: tr("build.desc"), command: "build", hasPackage: false, hasAtomic: false, needsRoot: true},
+		item{title: tr("about.title"), desc: tr("about.desc"), command: "about", hasPackage: false, hasAtomic: false, readOnly: true},
+		item{title: tr("quit.title"), desc: tr("quit.desc"), command: "quit", hasPackage: false, hasAtomic: false},
 	}
 
 	delegate := list.NewDefaultDelegate()
 	delegate.Styles.SelectedTitle.Foreground(lipgloss.Color("#00FF00"))
 
 	l := list.New(items, delegate, 0, 0)
-	l.Title = "Hammer TUI"
+	l.Title = tr("title")
 	l.Styles.Title = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("#FAFAFA")).Background(lipgloss.Color("#7D56F4")).Padding(0, 1)
 
 	vp := viewport.New(0, 0)
@@ -117,15 +123,21 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					if i.command == "quit" {
 						return m, tea.Quit
 					}
+					if i.needsRoot && os.Geteuid() != 0 && !execx.DryRun() {
+						// hammer would refuse halfway through the prompts
+						m.state = outputState
+						m.viewport.SetContent(fmt.Sprintf(tr("error.root"), i.command))
+						return m, nil
+					}
 					if i.hasPackage {
 						m.state = promptPackage
-						m.textinput.Placeholder = "Enter package name"
+						m.textinput.Placeholder = tr("prompt.package")
 						m.textinput.Focus()
 						return m, textinput.Blink
 					}
 					if i.hasAtomic {
 						m.state = promptAtomic
-						m.textinput.Placeholder = "Atomic? (y/n)"
+						m.textinput.Placeholder = tr("prompt.atomic")
 						m.textinput.Focus()
 						return m, textinput.Blink
 					}
@@ -144,7 +156,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.textinput.Reset()
 				if m.currentItem.hasAtomic {
 					m.state = promptAtomic
-					m.textinput.Placeholder = "Atomic? (y/n)"
+					m.textinput.Placeholder = tr("prompt.atomic")
 					return m, textinput.Blink
 				}
 				m.state = running
@@ -161,8 +173,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch msg := msg.(type) {
 		case tea.KeyMsg:
 			if msg.String() == "enter" {
-				val := strings.ToLower(m.textinput.Value())
-				m.atomic = val == "y" || val == "yes"
+				m.atomic = isYes(m.textinput.Value())
 				m.textinput.Reset()
 				m.state = running
 				return m, m.runCommand()
@@ -181,7 +192,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.err = msg.err
 			m.state = outputState
 			if m.err != nil {
-				m.viewport.SetContent(fmt.Sprintf("Error: %v\n%s", m.err, m.output))
+				m.viewport.SetContent(fmt.Sprintf("%s: %v\n%s", tr("error"), m.err, m.output))
 			} else {
 				m.viewport.SetContent(m.output)
 			}
@@ -217,7 +228,8 @@ func (m model) runCommand() tea.Cmd {
 		if m.currentItem.hasPackage {
 			args = append(args, m.packageName)
 		}
-		c := exec.Command("hammer", args...)
+		c := execx.Command("hammer", args...)
+		c.ChangesSystem = !m.currentItem.readOnly
 		output, err := c.CombinedOutput()
 		return outputMsg{output: string(output), err: err}
 	}
@@ -232,17 +244,22 @@ func (m model) View() string {
 	case promptPackage, promptAtomic:
 		return baseStyle.Render(m.textinput.View())
 	case running:
-		return baseStyle.Render("Running command...")
+		return baseStyle.Render(tr("running"))
 	case outputState:
-		return baseStyle.Render(m.viewport.View() + "\nPress enter or q to return")
+		return baseStyle.Render(m.viewport.View() + "\n"+tr("output.return"))
 	}
 	return ""
 }
 
 func main() {
+	for _, arg := range os.Args[1:] {
+		if arg == "--dry-run" {
+			execx.SetDryRun()
+		}
+	}
 	p := tea.NewProgram(initialModel(), tea.WithAltScreen())
 	if _, err := p.Run(); err != nil {
-		fmt.Println("Error running program:", err)
+		fmt.Println(tr("error.program"), err)
 		os.Exit(1)
 	}
 }
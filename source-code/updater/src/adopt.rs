@@ -0,0 +1,117 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::{
+    events, journal, mount_btrfs_root, pool, run_change, run_command, umount_btrfs_root, HammerError, Logger,
+};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::{create_snapshot_name, timeshift};
+
+/// Files every bootable Debian-style root has; missing ones fail validation
+const REQUIRED: &[&str] = &["etc/os-release", "etc/fstab", "usr/bin", "usr/lib"];
+
+/// Paths that point to an init; one of them has to exist
+const INIT: &[&str] = &["sbin/init", "usr/sbin/init", "usr/lib/systemd/systemd"];
+
+/// A subvolume that passes validation but lacks dpkg cannot be updated by hammer
+const DPKG_STATUS: &str = "var/lib/dpkg/status";
+
+/// Problems that keep `path` from being a usable root filesystem
+fn validate(path: &Path) -> Vec<String> {
+    let mut problems: Vec<String> = REQUIRED
+    .iter()
+    .filter(|p| !path.join(p).exists())
+    .map(|p| format!("missing /{}", p))
+    .collect();
+    if !INIT.iter().any(|p| path.join(p).exists()) {
+        problems.push("no init (/sbin/init or systemd)".to_string());
+    }
+    problems
+}
+
+/// Absolute path of the subvolume; relative paths are taken from the top level
+fn locate(subvolume: &str) -> PathBuf {
+    let path = Path::new(subvolume);
+    if path.is_absolute() {
+        path.to_path_buf()
+    } else {
+        pool::top_level().join(subvolume.trim_start_matches("./"))
+    }
+}
+
+/// Refuses subvolumes another part of hammer (or Timeshift) already owns
+fn check_owner(src: &Path) -> Result<()> {
+    let rel = match src.strip_prefix(pool::top_level()) {
+        Ok(rel) => rel.to_string_lossy().to_string(),
+        Err(_) => return Ok(()),
+    };
+    if rel == "@" || rel.starts_with("@snapshots/") {
+        return Err(HammerError::ConfigError(format!("{} is already managed by hammer.", rel)).into());
+    }
+    if timeshift::is_managed(&rel) {
+        return Err(HammerError::ConfigError(format!(
+            "{} belongs to Timeshift. See [timeshift] adopt in hammer.toml to list it instead.", rel
+        )).into());
+    }
+    Ok(())
+}
+
+/// Copies an existing subvolume into @snapshots so it can be listed, diffed and rolled back to.
+/// The original is left in place.
+pub fn handle_adopt(subvolume: &str, kind: &str, force: bool) -> Result<()> {
+    Logger::section("ADOPT SUBVOLUME");
+
+    mount_btrfs_root()?;
+    let result = adopt(subvolume, kind, force);
+    umount_btrfs_root()?;
+    let name = result?;
+
+    events::emit(events::Event::SnapshotCreated, Some(&name));
+    Logger::success(&format!("Adopted as {}. Roll back to it with 'hammer rollback {}'.", name, name));
+    Logger::end_section();
+    Ok(())
+}
+
+fn adopt(subvolume: &str, kind: &str, force: bool) -> Result<String> {
+    let src = locate(subvolume);
+    check_owner(&src)?;
+    if run_command("btrfs", &["subvolume", "show", &src.to_string_lossy()], "Check Subvolume").is_err() {
+        return Err(HammerError::BtrfsError(format!(
+            "{} is not a Btrfs subvolume on the root filesystem.", src.display()
+        )).into());
+    }
+
+    let problems = validate(&src);
+    if !problems.is_empty() {
+        if !force {
+            for p in &problems {
+                Logger::error(p);
+            }
+            return Err(HammerError::ConfigError(format!(
+                "{} does not look like a root filesystem. Use --force to adopt it anyway.", src.display()
+            )).into());
+        }
+        Logger::warn(&format!("Adopting despite: {}", problems.join(", ")));
+    }
+    if !src.join(DPKG_STATUS).exists() {
+        Logger::warn("No dpkg database: package diffs and updates will not work for this deployment.");
+    }
+
+    let name = create_snapshot_name(kind);
+    let snap_dir = pool::top_level().join("@snapshots");
+    let dest = snap_dir.join(&name);
+    if dest.exists() {
+        return Err(HammerError::BtrfsError(format!("{} already exists in @snapshots.", name)).into());
+    }
+    fs::create_dir_all(&snap_dir).into_diagnostic()?;
+    run_change(
+        "btrfs",
+        &["subvolume", "snapshot", &src.to_string_lossy(), &dest.to_string_lossy()],
+        "Adopt Subvolume",
+    )?;
+
+    let mut tx = journal::Transaction::begin(&name, "adopt");
+    journal::attach(&name, "origin", &src.to_string_lossy())?;
+    tx.finish("success")?;
+    Ok(name)
+}
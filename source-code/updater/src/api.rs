@@ -0,0 +1,409 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::exec::Exec;
+use hammer_core::{config, journal, overrides, HammerError, Logger};
+use serde::Serialize;
+use serde_json::{json, Value};
+use std::env;
+use std::fs;
+use std::io::{BufRead, BufReader, Read, Write};
+use std::os::unix::fs::PermissionsExt;
+use std::os::unix::io::AsRawFd;
+use std::os::unix::net::{UnixListener, UnixStream};
+use std::path::Path;
+use std::process::Stdio;
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::Duration;
+
+use crate::{reboot, status, timeshift};
+
+pub const SOCKET_PATH: &str = "/run/hammer/api.sock";
+
+/// Requests larger than this are rejected; the API only takes small JSON bodies
+const MAX_BODY: usize = 64 * 1024;
+/// Longest request or header line, and most headers, read before a request is rejected
+const MAX_LINE: usize = 8 * 1024;
+const MAX_HEADERS: usize = 64;
+/// A client that has not sent its whole request by then is dropped
+pub(crate) const READ_TIMEOUT: Duration = Duration::from_secs(10);
+const PROGRESS_POLL: Duration = Duration::from_millis(250);
+
+/// A hammer-updater subprocess started through the API
+#[derive(Serialize, Clone)]
+struct Job {
+    id: u64,
+    kind: String,
+    args: Vec<String>,
+    started: String,
+    finished: Option<String>,
+    success: Option<bool>,
+    #[serde(skip)]
+    output: Vec<String>,
+}
+
+type Jobs = Arc<Mutex<Vec<Job>>>;
+
+struct Request {
+    method: String,
+    path: String,
+    body: Value,
+}
+
+struct Response {
+    status: u16,
+    body: Value,
+}
+
+impl Response {
+    fn ok(body: Value) -> Self {
+        Response { status: 200, body }
+    }
+
+    fn error(status: u16, message: &str) -> Self {
+        Response { status, body: json!({ "error": message }) }
+    }
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        202 => "Accepted",
+        400 => "Bad Request",
+        403 => "Forbidden",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        409 => "Conflict",
+        413 => "Payload Too Large",
+        _ => "Internal Server Error",
+    }
+}
+
+fn now() -> String {
+    chrono::Local::now().format("%Y-%m-%d %H:%M:%S").to_string()
+}
+
+/// An HTTP request as read off the wire
+pub(crate) struct RawRequest {
+    pub method: String,
+    pub path: String,
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl RawRequest {
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers.iter().find(|(n, _)| n.eq_ignore_ascii_case(name)).map(|(_, v)| v.as_str())
+    }
+}
+
+/// One line of at most MAX_LINE bytes; None when it is longer or cannot be read
+fn read_line<R: BufRead>(reader: &mut R) -> Option<String> {
+    let mut line = String::new();
+    reader.by_ref().take(MAX_LINE as u64).read_line(&mut line).ok()?;
+    (line.len() < MAX_LINE || line.ends_with('\n')).then_some(line)
+}
+
+pub(crate) fn read_raw<R: Read>(stream: R) -> Option<RawRequest> {
+    let mut reader = BufReader::new(stream);
+    let line = read_line(&mut reader)?;
+    let mut parts = line.split_whitespace();
+    let method = parts.next()?.to_string();
+    let path = parts.next()?.split('?').next()?.to_string();
+
+    let mut headers = Vec::new();
+    loop {
+        let header = read_line(&mut reader)?;
+        if header.trim().is_empty() {
+            break;
+        }
+        if headers.len() == MAX_HEADERS {
+            return None;
+        }
+        if let Some((name, value)) = header.split_once(':') {
+            headers.push((name.trim().to_string(), value.trim().to_string()));
+        }
+    }
+
+    let mut request = RawRequest { method, path, headers, body: Vec::new() };
+    let length: usize = request.header("content-length").and_then(|l| l.parse().ok()).unwrap_or(0);
+    if length > MAX_BODY {
+        return None;
+    }
+    request.body = vec![0; length];
+    reader.read_exact(&mut request.body).ok()?;
+    Some(request)
+}
+
+fn read_request(stream: &UnixStream) -> Option<Request> {
+    let raw = read_raw(stream)?;
+    let body = if raw.body.is_empty() { Value::Null } else { serde_json::from_slice(&raw.body).ok()? };
+    Some(Request { method: raw.method, path: raw.path, body })
+}
+
+fn write_response(stream: &mut UnixStream, response: &Response) {
+    let body = response.body.to_string();
+    let _ = write!(
+        stream,
+        "HTTP/1.1 {} {}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        response.status, reason(response.status), body.len(), body
+    );
+}
+
+fn write_chunk(stream: &mut UnixStream, data: &str) -> bool {
+    write!(stream, "{:x}\r\n{}\r\n", data.len(), data).is_ok()
+}
+
+/// A snapshot name from a client, refused when hammer-updater could read it as a flag or a path
+fn snapshot_arg(name: &str) -> Option<String> {
+    (!name.is_empty() && !name.starts_with('-') && !name.contains('/')).then(|| name.to_string())
+}
+
+/// Runs `hammer-updater <args>` in the background and records its output. Jobs have no
+/// terminal, so the client's request stands in for the confirmation a command would ask.
+fn start_job(jobs: &Jobs, kind: &str, args: Vec<String>) -> Response {
+    let mut list = jobs.lock().unwrap();
+    if list.iter().any(|j| j.finished.is_none()) {
+        return Response::error(409, "another job is still running");
+    }
+
+    let exe = match env::current_exe() {
+        Ok(e) => e,
+        Err(e) => return Response::error(500, &e.to_string()),
+    };
+    let exe = exe.to_string_lossy().to_string();
+    let words: Vec<&str> = args.iter().map(String::as_str).collect();
+    let mut child = match Exec::new(&exe, &words, "API Job")
+    .env(overrides::ASSUME_YES_ENV, "1")
+    .stderr(Stdio::piped())
+    .spawn()
+    {
+        Ok(c) => c,
+        Err(e) => return Response::error(500, &e.to_string()),
+    };
+
+    let id = list.last().map(|j| j.id + 1).unwrap_or(1);
+    list.push(Job {
+        id,
+        kind: kind.to_string(),
+        args,
+        started: now(),
+        finished: None,
+        success: None,
+        output: Vec::new(),
+    });
+    Logger::log(&format!("API: started job {} ({})", id, kind));
+
+    let append = |jobs: Jobs, pipe: Box<dyn Read + Send>| {
+        thread::spawn(move || {
+            for line in BufReader::new(pipe).lines().map_while(|l| l.ok()) {
+                if let Some(job) = jobs.lock().unwrap().iter_mut().find(|j| j.id == id) {
+                    job.output.push(line);
+                }
+            }
+        })
+    };
+    let out = append(jobs.clone(), Box::new(child.stdout.take().unwrap()));
+    let err = append(jobs.clone(), Box::new(child.stderr.take().unwrap()));
+
+    let jobs = jobs.clone();
+    thread::spawn(move || {
+        let success = child.wait().map(|s| s.success()).unwrap_or(false);
+        let _ = out.join();
+        let _ = err.join();
+        if let Some(job) = jobs.lock().unwrap().iter_mut().find(|j| j.id == id) {
+            job.finished = Some(now());
+            job.success = Some(success);
+        }
+        Logger::log(&format!("API: job {} finished (success: {})", id, success));
+    });
+
+    Response { status: 202, body: json!({ "job": id }) }
+}
+
+fn find_job(jobs: &Jobs, id: &str) -> Option<Job> {
+    let id: u64 = id.parse().ok()?;
+    jobs.lock().unwrap().iter().find(|j| j.id == id).cloned()
+}
+
+/// Streams job output as NDJSON until the job ends
+fn stream_progress(stream: &mut UnixStream, jobs: &Jobs, id: &str) {
+    if find_job(jobs, id).is_none() {
+        write_response(stream, &Response::error(404, "no such job"));
+        return;
+    }
+    let _ = write!(
+        stream,
+        "HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n"
+    );
+
+    let mut sent = 0;
+    loop {
+        let job = match find_job(jobs, id) {
+            Some(j) => j,
+            None => break,
+        };
+        for line in &job.output[sent..] {
+            if !write_chunk(stream, &format!("{}\n", json!({ "line": line }))) {
+                return;
+            }
+        }
+        sent = job.output.len();
+        if job.finished.is_some() {
+            write_chunk(stream, &format!("{}\n", json!({ "done": true, "success": job.success })));
+            break;
+        }
+        thread::sleep(PROGRESS_POLL);
+    }
+    let _ = stream.write_all(b"0\r\n\r\n");
+}
+
+fn to_json<T: Serialize>(value: &T) -> Response {
+    match serde_json::to_value(value) {
+        Ok(v) => Response::ok(v),
+        Err(e) => Response::error(500, &e.to_string()),
+    }
+}
+
+fn deployments(snapshots_only: bool) -> Response {
+    let adopt_timeshift = config::load().map(|c| c.timeshift.adopt).unwrap_or(false);
+    match status::collect() {
+        Ok(rows) => {
+            let rows: Vec<&status::DeploymentRow> = rows
+            .iter()
+            .filter(|r| !snapshots_only || r.path.starts_with("@snapshots/"))
+            .filter(|r| adopt_timeshift || !timeshift::is_managed(&r.path))
+            .collect();
+            to_json(&rows)
+        }
+        Err(e) => Response::error(500, &e.to_string()),
+    }
+}
+
+fn route(request: &Request, jobs: &Jobs) -> Response {
+    let segments: Vec<&str> = request.path.trim_matches('/').split('/').collect();
+    let body_str = |key: &str| request.body.get(key).and_then(|v| v.as_str()).map(|s| s.to_string());
+
+    match (request.method.as_str(), segments.as_slice()) {
+        ("GET", ["v1", "deployments"]) => deployments(false),
+        ("GET", ["v1", "snapshots"]) => deployments(true),
+        ("DELETE", ["v1", "snapshots", name]) => match snapshot_arg(name) {
+            Some(name) => start_job(jobs, "delete", vec!["delete".into(), "--".into(), name]),
+            None => Response::error(400, "invalid snapshot name"),
+        },
+        ("GET", ["v1", "transactions"]) => to_json(&journal::list()),
+        ("GET", ["v1", "transactions", id]) => match journal::load(id) {
+            Ok(tx) => to_json(&tx),
+            Err(_) => Response::error(404, "no such transaction"),
+        },
+        ("POST", ["v1", "updates"]) => {
+            let mut args = vec!["update".to_string()];
+            // "staged": never touch the running root, whatever executor is configured
+            let staged = request.body.get("staged").and_then(|v| v.as_bool()).unwrap_or(false);
+            let configured_live = config::load().map(|c| !c.update.executor.is_staged()).unwrap_or(true);
+            let executor = body_str("executor").or_else(|| (staged && configured_live).then(|| "chroot".to_string()));
+            if let Some(executor) = executor {
+                // One argument, so the client's value cannot be read as a flag of its own
+                args.push(format!("--executor={}", executor));
+            }
+            start_job(jobs, "update", args)
+        }
+        ("POST", ["v1", "rollback"]) => match body_str("snapshot").as_deref().map(snapshot_arg) {
+            Some(Some(snapshot)) => start_job(jobs, "rollback", vec!["rollback".into(), "--".into(), snapshot]),
+            Some(None) => Response::error(400, "invalid snapshot name"),
+            None => Response::error(400, "'snapshot' is required"),
+        },
+        ("GET", ["v1", "pending"]) => match reboot::pending_reasons() {
+            Ok(reasons) => Response::ok(json!({ "pending": !reasons.is_empty(), "reasons": reasons })),
+            Err(e) => Response::error(500, &e.to_string()),
+        },
+        ("POST", ["v1", "apply"]) => {
+            let flag = match body_str("mode").as_deref() {
+                None | Some("reboot") => None,
+                Some("soft-reboot") => Some("--soft-reboot"),
+                Some("kexec") => Some("--kexec"),
+                Some("live") => Some("--live"),
+                Some(_) => return Response::error(400, "'mode' must be reboot, soft-reboot, kexec or live"),
+            };
+            let mut args = vec!["apply".to_string()];
+            args.extend(flag.map(String::from));
+            start_job(jobs, "apply", args)
+        }
+        ("GET", ["v1", "jobs"]) => to_json(&*jobs.lock().unwrap()),
+        ("GET", ["v1", "jobs", id]) => match find_job(jobs, id) {
+            Some(job) => to_json(&job),
+            None => Response::error(404, "no such job"),
+        },
+        (_, ["v1", ..]) => Response::error(405, "unsupported method or path"),
+        _ => Response::error(404, "unknown path"),
+    }
+}
+
+/// uid of the process at the other end of `stream`, from SO_PEERCRED
+fn peer_uid(stream: &UnixStream) -> Option<u32> {
+    let mut cred = libc::ucred { pid: 0, uid: 0, gid: 0 };
+    let mut len = std::mem::size_of::<libc::ucred>() as libc::socklen_t;
+    let rc = unsafe {
+        libc::getsockopt(
+            stream.as_raw_fd(),
+            libc::SOL_SOCKET,
+            libc::SO_PEERCRED,
+            &mut cred as *mut libc::ucred as *mut libc::c_void,
+            &mut len,
+        )
+    };
+    (rc == 0).then_some(cred.uid)
+}
+
+fn handle_connection(mut stream: UnixStream, jobs: Jobs) {
+    // The socket mode is the first guard; this one holds even if the mode is changed
+    if peer_uid(&stream) != Some(0) {
+        write_response(&mut stream, &Response::error(403, "root only"));
+        return;
+    }
+    let _ = stream.set_read_timeout(Some(READ_TIMEOUT));
+    let request = match read_request(&stream) {
+        Some(r) => r,
+        None => {
+            write_response(&mut stream, &Response::error(400, "malformed request"));
+            return;
+        }
+    };
+
+    let segments: Vec<&str> = request.path.trim_matches('/').split('/').collect();
+    if let ("GET", ["v1", "jobs", id, "progress"]) = (request.method.as_str(), segments.as_slice()) {
+        stream_progress(&mut stream, &jobs, id);
+        return;
+    }
+    write_response(&mut stream, &route(&request, &jobs));
+}
+
+/// Serves the REST API on a root-only unix socket until killed
+pub fn handle_serve(socket: &str) -> Result<()> {
+    let path = Path::new(socket);
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir).into_diagnostic()?;
+    }
+    if path.exists() {
+        fs::remove_file(path).into_diagnostic()?;
+    }
+
+    // Created 0600 from the start: between bind and chmod any local user could connect
+    let umask = unsafe { libc::umask(0o177) };
+    let bound = UnixListener::bind(path);
+    unsafe { libc::umask(umask) };
+    let listener = bound.map_err(|e| HammerError::IoError(format!("Cannot bind {}: {}", socket, e)))?;
+    fs::set_permissions(path, fs::Permissions::from_mode(0o600)).into_diagnostic()?;
+
+    Logger::info(&format!("API listening on {}", socket));
+    let jobs: Jobs = Arc::new(Mutex::new(Vec::new()));
+    for stream in listener.incoming() {
+        match stream {
+            Ok(stream) => {
+                let jobs = jobs.clone();
+                thread::spawn(move || handle_connection(stream, jobs));
+            }
+            Err(e) => Logger::warn(&format!("API connection failed: {}", e)),
+        }
+    }
+    Ok(())
+}
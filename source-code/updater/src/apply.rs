@@ -0,0 +1,161 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::exec::Exec;
+use hammer_core::{packages, root_device, run_change, run_command, HammerError, Logger};
+use std::fs;
+use std::path::Path;
+
+use crate::{kernel, reboot};
+
+/// systemd soft-reboot switches into this root when it is a mount point
+const NEXTROOT: &str = "/run/nextroot";
+
+fn running_kernel() -> String {
+    run_command("uname", &["-r"], "Running Kernel").unwrap_or_default().trim().to_string()
+}
+
+/// Mounts the current @ on /run/nextroot and returns its newest kernel
+fn prepare_nextroot() -> Result<Option<String>> {
+    fs::create_dir_all(NEXTROOT).into_diagnostic()?;
+    if run_command("mountpoint", &["-q", NEXTROOT], "Check Nextroot").is_err() {
+        let device = root_device()?;
+        run_change("mount", &["-t", "btrfs", "-o", "subvol=@", &device, NEXTROOT], "Mount Next Root")?;
+    }
+    Ok(kernel::newest_in(Path::new(NEXTROOT)))
+}
+
+fn release_nextroot() {
+    let _ = run_change("umount", &[NEXTROOT], "Unmount Next Root");
+}
+
+/// Packages whose update can never be activated without a reboot
+const LIVE_UNSAFE: &[&str] = &["linux-image-", "libc6", "libc-bin", "systemd", "libsystemd0", "dbus", "udev"];
+
+/// Trees synced by --live; /etc keeps local files that only exist in the running root
+const LIVE_TREES: &[(&str, bool)] = &[("usr", true), ("etc", false), ("var/lib/dpkg", true)];
+
+fn live_blockers(diff: &packages::PackageDiff) -> Vec<String> {
+    diff.added.iter().map(|(n, _)| n)
+    .chain(diff.removed.iter().map(|(n, _)| n))
+    .chain(diff.changed.iter().map(|(n, _, _)| n))
+    .filter(|name| LIVE_UNSAFE.iter().any(|p| name == p || (p.ends_with('-') && name.starts_with(p))))
+    .cloned()
+    .collect()
+}
+
+/// Copies the new root's files into the running system; @ stays the reboot target
+fn apply_live() -> Result<()> {
+    let next = Path::new(NEXTROOT);
+    let diff = packages::diff(&packages::installed_packages(Path::new("/")), &packages::installed_packages(next));
+
+    if diff.is_empty() {
+        Logger::info("Running system already matches the new root.");
+        return Ok(());
+    }
+    let blockers = live_blockers(&diff);
+    if !blockers.is_empty() {
+        return Err(HammerError::ConfigError(format!(
+            "Live apply refused: {} changed. Reboot with 'hammer apply' instead.",
+            blockers.join(", ")
+        )).into());
+    }
+
+    Logger::info(&format!("Live-applying package changes {}...", diff.summary()));
+    for (tree, delete) in LIVE_TREES {
+        let src = format!("{}/{}/", NEXTROOT, tree);
+        let dest = format!("/{}/", tree);
+        let mut args = vec!["-aHAX", "--checksum", "--info=stats1"];
+        if *delete {
+            args.push("--delete");
+        }
+        args.push(&src);
+        args.push(&dest);
+
+        let status = Exec::new("rsync", &args, "Copy Tree Live").changes_system().status()?;
+        if !status.success() {
+            return Err(HammerError::CommandFailed(format!("rsync of /{} failed", tree)).into());
+        }
+    }
+
+    let _ = run_change("systemctl", &["daemon-reload"], "Reloading Daemon");
+    Logger::success("Changes are live. The new root stays the boot target.");
+    Ok(())
+}
+
+fn full_reboot() -> Result<()> {
+    reboot::handle_reboot(reboot::RebootWhen::Now, true)
+}
+
+/// Activates the pending root without firmware reboot when the kernel stays the same
+pub fn handle_apply(soft_reboot: bool, kexec: bool, live: bool) -> Result<()> {
+    Logger::section("APPLY");
+
+    let reasons = reboot::pending_reasons()?;
+    if reasons.is_empty() {
+        Logger::info("Nothing pending to apply.");
+        Logger::end_section();
+        return Ok(());
+    }
+    for reason in &reasons {
+        Logger::info(&format!("Pending: {}", reason));
+    }
+
+    let running = running_kernel();
+    let target_kernel = prepare_nextroot()?;
+    let kernel_changed = target_kernel.as_deref() != Some(running.as_str());
+
+    if live {
+        let result = apply_live();
+        release_nextroot();
+        Logger::end_section();
+        return result;
+    }
+
+    if soft_reboot {
+        if kernel_changed {
+            release_nextroot();
+            Logger::warn(&format!(
+                "Kernel changes ({} -> {}); soft-reboot cannot apply it. Falling back to a full reboot.",
+                running, target_kernel.as_deref().unwrap_or("unknown")
+            ));
+            Logger::end_section();
+            return full_reboot();
+        }
+        Logger::success("Userspace-only change. Soft-rebooting into the new root...");
+        Logger::end_section();
+        run_change("systemctl", &["soft-reboot"], "Soft Reboot")?;
+        return Ok(());
+    }
+
+    if kexec {
+        let version = match target_kernel {
+            Some(v) => v,
+            None => {
+                release_nextroot();
+                return Err(HammerError::BtrfsError("No kernel found in the new root".into()).into());
+            }
+        };
+        // /boot may be part of @ or a separate partition
+        let boot = if Path::new(NEXTROOT).join("boot").join(format!("vmlinuz-{}", version)).exists() {
+            Path::new(NEXTROOT).join("boot")
+        } else {
+            Path::new("/boot").to_path_buf()
+        };
+        let image = boot.join(format!("vmlinuz-{}", version));
+        let initrd = boot.join(format!("initrd.img-{}", version));
+        run_change("kexec", &[
+            "-l", &image.to_string_lossy(),
+            &format!("--initrd={}", initrd.display()),
+            "--reuse-cmdline",
+        ], "Load Kernel")?;
+        release_nextroot();
+
+        Logger::success(&format!("Kernel {} loaded. Rebooting via kexec...", version));
+        Logger::end_section();
+        run_change("systemctl", &["kexec"], "Kexec Reboot")?;
+        return Ok(());
+    }
+
+    release_nextroot();
+    Logger::end_section();
+    full_reboot()
+}
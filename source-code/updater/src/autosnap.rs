@@ -0,0 +1,170 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::config::{self, PackageOp};
+use hammer_core::{journal, packages, state, storage, store, HammerError, Logger};
+use std::fs;
+use std::io::Read;
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+
+use crate::{create_snapshot_name, os, snapshots};
+
+// Safety net for package changes made with plain apt (config/apt). The DPkg::Pre-Invoke
+// hook runs `snapshot --kind apt-external --apt-hook` before every dpkg run and opens a
+// journal transaction that `apt-finished` (DPkg::Post-Invoke) completes with the
+// package changes. The older `auto-snapshot` hook (DPkg::Pre-Install-Pkgs) reads the
+// run from stdin and snapshots only for the operations in auto_snapshot_on.
+
+/// Kind of the automatic snapshots, the part of the name after the date
+pub const KIND: &str = "pkg";
+
+/// Set for everything hammer starts; its commands take their own snapshots
+pub const TRANSACTION_ENV: &str = "HAMMER_TRANSACTION";
+
+/// The open apt-external transaction: `id` and a copy of var/lib/dpkg/status from before
+const EXTERNAL_DIR: &str = "/run/hammer/apt-external";
+
+/// Operations in an APT hook protocol version 2 description
+fn operations(input: &str) -> Vec<PackageOp> {
+    // "VERSION 2", apt's configuration, an empty line, then one line per package:
+    // "name old-version < new-version /var/cache/apt/archives/x.deb" or "... **REMOVE**"
+    let mut ops = Vec::new();
+    for line in input.split_once("\n\n").map(|(_, pkgs)| pkgs).unwrap_or_default().lines() {
+        let op = match line.split_whitespace().last() {
+            Some("**REMOVE**") => PackageOp::Remove,
+            Some("**CONFIGURE**") | None => continue,
+            Some(_) => PackageOp::Install,
+        };
+        if !ops.contains(&op) {
+            ops.push(op);
+        }
+    }
+    ops
+}
+
+/// Why no snapshot is taken even though one is due; apt inside a staged root or container included
+fn skip_reason() -> Option<&'static str> {
+    if std::env::var_os(TRANSACTION_ENV).is_some() {
+        return Some("run by hammer");
+    }
+    if os::parked_boot().is_some() {
+        return Some("running a parked OS");
+    }
+    if Path::new("/run/systemd/container").exists() || Path::new("/run/.containerenv").exists() {
+        return Some("inside a container");
+    }
+    let root = fs::metadata("/").ok()?;
+    let init_root = fs::metadata("/proc/1/root").ok()?;
+    if (root.dev(), root.ino()) != (init_root.dev(), init_root.ino()) {
+        return Some("inside a chroot");
+    }
+    None
+}
+
+/// The APT hook. Problems are reported but never fail the apt run.
+pub fn handle_hook() -> Result<()> {
+    let mut input = String::new();
+    let _ = std::io::stdin().read_to_string(&mut input);
+    let cfg = match config::load() {
+        Ok(cfg) => cfg.snapshots,
+        Err(e) => {
+            Logger::warn(&format!("hammer: no automatic snapshot, config unreadable: {}", e));
+            return Ok(());
+        }
+    };
+    if !operations(&input).iter().any(|op| cfg.auto_snapshot_on.contains(op)) {
+        return Ok(());
+    }
+    if let Some(reason) = skip_reason() {
+        Logger::log(&format!("Automatic snapshot skipped: {}", reason));
+        return Ok(());
+    }
+    if Path::new(EXTERNAL_DIR).join("id").exists() {
+        Logger::log("Automatic snapshot skipped: the apt-external hook took one");
+        return Ok(());
+    }
+    if let Err(e) = snapshot(cfg.auto_snapshot_keep) {
+        Logger::warn(&format!("hammer: automatic snapshot failed: {}", e));
+    }
+    Ok(())
+}
+
+fn snapshot(keep: usize) -> Result<()> {
+    let driver = storage::driver()?;
+    let name = create_snapshot_name(KIND);
+    driver.snapshot(&name)?;
+    println!("hammer: snapshot {} taken before this apt run", name);
+
+    let pinned = state::pinned_snapshots();
+    let automatic: Vec<String> = driver.list()?
+    .into_iter()
+    .filter(|s| snapshots::kind_of(s) == KIND && !pinned.contains(s))
+    .collect();
+    for old in &automatic[..automatic.len().saturating_sub(keep.max(1))] {
+        driver.delete(old)?;
+        Logger::log(&format!("Deleted automatic snapshot {}", old));
+    }
+    Ok(())
+}
+
+/// Snapshot of the running root of kind `kind`. As the apt hook it is skipped for apt
+/// runs hammer started and opens a journal transaction; failures never stop apt.
+pub fn handle_snapshot(kind: &str, apt_hook: bool) -> Result<()> {
+    if kind.is_empty() || !kind.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-') {
+        return Err(HammerError::ConfigError(format!("Invalid kind '{}': use a-z, 0-9 and -", kind)).into());
+    }
+    if !apt_hook {
+        let name = create_snapshot_name(kind);
+        storage::driver()?.snapshot(&name)?;
+        Logger::success(&format!("Snapshot {} created.", name));
+        return Ok(());
+    }
+    if let Some(reason) = skip_reason() {
+        Logger::log(&format!("apt-external snapshot skipped: {}", reason));
+        return Ok(());
+    }
+    if let Err(e) = open_external(kind) {
+        Logger::warn(&format!("hammer: no snapshot before this apt run: {}", e));
+    }
+    Ok(())
+}
+
+fn open_external(kind: &str) -> Result<()> {
+    let dir = Path::new(EXTERNAL_DIR);
+    if dir.join("id").exists() {
+        // Left open by a run whose Post-Invoke never came; its snapshot is still the way back
+        return Ok(());
+    }
+    let name = create_snapshot_name(kind);
+    storage::driver()?.snapshot(&name)?;
+    fs::create_dir_all(dir.join("var/lib/dpkg")).into_diagnostic()?;
+    fs::copy("/var/lib/dpkg/status", dir.join("var/lib/dpkg/status")).into_diagnostic()?;
+    store::write(&dir.join("id"), &name)?;
+    // apt owns this run; the hook process is gone long before it ends
+    let tx = journal::Transaction { pid: None, ..journal::Transaction::begin(&name, kind) };
+    journal::save(&tx)?;
+    println!("hammer: snapshot {} taken before this apt run", name);
+    Ok(())
+}
+
+/// ID of the transaction of an apt run that has not finished yet
+pub fn external_in_progress() -> Option<String> {
+    fs::read_to_string(Path::new(EXTERNAL_DIR).join("id")).ok().map(|id| id.trim().to_string())
+}
+
+/// Closes the transaction `snapshot --apt-hook` opened with the packages apt changed
+pub fn handle_apt_finished() -> Result<()> {
+    let dir = Path::new(EXTERNAL_DIR);
+    let Ok(id) = fs::read_to_string(dir.join("id")) else {
+        return Ok(());
+    };
+    let result = journal::load(id.trim()).and_then(|mut tx| {
+        let diff = packages::diff(&packages::installed_packages(dir), &packages::installed_packages(Path::new("/")));
+        tx.set_packages(&diff);
+        tx.finish(if diff.is_empty() { "unchanged" } else { "success" })
+    });
+    let _ = fs::remove_dir_all(dir);
+    if let Err(e) = result {
+        Logger::warn(&format!("hammer: apt run not recorded in the journal: {}", e));
+    }
+    Ok(())
+}
@@ -0,0 +1,436 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::state::STATE_DIR;
+use hammer_core::{mount_btrfs_root, pool, run_change, run_command, store, umount_btrfs_root, HammerError, Logger};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::export::run_pipeline;
+use crate::transfer::Transfer;
+use crate::{create_snapshot_name, s3, snapshots};
+
+const TARGETS_FILE: &str = "backup-targets.json";
+
+/// Read-only parents for incremental sends, one directory per target.
+/// Outside @snapshots so status and clean never see them.
+const PARENTS_SUBVOL: &str = "@hammer-backup";
+
+/// S3 objects: "<snapshot>.btrfs.zst" (full) or "<snapshot>~<parent>.btrfs.zst" (incremental)
+const STREAM_SUFFIX: &str = ".btrfs.zst";
+
+#[derive(Serialize, Deserialize, Clone)]
+pub struct Target {
+    pub name: String,
+    pub url: String,
+    /// Backups kept on the target
+    pub keep: usize,
+    /// Newest snapshot on the target; its local read-only copy is the next parent
+    #[serde(default)]
+    pub last: Option<String>,
+}
+
+enum Location {
+    Local(PathBuf),
+    /// ssh destination ("user@host"), port and remote directory
+    Ssh(String, Option<String>, String),
+    /// "s3://bucket/prefix" without trailing slash
+    S3(String),
+}
+
+impl Location {
+    fn parse(url: &str) -> Result<Self> {
+        if let Some(rest) = url.strip_prefix("ssh://") {
+            let (host, path) = rest.split_once('/').ok_or_else(|| {
+                HammerError::ConfigError(format!("'{}' has no remote path (ssh://user@host/path)", url))
+            })?;
+            let (host, port) = match host.rsplit_once(':') {
+                Some((h, p)) => (h.to_string(), Some(p.to_string())),
+                None => (host.to_string(), None),
+            };
+            return Ok(Location::Ssh(host, port, format!("/{}", path)));
+        }
+        if url.starts_with("s3://") {
+            return Ok(Location::S3(url.trim_end_matches('/').to_string()));
+        }
+        let path = url.strip_prefix("file://").unwrap_or(url);
+        if !path.starts_with('/') {
+            return Err(HammerError::ConfigError(format!(
+                "Unsupported backup target '{}'. Use /path, ssh://user@host/path or s3://bucket/prefix.", url
+            )).into());
+        }
+        Ok(Location::Local(PathBuf::from(path)))
+    }
+
+    fn ssh_args(host: &str, port: &Option<String>, remote: &[&str]) -> Vec<String> {
+        let mut args = Vec::new();
+        if let Some(port) = port {
+            args.extend(["-p".to_string(), port.clone()]);
+        }
+        args.push(host.to_string());
+        args.extend(remote.iter().map(|s| s.to_string()));
+        args
+    }
+
+    /// Entries on the target: subvolume names, or S3 stream object names
+    fn list(&self) -> Result<Vec<String>> {
+        let out = match self {
+            Location::Local(path) => {
+                return Ok(fs::read_dir(path)
+                .into_diagnostic()?
+                .flatten()
+                .map(|e| e.file_name().to_string_lossy().to_string())
+                .collect())
+            }
+            Location::Ssh(host, port, path) => {
+                run_command("ssh", &as_refs(&Self::ssh_args(host, port, &["ls", "-1", path])), "List Backups")?
+            }
+            Location::S3(url) => return s3::Client::load()?.list(url),
+        };
+        Ok(out.lines().map(|l| l.trim().to_string()).filter(|l| !l.is_empty()).collect())
+    }
+
+    fn delete(&self, entry: &str) -> Result<()> {
+        match self {
+            Location::Local(path) => {
+                run_change("btrfs", &["subvolume", "delete", &path.join(entry).to_string_lossy()], "Delete Backup")?;
+            }
+            Location::Ssh(host, port, path) => {
+                let remote = format!("{}/{}", path, entry);
+                run_change("ssh", &as_refs(&Self::ssh_args(host, port, &["btrfs", "subvolume", "delete", &remote])), "Delete Backup")?;
+            }
+            Location::S3(url) => s3::Client::load()?.delete(&format!("{}/{}", url, entry))?,
+        }
+        Ok(())
+    }
+
+    /// Stages that store a send stream of `snapshot` (incremental on `parent`)
+    fn receive_stages(&self, snapshot: &str, parent: Option<&str>) -> Result<Vec<(&'static str, Vec<String>)>> {
+        Ok(match self {
+            Location::Local(path) => vec![("btrfs", vec!["receive".into(), path.to_string_lossy().to_string()])],
+            Location::Ssh(host, port, path) => vec![("ssh", Self::ssh_args(host, port, &["btrfs", "receive", path]))],
+            Location::S3(url) => vec![
+                Transfer::load().zstd(),
+                s3::Client::load()?.upload_stage(&format!("{}/{}", url, stream_name(snapshot, parent))),
+            ],
+        })
+    }
+}
+
+fn as_refs(args: &[String]) -> Vec<&str> {
+    args.iter().map(|s| s.as_str()).collect()
+}
+
+fn stream_name(snapshot: &str, parent: Option<&str>) -> String {
+    match parent {
+        Some(parent) => format!("{}~{}{}", snapshot, parent, STREAM_SUFFIX),
+        None => format!("{}{}", snapshot, STREAM_SUFFIX),
+    }
+}
+
+/// "<snapshot>~<parent>.btrfs.zst" -> (snapshot, parent)
+fn parse_stream(object: &str) -> Option<(String, Option<String>)> {
+    let stem = object.strip_suffix(STREAM_SUFFIX)?;
+    Some(match stem.split_once('~') {
+        Some((snap, parent)) => (snap.to_string(), Some(parent.to_string())),
+        None => (stem.to_string(), None),
+    })
+}
+
+fn targets_file() -> PathBuf {
+    Path::new(STATE_DIR).join(TARGETS_FILE)
+}
+
+pub fn load_targets() -> Vec<Target> {
+    fs::read_to_string(targets_file())
+    .ok()
+    .and_then(|s| serde_json::from_str(&s).ok())
+    .unwrap_or_default()
+}
+
+fn save_targets(targets: &[Target]) -> Result<()> {
+    store::write(&targets_file(), serde_json::to_string_pretty(targets).into_diagnostic()?)
+}
+
+fn find_target(name: &str) -> Result<Target> {
+    load_targets()
+    .into_iter()
+    .find(|t| t.name == name)
+    .ok_or_else(|| HammerError::ConfigError(format!("No backup target '{}'. See 'hammer backup list'.", name)).into())
+}
+
+/// "/mnt/usb/backups" -> "mnt-usb-backups"
+fn default_name(url: &str) -> String {
+    let rest = url.split_once("://").map(|(_, r)| r).unwrap_or(url);
+    rest.split(|c: char| !c.is_ascii_alphanumeric())
+    .filter(|p| !p.is_empty())
+    .collect::<Vec<_>>()
+    .join("-")
+}
+
+pub fn handle_add(url: &str, name: Option<String>, keep: usize) -> Result<()> {
+    Location::parse(url)?;
+    let name = name.unwrap_or_else(|| default_name(url));
+    let mut targets = load_targets();
+    if targets.iter().any(|t| t.name == name) {
+        return Err(HammerError::ConfigError(format!("Backup target '{}' already exists.", name)).into());
+    }
+    targets.push(Target { name: name.clone(), url: url.to_string(), keep: keep.max(1), last: None });
+    save_targets(&targets)?;
+    Logger::success(&format!("Added backup target '{}' ({}), keeping {} backups.", name, url, keep.max(1)));
+    Logger::info("Enable hammer-backup.timer to run it on a schedule, or run 'hammer backup run' now.");
+    Ok(())
+}
+
+pub fn handle_remove(name: &str) -> Result<()> {
+    let target = find_target(name)?;
+    let mut targets = load_targets();
+    targets.retain(|t| t.name != name);
+    save_targets(&targets)?;
+
+    // The local parent is useless without its target
+    mount_btrfs_root()?;
+    let dir = parents_dir(&target.name);
+    if let Some(last) = &target.last {
+        let _ = run_change("btrfs", &["subvolume", "delete", &dir.join(last).to_string_lossy()], "Delete Backup Parent");
+    }
+    let _ = fs::remove_dir(&dir);
+    umount_btrfs_root()?;
+    Logger::success(&format!("Removed backup target '{}'. Backups on {} were kept.", name, target.url));
+    Ok(())
+}
+
+pub fn handle_list() -> Result<()> {
+    Logger::section("BACKUP TARGETS");
+    let targets = load_targets();
+    if targets.is_empty() {
+        Logger::info("No backup targets. Add one with 'hammer backup add <target>'.");
+    }
+    for t in &targets {
+        Logger::info(&format!(
+            "{: <20} {: <40} keep {: <3} last {}",
+            t.name, t.url, t.keep, t.last.as_deref().unwrap_or("-")
+        ));
+    }
+    Logger::end_section();
+    Ok(())
+}
+
+fn parents_dir(target: &str) -> PathBuf {
+    pool::top_level().join(PARENTS_SUBVOL).join(target)
+}
+
+/// Backs up the running root (@) to `target`, incrementally when the last parent is still on both sides
+fn send(target: &mut Target) -> Result<()> {
+    let location = Location::parse(&target.url)?;
+    let remote = location.list()?;
+    let dir = parents_dir(&target.name);
+    fs::create_dir_all(&dir).into_diagnostic()?;
+
+    let parent = target.last.clone().filter(|last| {
+        dir.join(last).exists() && remote.iter().any(|r| r == last || parse_stream(r).map(|(s, _)| s) == Some(last.clone()))
+    });
+
+    let name = create_snapshot_name("backup");
+    let snap = dir.join(&name);
+    run_change(
+        "btrfs",
+        &["subvolume", "snapshot", "-r", &pool::top_level().join("@").to_string_lossy(), &snap.to_string_lossy()],
+        "Snapshot Root For Backup",
+    )?;
+
+    let mut send_args = vec!["send".to_string(), "-q".to_string()];
+    if let Some(parent) = &parent {
+        send_args.extend(["-p".to_string(), dir.join(parent).to_string_lossy().to_string()]);
+    }
+    send_args.push(snap.to_string_lossy().to_string());
+    let mut stages = vec![("btrfs", send_args)];
+    stages.extend(Transfer::load().buffer());
+    stages.extend(location.receive_stages(&name, parent.as_deref())?);
+
+    Logger::info(&format!(
+        "Sending {} to {} ({})...",
+        name, target.url, if parent.is_some() { "incremental" } else { "full" }
+    ));
+    if let Err(e) = run_pipeline(&stages) {
+        let _ = run_change("btrfs", &["subvolume", "delete", &snap.to_string_lossy()], "Delete Backup Snapshot");
+        return Err(e);
+    }
+
+    // Only the newest copy is needed as the next parent
+    if let Some(old) = &target.last {
+        if dir.join(old).exists() {
+            let _ = run_change("btrfs", &["subvolume", "delete", &dir.join(old).to_string_lossy()], "Delete Old Parent");
+        }
+    }
+    target.last = Some(name);
+    prune(&location, target.keep)
+}
+
+/// Deletes backups beyond `keep`. S3 streams stay while a kept backup's chain needs them.
+fn prune(location: &Location, keep: usize) -> Result<()> {
+    let entries = location.list()?;
+    let doomed: Vec<String> = match location {
+        Location::S3(_) => {
+            let streams: Vec<(String, (String, Option<String>))> = entries
+            .iter()
+            .filter_map(|o| parse_stream(o).map(|s| (o.clone(), s)))
+            .collect();
+            let mut snaps: Vec<&String> = streams.iter().map(|(_, (s, _))| s).collect();
+            snaps.sort_by_key(|s| snapshots::parse_created(s));
+            let mut needed: BTreeSet<String> = snaps.iter().rev().take(keep).map(|s| s.to_string()).collect();
+            // Walk each kept backup back to its full stream
+            let mut queue: Vec<String> = needed.iter().cloned().collect();
+            while let Some(snap) = queue.pop() {
+                let parent = streams.iter().find(|(_, (s, _))| *s == snap).and_then(|(_, (_, p))| p.clone());
+                if let Some(parent) = parent {
+                    if needed.insert(parent.clone()) {
+                        queue.push(parent);
+                    }
+                }
+            }
+            streams.into_iter().filter(|(_, (s, _))| !needed.contains(s)).map(|(o, _)| o).collect()
+        }
+        _ => {
+            let mut snaps: Vec<String> = entries.into_iter().filter(|e| snapshots::parse_created(e).is_some()).collect();
+            snaps.sort_by_key(|s| snapshots::parse_created(s));
+            let excess = snaps.len().saturating_sub(keep);
+            snaps.truncate(excess);
+            snaps
+        }
+    };
+    for entry in &doomed {
+        Logger::info(&format!("Retention: deleting {}", entry));
+        location.delete(entry)?;
+    }
+    Ok(())
+}
+
+/// Backs up to one target, or to all of them (what hammer-backup.timer runs)
+pub fn handle_run(only: Option<String>) -> Result<()> {
+    Logger::section("BACKUP");
+    let mut targets = load_targets();
+    if let Some(name) = &only {
+        find_target(name)?;
+    }
+    if targets.is_empty() {
+        Logger::info("No backup targets configured.");
+        Logger::end_section();
+        return Ok(());
+    }
+
+    mount_btrfs_root()?;
+    let mut failed = Vec::new();
+    for target in targets.iter_mut().filter(|t| only.as_ref().map_or(true, |n| *n == t.name)) {
+        match send(target) {
+            Ok(()) => Logger::success(&format!("{}: backed up as {}", target.name, target.last.as_deref().unwrap_or("-"))),
+            Err(e) => {
+                Logger::error(&format!("{}: {}", target.name, e));
+                failed.push(target.name.clone());
+            }
+        }
+    }
+    umount_btrfs_root()?;
+    save_targets(&targets)?;
+    Logger::end_section();
+
+    if !failed.is_empty() {
+        return Err(HammerError::CommandFailed(format!("Backup failed for: {}", failed.join(", "))).into());
+    }
+    Ok(())
+}
+
+/// Receives a backup into @snapshots as a writable snapshot, ready for `hammer rollback`
+pub fn handle_restore(name: &str, snapshot: Option<String>) -> Result<()> {
+    Logger::section("BACKUP RESTORE");
+    let target = find_target(name)?;
+    let location = Location::parse(&target.url)?;
+    let entries = location.list()?;
+
+    let mut available: Vec<String> = match location {
+        Location::S3(_) => entries.iter().filter_map(|o| parse_stream(o)).map(|(s, _)| s).collect(),
+        _ => entries.iter().filter(|e| snapshots::parse_created(e).is_some()).cloned().collect(),
+    };
+    available.sort();
+    let snapshot = match snapshot {
+        Some(s) if available.contains(&s) => s,
+        Some(s) => return Err(HammerError::ConfigError(format!("'{}' is not on {}.", s, target.url)).into()),
+        None => available.last().cloned().ok_or_else(|| HammerError::ConfigError(format!("No backups on {}.", target.url)))?,
+    };
+
+    mount_btrfs_root()?;
+    let result = receive(&location, &entries, &snapshot);
+    umount_btrfs_root()?;
+    result?;
+
+    Logger::success(&format!("Restored {} into @snapshots.", snapshot));
+    Logger::info(&format!("Boot into it with 'hammer rollback {}'.", snapshot));
+    Logger::end_section();
+    Ok(())
+}
+
+fn receive(location: &Location, entries: &[String], snapshot: &str) -> Result<()> {
+    let snap_dir = pool::top_level().join("@snapshots");
+    if snap_dir.join(snapshot).exists() {
+        return Err(HammerError::BtrfsError(format!("{} already exists in @snapshots.", snapshot)).into());
+    }
+    fs::create_dir_all(&snap_dir).into_diagnostic()?;
+    let dest = snap_dir.to_string_lossy().to_string();
+    let receive = ("btrfs", vec!["receive".to_string(), dest.clone()]);
+
+    match location {
+        Location::Local(path) => {
+            run_pipeline(&[("btrfs", vec!["send".into(), "-q".into(), path.join(snapshot).to_string_lossy().to_string()]), receive])?;
+        }
+        Location::Ssh(host, port, path) => {
+            let remote = format!("{}/{}", path, snapshot);
+            run_pipeline(&[("ssh", Location::ssh_args(host, port, &["btrfs", "send", "-q", &remote])), receive])?;
+        }
+        Location::S3(url) => {
+            // Replay the chain from the full stream into a scratch directory
+            let mut chain = Vec::new();
+            let mut current = Some(snapshot.to_string());
+            while let Some(snap) = current {
+                let (object, parent) = entries
+                .iter()
+                .find_map(|o| parse_stream(o).filter(|(s, _)| *s == snap).map(|(_, p)| (o.clone(), p)))
+                .ok_or_else(|| HammerError::ConfigError(format!("Backup chain is missing {}", snap)))?;
+                chain.push((snap, object));
+                current = parent;
+            }
+            chain.reverse();
+
+            let client = s3::Client::load()?;
+            let scratch = pool::top_level().join(PARENTS_SUBVOL).join(".restore");
+            fs::create_dir_all(&scratch).into_diagnostic()?;
+            let result = (|| -> Result<()> {
+                for (_, object) in &chain {
+                    Logger::info(&format!("Receiving {}...", object));
+                    run_pipeline(&[
+                        client.download_stage(&format!("{}/{}", url, object)),
+                        Transfer::load().decompress(STREAM_SUFFIX).unwrap(),
+                        ("btrfs", vec!["receive".into(), scratch.to_string_lossy().to_string()]),
+                    ])?;
+                }
+                run_change(
+                    "btrfs",
+                    &["subvolume", "snapshot", &scratch.join(snapshot).to_string_lossy(), &snap_dir.join(snapshot).to_string_lossy()],
+                    "Restore Snapshot",
+                )?;
+                Ok(())
+            })();
+            for (snap, _) in &chain {
+                let _ = run_change("btrfs", &["subvolume", "delete", &scratch.join(snap).to_string_lossy()], "Delete Restore Scratch");
+            }
+            return result;
+        }
+    }
+
+    // Received subvolumes are read-only; hammer snapshots are not
+    run_change(
+        "btrfs",
+        &["property", "set", "-ts", &snap_dir.join(snapshot).to_string_lossy(), "ro", "false"],
+        "Make Restored Snapshot Writable",
+    )?;
+    Ok(())
+}
@@ -0,0 +1,169 @@
+use miette::Result;
+use hammer_core::output::print_table;
+use hammer_core::{run_change, run_command, store, HammerError, Logger};
+use regex::Regex;
+use std::fs;
+use std::path::Path;
+
+// GRUB settings hammer owns. They go to a drop-in that update-grub reads after
+// /etc/default/grub, which stays as the admin left it; the default entry is kept in
+// grubenv (GRUB_DEFAULT=saved) so it can follow the deployments without regenerating
+// grub.cfg. hammer's own entries carry the IDs hammer-rescue, hammer-os-NAME and
+// hammer-composefs-NAME.
+
+const DROP_IN: &str = "/etc/default/grub.d/hammer.cfg";
+
+const GRUB_CFG: &str = "/boot/grub/grub.cfg";
+
+/// Top-level menu entries of grub.cfg as (id, title), in menu order; submenus are skipped
+fn entries() -> Vec<(String, String)> {
+    let head = Regex::new(r#"^(menuentry|submenu)\s+['"]([^'"]*)['"]"#).unwrap();
+    let id = Regex::new(r#"(?:\$menuentry_id_option|--id)\s+['"]?([^'"\s{]+)"#).unwrap();
+    let content = fs::read_to_string(GRUB_CFG).unwrap_or_default();
+    let mut depth = 0usize;
+    let mut found = Vec::new();
+    for line in content.lines().map(str::trim) {
+        if let Some(cap) = head.captures(line) {
+            if depth == 0 && &cap[1] == "menuentry" {
+                let entry_id = id.captures(line).map(|c| c[1].to_string()).unwrap_or_default();
+                found.push((entry_id, cap[2].to_string()));
+            }
+            depth += 1;
+        } else if line == "}" {
+            depth = depth.saturating_sub(1);
+        }
+    }
+    found
+}
+
+/// The entry Debian generates for the running root (@)
+fn current_entry(entries: &[(String, String)]) -> Option<String> {
+    entries
+    .iter()
+    .find(|(id, _)| id.starts_with("gnulinux-simple-"))
+    .or_else(|| entries.first())
+    .map(|(id, _)| id.clone())
+}
+
+/// The deployment an entry boots, for hammer's entries and the current one
+fn deployment_of(id: &str, current: Option<&str>) -> String {
+    if Some(id) == current {
+        return "current".to_string();
+    }
+    if id == "hammer-rescue" {
+        return "@rescue".to_string();
+    }
+    id.strip_prefix("hammer-os-")
+    .map(|n| format!("os {}", n))
+    .or_else(|| id.strip_prefix("hammer-composefs-").map(|n| format!("composefs {}", n)))
+    .unwrap_or_else(|| "-".to_string())
+}
+
+/// Menu entry ID of a deployment: "current", "@rescue", a parked OS or a composefs image
+fn entry_for(deployment: &str, entries: &[(String, String)]) -> Result<String> {
+    let candidates = match deployment {
+        "current" | "@" => current_entry(entries).into_iter().collect(),
+        "@rescue" | "rescue" => vec!["hammer-rescue".to_string()],
+        name => vec![format!("hammer-os-{}", name), format!("hammer-composefs-{}", name)],
+    };
+    if let Some(id) = candidates.into_iter().find(|c| entries.iter().any(|(id, _)| id == c)) {
+        return Ok(id);
+    }
+    Err(HammerError::ConfigError(format!(
+        "No boot entry for '{}'. Snapshots become the default with 'hammer rollback'; see 'hammer boot show'.", deployment
+    )).into())
+}
+
+fn drop_in_value(key: &str) -> Option<String> {
+    fs::read_to_string(DROP_IN)
+    .ok()?
+    .lines()
+    .find_map(|l| l.strip_prefix(key)?.strip_prefix('='))
+    .map(|v| v.trim_matches('"').to_string())
+}
+
+/// Sets KEY=value in the drop-in; returns whether it changed
+fn set_drop_in(key: &str, value: &str) -> Result<bool> {
+    let line = format!("{}={}", key, value);
+    let content = fs::read_to_string(DROP_IN).unwrap_or_else(|_| {
+        "# Written by 'hammer boot'; /etc/default/grub is read first and left as it is.\n".to_string()
+    });
+    if content.lines().any(|l| l == line) {
+        return Ok(false);
+    }
+    let mut lines: Vec<String> = content.lines().filter(|l| !l.starts_with(&format!("{}=", key))).map(String::from).collect();
+    lines.push(line);
+    store::write(Path::new(DROP_IN), lines.join("\n") + "\n")?;
+    Ok(true)
+}
+
+fn saved_entry() -> Option<String> {
+    run_command("grub-editenv", &["list"], "Read grubenv")
+    .ok()?
+    .lines()
+    .find_map(|l| l.strip_prefix("saved_entry=").map(String::from))
+}
+
+/// Boots `deployment` by default from now on
+pub fn handle_set_default(deployment: &str) -> Result<()> {
+    if set_drop_in("GRUB_DEFAULT", "saved")? {
+        run_change("update-grub", &[], "Update GRUB")?;
+    }
+    let id = entry_for(deployment, &entries())?;
+    run_change("grub-set-default", &[&id], "Set Default Boot Entry")?;
+    Logger::success(&format!("{} boots by default ({}).", deployment, id));
+    Ok(())
+}
+
+/// Seconds the GRUB menu waits; 0 boots the default right away
+pub fn handle_set_timeout(seconds: u32) -> Result<()> {
+    if set_drop_in("GRUB_TIMEOUT", &seconds.to_string())? {
+        run_change("update-grub", &[], "Update GRUB")?;
+    }
+    Logger::success(&format!("The boot menu waits {} s.", seconds));
+    Ok(())
+}
+
+/// Default entry, timeout and the top-level entries with the deployments they boot
+pub fn handle_show() -> Result<()> {
+    let entries = entries();
+    let current = current_entry(&entries);
+    let saved = drop_in_value("GRUB_DEFAULT").filter(|v| v == "saved").and_then(|_| saved_entry());
+    let default = saved.clone().or_else(|| current.clone()).unwrap_or_default();
+
+    let mut rows = vec![vec!["".to_string(), "ID".to_string(), "TITLE".to_string(), "DEPLOYMENT".to_string()]];
+    for (id, title) in &entries {
+        rows.push(vec![
+            if *id == default { "*".to_string() } else { "".to_string() },
+            if id.is_empty() { "-".to_string() } else { id.clone() },
+            title.clone(),
+            deployment_of(id, current.as_deref()),
+        ]);
+    }
+    print_table(&rows);
+    println!();
+    println!("Default: {}", deployment_of(&default, current.as_deref()));
+    println!("Timeout: {}", drop_in_value("GRUB_TIMEOUT").map(|t| format!("{} s", t)).unwrap_or_else(|| "from /etc/default/grub".to_string()));
+    Ok(())
+}
+
+/// Points the saved default back at the current deployment when its entry is gone,
+/// e.g. after the image or OS it booted was removed. Call after update-grub.
+pub fn reconcile() {
+    if drop_in_value("GRUB_DEFAULT").as_deref() != Some("saved") {
+        return;
+    }
+    let entries = entries();
+    let Some(saved) = saved_entry() else {
+        return;
+    };
+    if entries.iter().any(|(id, _)| *id == saved) {
+        return;
+    }
+    if let Some(current) = current_entry(&entries) {
+        match run_change("grub-set-default", &[&current], "Set Default Boot Entry") {
+            Ok(_) => Logger::warn(&format!("Default boot entry {} no longer exists; the current deployment boots by default.", saved)),
+            Err(e) => Logger::warn(&format!("Default boot entry {} no longer exists and was not reset: {}", saved, e)),
+        }
+    }
+}
@@ -0,0 +1,133 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::state::{self, STATE_DIR};
+use hammer_core::{mount_btrfs_root, packages, pool, store, umount_btrfs_root, HammerError};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+
+use crate::snapshots;
+use crate::status::{self, DeploymentRow};
+
+/// World-readable summaries for unprivileged status, history and diff --cached.
+/// Written by root runs; never contains journal attachments or config.
+const CACHE_SUBDIR: &str = "cache";
+const DEPLOYMENTS: &str = "deployments.json";
+const PACKAGES_SUBDIR: &str = "packages";
+
+#[derive(Serialize, Deserialize)]
+pub struct Deployments {
+    pub updated: String,
+    pub rows: Vec<DeploymentRow>,
+}
+
+fn cache_dir() -> PathBuf {
+    Path::new(STATE_DIR).join(CACHE_SUBDIR)
+}
+
+fn write_public(path: &Path, content: &str) -> Result<()> {
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir).into_diagnostic()?;
+        fs::set_permissions(dir, fs::Permissions::from_mode(0o755)).into_diagnostic()?;
+    }
+    store::write_mode(path, content, 0o644)
+}
+
+pub fn write_deployments(rows: &[DeploymentRow]) -> Result<()> {
+    // Readers below STATE_DIR need to traverse it
+    let _ = fs::set_permissions(STATE_DIR, fs::Permissions::from_mode(0o755));
+    let cached = Deployments {
+        updated: chrono::Local::now().format("%Y-%m-%d %H:%M").to_string(),
+        rows: rows.to_vec(),
+    };
+    write_public(&cache_dir().join(DEPLOYMENTS), &serde_json::to_string_pretty(&cached).into_diagnostic()?)
+}
+
+pub fn read_deployments() -> Result<Deployments> {
+    let path = cache_dir().join(DEPLOYMENTS);
+    let content = fs::read_to_string(&path).map_err(|_| {
+        HammerError::ConfigError(format!(
+            "No cached state in {}. Run 'sudo hammer status' once to create it.", path.display()
+        ))
+    })?;
+    serde_json::from_str(&content).into_diagnostic()
+}
+
+fn packages_path(snapshot: &str) -> PathBuf {
+    cache_dir().join(PACKAGES_SUBDIR).join(snapshot)
+}
+
+/// Package list of a snapshot as of the last root run
+pub fn read_packages(snapshot: &str) -> Option<BTreeMap<String, String>> {
+    let content = fs::read_to_string(packages_path(snapshot)).ok()?;
+    Some(
+        content
+        .lines()
+        .filter_map(|l| l.split_once(' '))
+        .map(|(n, v)| (n.to_string(), v.to_string()))
+        .collect(),
+    )
+}
+
+/// Rebuilds the cache: deployment rows plus package lists of snapshots not cached yet.
+/// Snapshots never change, so their lists are written once and dropped with them.
+pub fn refresh() -> Result<()> {
+    let rows = status::collect()?;
+    write_deployments(&rows)?;
+
+    let names: Vec<String> = rows
+    .iter()
+    .filter(|r| r.path.starts_with("@snapshots/"))
+    .map(|r| r.name.clone())
+    .collect();
+    let missing: Vec<&String> = names.iter().filter(|n| !packages_path(n).exists()).collect();
+    if !missing.is_empty() {
+        mount_btrfs_root()?;
+        for name in missing {
+            let pkgs = packages::installed_packages(&pool::top_level().join("@snapshots").join(name));
+            let content: String = pkgs.iter().map(|(n, v)| format!("{} {}\n", n, v)).collect();
+            write_public(&packages_path(name), &content)?;
+        }
+        umount_btrfs_root()?;
+    }
+
+    for entry in fs::read_dir(cache_dir().join(PACKAGES_SUBDIR)).into_iter().flatten().flatten() {
+        let name = entry.file_name().to_string_lossy().to_string();
+        if !names.contains(&name) {
+            let _ = fs::remove_file(entry.path());
+        }
+    }
+    Ok(())
+}
+
+/// Snapshot name from the cache: exact match, or the only fuzzy match; None means the newest
+pub fn resolve(query: Option<&str>) -> Result<String> {
+    let mut names: Vec<String> = read_deployments()?
+    .rows
+    .into_iter()
+    .filter(|r| r.path.starts_with("@snapshots/"))
+    .map(|r| r.name)
+    .collect();
+    names.sort_by(|a, b| snapshots::parse_created(b).cmp(&snapshots::parse_created(a)).then_with(|| b.cmp(a)));
+
+    let query = match query {
+        Some(q) => q,
+        None => return names.into_iter().next().ok_or_else(|| HammerError::ConfigError("No snapshots in the cache".into()).into()),
+    };
+    if names.iter().any(|n| n == query) {
+        return Ok(query.to_string());
+    }
+    if let Some(target) = state::aliases().get(query) {
+        if names.contains(target) {
+            return Ok(target.clone());
+        }
+        return Err(HammerError::ConfigError(format!("Alias '{}' points to {}, which is not in the cache", query, target)).into());
+    }
+    let matches: Vec<String> = names.into_iter().filter(|n| snapshots::fuzzy_match(n, query)).collect();
+    match matches.len() {
+        1 => Ok(matches[0].clone()),
+        0 => Err(HammerError::ConfigError(format!("No cached snapshot matches '{}'", query)).into()),
+        _ => Err(HammerError::ConfigError(format!("'{}' matches several snapshots: {}", query, matches.join(", "))).into()),
+    }
+}
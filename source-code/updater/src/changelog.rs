@@ -0,0 +1,76 @@
+use hammer_core::exec::Exec;
+use hammer_core::packages::PackageDiff;
+use std::fs;
+use std::path::Path;
+
+/// Reads a (possibly gzipped) file from /usr/share/doc
+fn read_doc(path: &Path) -> Option<String> {
+    if !path.exists() {
+        return None;
+    }
+    if path.extension().map(|e| e == "gz").unwrap_or(false) {
+        return Exec::new("zcat", &[&path.to_string_lossy()], "Read Changelog").output().ok();
+    }
+    fs::read_to_string(path).ok()
+}
+
+/// Entries newer than `old_version`. Debian changelog headers look like
+/// "package (1.2-3) unstable; urgency=medium" and are never indented.
+fn entries_since(content: &str, old_version: &str) -> String {
+    let mut out = Vec::new();
+    for line in content.lines() {
+        let is_header = !line.starts_with(' ') && line.contains(" (") && line.contains(')');
+        if is_header {
+            let version = line.split(" (").nth(1).and_then(|v| v.split(')').next()).unwrap_or("");
+            if version == old_version {
+                break;
+            }
+        }
+        out.push(line);
+    }
+    out.join("\n").trim().to_string()
+}
+
+fn doc_file(root: &Path, package: &str, names: &[&str]) -> Option<String> {
+    let dir = root.join("usr/share/doc").join(package);
+    names.iter().find_map(|n| read_doc(&dir.join(n)))
+}
+
+/// Changelog entries of `package` in `root` that are newer than `old_version`
+pub fn changelog_since(root: &Path, package: &str, old_version: &str) -> String {
+    doc_file(root, package, &["changelog.Debian.gz", "changelog.Debian", "changelog.gz"])
+    .map(|c| entries_since(&c, old_version))
+    .unwrap_or_default()
+}
+
+/// Aggregated NEWS and changelog entries for every upgraded package in `root`
+pub fn collect(root: &Path, diff: &PackageDiff) -> String {
+    let mut news = Vec::new();
+    let mut changes = Vec::new();
+
+    for (name, old, new) in &diff.changed {
+        if let Some(content) = doc_file(root, name, &["NEWS.Debian.gz", "NEWS.Debian"]) {
+            let entries = entries_since(&content, old);
+            if !entries.is_empty() {
+                news.push(format!("== {} {} -> {} ==\n{}", name, old, new, entries));
+            }
+        }
+        let entries = changelog_since(root, name, old);
+        if entries.is_empty() {
+            changes.push(format!("== {} {} -> {} ==\n(no changelog available)", name, old, new));
+        } else {
+            changes.push(format!("== {} {} -> {} ==\n{}", name, old, new, entries));
+        }
+    }
+
+    let mut report = String::new();
+    if !news.is_empty() {
+        report.push_str("######## NEWS ########\n\n");
+        report.push_str(&news.join("\n\n"));
+        report.push_str("\n\n");
+    }
+    report.push_str("######## CHANGELOGS ########\n\n");
+    report.push_str(&changes.join("\n\n"));
+    report.push('\n');
+    report
+}
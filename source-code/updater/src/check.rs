@@ -0,0 +1,60 @@
+use miette::Result;
+use chrono::{DateTime, Local};
+use hammer_core::i18n::{tr, tr_fmt};
+use hammer_core::{config, journal, run_command, Logger};
+use std::fs;
+
+use crate::{health, migrations, reboot, simulate};
+
+/// (package, installed version or "-", candidate version) from apt's last downloaded lists.
+/// A simulation needs no lock, so this works without root.
+fn upgradable() -> Result<Vec<(String, String, String)>> {
+    let out = run_command(
+        "apt-get",
+        &["-s", "-o", "Debug::NoLocking=1", "dist-upgrade"],
+        "Simulate Upgrade",
+    )?;
+    Ok(simulate::parse(&out)
+    .into_iter()
+    .filter(|c| c.action != "remove")
+    .map(|c| (c.name, c.old, c.new))
+    .collect())
+}
+
+fn lists_updated() -> Option<String> {
+    let modified = fs::metadata("/var/lib/apt/lists").ok()?.modified().ok()?;
+    Some(DateTime::<Local>::from(modified).format("%Y-%m-%d %H:%M").to_string())
+}
+
+/// Available updates, the last update, pending reboots and disk errors; safe to run as any user
+pub fn handle_check() -> Result<()> {
+    Logger::section(tr("check.title"));
+
+    let updates = upgradable()?;
+    let age = lists_updated().map(|t| tr_fmt("check.lists-from", &[&t])).unwrap_or_default();
+    if updates.is_empty() {
+        Logger::success(&tr_fmt("check.none", &[&age]));
+    } else {
+        Logger::info(&tr_fmt("check.available", &[&updates.len(), &age]));
+        for (name, old, new) in &updates {
+            Logger::info(&format!("  {: <32} {} -> {}", name, old, new));
+        }
+    }
+
+    if let Some(tx) = journal::list().into_iter().rev().find(|tx| tx.kind == "update") {
+        Logger::info(&format!(
+            "Last update: {} ({}, {})",
+            tx.id, tx.result, tx.finished.as_deref().unwrap_or(&tx.started)
+        ));
+    }
+
+    for reason in reboot::pending_reasons()? {
+        Logger::warn(&tr_fmt("check.reboot-pending", &[&reason]));
+    }
+    for (name, time) in migrations::failed() {
+        Logger::warn(&format!("Migration {} failed at {}; see journalctl -u hammer-first-boot", name, time));
+    }
+    health::report(config::load().map(|c| c.status.smart).unwrap_or(false));
+    Logger::end_section();
+    Ok(())
+}
@@ -0,0 +1,274 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::output::print_table;
+use hammer_core::{config, mount_btrfs_root, pool, root_device_uuid, run_change, run_command, umount_btrfs_root, HammerError, Logger};
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::{boot, create_snapshot_name, snapshots, status};
+
+// Experimental image-based deployments. A finished deployment is sealed with
+// mkcomposefs into an EROFS metadata image; file contents go to one content-addressed
+// object store, so files that did not change between versions are stored once. The
+// hammer-composefs initramfs script boots an image read-only with a writable overlay
+// kept per image. Layout below the top level:
+//   @composefs/objects/        shared file contents
+//   @composefs/images/NAME.cfs image, NAME.kernel the kernel version it boots
+//   @composefs/boot/VERSION/   vmlinuz and initrd.img, shared by images of that kernel
+//   @composefs/state/NAME/     upper and work directory of the overlay
+
+/// Subvolume below the top level; GRUB reads the kernels from it by path
+const COMPOSEFS_SUBVOL: &str = "@composefs";
+
+/// Adds one entry per image to grub.cfg on every update-grub
+const GRUB_SCRIPT: &str = "/etc/grub.d/43_hammer_composefs";
+
+fn store() -> PathBuf {
+    pool::top_level().join(COMPOSEFS_SUBVOL)
+}
+
+/// Image names, oldest first (names start with their date)
+fn images(store: &Path) -> Vec<String> {
+    let mut names: Vec<String> = fs::read_dir(store.join("images"))
+    .map(|entries| {
+        entries.flatten()
+        .filter_map(|e| e.file_name().to_string_lossy().strip_suffix(".cfs").map(String::from))
+        .collect()
+    })
+    .unwrap_or_default();
+    names.sort();
+    names
+}
+
+/// The image the running system booted, from hammer.composefs= on the kernel command line
+fn booted() -> Option<String> {
+    fs::read_to_string("/proc/cmdline")
+    .ok()?
+    .split_whitespace()
+    .find_map(|arg| arg.strip_prefix("hammer.composefs=").map(String::from))
+}
+
+fn image_kernel(store: &Path, name: &str) -> String {
+    fs::read_to_string(store.join("images").join(format!("{}.kernel", name)))
+    .map(|v| v.trim().to_string())
+    .unwrap_or_default()
+}
+
+/// Kernel version the deployment boots, from the vmlinuz symlink Debian maintains
+pub(crate) fn kernel_version(root: &Path) -> Result<String> {
+    for link in ["boot/vmlinuz", "vmlinuz"] {
+        if let Ok(target) = fs::read_link(root.join(link)) {
+            let file = target.file_name().map(|f| f.to_string_lossy().to_string()).unwrap_or_default();
+            if let Some(version) = file.strip_prefix("vmlinuz-") {
+                return Ok(version.to_string());
+            }
+        }
+    }
+    Err(HammerError::CommandFailed(format!("No vmlinuz link in {}", root.display())).into())
+}
+
+fn size_of(path: &Path) -> Option<u64> {
+    run_command("du", &["-sb", &path.to_string_lossy()], "Measure Size")
+    .ok()
+    .and_then(|out| out.split_whitespace().next().and_then(|n| n.parse().ok()))
+}
+
+/// Seals the deployment at `root` as image `name`; the pool must be mounted
+fn seal(root: &Path, name: &str) -> Result<()> {
+    let store = store();
+    if !store.exists() {
+        run_change("btrfs", &["subvolume", "create", &store.to_string_lossy()], "Create Composefs Subvolume")?;
+    }
+    for dir in ["objects", "images", "boot", "state"] {
+        fs::create_dir_all(store.join(dir)).into_diagnostic()?;
+    }
+    let image = store.join("images").join(format!("{}.cfs", name));
+    if image.exists() {
+        return Err(HammerError::CommandFailed(format!("Image {} already exists", name)).into());
+    }
+
+    let version = kernel_version(root)?;
+    let boot = store.join("boot").join(&version);
+    if !boot.join("initrd.img").exists() {
+        fs::create_dir_all(&boot).into_diagnostic()?;
+        fs::copy(root.join("boot").join(format!("vmlinuz-{}", version)), boot.join("vmlinuz")).into_diagnostic()?;
+        fs::copy(root.join("boot").join(format!("initrd.img-{}", version)), boot.join("initrd.img")).into_diagnostic()?;
+    }
+
+    run_change("mkcomposefs", &[
+        &format!("--digest-store={}", store.join("objects").display()),
+        &root.to_string_lossy(),
+        &image.to_string_lossy(),
+    ], "Seal Composefs Image")?;
+    hammer_core::store::write(&store.join("images").join(format!("{}.kernel", name)), format!("{}\n", version))?;
+
+    let keep = config::load()?.composefs.keep.max(1);
+    let names = images(&store);
+    let booted = booted();
+    for old in &names[..names.len().saturating_sub(keep)] {
+        if booted.as_deref() == Some(old.as_str()) {
+            continue;
+        }
+        remove_image(&store, old)?;
+    }
+    gc(&store)?;
+    write_grub_script(&store)
+}
+
+fn remove_image(store: &Path, name: &str) -> Result<()> {
+    let _ = fs::remove_file(store.join("images").join(format!("{}.cfs", name)));
+    let _ = fs::remove_file(store.join("images").join(format!("{}.kernel", name)));
+    let state = store.join("state").join(name);
+    if state.exists() {
+        fs::remove_dir_all(&state).into_diagnostic()?;
+    }
+    Logger::info(&format!("Removed composefs image {}", name));
+    Ok(())
+}
+
+/// Deletes objects and kernels no image refers to any more
+fn gc(store: &Path) -> Result<()> {
+    let names = images(store);
+    let mut referenced = BTreeSet::new();
+    for name in &names {
+        let image = store.join("images").join(format!("{}.cfs", name));
+        let out = run_command("composefs-info", &["objects", &image.to_string_lossy()], "List Image Objects")?;
+        referenced.extend(out.lines().map(|l| l.trim().to_string()));
+    }
+
+    let objects = store.join("objects");
+    let mut freed = 0;
+    for prefix in fs::read_dir(&objects).into_diagnostic()?.flatten() {
+        for object in fs::read_dir(prefix.path()).into_diagnostic()?.flatten() {
+            let relative = format!("{}/{}", prefix.file_name().to_string_lossy(), object.file_name().to_string_lossy());
+            if !referenced.contains(&relative) {
+                freed += object.metadata().map(|m| m.len()).unwrap_or(0);
+                fs::remove_file(object.path()).into_diagnostic()?;
+            }
+        }
+    }
+
+    let kernels: BTreeSet<String> = names.iter().map(|n| image_kernel(store, n)).collect();
+    for boot in fs::read_dir(store.join("boot")).into_diagnostic()?.flatten() {
+        if !kernels.contains(&*boot.file_name().to_string_lossy()) {
+            fs::remove_dir_all(boot.path()).into_diagnostic()?;
+        }
+    }
+    if freed > 0 {
+        Logger::info(&format!("Freed {} of unshared objects", status::human_size(Some(freed))));
+    }
+    Ok(())
+}
+
+fn write_grub_script(store: &Path) -> Result<()> {
+    let names = images(store);
+    if names.is_empty() {
+        if Path::new(GRUB_SCRIPT).exists() {
+            fs::remove_file(GRUB_SCRIPT).into_diagnostic()?;
+            run_change("update-grub", &[], "Update GRUB")?;
+            boot::reconcile();
+        }
+        return Ok(());
+    }
+
+    let uuid = root_device_uuid()?;
+    let mut script = String::from("#!/bin/sh\n# Written by hammer for its composefs images; see 'hammer composefs list'.\ncat <<'EOF'\n");
+    for name in names.iter().rev() {
+        script.push_str(&format!(
+            r#"menuentry 'HackerOS (composefs {name})' --class gnu-linux --id hammer-composefs-{name} {{
+	insmod btrfs
+	search --no-floppy --fs-uuid --set=root {uuid}
+	linux /{subvol}/boot/{kernel}/vmlinuz root=UUID={uuid} rootflags=subvol={subvol} ro hammer.composefs={name}
+	initrd /{subvol}/boot/{kernel}/initrd.img
+}}
+"#,
+            name = name,
+            uuid = uuid,
+            subvol = COMPOSEFS_SUBVOL,
+            kernel = image_kernel(store, name)
+        ));
+    }
+    script.push_str("EOF\n");
+    hammer_core::store::write_mode(Path::new(GRUB_SCRIPT), script, 0o755)?;
+    run_change("update-grub", &[], "Update GRUB")?;
+    boot::reconcile();
+    Ok(())
+}
+
+/// Seals a staged deployment when [composefs] is enabled; a failure leaves the update as it is
+pub fn seal_deployment(root: &Path, kind: &str) {
+    if !config::load().map(|c| c.composefs.enabled).unwrap_or(false) {
+        return;
+    }
+    let name = create_snapshot_name(kind);
+    match seal(root, &name) {
+        Ok(()) => Logger::info(&format!("Sealed as composefs image {}", name)),
+        Err(e) => Logger::warn(&format!("Composefs image not sealed: {}", e)),
+    }
+}
+
+/// Seals a snapshot, or the current @, into an image
+pub fn handle_seal(snapshot: Option<String>) -> Result<()> {
+    Logger::section("SEAL COMPOSEFS IMAGE");
+    let source = match snapshots::resolve(snapshot.as_deref(), None)? {
+        Some(name) => PathBuf::from("@snapshots").join(name),
+        None => PathBuf::from("@"),
+    };
+    let kind = match &snapshot {
+        Some(_) => "sealed",
+        None => "current",
+    };
+    let name = create_snapshot_name(kind);
+    mount_btrfs_root()?;
+    let result = seal(&pool::top_level().join(&source), &name);
+    umount_btrfs_root()?;
+    result?;
+    Logger::success(&format!("{} sealed as {}. It has its own GRUB entry.", source.display(), name));
+    Logger::end_section();
+    Ok(())
+}
+
+/// Images with their kernel and sizes; objects are counted once for all of them
+pub fn handle_list() -> Result<()> {
+    mount_btrfs_root()?;
+    let store = store();
+    let names = images(&store);
+    let mut rows = vec![vec!["IMAGE".to_string(), "KERNEL".to_string(), "METADATA".to_string(), "WRITES".to_string()]];
+    for name in &names {
+        rows.push(vec![
+            name.clone(),
+            image_kernel(&store, name),
+            status::human_size(size_of(&store.join("images").join(format!("{}.cfs", name)))),
+            status::human_size(size_of(&store.join("state").join(name))),
+        ]);
+    }
+    let objects = size_of(&store.join("objects"));
+    umount_btrfs_root()?;
+
+    if names.is_empty() {
+        Logger::info("No composefs images. Seal one with: hammer composefs seal");
+        return Ok(());
+    }
+    print_table(&rows);
+    println!("\nShared objects: {} for {} images", status::human_size(objects), names.len());
+    Ok(())
+}
+
+pub fn handle_remove(name: &str) -> Result<()> {
+    Logger::section("REMOVE COMPOSEFS IMAGE");
+    if booted().as_deref() == Some(name) {
+        return Err(HammerError::CommandFailed(format!("{} is the running image", name)).into());
+    }
+    mount_btrfs_root()?;
+    let store = store();
+    let result = if images(&store).iter().any(|n| n == name) {
+        remove_image(&store, name).and_then(|_| gc(&store)).and_then(|_| write_grub_script(&store))
+    } else {
+        Err(HammerError::CommandFailed(format!("No composefs image {}", name)).into())
+    };
+    umount_btrfs_root()?;
+    result?;
+    Logger::success(&format!("Image {} removed.", name));
+    Logger::end_section();
+    Ok(())
+}
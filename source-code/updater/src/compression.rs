@@ -0,0 +1,155 @@
+use miette::{IntoDiagnostic, Result};
+use dialoguer::Confirm;
+use hammer_core::i18n::tr_fmt;
+use hammer_core::exec::{self, Exec};
+use hammer_core::{config, create_progress_bar, mount_btrfs_root, overrides, run_change, run_command, umount_btrfs_root, HammerError, Logger};
+use std::fs;
+use std::io::{BufRead, BufReader};
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+use std::process::Stdio;
+
+use crate::integrity;
+
+/// Values the btrfs compression property takes
+const ALGORITHMS: &[&str] = &["zstd", "lzo", "zlib", "none"];
+
+fn check_algorithm(algorithm: &str) -> Result<()> {
+    if ALGORITHMS.contains(&algorithm) {
+        return Ok(());
+    }
+    Err(HammerError::ConfigError(format!("Unknown compression '{}'; use one of {}", algorithm, ALGORITHMS.join(", "))).into())
+}
+
+fn property(path: &Path) -> String {
+    run_command("btrfs", &["property", "get", "-ts", &path.to_string_lossy(), "compression"], "Read Compression")
+    .ok()
+    .and_then(|out| out.trim().strip_prefix("compression=").map(String::from))
+    .unwrap_or_default()
+}
+
+fn set_property(path: &Path, algorithm: &str) -> Result<()> {
+    // An empty value clears the property; "none" stores data uncompressed
+    run_change("btrfs", &["property", "set", "-ts", &path.to_string_lossy(), "compression", algorithm], "Set Compression")?;
+    Ok(())
+}
+
+/// Sets [compression] algorithm on a new deployment; nothing when it is unset
+pub fn apply_to_new(deployment: &Path) -> Result<()> {
+    let algorithm = config::load()?.compression.algorithm;
+    if algorithm.is_empty() {
+        return Ok(());
+    }
+    check_algorithm(&algorithm)?;
+    set_property(deployment, &algorithm)
+}
+
+/// Regular files below `path` on its own filesystem; what defragment will visit
+fn count_files(path: &Path, dev: u64) -> u64 {
+    let mut count = 0;
+    if let Ok(entries) = fs::read_dir(path) {
+        for entry in entries.flatten() {
+            match entry.path().symlink_metadata() {
+                Ok(m) if m.is_dir() && m.dev() == dev => count += count_files(&entry.path(), dev),
+                Ok(m) if m.is_file() => count += 1,
+                _ => {}
+            }
+        }
+    }
+    count
+}
+
+/// Shows the compression property of a deployment, or sets it with `algorithm`
+pub fn handle_compression(deployment: &str, algorithm: Option<String>) -> Result<()> {
+    mount_btrfs_root()?;
+    let result = compression(deployment, algorithm);
+    umount_btrfs_root()?;
+    result
+}
+
+fn compression(deployment: &str, algorithm: Option<String>) -> Result<()> {
+    let path = integrity::locate(deployment);
+    if !path.exists() {
+        return Err(HammerError::ConfigError(format!("No deployment '{}'", deployment)).into());
+    }
+    match algorithm {
+        Some(algorithm) => {
+            check_algorithm(&algorithm)?;
+            set_property(&path, &algorithm)?;
+            Logger::success(&format!("New writes to {} use {}. Existing data: hammer fs recompress {}", deployment, algorithm, deployment));
+        }
+        None => {
+            let current = property(&path);
+            println!("{}: {}", deployment, if current.is_empty() { "inherited (mount option)" } else { &current });
+        }
+    }
+    Ok(())
+}
+
+/// Rewrites the data of a deployment compressed, file by file with a progress bar
+pub fn handle_recompress(deployment: &str, algorithm: Option<String>, level: Option<u32>) -> Result<()> {
+    Logger::section("RECOMPRESS DEPLOYMENT");
+    mount_btrfs_root()?;
+    let result = recompress(deployment, algorithm, level);
+    umount_btrfs_root()?;
+    Logger::end_section();
+    result
+}
+
+fn recompress(deployment: &str, algorithm: Option<String>, level: Option<u32>) -> Result<()> {
+    let path = integrity::locate(deployment);
+    if !path.exists() {
+        return Err(HammerError::ConfigError(format!("No deployment '{}'", deployment)).into());
+    }
+    let cfg = config::load()?.compression;
+    let algorithm = algorithm
+    .or_else(|| Some(cfg.algorithm.clone()).filter(|a| !a.is_empty() && a != "none"))
+    .unwrap_or_else(|| "zstd".to_string());
+    check_algorithm(&algorithm)?;
+    if algorithm == "none" {
+        return Err(HammerError::ConfigError("Defragment cannot decompress; pick an algorithm".to_string()).into());
+    }
+    let level = level.or(cfg.level);
+
+    Logger::warn("Rewriting files unshares their extents with snapshots; the space used grows until those are deleted.");
+    if !overrides::assume_yes() && !Confirm::new().with_prompt(tr_fmt("prompt.recompress", &[&deployment, &algorithm])).interact().into_diagnostic()? {
+        return Ok(());
+    }
+
+    let dev = fs::metadata(&path).into_diagnostic()?.dev();
+    let total = count_files(&path, dev);
+    let pb = create_progress_bar(total, &format!("Compressing {}", deployment));
+
+    let mut args = vec!["filesystem".to_string(), "defragment".to_string(), "-r".to_string(), "-v".to_string()];
+    args.push(format!("-c{}", algorithm));
+    if let Some(level) = level {
+        args.push(format!("--level={}", level));
+    }
+    args.push(path.to_string_lossy().to_string());
+    if exec::dry_run() {
+        pb.finish_and_clear();
+        Logger::info(&format!("Dry run, not running: btrfs {}", args.join(" ")));
+        return Ok(());
+    }
+
+    let args: Vec<&str> = args.iter().map(String::as_str).collect();
+    let mut child = Exec::new("btrfs", &args, "Recompress")
+    .stderr(Stdio::piped())
+    .changes_system()
+    .spawn()?;
+    if let Some(stdout) = child.stdout.take() {
+        // -v prints each file as it is done
+        for _ in BufReader::new(stdout).lines().map_while(|l| l.ok()) {
+            pb.inc(1);
+        }
+    }
+    let output = child.wait_with_output().into_diagnostic()?;
+    pb.finish_and_clear();
+    if !output.status.success() {
+        return Err(HammerError::CommandFailed(format!("Recompress failed: {}", String::from_utf8_lossy(&output.stderr))).into());
+    }
+
+    set_property(&path, &algorithm)?;
+    Logger::success(&format!("{} recompressed with {}{}.", deployment, algorithm, level.map(|l| format!(" level {}", l)).unwrap_or_default()));
+    Ok(())
+}
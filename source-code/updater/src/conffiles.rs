@@ -0,0 +1,127 @@
+use miette::{IntoDiagnostic, Result};
+use dialoguer::Select;
+use hammer_core::exec::Exec;
+use hammer_core::i18n::tr;
+use hammer_core::{mount_btrfs_root, pool, umount_btrfs_root, HammerError, Logger};
+use std::fs;
+use std::io::IsTerminal;
+use std::path::{Path, PathBuf};
+
+/// Where dpkg and ucf leave the package's version of a conffile they did not install
+const SUFFIXES: &[&str] = &[".dpkg-dist", ".dpkg-new", ".ucf-dist"];
+
+fn scan(dir: &Path, found: &mut Vec<PathBuf>) {
+    for entry in fs::read_dir(dir).into_iter().flatten().flatten() {
+        let path = entry.path();
+        let Ok(kind) = entry.file_type() else { continue };
+        if kind.is_dir() {
+            scan(&path, found);
+        } else if kind.is_file() {
+            let name = entry.file_name().to_string_lossy().to_string();
+            if SUFFIXES.iter().any(|s| name.ends_with(s)) {
+                found.push(path);
+            }
+        }
+    }
+}
+
+/// Unresolved conffile conflicts in `root`: (local file, package's version)
+pub fn pending(root: &Path) -> Vec<(PathBuf, PathBuf)> {
+    let mut found = Vec::new();
+    scan(&root.join("etc"), &mut found);
+    found.sort();
+    found
+    .into_iter()
+    .filter_map(|new| {
+        let name = new.to_string_lossy().to_string();
+        let local = SUFFIXES.iter().find_map(|s| name.strip_suffix(s))?;
+        Some((PathBuf::from(local), new))
+    })
+    .collect()
+}
+
+fn show_diff(local: &Path, new: &Path) {
+    // diff exits 1 when the files differ; its output is all that matters
+    let _ = Exec::new("diff", &["-u", &local.to_string_lossy(), &new.to_string_lossy()], "Show Configuration Changes").status();
+}
+
+/// Installs the package's version; the local one is kept as .dpkg-old
+fn take_new(local: &Path, new: &Path) -> Result<()> {
+    if local.exists() {
+        fs::rename(local, format!("{}.dpkg-old", local.display())).into_diagnostic()?;
+    }
+    fs::rename(new, local).into_diagnostic()
+}
+
+/// Asks about each conflict in `root`. Without a terminal the conflicts are only listed.
+/// Returns how many are left unresolved.
+pub fn resolve(root: &Path) -> Result<usize> {
+    let conflicts = pending(root);
+    if conflicts.is_empty() {
+        return Ok(0);
+    }
+    let shown = |p: &Path| format!("/{}", p.strip_prefix(root).unwrap_or(p).display());
+    if !std::io::stdin().is_terminal() {
+        Logger::warn(&format!("{} configuration files kept their local version; the package's version is next to them:", conflicts.len()));
+        for (local, _) in &conflicts {
+            Logger::warn(&format!("  {}", shown(local)));
+        }
+        Logger::info("Review them with: sudo hammer conffiles");
+        return Ok(conflicts.len());
+    }
+
+    let mut left = 0;
+    for (local, new) in &conflicts {
+        Logger::info(&format!("Configuration file {} was changed locally and by its package:", shown(local)));
+        show_diff(local, new);
+        let choice = Select::new()
+        .with_prompt(shown(local))
+        .items(&[tr("prompt.conffile-keep"), tr("prompt.conffile-install"), tr("prompt.conffile-later")])
+        .default(0)
+        .interact()
+        .into_diagnostic()?;
+        match choice {
+            0 => fs::remove_file(new).into_diagnostic()?,
+            1 => take_new(local, new)?,
+            _ => left += 1,
+        }
+    }
+    Ok(left)
+}
+
+/// Lists or resolves conffile conflicts of the running system or of a top-level deployment
+pub fn handle_conffiles(deployment: Option<String>, list: bool) -> Result<()> {
+    if let Some(d) = &deployment {
+        if !d.starts_with('@') || d.contains('/') {
+            return Err(HammerError::ConfigError(format!("'{}' is not a top-level deployment like @update", d)).into());
+        }
+    }
+    Logger::section("CONFIGURATION FILES");
+    let root = match &deployment {
+        Some(d) => {
+            mount_btrfs_root()?;
+            pool::top_level().join(d)
+        }
+        None => PathBuf::from("/"),
+    };
+
+    let result = if list {
+        let conflicts = pending(&root);
+        for (local, new) in &conflicts {
+            let rel = |p: &Path| format!("/{}", p.strip_prefix(&root).unwrap_or(p).display());
+            println!("{}\t{}", rel(local), rel(new));
+        }
+        Ok(conflicts.len())
+    } else {
+        resolve(&root)
+    };
+
+    if deployment.is_some() {
+        umount_btrfs_root()?;
+    }
+    if result? == 0 {
+        Logger::success("No conffile conflicts.");
+    }
+    Logger::end_section();
+    Ok(())
+}
@@ -0,0 +1,260 @@
+use miette::Result;
+use chrono::NaiveDateTime;
+use hammer_core::output::{self, Tone};
+use hammer_core::{journal, mount_btrfs_root, pool, run_command, storage, umount_btrfs_root, Logger};
+use regex::Regex;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::Path;
+
+use crate::snapshots;
+
+// Every deployment carries the apt and dpkg logs of everything that happened to it
+// up to the moment it was snapshotted. Read side by side they tell what changed when,
+// including what was installed outside hammer or later rolled back.
+
+/// Seconds between dpkg records without apt history that still count as one run
+const DPKG_GAP: i64 = 120;
+
+/// Packages listed per event before the rest is summed up
+const SHOWN_CHANGES: usize = 8;
+
+const CURRENT: &str = "current";
+
+struct Event {
+    start: NaiveDateTime,
+    end: NaiveDateTime,
+    /// apt's Commandline, or "dpkg" for runs apt has no history of
+    command: String,
+    requested_by: Option<String>,
+    /// (+, ~ or -, package, version)
+    changes: Vec<(char, String, String)>,
+    /// "current" and the snapshots whose logs contain the event
+    seen_in: BTreeSet<String>,
+}
+
+struct DpkgRecord {
+    time: NaiveDateTime,
+    change: (char, String, String),
+}
+
+/// A log file and its rotations (.1, .2.gz, ...), oldest first
+fn read_rotated(dir: &Path, name: &str) -> String {
+    let mut files: Vec<(u32, std::path::PathBuf)> = fs::read_dir(dir)
+    .map(|entries| {
+        entries.flatten()
+        .filter_map(|e| {
+            let file = e.file_name().to_string_lossy().to_string();
+            let rest = file.strip_prefix(name)?;
+            let n = match rest.trim_end_matches(".gz").strip_prefix('.') {
+                None if rest.is_empty() => 0,
+                Some(n) => n.parse().ok()?,
+                None => return None,
+            };
+            Some((n, e.path()))
+        })
+        .collect()
+    })
+    .unwrap_or_default();
+    files.sort_by(|a, b| b.0.cmp(&a.0));
+
+    let mut text = String::new();
+    for (_, path) in files {
+        let content = if path.extension().is_some_and(|e| e == "gz") {
+            run_command("zcat", &[&path.to_string_lossy()], "Read Rotated Log").unwrap_or_default()
+        } else {
+            fs::read_to_string(&path).unwrap_or_default()
+        };
+        text.push_str(&content);
+        text.push('\n');
+    }
+    text
+}
+
+fn parse_time(text: &str) -> Option<NaiveDateTime> {
+    // apt pads the date and time with two spaces
+    let text = text.split_whitespace().collect::<Vec<_>>().join(" ");
+    NaiveDateTime::parse_from_str(&text, "%Y-%m-%d %H:%M:%S").ok()
+}
+
+/// Entries of /var/log/apt/history.log
+fn apt_history(root: &Path) -> Vec<Event> {
+    let package = Regex::new(r"([^\s,()]+) \(([^)]*)\)").unwrap();
+    let text = read_rotated(&root.join("var/log/apt"), "history.log");
+    let mut events = Vec::new();
+    for block in text.split("\n\n") {
+        let field = |key: &str| block.lines().find_map(|l| l.strip_prefix(key)).map(|v| v.trim().to_string());
+        let Some(start) = field("Start-Date:").and_then(|t| parse_time(&t)) else {
+            continue;
+        };
+        let mut changes = Vec::new();
+        for (key, sign) in [("Install:", '+'), ("Upgrade:", '~'), ("Downgrade:", '~'), ("Remove:", '-'), ("Purge:", '-')] {
+            for line in block.lines().filter_map(|l| l.strip_prefix(key)) {
+                for cap in package.captures_iter(line) {
+                    let name = cap[1].split(':').next().unwrap_or(&cap[1]).to_string();
+                    // "(old, new)" for upgrades, "(version, automatic)" for installs
+                    let versions: Vec<&str> = cap[2].split(", ").filter(|v| *v != "automatic").collect();
+                    let version = versions.last().copied().unwrap_or_default().to_string();
+                    changes.push((sign, name, version));
+                }
+            }
+        }
+        events.push(Event {
+            start,
+            end: field("End-Date:").and_then(|t| parse_time(&t)).unwrap_or(start),
+            command: field("Commandline:").unwrap_or_else(|| "apt".to_string()),
+            requested_by: field("Requested-By:"),
+            changes,
+            seen_in: BTreeSet::new(),
+        });
+    }
+    events
+}
+
+/// install, upgrade and remove records of /var/log/dpkg.log
+fn dpkg_log(root: &Path) -> Vec<DpkgRecord> {
+    let text = read_rotated(&root.join("var/log"), "dpkg.log");
+    text.lines()
+    .filter_map(|line| {
+        // "2025-11-29 10:02:13 upgrade libc6:amd64 2.36-9 2.36-9+deb12u4"
+        let fields: Vec<&str> = line.split_whitespace().collect();
+        if fields.len() < 6 {
+            return None;
+        }
+        let sign = match fields[2] {
+            "install" => '+',
+            "upgrade" => '~',
+            "remove" | "purge" => '-',
+            _ => return None,
+        };
+        let time = parse_time(&format!("{} {}", fields[0], fields[1]))?;
+        let name = fields[3].split(':').next().unwrap_or(fields[3]).to_string();
+        let version = if sign == '-' { fields[4] } else { fields[5] };
+        Some(DpkgRecord { time, change: (sign, name, version.to_string()) })
+    })
+    .collect()
+}
+
+/// Events of all deployments, merged; dpkg runs without apt history become events of their own
+fn collect(roots: &[(String, std::path::PathBuf)]) -> Vec<Event> {
+    let mut events: BTreeMap<(NaiveDateTime, String), Event> = BTreeMap::new();
+    let mut dpkg: BTreeMap<(NaiveDateTime, char, String), (String, BTreeSet<String>)> = BTreeMap::new();
+    for (label, root) in roots {
+        for event in apt_history(root) {
+            events.entry((event.start, event.command.clone())).or_insert(event).seen_in.insert(label.clone());
+        }
+        for record in dpkg_log(root) {
+            let (sign, name, version) = record.change;
+            dpkg.entry((record.time, sign, name)).or_insert((version, BTreeSet::new())).1.insert(label.clone());
+        }
+    }
+
+    let windows: Vec<(NaiveDateTime, NaiveDateTime)> = events.values().map(|e| (e.start, e.end)).collect();
+    let mut orphans: Vec<Event> = Vec::new();
+    for ((time, sign, name), (version, seen_in)) in dpkg {
+        if windows.iter().any(|(start, end)| time >= *start && time <= *end) {
+            continue;
+        }
+        match orphans.last_mut() {
+            Some(last) if (time - last.end).num_seconds() <= DPKG_GAP => {
+                last.end = time;
+                last.changes.push((sign, name, version));
+                last.seen_in.extend(seen_in);
+            }
+            _ => orphans.push(Event {
+                start: time,
+                end: time,
+                command: "dpkg".to_string(),
+                requested_by: None,
+                changes: vec![(sign, name, version)],
+                seen_in,
+            }),
+        }
+    }
+
+    let mut all: Vec<Event> = events.into_values().chain(orphans).collect();
+    all.sort_by_key(|e| e.start);
+    all
+}
+
+/// Who ran it: the hammer transaction whose time span covers the start
+fn origin(event: &Event, transactions: &[journal::Transaction]) -> (String, bool) {
+    for tx in transactions {
+        let Some(started) = parse_time(&tx.started) else {
+            continue;
+        };
+        let finished = tx.finished.as_deref().and_then(parse_time).unwrap_or(started + chrono::Duration::hours(6));
+        if event.start >= started && event.start <= finished {
+            return match tx.kind.as_str() {
+                "apt-external" | "pkg" => (format!("outside hammer, snapshot {}", tx.id), true),
+                kind => (format!("hammer {} {}", kind, tx.id), false),
+            };
+        }
+    }
+    ("outside hammer".to_string(), true)
+}
+
+/// Maps the apt and dpkg logs of every deployment onto snapshots and hammer transactions
+pub fn handle_correlate(since: Option<String>, outside_only: bool) -> Result<()> {
+    let since = since.as_deref().map(snapshots::parse_date_expr).transpose()?;
+    let driver = storage::driver()?;
+    let names = if matches!(driver, storage::Driver::Btrfs) { driver.list()? } else { Vec::new() };
+
+    mount_btrfs_root()?;
+    let mut roots = vec![(CURRENT.to_string(), std::path::PathBuf::from("/"))];
+    roots.extend(names.iter().map(|n| (n.clone(), pool::top_level().join("@snapshots").join(n))));
+    let events = collect(&roots);
+    umount_btrfs_root()?;
+
+    let transactions = journal::list();
+    let created: Vec<(String, NaiveDateTime)> = names
+    .iter()
+    .filter_map(|n| Some((n.clone(), snapshots::parse_created(n)?.with_timezone(&chrono::Local).naive_local())))
+    .collect();
+    // Older events may be missing from the running root only because its logs were rotated away
+    let current_from = events.iter().find(|e| e.seen_in.contains(CURRENT)).map(|e| e.start);
+
+    Logger::section("HISTORY CORRELATION");
+    let mut shown = 0;
+    for event in &events {
+        if since.is_some_and(|s| event.start < s) {
+            continue;
+        }
+        let (origin, outside) = origin(event, &transactions);
+        if outside_only && !outside {
+            continue;
+        }
+        shown += 1;
+
+        let who = event.requested_by.as_deref().map(|r| format!(" [{}]", r)).unwrap_or_default();
+        println!("{}  {}{}", output::paint(&event.start.format("%Y-%m-%d %H:%M").to_string(), Tone::Accent), event.command, who);
+
+        let mut notes = vec![output::paint(&origin, if outside { Tone::Warn } else { Tone::Good })];
+        if event.seen_in.contains(CURRENT) {
+            notes.push("in the running root".to_string());
+        } else if current_from.is_some_and(|from| event.start > from) {
+            notes.push(output::paint("not in the running root (rolled back)", Tone::Bad));
+        }
+        if let Some((name, _)) = created.iter().find(|(_, at)| *at >= event.end) {
+            notes.push(format!("before {}", name));
+        }
+        println!("    {}", notes.join(", "));
+
+        let mut line: Vec<String> = event.changes
+        .iter()
+        .take(SHOWN_CHANGES)
+        .map(|(sign, name, version)| format!("{}{} {}", sign, name, output::paint(version, Tone::Muted)))
+        .collect();
+        if event.changes.len() > SHOWN_CHANGES {
+            line.push(format!("and {} more", event.changes.len() - SHOWN_CHANGES));
+        }
+        if !line.is_empty() {
+            println!("    {}", line.join("  "));
+        }
+    }
+    if shown == 0 {
+        Logger::info("No package changes in the logs of the deployments.");
+    }
+    Logger::end_section();
+    Ok(())
+}
@@ -0,0 +1,102 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::{mount_btrfs_root, pool, run_change, run_command, umount_btrfs_root, HammerError, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::{integrity, status};
+
+// Package reinstalls and upgrades that rewrite identical files leave a deployment
+// with new extents for content its parent already has. duperemove finds those
+// files and shares the extents again (FIDEDUPERANGE), so the data is stored once.
+
+/// duperemove's block hashes; it survives only one run
+const HASHFILE: &str = "/run/hammer/dedupe.hash";
+
+/// Exclusive bytes of a subvolume, i.e. what deleting it would free
+fn exclusive_bytes(path: &Path) -> Option<u64> {
+    let out = run_command("btrfs", &["filesystem", "du", "-s", "--raw", &path.to_string_lossy()], "Measure Exclusive Data").ok()?;
+    out.lines().nth(1)?.split_whitespace().nth(1)?.parse().ok()
+}
+
+fn is_read_only(path: &Path) -> bool {
+    run_command("btrfs", &["property", "get", "-ts", &path.to_string_lossy(), "ro"], "Inspect Subvolume")
+    .map(|out| out.trim() == "ro=true")
+    .unwrap_or(false)
+}
+
+/// Shares identical extents of `deployment` with `parent`; returns the bytes reclaimed
+pub fn run(deployment: &Path, parent: &Path) -> Result<u64> {
+    if is_read_only(deployment) {
+        return Err(HammerError::BtrfsError(format!("{} is read-only; extents can only be shared into a writable deployment", deployment.display())).into());
+    }
+    let before = exclusive_bytes(deployment);
+    if let Some(dir) = Path::new(HASHFILE).parent() {
+        fs::create_dir_all(dir).into_diagnostic()?;
+    }
+    let result = run_change("duperemove", &[
+        "-dr", "-q", "--skip-zeroes",
+        &format!("--hashfile={}", HASHFILE),
+        &deployment.to_string_lossy(),
+        &parent.to_string_lossy(),
+    ], "Deduplicate Deployment");
+    let _ = fs::remove_file(HASHFILE);
+    result?;
+    let after = exclusive_bytes(deployment);
+    Ok(match (before, after) {
+        (Some(b), Some(a)) => b.saturating_sub(a),
+        _ => 0,
+    })
+}
+
+/// The deployment `deployment` was built from: @ for @update, the newest snapshot for @
+fn parent_of(top: &Path, deployment: &str) -> Option<PathBuf> {
+    match deployment {
+        "@update" => Some(top.join("@")),
+        "@" => {
+            let mut names: Vec<String> = fs::read_dir(top.join("@snapshots"))
+            .map(|entries| entries.flatten().map(|e| e.file_name().to_string_lossy().to_string()).collect())
+            .unwrap_or_default();
+            names.sort();
+            names.pop().map(|name| top.join("@snapshots").join(name))
+        }
+        _ => None,
+    }
+}
+
+/// Deduplicates a deployment (default: @update if staged, else @) against its parent
+pub fn handle_dedupe(deployment: Option<String>, against: Option<String>) -> Result<()> {
+    Logger::section("DEDUPLICATE DEPLOYMENT");
+    mount_btrfs_root()?;
+    let result = dedupe(deployment, against);
+    umount_btrfs_root()?;
+    Logger::end_section();
+    result
+}
+
+fn dedupe(deployment: Option<String>, against: Option<String>) -> Result<()> {
+    let top = pool::top_level();
+    let deployment = match deployment.as_deref() {
+        Some("current") => "@".to_string(),
+        Some(d) => d.to_string(),
+        None if top.join("@update").exists() => "@update".to_string(),
+        None => "@".to_string(),
+    };
+    let path = integrity::locate(&deployment);
+    if !path.exists() {
+        return Err(HammerError::ConfigError(format!("No deployment '{}'", deployment)).into());
+    }
+    let parent = match against {
+        Some(a) => integrity::locate(&a),
+        None => parent_of(top, &deployment).ok_or_else(|| {
+            HammerError::ConfigError(format!("No parent known for {}; name one with --against", deployment))
+        })?,
+    };
+    if !parent.exists() {
+        return Err(HammerError::ConfigError(format!("No deployment {}", parent.display())).into());
+    }
+
+    Logger::info(&format!("{} against {}", deployment, parent.strip_prefix(top).unwrap_or(&parent).display()));
+    let reclaimed = run(&path, &parent)?;
+    Logger::success(&format!("Reclaimed {}.", status::human_size(Some(reclaimed))));
+    Ok(())
+}
@@ -0,0 +1,219 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::output::{paint, print_table, Tone};
+use hammer_core::packages::{self, PackageDiff};
+use hammer_core::{is_root, run_command, HammerError, Logger};
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::integrity;
+
+// How the running system differs from the image it was installed from, against the
+// baseline hammer-builder records in every image (builder/src/baseline.rs): packages
+// added, removed or at other versions, files in /etc that changed, and package files
+// dpkg --verify finds modified. It only reads; without root, files only root can read
+// are counted instead of compared.
+
+pub const BASELINE_DIR: &str = "/usr/lib/HackerOS/hammer/image";
+
+/// Files in /etc that every installation writes for itself, left out of the comparison
+const EXPECTED: &[&str] = &[
+    "/etc/machine-id",
+    "/etc/hostname",
+    "/etc/hosts",
+    "/etc/fstab",
+    "/etc/crypttab",
+    "/etc/adjtime",
+    "/etc/ld.so.cache",
+    "/etc/.pwd.lock",
+    "/etc/ssh/ssh_host_",
+];
+
+/// Rows listed per section before summarizing
+const SHOW_LIMIT: usize = 50;
+
+#[derive(Serialize)]
+struct Added {
+    name: String,
+    version: String,
+    /// Installed on purpose rather than pulled in as a dependency
+    manual: bool,
+}
+
+#[derive(Serialize, Default)]
+struct Files {
+    modified: Vec<String>,
+    removed: Vec<String>,
+    added: Vec<String>,
+    /// Package files outside /etc whose content dpkg no longer recognizes
+    package_files: Vec<String>,
+    /// Files that could not be read without root
+    unreadable: usize,
+}
+
+#[derive(Serialize)]
+struct Deviations {
+    image: serde_json::Value,
+    added: Vec<Added>,
+    removed: Vec<(String, String)>,
+    /// name, version in the image, installed version
+    changed: Vec<(String, String, String)>,
+    files: Files,
+}
+
+fn expected(path: &str) -> bool {
+    EXPECTED.iter().any(|e| path.starts_with(e))
+}
+
+fn read_baseline(name: &str) -> Result<String> {
+    let path = Path::new(BASELINE_DIR).join(name);
+    fs::read_to_string(&path).map_err(|_| {
+        HammerError::ConfigError(format!(
+            "No image baseline ({} missing); this system was not installed from an image hammer-builder built", path.display()
+        )).into()
+    })
+}
+
+/// name -> version, as the image shipped them
+fn image_packages() -> Result<BTreeMap<String, String>> {
+    Ok(read_baseline("packages")?
+    .lines()
+    .filter_map(|l| l.split_once('\t'))
+    .map(|(n, v)| (n.to_string(), v.to_string()))
+    .collect())
+}
+
+/// Regular files below `dir`, symlinks not followed
+fn walk(dir: &Path, files: &mut Vec<PathBuf>) {
+    for entry in fs::read_dir(dir).into_iter().flatten().flatten() {
+        match entry.file_type() {
+            Ok(t) if t.is_dir() => walk(&entry.path(), files),
+            Ok(t) if t.is_file() => files.push(entry.path()),
+            _ => {}
+        }
+    }
+}
+
+fn compare_etc(files: &mut Files) -> Result<()> {
+    // sha256sum lines: "<hash>  <path>"
+    let shipped: BTreeMap<String, String> = read_baseline("etc.sha256")?
+    .lines()
+    .filter_map(|l| l.split_once("  "))
+    .map(|(h, p)| (p.to_string(), h.to_string()))
+    .collect();
+    let mut present = Vec::new();
+    walk(Path::new("/etc"), &mut present);
+    let present: BTreeSet<String> = present.iter().map(|p| p.to_string_lossy().to_string()).collect();
+
+    for (path, hash) in &shipped {
+        if expected(path) {
+            continue;
+        }
+        if !present.contains(path) {
+            files.removed.push(path.clone());
+            continue;
+        }
+        match integrity::hash_file(Path::new(path)) {
+            Some(h) if h == *hash => {}
+            Some(_) => files.modified.push(path.clone()),
+            None => files.unreadable += 1,
+        }
+    }
+    files.added = present.into_iter().filter(|p| !shipped.contains_key(p) && !expected(p)).collect();
+    Ok(())
+}
+
+/// Package files dpkg --verify reports, conffiles and /etc left to `compare_etc`
+fn package_files() -> Vec<String> {
+    run_command("dpkg", &["--verify"], "Verify Packages")
+    .unwrap_or_default()
+    .lines()
+    .filter(|l| !l.contains(" c /"))
+    .filter_map(|l| l.split_whitespace().last())
+    .filter(|p| p.starts_with('/') && !p.starts_with("/etc/"))
+    .map(str::to_string)
+    .collect()
+}
+
+fn collect() -> Result<Deviations> {
+    let image: serde_json::Value = serde_json::from_str(&read_baseline("image.json")?).into_diagnostic()?;
+    let diff: PackageDiff = packages::diff(&image_packages()?, &packages::installed_packages(Path::new("/")));
+    let manual: BTreeSet<String> = run_command("apt-mark", &["showmanual"], "List Manual Packages")
+    .unwrap_or_default()
+    .lines()
+    .map(|l| l.trim().to_string())
+    .collect();
+    let mut files = Files::default();
+    compare_etc(&mut files)?;
+    files.package_files = package_files();
+    Ok(Deviations {
+        image,
+        added: diff
+        .added
+        .into_iter()
+        .map(|(name, version)| Added { manual: manual.contains(&name), name, version })
+        .collect(),
+        removed: diff.removed,
+        changed: diff.changed,
+        files,
+    })
+}
+
+/// Prints `items` under `title`, the first SHOW_LIMIT of them
+fn section(title: &str, items: &[String]) {
+    if items.is_empty() {
+        return;
+    }
+    println!();
+    println!("{} ({})", paint(title, Tone::Accent), items.len());
+    for item in items.iter().take(SHOW_LIMIT) {
+        println!("  {}", item);
+    }
+    if items.len() > SHOW_LIMIT {
+        println!("  ... and {} more (see --json)", items.len() - SHOW_LIMIT);
+    }
+}
+
+pub fn handle_deviations(json: bool, show_updates: bool) -> Result<()> {
+    let d = collect()?;
+    if json {
+        println!("{}", serde_json::to_string_pretty(&d).into_diagnostic()?);
+        return Ok(());
+    }
+
+    let field = |key: &str| d.image[key].as_str().unwrap_or("?").to_string();
+    print_table(&[
+        vec!["Image".to_string(), field("image")],
+        vec!["Built".to_string(), field("built")],
+        vec!["Builder".to_string(), field("builder")],
+    ]);
+
+    let (manual, dependencies): (Vec<&Added>, Vec<&Added>) = d.added.iter().partition(|a| a.manual);
+    section("Packages installed locally", &manual.iter().map(|a| format!("{} {}", a.name, a.version)).collect::<Vec<_>>());
+    section("Packages pulled in as dependencies", &dependencies.iter().map(|a| format!("{} {}", a.name, a.version)).collect::<Vec<_>>());
+    section("Packages removed", &d.removed.iter().map(|(n, v)| format!("{} {}", n, v)).collect::<Vec<_>>());
+    if show_updates {
+        section("Packages at another version", &d.changed.iter().map(|(n, a, b)| format!("{}: {} → {}", n, a, b)).collect::<Vec<_>>());
+    }
+    section("Modified in /etc", &d.files.modified);
+    section("Removed from /etc", &d.files.removed);
+    section("Added to /etc", &d.files.added);
+    section("Modified package files", &d.files.package_files);
+
+    println!();
+    let count = d.added.len() + d.removed.len() + d.files.modified.len() + d.files.removed.len() + d.files.added.len() + d.files.package_files.len();
+    if count == 0 {
+        Logger::success("Nothing differs from the image but updates.");
+    } else {
+        Logger::info(&format!("{} deviation(s) from the image.", count));
+    }
+    if !show_updates && !d.changed.is_empty() {
+        Logger::info(&format!("{} package(s) are at another version, mostly from updates; list them with --updates.", d.changed.len()));
+    }
+    if d.files.unreadable > 0 {
+        let hint = if is_root() { "" } else { "; run as root to compare them" };
+        Logger::warn(&format!("{} file(s) in /etc could not be read{}.", d.files.unreadable, hint));
+    }
+    Ok(())
+}
@@ -0,0 +1,121 @@
+use miette::{IntoDiagnostic, Result};
+use dialoguer::Confirm;
+use hammer_core::i18n::tr_fmt;
+use hammer_core::{overrides, run_change, run_command, Logger};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io::IsTerminal;
+use std::path::{Path, PathBuf};
+
+use crate::kernel;
+
+const DKMS_TREE: &str = "var/lib/dkms";
+
+/// Lines of a failed build's make.log shown in the report
+const LOG_LINES: usize = 15;
+
+/// A DKMS module built for the running kernel but not for the one the update installed
+pub struct Failure {
+    pub module: String,
+    pub version: String,
+    pub log: Option<PathBuf>,
+}
+
+/// module -> version of the DKMS modules in `root` with a built .ko for `kernel`
+fn built_for(root: &Path, kernel: &str) -> BTreeMap<String, String> {
+    let mut built = BTreeMap::new();
+    for module in fs::read_dir(root.join(DKMS_TREE)).into_iter().flatten().flatten() {
+        for version in fs::read_dir(module.path()).into_iter().flatten().flatten() {
+            // <module>/<version>/<kernel>/<arch>/module/*.ko[.xz|.zst]
+            let has_ko = fs::read_dir(version.path().join(kernel))
+            .into_iter()
+            .flatten()
+            .flatten()
+            .flat_map(|arch| fs::read_dir(arch.path().join("module")).into_iter().flatten().flatten())
+            .any(|f| f.file_name().to_string_lossy().contains(".ko"));
+            if has_ko {
+                built.insert(
+                    module.file_name().to_string_lossy().to_string(),
+                    version.file_name().to_string_lossy().to_string(),
+                );
+            }
+        }
+    }
+    built
+}
+
+/// The newest kernel in `root` if it differs from the running one, with the modules that did
+/// not build for it (nvidia, virtualbox, ...)
+pub fn check(root: &Path) -> Option<(String, Vec<Failure>)> {
+    let running = run_command("uname", &["-r"], "Running Kernel").ok()?.trim().to_string();
+    let new = kernel::newest_in(root)?;
+    if new == running {
+        return None;
+    }
+    let after = built_for(root, &new);
+    let failures: Vec<Failure> = built_for(root, &running)
+    .into_iter()
+    .filter(|(module, _)| !after.contains_key(module))
+    .map(|(module, version)| {
+        let log = root.join(DKMS_TREE).join(&module).join(&version).join("build/make.log");
+        Failure { log: log.exists().then_some(log), module, version }
+    })
+    .collect();
+    Some((new, failures))
+}
+
+pub fn report(root: &Path, kernel: &str, failures: &[Failure]) {
+    Logger::error(&format!("DKMS modules did not build for kernel {}:", kernel));
+    for f in failures {
+        Logger::error(&format!("  {} {}", f.module, f.version));
+        if let Some(log) = &f.log {
+            let content = fs::read_to_string(log).unwrap_or_default();
+            let lines: Vec<&str> = content.lines().collect();
+            for line in &lines[lines.len().saturating_sub(LOG_LINES)..] {
+                Logger::info(&format!("    {}", line));
+            }
+        }
+    }
+    if !root.join("usr/src").join(format!("linux-headers-{}", kernel)).exists() {
+        Logger::warn(&format!("linux-headers-{} is not installed; DKMS cannot build without it.", kernel));
+    }
+}
+
+/// Kernel metapackages ("linux-image-amd64") that pulled in the new kernel
+fn kernel_metapackages(root: &Path) -> Vec<String> {
+    hammer_core::packages::installed_packages(root)
+    .into_keys()
+    .filter(|p| {
+        ["linux-image-", "linux-headers-"]
+        .iter()
+        .any(|pre| p.strip_prefix(pre).is_some_and(|rest| !rest.starts_with(|c: char| c.is_ascii_digit())))
+    })
+    .collect()
+}
+
+/// Offers to hold the kernel metapackages on the running system, so the next update keeps
+/// the current kernel until the out-of-tree modules support the new one
+pub fn offer_kernel_hold() -> Result<()> {
+    let held = kernel_metapackages(Path::new("/"));
+    if held.is_empty() {
+        return Ok(());
+    }
+    let command = format!("apt-mark hold {}", held.join(" "));
+    // Not a confirmation of what was asked for, so HAMMER_ASSUME_YES does not answer it
+    if !std::io::stdin().is_terminal() || overrides::assume_yes() {
+        Logger::info(&format!("To keep the current kernel for now: {}", command));
+        return Ok(());
+    }
+    let hold = Confirm::new()
+    .with_prompt(tr_fmt("prompt.hold-kernel", &[&command]))
+    .default(false)
+    .interact()
+    .into_diagnostic()?;
+    if hold {
+        let mut args = vec!["hold"];
+        args.extend(held.iter().map(|s| s.as_str()));
+        run_change("apt-mark", &args, "Hold Kernel Packages")?;
+        Logger::info(&format!("Held. Undo with: apt-mark unhold {}", held.join(" ")));
+    }
+    Ok(())
+}
@@ -0,0 +1,119 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::{direct, HammerError, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::snapshots;
+
+// Runs from the initramfs emergency shell (see config/initramfs-tools): no btrfs-progs,
+// no mount(8), no config. Only syscalls, so the static build needs nothing else.
+
+/// Top level mount; /run is a tmpfs in the initramfs as well
+const TOP: &str = "/run/hammer-emergency";
+
+/// "UUID=...", "PARTUUID=...", "LABEL=..." or a device path; without `device`, root= from the kernel command line
+fn root_device(device: Option<String>) -> Result<PathBuf> {
+    let spec = match device {
+        Some(d) => d,
+        None => fs::read_to_string("/proc/cmdline")
+        .into_diagnostic()?
+        .split_whitespace()
+        .find_map(|arg| arg.strip_prefix("root="))
+        .map(String::from)
+        .ok_or_else(|| HammerError::ConfigError("No root= on the kernel command line; pass --device".into()))?,
+    };
+    let path = [("UUID=", "by-uuid"), ("PARTUUID=", "by-partuuid"), ("LABEL=", "by-label")]
+    .iter()
+    .find_map(|(prefix, dir)| spec.strip_prefix(prefix).map(|v| Path::new("/dev/disk").join(dir).join(v)))
+    .unwrap_or_else(|| PathBuf::from(&spec));
+    if !path.exists() {
+        return Err(HammerError::ConfigError(format!("Root device {} not found ({})", path.display(), spec)).into());
+    }
+    Ok(path)
+}
+
+/// Runs `f` with the top level mounted at TOP
+fn with_top<T>(device: Option<String>, f: impl FnOnce(&Path) -> Result<T>) -> Result<T> {
+    let device = root_device(device)?;
+    let top = Path::new(TOP);
+    direct::mount_top_level(&device, top)?;
+    let result = f(top);
+    direct::unmount(top)?;
+    result
+}
+
+/// Root subvolumes below the top level: @, @bad-* and @snapshots/*, sorted
+fn deployments(top: &Path) -> Vec<String> {
+    let names = |dir: &Path| -> Vec<String> {
+        fs::read_dir(dir)
+        .map(|entries| entries.flatten().map(|e| e.file_name().to_string_lossy().to_string()).collect())
+        .unwrap_or_default()
+    };
+    let mut list: Vec<String> = names(top).into_iter().filter(|n| n == "@" || n.starts_with("@bad-")).collect();
+    list.extend(names(&top.join("@snapshots")).into_iter().map(|n| format!("@snapshots/{}", n)));
+    list.sort();
+    list
+}
+
+pub fn handle_list(device: Option<String>) -> Result<()> {
+    with_top(device, |top| {
+        for path in deployments(top) {
+            match direct::subvolume_id(&top.join(&path)) {
+                Ok(id) => println!("{: >6}  {}", id, path),
+                Err(_) => println!("{: >6}  {}", "-", path),
+            }
+        }
+        Ok(())
+    })
+}
+
+/// Same as `hammer rollback`: @ becomes @bad-<date> and a writable copy of the snapshot becomes @
+pub fn handle_rollback(snapshot: &str, device: Option<String>) -> Result<()> {
+    Logger::section("EMERGENCY ROLLBACK");
+    let name = with_top(device, |top| {
+        let available = deployments(top);
+        let matches: Vec<&String> = available
+        .iter()
+        .filter_map(|p| p.strip_prefix("@snapshots/").map(|n| (p, n)))
+        .filter(|(_, n)| *n == snapshot || snapshots::fuzzy_match(n, snapshot))
+        .map(|(p, _)| p)
+        .collect();
+        let source = match matches.as_slice() {
+            [one] => top.join(one),
+            [] => return Err(HammerError::ConfigError(format!("No snapshot matches '{}'", snapshot)).into()),
+            many => {
+                return Err(HammerError::ConfigError(format!(
+                    "'{}' matches {} snapshots: {}", snapshot, many.len(),
+                    many.iter().map(|s| s.as_str()).collect::<Vec<_>>().join(", ")
+                )).into())
+            }
+        };
+
+        let bad = format!("@bad-{}", chrono::Local::now().format("%Y%m%d-%H%M%S"));
+        fs::rename(top.join("@"), top.join(&bad)).into_diagnostic()?;
+        Logger::info(&format!("Moved @ to {}", bad));
+        if let Err(e) = direct::snapshot(&source, top, "@") {
+            // Put the old root back rather than leaving nothing to boot
+            fs::rename(top.join(&bad), top.join("@")).into_diagnostic()?;
+            return Err(e);
+        }
+        Ok(source.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default())
+    })?;
+
+    Logger::success(&format!("@ is now a copy of {}. hammer state (pins, journal) is the snapshot's. Reboot with: reboot -f", name));
+    Logger::end_section();
+    Ok(())
+}
+
+/// Points the default subvolume at "@", "@snapshots/NAME", "@bad-..." or a numeric ID
+pub fn handle_set_default(target: &str, device: Option<String>) -> Result<()> {
+    with_top(device, |top| {
+        let id = match target.parse::<u64>() {
+            Ok(id) => id,
+            Err(_) => direct::subvolume_id(&top.join(target))?,
+        };
+        direct::set_default(top, id)?;
+        Logger::success(&format!("Default subvolume is now {} ({}).", id, target));
+        Ok(())
+    })
+}
@@ -0,0 +1,131 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::{Duration, Local, NaiveDateTime};
+use hammer_core::exec::Exec;
+use hammer_core::{journal, HammerError, Logger};
+use serde::Serialize;
+use std::env;
+use std::io::{self, Write};
+use std::os::fd::AsFd;
+use std::process::Stdio;
+
+use crate::reboot;
+
+/// Result document in the shape Ansible/Salt modules use
+#[derive(Serialize, Default)]
+struct Outcome {
+    changed: bool,
+    failed: bool,
+    msg: String,
+    actions: Vec<String>,
+    /// Finish time of the newest successful update
+    last_update: Option<String>,
+    pending: Vec<String>,
+}
+
+/// "7d", "12h", "30m", "2w"
+pub fn parse_max_age(value: &str) -> Result<Duration> {
+    let (num, unit) = value.split_at(value.trim_end_matches(|c: char| c.is_ascii_alphabetic()).len());
+    let n: i64 = num.parse().map_err(|_| HammerError::ConfigError(format!("Invalid --max-age '{}'", value)))?;
+    match unit {
+        "m" => Ok(Duration::minutes(n)),
+        "h" => Ok(Duration::hours(n)),
+        "d" | "" => Ok(Duration::days(n)),
+        "w" => Ok(Duration::weeks(n)),
+        _ => Err(HammerError::ConfigError(format!("Invalid --max-age unit in '{}' (m, h, d, w)", value)).into()),
+    }
+}
+
+/// Newest update that ran to completion, whether or not it changed anything
+fn last_update() -> Option<(String, NaiveDateTime)> {
+    journal::list()
+    .into_iter()
+    .filter(|tx| tx.kind == "update" && (tx.result == "success" || tx.result == "unchanged"))
+    .filter_map(|tx| {
+        let finished = tx.finished?;
+        let time = NaiveDateTime::parse_from_str(&finished, "%Y-%m-%d %H:%M:%S").ok()?;
+        Some((tx.id, time))
+    })
+    .last()
+}
+
+/// Runs hammer-updater with its output on stderr so stdout stays pure JSON
+fn run_self(args: &[&str]) -> Result<bool> {
+    let stderr = io::stderr().as_fd().try_clone_to_owned().into_diagnostic()?;
+    let exe = env::current_exe().into_diagnostic()?.to_string_lossy().to_string();
+    let status = Exec::new(&exe, args, "Run Step")
+    .stdin(Stdio::null())
+    .stdout(Stdio::from(stderr))
+    .status()?;
+    Ok(status.success())
+}
+
+fn print(outcome: &Outcome) -> Result<()> {
+    println!("{}", serde_json::to_string(outcome).into_diagnostic()?);
+    io::stdout().flush().into_diagnostic()
+}
+
+fn converge(updated: bool, switched: bool, max_age: Option<Duration>, outcome: &mut Outcome) -> Result<()> {
+    if updated {
+        let previous = last_update();
+        let fresh = match (&previous, max_age) {
+            (Some((_, at)), Some(age)) => Local::now().naive_local() - *at < age,
+            _ => false,
+        };
+        if fresh {
+            outcome.last_update = previous.map(|(_, at)| at.format("%Y-%m-%d %H:%M:%S").to_string());
+        } else {
+            if !run_self(&["update"])? {
+                return Err(HammerError::CommandFailed("update failed".into()).into());
+            }
+            let latest = journal::list().into_iter().filter(|tx| tx.kind == "update").last();
+            match latest {
+                Some(tx) if tx.result == "success" => {
+                    outcome.changed = true;
+                    outcome.actions.push(format!("updated ({})", tx.id));
+                }
+                Some(tx) if tx.result == "unchanged" => {}
+                _ => return Err(HammerError::CommandFailed("update did not complete".into()).into()),
+            }
+            outcome.last_update = last_update().map(|(_, at)| at.format("%Y-%m-%d %H:%M:%S").to_string());
+        }
+    }
+
+    outcome.pending = reboot::pending_reasons()?;
+    if switched && !outcome.pending.is_empty() {
+        outcome.changed = true;
+        outcome.actions.push("rebooting into the new deployment".to_string());
+    }
+    Ok(())
+}
+
+/// Declarative, idempotent entry point for configuration management.
+/// Prints one JSON object with "changed" and exits non-zero only on failure.
+pub fn handle_ensure(updated: bool, switched: bool, max_age: Option<String>) -> Result<()> {
+    Logger::use_stderr();
+    let mut outcome = Outcome::default();
+    let max_age = match max_age.as_deref().map(parse_max_age).transpose() {
+        Ok(a) => a,
+        Err(e) => {
+            outcome.failed = true;
+            outcome.msg = e.to_string();
+            print(&outcome)?;
+            std::process::exit(1);
+        }
+    };
+
+    if let Err(e) = converge(updated, switched, max_age, &mut outcome) {
+        outcome.failed = true;
+        outcome.msg = e.to_string();
+        print(&outcome)?;
+        std::process::exit(1);
+    }
+
+    let reboot = switched && !outcome.pending.is_empty();
+    outcome.msg = if outcome.changed { "system converged".into() } else { "already in desired state".into() };
+    // Report before rebooting so the caller sees the result
+    print(&outcome)?;
+    if reboot {
+        run_self(&["apply"])?;
+    }
+    Ok(())
+}
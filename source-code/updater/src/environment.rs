@@ -0,0 +1,86 @@
+use hammer_core::overrides;
+use sha2::{Digest, Sha256};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::sources;
+
+// What besides the package lists decides the outcome of an apt run. Recorded with each
+// staged update as the "env" attachment, so `hammer history show --env` can tell why two
+// updates of the same day ended up different, or set up the same run again.
+
+fn sha256(path: &Path) -> String {
+    let content = fs::read(path).unwrap_or_default();
+    Sha256::digest(&content).iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// /etc/apt/preferences and the files in preferences.d, which apt reads in name order
+fn preference_files(root: &Path) -> Vec<PathBuf> {
+    let apt = root.join("etc/apt");
+    let mut files = vec![apt.join("preferences")];
+    if let Ok(entries) = fs::read_dir(apt.join("preferences.d")) {
+        let mut parts: Vec<PathBuf> = entries.flatten().map(|e| e.path()).filter(|p| p.is_file()).collect();
+        parts.sort();
+        files.extend(parts);
+    }
+    files.into_iter().filter(|f| f.exists()).collect()
+}
+
+/// Packages on hold in the dpkg database of `root`
+fn held(root: &Path) -> Vec<String> {
+    let status = fs::read_to_string(root.join("var/lib/dpkg/status")).unwrap_or_default();
+    status
+    .split("\n\n")
+    .filter(|stanza| stanza.lines().any(|l| l.starts_with("Status: hold ")))
+    .filter_map(|stanza| stanza.lines().find_map(|l| l.strip_prefix("Package: ")))
+    .map(|p| p.trim().to_string())
+    .collect()
+}
+
+/// Native architecture first, then the foreign ones dpkg was told about
+fn architectures(root: &Path) -> Vec<String> {
+    fs::read_to_string(root.join("var/lib/dpkg/arch"))
+    .unwrap_or_default()
+    .lines()
+    .map(|l| l.trim().to_string())
+    .filter(|l| !l.is_empty())
+    .collect()
+}
+
+fn relative(root: &Path, file: &Path) -> String {
+    format!("/{}", file.strip_prefix(root).unwrap_or(file).display())
+}
+
+/// The environment of an apt run in `root` with `apt_options`, as text for the journal
+pub fn capture(root: &Path, apt_options: &[String]) -> String {
+    let mut text = String::from("# apt sources (sha256)\n");
+    for file in sources::source_files(root) {
+        text.push_str(&format!("{}  {}\n", sha256(&file), relative(root, &file)));
+    }
+
+    text.push_str("\n# apt preferences (pin priorities)\n");
+    let preferences = preference_files(root);
+    if preferences.is_empty() {
+        text.push_str("none\n");
+    }
+    for file in preferences {
+        text.push_str(&format!("## {}  {}\n", relative(root, &file), sha256(&file)));
+        text.push_str(fs::read_to_string(&file).unwrap_or_default().trim_end());
+        text.push('\n');
+    }
+
+    let held = held(root);
+    text.push_str(&format!("\n# held packages\n{}\n", if held.is_empty() { "none".to_string() } else { held.join(" ") }));
+    let archs = architectures(root);
+    text.push_str(&format!("\n# dpkg architectures\n{}\n", if archs.is_empty() { "native only".to_string() } else { archs.join(" ") }));
+    text.push_str(&format!("\n# apt options\n{}\n", if apt_options.is_empty() { "none".to_string() } else { apt_options.join(" ") }));
+
+    let config = overrides::config_path();
+    text.push_str(&format!("\n# {}\n", config.display()));
+    match fs::read_to_string(&config) {
+        Ok(config) => text.push_str(config.trim_end()),
+        Err(_) => text.push_str("missing, built-in defaults"),
+    }
+    text.push('\n');
+    text
+}
@@ -0,0 +1,224 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::config::{Executor, Limits, UpdateConfig};
+use hammer_core::exec::{self, Exec};
+use hammer_core::{journal, packages, HammerError, Logger};
+use std::fs;
+use std::path::Path;
+
+/// Where preseed selections are copied inside the root while debconf reads them
+const PRESEED_COPY: &str = "/tmp/hammer-preseed.conf";
+
+/// Prepares the staged root inside a private mount and PID namespace, then chroots into it.
+/// Everything mounted here goes away with the namespace, so a crash in apt (or in hammer)
+/// cannot leave bind mounts behind on the host. /dev gets only the nodes apt and maintainer
+/// scripts use, with a private devpts instance instead of the host's terminals. DNS, apt
+/// credentials (auth.conf, auth.conf.d) and apt proxy settings are taken from the host.
+const CHROOT_SETUP: &str = r#"set -e
+root="$1"; shift
+mount -t tmpfs -o mode=755,nosuid,noexec tmpfs "$root/dev"
+for node in null:1:3 zero:1:5 full:1:7 random:1:8 urandom:1:9 tty:5:0; do
+    name=${node%%:*}; nums=${node#*:}
+    mknod -m 666 "$root/dev/$name" c "${nums%:*}" "${nums#*:}"
+done
+mkdir -p "$root/dev/pts" "$root/dev/shm"
+mount -t devpts -o newinstance,ptmxmode=0666,mode=620 devpts "$root/dev/pts"
+mount -t tmpfs -o mode=1777,nosuid,nodev shm "$root/dev/shm"
+ln -s pts/ptmx "$root/dev/ptmx"
+ln -s /proc/self/fd "$root/dev/fd"
+ln -s /proc/self/fd/0 "$root/dev/stdin"
+ln -s /proc/self/fd/1 "$root/dev/stdout"
+ln -s /proc/self/fd/2 "$root/dev/stderr"
+mount -t proc -o nosuid,nodev,noexec proc "$root/proc"
+mount -t sysfs -o ro,nosuid,nodev,noexec sysfs "$root/sys"
+
+# Host network settings go to a tmpfs /run, so none of them is left in the deployment
+mount -t tmpfs -o mode=755,nosuid,nodev tmpfs "$root/run"
+hammer="$root/run/hammer"
+mkdir -p "$hammer/auth.conf.d"
+for dir in "$root/etc/apt/auth.conf.d" /etc/apt/auth.conf.d; do
+    if [ -d "$dir" ]; then cp -a "$dir/." "$hammer/auth.conf.d/"; fi
+done
+cat "$root/etc/apt/auth.conf" /etc/apt/auth.conf > "$hammer/auth.conf" 2>/dev/null || true
+chmod 700 "$hammer" "$hammer/auth.conf.d"
+chmod 600 "$hammer/auth.conf"
+if [ -e "$root/etc/apt/apt.conf" ]; then
+    echo '#include "/etc/apt/apt.conf";' > "$hammer/apt.conf"
+fi
+printf 'Dir::Etc::netrc "/run/hammer/auth.conf";\nDir::Etc::netrcparts "/run/hammer/auth.conf.d";\n%s\n' \
+    "$HAMMER_APT_PROXY" >> "$hammer/apt.conf"
+export APT_CONFIG=/run/hammer/apt.conf
+
+# systemd-resolved makes resolv.conf a symlink into /run; give it the host's resolved file
+resolv="$root/etc/resolv.conf"
+if [ -L "$resolv" ]; then
+    target=$(readlink "$resolv")
+    case "$target" in /*) ;; *) target="/etc/$target" ;; esac
+    case "$target" in /run/*|/etc/../run/*) ;; *) target="" ;; esac
+    if [ -n "$target" ]; then
+        resolv="$root$target"
+        mkdir -p "$(dirname "$resolv")"
+        touch "$resolv"
+    fi
+fi
+if [ -f "$resolv" ] && [ -e /etc/resolv.conf ]; then
+    mount --bind -o ro "$(readlink -f /etc/resolv.conf)" "$resolv"
+fi
+
+exec chroot "$root" "$@"
+"#;
+
+/// Proxy settings from the host's apt configuration, in apt.conf syntax.
+/// http_proxy and friends reach the chroot through the environment already.
+fn host_apt_proxy() -> String {
+    Exec::new("apt-config", &["dump", "Acquire"], "Read Apt Proxy")
+    .output()
+    .unwrap_or_default()
+    .lines()
+    .filter(|l| l.to_lowercase().contains("::proxy"))
+    .collect::<Vec<_>>()
+    .join("\n")
+}
+
+fn words(words: &[&str]) -> Vec<String> {
+    words.iter().map(|w| w.to_string()).collect()
+}
+
+/// The command line, program first, that runs `args` inside `root` with the given executor.
+/// Containers do not inherit hammer's environment, so `env` is passed explicitly.
+fn command_for(executor: Executor, root: &Path, args: &[&str], env: &[(&str, &str)]) -> Vec<String> {
+    let root_str = root.to_string_lossy().to_string();
+    let mut line = match executor {
+        Executor::Live => Vec::new(),
+        Executor::Chroot => {
+            // --kill-child: the sandbox dies with hammer instead of running on unsupervised
+            words(&["unshare", "--mount", "--propagation", "private", "--pid", "--fork", "--kill-child", "--", "sh", "-c", CHROOT_SETUP, "sh", &root_str])
+        }
+        Executor::Nspawn => {
+            // Host networking, private /dev and /proc managed by nspawn itself
+            let mut line = words(&["systemd-nspawn", "--quiet", "--register=no", "--resolv-conf=copy-host", "-D", &root_str]);
+            line.extend(env.iter().map(|(k, v)| format!("--setenv={}={}", k, v)));
+            line
+        }
+        Executor::Podman => {
+            let mut line = words(&["podman", "run", "--rm", "--net=host", "--privileged"]);
+            line.extend(env.iter().flat_map(|(k, v)| ["-e".to_string(), format!("{}={}", k, v)]));
+            line.extend(words(&["--rootfs", &root_str]));
+            line
+        }
+    };
+    line.extend(words(args));
+    line
+}
+
+/// Wraps the command line in a transient systemd scope carrying the cgroup limits
+fn limited(line: Vec<String>, limits: &Limits) -> Vec<String> {
+    if limits.is_empty() {
+        return line;
+    }
+    let mut scoped = words(&["systemd-run", "--scope", "--quiet", "--collect"]);
+    scoped.extend(limits.systemd_run_args());
+    scoped.push("--".to_string());
+    scoped.extend(line);
+    scoped
+}
+
+/// Journal phase name of an apt command line: "apt upgrade", "apt install", ...
+pub fn phase_name(args: &[&str]) -> String {
+    let verb = args.iter().skip(1).find(|a| !a.starts_with('-') && !a.contains("::") && !a.contains('='));
+    format!("apt {}", verb.unwrap_or(&"run"))
+}
+
+/// The command line run_in_root would start, for `hammer explain`; the chroot setup script is elided
+pub fn describe(cfg: &UpdateConfig, root: &Path, args: &[&str]) -> String {
+    let env = [("DEBIAN_FRONTEND", cfg.apt.frontend.as_str())];
+    let words: Vec<String> = limited(command_for(cfg.executor, root, args, &env), &cfg.limits)
+    .into_iter()
+    .map(|w| match w.as_str() {
+        CHROOT_SETUP => "'<sandbox setup>'".to_string(),
+        _ if w.contains(' ') => format!("'{}'", w),
+        _ => w,
+    })
+    .collect();
+    format!("DEBIAN_FRONTEND={} {}", cfg.apt.frontend, words.join(" "))
+}
+
+/// Runs a command inside the (staged) root, streaming its output. Returns success.
+pub fn run_in_root(cfg: &UpdateConfig, root: &Path, args: &[&str]) -> Result<bool> {
+    let executor = cfg.executor;
+    if exec::dry_run() {
+        Logger::info(&format!("Dry run, not running: {}", describe(cfg, root, args)));
+        return Ok(true);
+    }
+    Logger::log(&format!("Running in {} ({}): {}", root.display(), executor.name(), args.join(" ")));
+
+    let env = [("DEBIAN_FRONTEND", cfg.apt.frontend.as_str())];
+    let line = limited(command_for(executor, root, args, &env), &cfg.limits);
+    let rest: Vec<&str> = line[1..].iter().map(String::as_str).collect();
+    let mut command = Exec::new(&line[0], &rest, "Run in Root");
+    for (key, value) in env {
+        command = command.env(key, value);
+    }
+    if executor == Executor::Chroot {
+        command = command.env("HAMMER_APT_PROXY", &host_apt_proxy());
+    }
+    Ok(command.status()?.success())
+}
+
+/// Loads the configured debconf preseed files into the root, so questions apt would
+/// ask are answered before it runs. Returns success.
+pub fn preseed(cfg: &UpdateConfig, root: &Path) -> Result<bool> {
+    if cfg.apt.preseed.is_empty() {
+        return Ok(true);
+    }
+    // The files live on the host; the root only sees what is copied into it
+    let mut selections = String::new();
+    for file in &cfg.apt.preseed {
+        let content = fs::read_to_string(file)
+        .map_err(|e| HammerError::ConfigError(format!("Preseed file {}: {}", file, e)))?;
+        selections.push_str(&content);
+        selections.push('\n');
+    }
+    if exec::dry_run() {
+        let count = selections.lines().filter(|l| !l.trim().is_empty() && !l.starts_with('#')).count();
+        Logger::info(&format!(
+            "Dry run, not preseeding debconf in {} with {} selection(s) from {}",
+            root.display(), count, cfg.apt.preseed.join(", ")
+        ));
+        return Ok(true);
+    }
+    let copy = root.join(PRESEED_COPY.trim_start_matches('/'));
+    fs::write(&copy, selections).into_diagnostic()?;
+    Logger::info(&format!("Preseeding debconf from {}", cfg.apt.preseed.join(", ")));
+    let ok = run_in_root(cfg, root, &["debconf-set-selections", PRESEED_COPY]);
+    let _ = fs::remove_file(&copy);
+    ok
+}
+
+/// apt-get autoremove --purge in the root; the removed orphans are logged and attached
+/// to the journal entry `tx_id`. Returns success.
+pub fn autoremove(cfg: &UpdateConfig, root: &Path, apt_options: &[String], tx_id: &str) -> Result<bool> {
+    let before = packages::installed_packages(root);
+    let mut args = vec!["apt-get"];
+    args.extend(apt_options.iter().map(|o| o.as_str()));
+    args.extend(["autoremove", "--purge", "-y"]);
+    if !run_in_root(cfg, root, &args)? {
+        return Ok(false);
+    }
+
+    let after = packages::installed_packages(root);
+    let removed: Vec<String> = before
+    .iter()
+    .filter(|(name, _)| !after.contains_key(*name))
+    .map(|(name, version)| format!("{} {}", name, version))
+    .collect();
+    if removed.is_empty() {
+        Logger::info("No orphaned packages.");
+    } else {
+        Logger::info(&format!("Removed {} orphaned packages:", removed.len()));
+        for line in &removed {
+            Logger::info(&format!("  {}", line));
+        }
+        journal::attach(tx_id, "orphans", &removed.join("\n"))?;
+    }
+    Ok(true)
+}
@@ -0,0 +1,368 @@
+use miette::Result;
+use hammer_core::config::{self, ConffilePolicy, UpdateConfig};
+use hammer_core::events::{self, Event};
+use hammer_core::state::{self, STATE_DIR};
+use hammer_core::{boot_assets, grub_btrfs, journal, lsm, output, pool, root_device, root_device_uuid, storage, HammerError, Logger};
+use std::path::Path;
+
+use crate::status::{self, DeploymentRow};
+use crate::{clean_candidates, create_snapshot_name, executor, kernel, protect, rescue, snapshots, sources, staged, Commands, RescueAction};
+
+// `hammer explain` walks the same steps as the command it explains, with this machine's
+// devices, subvolume IDs, config and hooks filled in, and prints them instead of running them.
+
+/// Stands in for a snapshot the command would ask for
+const PICKED: &str = "<snapshot picked interactively>";
+
+#[derive(Clone, Copy)]
+enum Effect {
+    Run,
+    Mount,
+    Write,
+    Move,
+    Delete,
+    Hook,
+}
+
+impl Effect {
+    fn label(self) -> &'static str {
+        match self {
+            Effect::Run => "run",
+            Effect::Mount => "mount",
+            Effect::Write => "write",
+            Effect::Move => "move",
+            Effect::Delete => "delete",
+            Effect::Hook => "hook",
+        }
+    }
+}
+
+/// Ordered steps of one command and the facts that decided them
+struct Explanation {
+    device: String,
+    rows: Vec<DeploymentRow>,
+    steps: Vec<(Effect, String)>,
+    notes: Vec<String>,
+}
+
+impl Explanation {
+    fn new() -> Self {
+        Explanation {
+            device: root_device().unwrap_or_else(|_| "<root device>".to_string()),
+            rows: status::load_rows().map(|(rows, _)| rows).unwrap_or_default(),
+            steps: Vec::new(),
+            notes: Vec::new(),
+        }
+    }
+
+    fn step(&mut self, effect: Effect, text: impl Into<String>) {
+        self.steps.push((effect, text.into()));
+    }
+
+    fn note(&mut self, text: impl Into<String>) {
+        self.notes.push(text.into());
+    }
+
+    /// Path of a subvolume below the top level mount, with its ID when it exists
+    fn subvol(&self, path: &str) -> String {
+        let full = pool::top_level().join(path).display().to_string();
+        match self.rows.iter().find(|r| r.path == path) {
+            Some(row) => format!("{} (ID {})", full, row.id),
+            None => full,
+        }
+    }
+
+    fn mount_top(&mut self) {
+        let top = pool::top_level().display();
+        if pool::unmount_after_use() || !pool::mounted() {
+            let text = format!("mount -t btrfs -o subvolid=5 {} {}", self.device, top);
+            self.step(Effect::Mount, text);
+        }
+    }
+
+    fn umount_top(&mut self) {
+        if pool::unmount_after_use() {
+            self.step(Effect::Mount, format!("umount {}", pool::top_level().display()));
+        }
+    }
+
+    fn emit(&mut self, event: Event, snapshot: &str) {
+        for hook in events::hooks(event) {
+            let text = format!("HAMMER_EVENT={} HAMMER_SNAPSHOT={} {}", event.name(), snapshot, hook.display());
+            self.step(Effect::Hook, text);
+        }
+        if events::has_target(event) {
+            self.step(Effect::Run, format!("systemctl start --no-block {}", event.target()));
+        }
+    }
+
+    fn refresh_grub_btrfs(&mut self) {
+        if grub_btrfs::enabled() {
+            self.step(Effect::Run, "regenerate the grub-btrfs snapshot menu");
+        }
+    }
+
+    fn esp_assets(&self, name: &str) -> Option<String> {
+        boot_assets::esp_mount()
+        .filter(|_| boot_assets::enabled())
+        .map(|esp| esp.join(boot_assets::ASSET_SUBDIR).join(name).display().to_string())
+    }
+
+    /// btrfs_snapshot_atomic: a snapshot of @ in @snapshots and a way to boot it
+    fn snapshot_root(&mut self, name: &str) {
+        self.mount_top();
+        let text = format!("btrfs subvolume snapshot {} {}", self.subvol("@"), self.subvol(&format!("@snapshots/{}", name)));
+        self.step(Effect::Run, text);
+        self.umount_top();
+        if grub_btrfs::enabled() {
+            self.refresh_grub_btrfs();
+        } else if let Some(dir) = self.esp_assets(name) {
+            self.step(Effect::Write, format!("{} (copy of the current kernel and initrd)", dir));
+        }
+        self.emit(Event::SnapshotCreated, name);
+    }
+
+    /// btrfs_delete_atomic_snapshot
+    fn delete_snapshot(&mut self, name: &str) {
+        self.mount_top();
+        let text = format!("btrfs subvolume delete {}", self.subvol(&format!("@snapshots/{}", name)));
+        self.step(Effect::Delete, text);
+        self.umount_top();
+        if let Some(dir) = self.esp_assets(name) {
+            self.step(Effect::Delete, dir);
+        }
+        self.refresh_grub_btrfs();
+    }
+
+    fn carry_over(&mut self, new_root: &Path) {
+        let dest = new_root.join(STATE_DIR.trim_start_matches('/'));
+        self.step(Effect::Run, format!("cp -a {}/. {}", STATE_DIR, dest.display()));
+    }
+
+    fn print(&self, command: &str) {
+        Logger::section(&format!("PLAN: hammer {}", command));
+        for (i, (effect, text)) in self.steps.iter().enumerate() {
+            let label = output::paint(format!("{: <6}", effect.label()), output::Tone::Accent);
+            Logger::info(&format!("{: >3}. {} {}", i + 1, label, text));
+        }
+        for note in &self.notes {
+            Logger::info(&output::paint(format!("note: {}", note), output::Tone::Muted));
+        }
+        Logger::success("Nothing was run.");
+        Logger::end_section();
+    }
+}
+
+/// Preflight, the pre-update snapshot and its journal entry; returns the snapshot name
+fn begin_update(e: &mut Explanation, kind: &str) -> String {
+    let snap = create_snapshot_name(&format!("pre-{}", kind));
+    e.emit(Event::PreUpdate, "");
+    if boot_assets::enabled() {
+        e.step(Effect::Run, format!("check the ESP has {} MiB free", boot_assets::required_bytes() / 1024 / 1024));
+    }
+    e.snapshot_root(&snap);
+    e.step(Effect::Write, format!("{}/{}.json (transaction {})", journal::journal_dir().display(), snap, kind));
+    e.note(format!("the snapshot name is stamped at run time, e.g. {}", snap));
+    snap
+}
+
+/// staged::apply and the live equivalent: pinning, preseeding, the apt steps and autoremove in `root`
+fn apt_steps(e: &mut Explanation, cfg: &UpdateConfig, root: &Path, steps: &[Vec<&str>], snap: &str) {
+    let mut options = Vec::new();
+    if let Some(ts) = &cfg.pin_mirror {
+        e.step(Effect::Write, format!("{} (sources pinned to snapshot.debian.org at {})", root.join("etc/apt/hammer-pinned").display(), ts));
+        options.push("-o".to_string());
+        options.push("Dir::Etc::SourceList=/etc/apt/hammer-pinned/sources.list".to_string());
+        options.push("-o".to_string());
+        options.push("Dir::Etc::SourceParts=/etc/apt/hammer-pinned/sources.list.d".to_string());
+    }
+    options.extend(cfg.apt.apt_args());
+    e.step(Effect::Write, format!("{} (apt sources)", journal::attachment_path(snap, "sources").display()));
+    if !cfg.apt.preseed.is_empty() {
+        e.step(Effect::Write, format!("{} from {}", root.join("tmp/hammer-preseed.conf").display(), cfg.apt.preseed.join(", ")));
+        e.step(Effect::Run, executor::describe(cfg, root, &["debconf-set-selections", "/tmp/hammer-preseed.conf"]));
+    }
+    for step in steps {
+        e.step(Effect::Run, executor::describe(cfg, root, &sources::with_options(step, &options)));
+    }
+    if cfg.autoremove {
+        let mut args = vec!["apt-get"];
+        args.extend(options.iter().map(|o| o.as_str()));
+        args.extend(["autoremove", "--purge", "-y"]);
+        e.step(Effect::Run, executor::describe(cfg, root, &args));
+    }
+    if cfg.pin_mirror.is_some() {
+        e.step(Effect::Delete, root.join("etc/apt/hammer-pinned").display().to_string());
+    }
+}
+
+/// staged::run
+fn explain_staged_update(e: &mut Explanation, cfg: &UpdateConfig) {
+    let layered = state::layered_packages();
+    let plan = staged::Plan::update(cfg, &layered);
+    e.note(format!("executor: {}; the running system is not modified", cfg.executor.name()));
+    let snap = begin_update(e, plan.kind);
+    let staged_root = pool::top_level().join(staged::UPDATE_SUBVOL);
+
+    e.mount_top();
+    let text = format!("btrfs subvolume snapshot {} {}", e.subvol("@"), staged_root.display());
+    e.step(Effect::Run, text);
+    apt_steps(e, cfg, &staged_root, &plan.steps, &snap);
+    e.step(Effect::Run, format!("dkms status for the newest kernel in {}", staged_root.display()));
+    for lsm in lsm::active_lsms() {
+        e.step(Effect::Write, format!("{} first-boot preparation in {}", lsm.name(), staged_root.display()));
+    }
+    if cfg.apt.conffiles == ConffilePolicy::Ask {
+        e.step(Effect::Run, format!("ask about each changed conffile in {}", staged_root.display()));
+    }
+    if cfg.clean_cache {
+        e.step(Effect::Delete, format!("{}/var/cache/apt/archives/*.deb and the apt binary caches", staged_root.display()));
+    }
+    e.step(Effect::Write, format!("{}/integrity/<UUID of {}> (file hashes)", STATE_DIR, staged::UPDATE_SUBVOL));
+    e.step(Effect::Write, format!("{} ({})", protect::switch_file().display(), snap));
+    e.carry_over(&staged_root);
+    let text = format!("mv {} {}/@bad-<date>", e.subvol("@"), pool::top_level().display());
+    e.step(Effect::Move, text);
+    e.step(Effect::Move, format!("mv {} {}/@", staged_root.display(), pool::top_level().display()));
+    e.umount_top();
+    e.emit(Event::UpdateStaged, &snap);
+    e.emit(Event::Switched, &snap);
+
+    e.note(format!("if apt fails or nothing changes, {} is deleted and nothing after the apt steps happens", staged::UPDATE_SUBVOL));
+    if !cfg.allow_dkms_failures {
+        e.note("a DKMS module that fails to build for the new kernel stops the switch");
+    }
+}
+
+/// handle_update
+fn explain_live_update(e: &mut Explanation, cfg: &UpdateConfig) {
+    e.note("executor: live; packages change in the running system");
+    e.step(Effect::Mount, "mount -o remount,rw /");
+    let snap = begin_update(e, "update");
+    let root = Path::new("/");
+    let mut upgrade = vec!["apt"];
+    upgrade.extend(cfg.upgrade_args());
+    apt_steps(e, cfg, root, &[vec!["apt", "update"], upgrade], &snap);
+    e.step(Effect::Run, "sync");
+    if cfg.apt.conffiles == ConffilePolicy::Ask {
+        e.step(Effect::Run, "ask about each changed conffile");
+    }
+    e.step(Effect::Run, "dkms status for the newest kernel");
+    let lsms = lsm::active_lsms();
+    if !lsms.is_empty() {
+        let names: Vec<&str> = lsms.iter().map(|l| l.name()).collect();
+        e.step(Effect::Run, format!("reload changed {} policy", names.join(" and ")));
+    }
+    e.step(Effect::Write, format!("{}/integrity/<UUID of @> (file hashes, if packages changed)", STATE_DIR));
+    e.step(Effect::Write, format!("{} ({}, if packages changed)", protect::switch_file().display(), snap));
+    e.emit(Event::UpdateStaged, &snap);
+}
+
+/// handle_rollback
+fn explain_rollback(e: &mut Explanation, target: Option<String>, before: Option<String>) -> Result<()> {
+    let target = snapshots::resolve(target.as_deref(), before.as_deref())?.unwrap_or_else(|| PICKED.to_string());
+    let new_root = pool::top_level().join("@");
+    e.mount_top();
+    let text = format!("mv {} {}/@bad-<date>", e.subvol("@"), pool::top_level().display());
+    e.step(Effect::Move, text);
+    let text = format!("btrfs subvolume snapshot {} {}", e.subvol(&format!("@snapshots/{}", target)), new_root.display());
+    e.step(Effect::Run, text);
+    for lsm in lsm::active_lsms() {
+        e.step(Effect::Write, format!("{} first-boot preparation in {}", lsm.name(), new_root.display()));
+    }
+    e.carry_over(&new_root);
+    e.umount_top();
+    e.emit(Event::Switched, &target);
+    e.note("asks for confirmation first; the new @ is used after a reboot");
+    Ok(())
+}
+
+fn explain_deletes(e: &mut Explanation, names: &[String]) {
+    if names.is_empty() {
+        e.note("nothing to delete");
+    }
+    for name in names {
+        e.delete_snapshot(name);
+    }
+}
+
+/// rescue::handle_prepare
+fn explain_rescue(e: &mut Explanation, kernel_version: Option<String>) {
+    let version = kernel_version.unwrap_or_else(kernel::running_kernel);
+    let dir = pool::top_level().join(rescue::RESCUE_SUBVOL);
+    let uuid = root_device_uuid().unwrap_or_else(|_| "<UUID>".to_string());
+    e.mount_top();
+    if e.rows.iter().any(|r| r.path == rescue::RESCUE_SUBVOL) {
+        let text = format!("btrfs subvolume delete {}", e.subvol(rescue::RESCUE_SUBVOL));
+        e.step(Effect::Delete, text);
+    }
+    e.step(Effect::Run, format!("btrfs subvolume create {}", dir.display()));
+    e.step(Effect::Write, format!("{} from /boot/vmlinuz-{}", dir.join("vmlinuz").display(), version));
+    e.step(Effect::Write, format!("{} from /boot/initrd.img-{}", dir.join("initrd.img").display(), version));
+    e.step(Effect::Write, format!("{} (rescue init, hammer-rescue and static tools)", dir.join("overlay.cpio").display()));
+    e.step(Effect::Run, format!("btrfs property set -ts {} ro true", dir.display()));
+    e.umount_top();
+    e.step(Effect::Write, format!("{} (menu entry searching for UUID {})", rescue::GRUB_SCRIPT, uuid));
+    e.step(Effect::Run, "update-grub");
+}
+
+/// Prints the plan of `args`, a hammer command line without "hammer"
+pub fn handle_explain(args: Vec<String>) -> Result<()> {
+    let line = args.join(" ");
+    let command = crate::parse_command(&args)?;
+    let driver = storage::driver()?;
+    if !matches!(driver, storage::Driver::Btrfs) {
+        return Err(HammerError::ConfigError(format!("explain knows the Btrfs steps only, not {}", driver.name())).into());
+    }
+    let cfg = config::load()?;
+    let mut e = Explanation::new();
+
+    match command {
+        Commands::Update { simulate: true, .. } => {
+            let update = command.update_config(cfg.update);
+            e.step(Effect::Write, "/run/hammer/simulate-lists (copy of /var/lib/apt/lists, refreshed with apt-get update as root)");
+            e.step(Effect::Run, format!("apt-get -s {}", update.upgrade_args().join(" ")));
+            e.step(Effect::Delete, "/run/hammer/simulate-lists");
+            e.note("No snapshot or subvolume is created and no package is installed");
+        }
+        Commands::Update { .. } => {
+            let update = command.update_config(cfg.update);
+            if update.executor.is_staged() {
+                explain_staged_update(&mut e, &update);
+            } else {
+                explain_live_update(&mut e, &update);
+            }
+        }
+        Commands::Rollback { snapshot, before } => explain_rollback(&mut e, snapshot, before)?,
+        Commands::Clean { deployment: None } => {
+            let (names, protection) = clean_candidates(&cfg.clean)?;
+            if let Some(p) = protection {
+                e.note(format!("{} is kept as the rollback target of the last update ({})", p.snapshot, p.reason));
+            }
+            explain_deletes(&mut e, &names);
+            if boot_assets::enabled() {
+                e.step(Effect::Delete, "ESP boot assets of snapshots that no longer exist");
+            }
+        }
+        Commands::Delete { snapshot, before, force } => {
+            let name = snapshots::resolve(snapshot.as_deref(), before.as_deref())?.unwrap_or_else(|| PICKED.to_string());
+            let protection = protect::protected(&cfg.clean).filter(|p| p.snapshot == name);
+            if state::is_pinned(&name) {
+                e.note(format!("{} is pinned; nothing would be deleted", name));
+            } else if let (Some(p), false) = (&protection, force) {
+                e.note(format!("{} is the rollback target of the last update ({}); refused without --force", name, p.reason));
+            } else {
+                e.note("asks for confirmation first");
+                explain_deletes(&mut e, &[name]);
+            }
+        }
+        Commands::Rescue { action: RescueAction::Prepare { kernel } } => explain_rescue(&mut e, kernel),
+        _ => {
+            return Err(HammerError::ConfigError(format!(
+                "explain covers update, rollback, clean, delete and rescue prepare, not '{}'", line
+            )).into())
+        }
+    }
+    e.print(&line);
+    Ok(())
+}
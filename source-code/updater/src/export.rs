@@ -0,0 +1,335 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::exec::Exec;
+use hammer_core::{mount_btrfs_root, pool, run_change, umount_btrfs_root, HammerError, Logger};
+use sha2::{Digest, Sha256};
+use std::fs::{self, File};
+use std::io::{self, Read, Write};
+use std::path::Path;
+use std::process::{Child, Stdio};
+use std::thread;
+
+use crate::transfer::Transfer;
+use crate::{layer, s3, snapshots};
+
+/// How the send stream is protected before it leaves the machine
+pub enum Encryption {
+    None,
+    /// age recipients (public keys or ssh keys)
+    Age(Vec<String>),
+    /// GPG key ID or user ID
+    Gpg(String),
+}
+
+impl Encryption {
+    fn stage(&self) -> Option<(&'static str, Vec<String>)> {
+        match self {
+            Encryption::None => None,
+            Encryption::Age(recipients) => Some((
+                "age",
+                recipients.iter().flat_map(|r| ["-r".to_string(), r.clone()]).collect(),
+            )),
+            Encryption::Gpg(recipient) => Some((
+                "gpg",
+                vec!["--batch".into(), "--yes".into(), "--encrypt".into(), "-r".into(), recipient.clone()],
+            )),
+        }
+    }
+
+    fn extension(&self) -> &'static str {
+        match self {
+            Encryption::None => "",
+            Encryption::Age(_) => ".age",
+            Encryption::Gpg(_) => ".gpg",
+        }
+    }
+}
+
+/// Chains `stages` stdout-to-stdin; the first reads `input`, the last one's stdout stays piped
+pub(crate) fn spawn_pipeline(stages: &[(&str, Vec<String>)], input: Stdio) -> Result<Vec<Child>> {
+    let mut children: Vec<Child> = Vec::new();
+    let mut input = Some(input);
+    for (cmd, args) in stages {
+        let stdin = match children.last_mut() {
+            Some(prev) => Stdio::from(prev.stdout.take().unwrap()),
+            None => input.take().unwrap(),
+        };
+        let args: Vec<&str> = args.iter().map(String::as_str).collect();
+        children.push(Exec::new(cmd, &args, "Pipeline Stage").stdin(stdin).spawn()?);
+    }
+    Ok(children)
+}
+
+/// Runs `stages` as one pipeline and fails if any stage does
+pub(crate) fn run_pipeline(stages: &[(&str, Vec<String>)]) -> Result<()> {
+    let mut children = spawn_pipeline(stages, Stdio::null())?;
+    if let Some(mut out) = children.last_mut().and_then(|c| c.stdout.take()) {
+        io::copy(&mut out, &mut io::sink()).into_diagnostic()?;
+    }
+    wait_all(&mut children)
+}
+
+fn wait_all(children: &mut [Child]) -> Result<()> {
+    for child in children.iter_mut() {
+        let status = child.wait().into_diagnostic()?;
+        if !status.success() {
+            return Err(HammerError::CommandFailed(format!("Pipeline stage failed ({})", status)).into());
+        }
+    }
+    Ok(())
+}
+
+/// Copies `input` to `output` and returns the SHA-256 of what passed through
+fn copy_hashed(input: &mut dyn Read, output: &mut dyn Write) -> Result<String> {
+    let mut hasher = Sha256::new();
+    let mut buf = vec![0u8; 4 << 20];
+    loop {
+        let n = input.read(&mut buf).into_diagnostic()?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+        output.write_all(&buf[..n]).into_diagnostic()?;
+    }
+    output.flush().into_diagnostic()?;
+    Ok(hasher.finalize().iter().map(|b| format!("{:02x}", b)).collect())
+}
+
+/// Copies the pipeline output to a file or an S3 object and returns its SHA-256
+fn write_hashed(children: &mut [Child], output: &str) -> Result<String> {
+    let mut stream = children.last_mut().and_then(|c| c.stdout.take()).unwrap();
+    let hash = if s3::is_s3(output) {
+        let (cmd, args) = s3::Client::load()?.upload_stage(output);
+        let args: Vec<&str> = args.iter().map(String::as_str).collect();
+        let mut upload = Exec::new(cmd, &args, "Upload Export")
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .spawn()?;
+        let hash = copy_hashed(&mut stream, &mut upload.stdin.take().unwrap())?;
+        wait_all(std::slice::from_mut(&mut upload))?;
+        hash
+    } else {
+        let mut file = File::create(output).into_diagnostic()?;
+        let hash = copy_hashed(&mut stream, &mut file)?;
+        file.sync_all().into_diagnostic()?;
+        hash
+    };
+
+    wait_all(children)?;
+    Ok(hash)
+}
+
+/// "<dir>/<file>" or "s3://bucket/<key>" -> the last path segment
+fn base_name(location: &str) -> &str {
+    location.rsplit('/').next().unwrap_or(location)
+}
+
+/// Streams a snapshot through btrfs send, zstd/pigz and age/GPG into a file with a .sha256 sidecar
+pub fn handle_export(query: &str, output: Option<String>, compress: bool, encryption: Encryption) -> Result<()> {
+    Logger::section("SNAPSHOT EXPORT");
+    let name = match snapshots::resolve(Some(query), None)? {
+        Some(name) => name,
+        None => return Ok(()),
+    };
+
+    let transfer = Transfer::load();
+    let file_name = format!("{}.btrfs{}{}", name, if compress { transfer.extension() } else { "" }, encryption.extension());
+    // A bucket prefix ending in "/" gets the default file name
+    let output = match output {
+        Some(o) if s3::is_s3(&o) && o.ends_with('/') => format!("{}{}", o, file_name),
+        Some(o) => o,
+        None => file_name,
+    };
+    if let Encryption::None = encryption {
+        Logger::warn("No --age or --gpg recipient: the export is not encrypted.");
+    }
+
+    mount_btrfs_root()?;
+    // btrfs send needs a read-only source; hammer snapshots are writable
+    let ro = pool::top_level().join("@snapshots").join(format!(".export-{}", name));
+    let result = (|| -> Result<String> {
+        run_change(
+            "btrfs",
+            &["subvolume", "snapshot", "-r", &pool::top_level().join("@snapshots").join(&name).to_string_lossy(), &ro.to_string_lossy()],
+            "Create Read-only Snapshot",
+        )?;
+
+        let mut stages: Vec<(&str, Vec<String>)> = vec![("btrfs", vec!["send".into(), "-q".into(), ro.to_string_lossy().to_string()])];
+        stages.extend(transfer.buffer());
+        if compress {
+            stages.push(transfer.compress());
+        }
+        stages.extend(encryption.stage());
+
+        Logger::info(&format!("Exporting {} to {}...", name, output));
+        let mut children = spawn_pipeline(&stages, Stdio::null())?;
+        write_hashed(&mut children, &output)
+    })();
+    let _ = run_change("btrfs", &["subvolume", "delete", &ro.to_string_lossy()], "Delete Read-only Snapshot");
+    umount_btrfs_root()?;
+
+    let hash = match result {
+        Ok(hash) => hash,
+        Err(e) => {
+            if !s3::is_s3(&output) {
+                let _ = fs::remove_file(&output);
+            }
+            return Err(e);
+        }
+    };
+
+    // sha256sum -c format, so the file can be checked on any machine before decrypting
+    let sidecar = format!("{}.sha256", output);
+    let checksum = format!("{}  {}\n", hash, base_name(&output));
+    if s3::is_s3(&output) {
+        s3::Client::load()?.put(&sidecar, &checksum)?;
+        Logger::success(&format!("Exported {}, SHA-256 {}", output, hash));
+    } else {
+        fs::write(&sidecar, checksum).into_diagnostic()?;
+        let size = fs::metadata(&output).map(|m| m.len()).unwrap_or(0);
+        Logger::success(&format!("Exported {} ({} MiB), SHA-256 {}", output, size / 1024 / 1024, hash));
+    }
+    Logger::info(&format!("Checksum written to {}", sidecar));
+
+    let identity = if let Encryption::Age(_) = encryption { " --identity KEYFILE" } else { "" };
+    Logger::info(&format!("Restore with 'hammer import {}{}'.", output, identity));
+    Logger::end_section();
+    Ok(())
+}
+
+/// Decryption and decompression stages implied by the file name, then btrfs receive
+fn import_stages(source: &str, identity: Option<&str>, dest: &Path) -> Result<Vec<(&'static str, Vec<String>)>> {
+    let mut stages: Vec<(&'static str, Vec<String>)> = Vec::new();
+    let mut name = base_name(source);
+    if let Some(rest) = name.strip_suffix(".age") {
+        let identity = identity.ok_or_else(|| {
+            HammerError::ConfigError(format!("{} is age-encrypted; pass --identity with the key file.", source))
+        })?;
+        stages.push(("age", vec!["-d".into(), "-i".into(), identity.to_string()]));
+        name = rest;
+    } else if let Some(rest) = name.strip_suffix(".gpg") {
+        stages.push(("gpg", vec!["--batch".into(), "--decrypt".into()]));
+        name = rest;
+    }
+    let transfer = Transfer::load();
+    stages.extend(transfer.decompress(name));
+    stages.extend(transfer.buffer());
+    stages.push(("btrfs", vec!["receive".into(), dest.to_string_lossy().to_string()]));
+    Ok(stages)
+}
+
+/// Expected SHA-256 from the sidecar next to `source`, if there is one
+fn expected_hash(source: &str) -> Option<String> {
+    let sidecar = format!("{}.sha256", source);
+    let content = if s3::is_s3(source) {
+        s3::Client::load().ok()?.get(&sidecar).ok()?
+    } else {
+        fs::read_to_string(&sidecar).ok()?
+    };
+    content.split_whitespace().next().map(|h| h.to_lowercase())
+}
+
+/// Receives a file or S3 object from `hammer export` into @snapshots, verifying its checksum
+pub fn handle_import(source: &str, identity: Option<String>) -> Result<()> {
+    Logger::section("SNAPSHOT IMPORT");
+    let expected = expected_hash(source);
+    if expected.is_none() {
+        Logger::warn(&format!("No {}.sha256 found: integrity is not verified.", source));
+    }
+
+    mount_btrfs_root()?;
+    let snap_dir = pool::top_level().join("@snapshots");
+    let result = (|| -> Result<String> {
+        fs::create_dir_all(&snap_dir).into_diagnostic()?;
+        let before: Vec<String> = list_dir(&snap_dir);
+        let stages = import_stages(source, identity.as_deref(), &snap_dir)?;
+
+        let mut download = None;
+        let mut input: Box<dyn Read> = if s3::is_s3(source) {
+            let (cmd, args) = s3::Client::load()?.download_stage(source);
+            let args: Vec<&str> = args.iter().map(String::as_str).collect();
+            let mut child = Exec::new(cmd, &args, "Download Import").spawn()?;
+            let out = child.stdout.take().unwrap();
+            download = Some(child);
+            Box::new(out)
+        } else {
+            Box::new(File::open(source).map_err(|e| HammerError::IoError(format!("{}: {}", source, e)))?)
+        };
+
+        Logger::info(&format!("Importing {}...", source));
+        let mut children = spawn_pipeline(&stages, Stdio::piped())?;
+        // Drained concurrently so a chatty last stage cannot block the copy
+        let drain = children.last_mut().and_then(|c| c.stdout.take()).map(|mut out| {
+            thread::spawn(move || {
+                let _ = io::copy(&mut out, &mut io::sink());
+            })
+        });
+        let mut stdin = children[0].stdin.take().unwrap();
+        let hash = copy_hashed(&mut input, &mut stdin);
+        drop(stdin);
+        if let Some(drain) = drain {
+            let _ = drain.join();
+        }
+        if let Some(child) = download.as_mut() {
+            wait_all(std::slice::from_mut(child))?;
+        }
+        let hash = hash?;
+        let waited = wait_all(&mut children);
+
+        let received: Vec<String> = list_dir(&snap_dir).into_iter().filter(|n| !before.contains(n)).collect();
+        let discard = |names: &[String]| {
+            for n in names {
+                let _ = run_change("btrfs", &["subvolume", "delete", &snap_dir.join(n).to_string_lossy()], "Discard Import");
+            }
+        };
+        if let Err(e) = waited {
+            discard(&received);
+            return Err(e);
+        }
+        if let Some(expected) = &expected {
+            if *expected != hash {
+                discard(&received);
+                return Err(HammerError::IoError(format!(
+                    "Checksum mismatch for {}: expected {}, got {}. The import was discarded.", source, expected, hash
+                )).into());
+            }
+        }
+        let received = received.into_iter().next().ok_or_else(|| HammerError::BtrfsError("btrfs receive created no subvolume".into()))?;
+
+        // Exports are sent from a temporary ".export-<name>" copy
+        let name = received.strip_prefix(".export-").unwrap_or(&received).to_string();
+        if name != received {
+            if snap_dir.join(&name).exists() {
+                discard(&[received.clone()]);
+                return Err(HammerError::BtrfsError(format!("{} already exists in @snapshots.", name)).into());
+            }
+            fs::rename(snap_dir.join(&received), snap_dir.join(&name)).into_diagnostic()?;
+        }
+        // Received subvolumes are read-only; hammer snapshots are not
+        run_change(
+            "btrfs",
+            &["property", "set", "-ts", &snap_dir.join(&name).to_string_lossy(), "ro", "false"],
+            "Make Imported Snapshot Writable",
+        )?;
+        // A base from the fleet server or the builder does not have what was layered here
+        if let Err(e) = layer::reapply(&snap_dir.join(&name)) {
+            Logger::warn(&format!("The package layer was not applied to {}: {}", name, e));
+            Logger::info("After switching to it, install the layer again with: hammer update");
+        }
+        Ok(name)
+    })();
+    umount_btrfs_root()?;
+    let name = result?;
+
+    if expected.is_some() {
+        Logger::info("Checksum verified.");
+    }
+    Logger::success(&format!("Imported {}. Boot into it with 'hammer rollback {}'.", name, name));
+    Logger::end_section();
+    Ok(())
+}
+
+fn list_dir(dir: &Path) -> Vec<String> {
+    fs::read_dir(dir)
+    .map(|entries| entries.flatten().map(|e| e.file_name().to_string_lossy().to_string()).collect())
+    .unwrap_or_default()
+}
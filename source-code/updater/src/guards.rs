@@ -0,0 +1,74 @@
+use hammer_core::config::AutoConfig;
+use hammer_core::run_command;
+use std::fs;
+use std::path::Path;
+
+const POWER_SUPPLY: &str = "/sys/class/power_supply";
+
+/// NetworkManager NMMetered: 1 = yes, 3 = guess-yes
+const METERED_YES: &[&str] = &["1", "3"];
+
+fn read_attr(dir: &Path, name: &str) -> Option<String> {
+    fs::read_to_string(dir.join(name)).ok().map(|s| s.trim().to_string())
+}
+
+/// Lowest battery charge when running on battery; None on AC or without a battery
+fn battery_level() -> Option<u8> {
+    let mut on_ac = false;
+    let mut levels = Vec::new();
+    for entry in fs::read_dir(POWER_SUPPLY).ok()?.flatten() {
+        let dir = entry.path();
+        match read_attr(&dir, "type").as_deref() {
+            Some("Mains") | Some("USB") => {
+                if read_attr(&dir, "online").as_deref() == Some("1") {
+                    on_ac = true;
+                }
+            }
+            Some("Battery") => {
+                // Peripheral batteries (mice, headsets) don't power the system
+                if read_attr(&dir, "scope").as_deref() == Some("Device") {
+                    continue;
+                }
+                if let Some(level) = read_attr(&dir, "capacity").and_then(|c| c.parse().ok()) {
+                    levels.push(level);
+                }
+            }
+            _ => {}
+        }
+    }
+    if on_ac {
+        return None;
+    }
+    levels.into_iter().min()
+}
+
+/// Whether NetworkManager reports the primary connection as metered
+fn is_metered() -> bool {
+    let out = run_command("busctl", &[
+        "get-property",
+        "org.freedesktop.NetworkManager",
+        "/org/freedesktop/NetworkManager",
+        "org.freedesktop.NetworkManager",
+        "Metered",
+    ], "Metered Connection");
+    // Output looks like "u 1"; NetworkManager not running means not metered
+    match out {
+        Ok(out) => out.split_whitespace().nth(1).map(|v| METERED_YES.contains(&v)).unwrap_or(false),
+        Err(_) => false,
+    }
+}
+
+/// Reason an unattended update should not run now, if any
+pub fn skip_reason(cfg: &AutoConfig) -> Option<String> {
+    if cfg.check_power {
+        if let Some(level) = battery_level() {
+            if level < cfg.min_battery {
+                return Some(format!("on battery at {}% (below {}%)", level, cfg.min_battery));
+            }
+        }
+    }
+    if cfg.check_metered && is_metered() {
+        return Some("connection is metered".to_string());
+    }
+    None
+}
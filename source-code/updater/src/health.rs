@@ -0,0 +1,94 @@
+use hammer_core::exec::Exec;
+use hammer_core::{is_root, run_command, Logger};
+use std::collections::BTreeMap;
+use std::process::Stdio;
+
+// A deployment switch trusts the disk with the only copy of the new root. Btrfs keeps
+// per-device error counters across reboots; SMART is the drive's own opinion. Either
+// one reporting trouble is worth a warning before the next update or rollback.
+
+/// (device, counter, value) of `btrfs device stats` for the filesystem / lives on
+fn device_stats() -> Vec<(String, String, u64)> {
+    // "[/dev/sda2].write_io_errs    0"
+    let out = run_command("btrfs", &["device", "stats", "/"], "Read Device Stats").unwrap_or_default();
+    out.lines()
+    .filter_map(|line| {
+        let (key, value) = line.split_once(char::is_whitespace)?;
+        let (device, counter) = key.strip_prefix('[')?.split_once("].")?;
+        Some((device.to_string(), counter.to_string(), value.trim().parse().ok()?))
+    })
+    .collect()
+}
+
+/// The disk a partition is on; the device itself for whole disks
+fn disk_of(device: &str) -> String {
+    run_command("lsblk", &["-ndo", "PKNAME", device], "Find Disk")
+    .ok()
+    .map(|p| p.trim().to_string())
+    .filter(|p| !p.is_empty())
+    .map(|p| format!("/dev/{}", p))
+    .unwrap_or_else(|| device.to_string())
+}
+
+/// SMART overall health of a disk; None when smartctl is missing or cannot tell
+fn smart_problem(disk: &str) -> Option<String> {
+    // smartctl encodes findings in its exit status, so a failing disk is not an error here
+    let output = Exec::new("smartctl", &["-H", disk], "Check SMART Health")
+    .env("LC_ALL", "C")
+    .stderr(Stdio::null())
+    .spawn()
+    .ok()?
+    .wait_with_output()
+    .ok()?;
+    let out = String::from_utf8_lossy(&output.stdout);
+    let verdict = out
+    .lines()
+    .find_map(|l| l.split_once("self-assessment test result:").or_else(|| l.split_once("SMART Health Status:")))
+    .map(|(_, v)| v.trim().to_string())?;
+    // Bit 3: disk failing; bit 5: some attribute was at or below its threshold before
+    let status = output.status.code().unwrap_or(0);
+    if verdict != "PASSED" && verdict != "OK" {
+        Some(format!("SMART health {}", verdict))
+    } else if status & 0b10_0000 != 0 {
+        Some("SMART attributes were past their threshold in the past".to_string())
+    } else {
+        None
+    }
+}
+
+/// Warnings about the devices under /; empty when they look fine or cannot be read
+fn problems(smart: bool) -> Vec<String> {
+    // The counters need CAP_SYS_ADMIN; without root there is nothing to read
+    if !is_root() {
+        return Vec::new();
+    }
+    let stats = device_stats();
+    let mut errors: BTreeMap<&str, Vec<String>> = BTreeMap::new();
+    for (device, counter, value) in stats.iter().filter(|(_, _, v)| *v > 0) {
+        errors.entry(device.as_str()).or_default().push(format!("{} {}", value, counter));
+    }
+    let mut problems: Vec<String> = errors
+    .into_iter()
+    .map(|(device, counters)| format!("{} reports {}", device, counters.join(", ")))
+    .collect();
+    if smart {
+        let mut devices: Vec<&str> = stats.iter().map(|(device, _, _)| device.as_str()).collect();
+        devices.dedup();
+        let mut disks: Vec<String> = devices.iter().map(|d| disk_of(d)).collect();
+        disks.sort();
+        disks.dedup();
+        problems.extend(disks.iter().filter_map(|disk| smart_problem(disk).map(|p| format!("{}: {}", disk, p))));
+    }
+    problems
+}
+
+/// Warns about device errors and how to go on
+pub fn report(smart: bool) {
+    let problems = problems(smart);
+    for problem in &problems {
+        Logger::warn(&format!("Disk: {}", problem));
+    }
+    if !problems.is_empty() {
+        Logger::warn("Back up before the next update or rollback. Once fixed, reset the counters with 'btrfs device stats -z /'.");
+    }
+}
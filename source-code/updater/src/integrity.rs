@@ -0,0 +1,204 @@
+use miette::Result;
+use hammer_core::state::STATE_DIR;
+use hammer_core::{mount_btrfs_root, pool, run_command, store, umount_btrfs_root, HammerError, Logger};
+use sha2::{Digest, Sha256};
+use std::collections::{BTreeMap, HashSet};
+use std::fs::{self, File};
+use std::io::Read;
+use std::path::{Path, PathBuf};
+use std::thread;
+
+/// Hash databases, one per deployment subvolume UUID
+const DB_DIR: &str = "integrity";
+const DB_HEADER: &str = "# hammer integrity sha256";
+
+/// Modified files listed individually before summarizing
+const SHOW_LIMIT: usize = 50;
+
+/// Regular files dpkg installed into `root`, without conffiles (those are meant to change)
+fn manifest_files(root: &Path) -> Vec<String> {
+    let info = root.join("var/lib/dpkg/info");
+    let mut lists = Vec::new();
+    let mut conffiles = HashSet::new();
+    for entry in fs::read_dir(&info).into_iter().flatten().flatten() {
+        let path = entry.path();
+        match path.extension().and_then(|e| e.to_str()) {
+            Some("list") => lists.push(path),
+            Some("conffiles") => {
+                conffiles.extend(fs::read_to_string(&path).unwrap_or_default().lines().map(|l| l.trim().to_string()));
+            }
+            _ => {}
+        }
+    }
+
+    let mut files: Vec<String> = lists
+    .iter()
+    .flat_map(|l| fs::read_to_string(l).unwrap_or_default().lines().map(|s| s.to_string()).collect::<Vec<_>>())
+    .filter(|f| f.starts_with('/') && !conffiles.contains(f))
+    .filter(|f| {
+        fs::symlink_metadata(root.join(f.trim_start_matches('/')))
+        .map(|m| m.file_type().is_file())
+        .unwrap_or(false)
+    })
+    .collect();
+    files.sort();
+    files.dedup();
+    files
+}
+
+pub(crate) fn hash_file(path: &Path) -> Option<String> {
+    let mut file = File::open(path).ok()?;
+    let mut hasher = Sha256::new();
+    let mut buf = vec![0u8; 1 << 20];
+    loop {
+        let n = file.read(&mut buf).ok()?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+    }
+    Some(hasher.finalize().iter().map(|b| format!("{:02x}", b)).collect())
+}
+
+/// path -> hash, spread over all cores; unreadable files are left out
+fn hash_all(root: &Path, files: Vec<String>) -> BTreeMap<String, String> {
+    let workers = thread::available_parallelism().map(|n| n.get()).unwrap_or(4);
+    let chunk = files.len().div_ceil(workers).max(1);
+    thread::scope(|scope| {
+        let handles: Vec<_> = files
+        .chunks(chunk)
+        .map(|part| {
+            scope.spawn(move || {
+                part.iter()
+                .filter_map(|f| hash_file(&root.join(f.trim_start_matches('/'))).map(|h| (f.clone(), h)))
+                .collect::<Vec<_>>()
+            })
+        })
+        .collect();
+        handles.into_iter().flat_map(|h| h.join().unwrap_or_default()).collect()
+    })
+}
+
+fn subvolume_field(path: &Path, field: &str) -> Option<String> {
+    let out = run_command("btrfs", &["subvolume", "show", &path.to_string_lossy()], "Show Subvolume").ok()?;
+    out.lines()
+    .find_map(|l| l.trim().strip_prefix(field))
+    .map(|v| v.trim().to_string())
+    .filter(|v| v != "-")
+}
+
+fn db_path(uuid: &str) -> PathBuf {
+    Path::new(STATE_DIR).join(DB_DIR).join(uuid)
+}
+
+fn load_db(uuid: &str) -> Option<(String, BTreeMap<String, String>)> {
+    let content = fs::read_to_string(db_path(uuid)).ok()?;
+    let recorded = content.lines().next()?.strip_prefix(DB_HEADER)?.trim().to_string();
+    let entries = content
+    .lines()
+    .skip(1)
+    .filter_map(|l| l.split_once("  "))
+    .map(|(h, p)| (p.to_string(), h.to_string()))
+    .collect();
+    Some((recorded, entries))
+}
+
+/// Hashes the package-managed files of the deployment at `root` and stores them under its UUID.
+/// Called when an update is staged; `hammer verify --deep` compares against it.
+pub fn record(root: &Path) -> Result<()> {
+    let uuid = subvolume_field(root, "UUID:")
+    .ok_or_else(|| HammerError::BtrfsError(format!("{} is not a Btrfs subvolume", root.display())))?;
+    let hashes = hash_all(root, manifest_files(root));
+
+    let mut content = format!("{} {}\n", DB_HEADER, chrono::Local::now().format("%Y-%m-%d %H:%M:%S"));
+    for (path, hash) in &hashes {
+        content.push_str(&format!("{}  {}\n", hash, path));
+    }
+    store::write(&db_path(&uuid), content)?;
+    Logger::info(&format!("Recorded hashes of {} files for verification.", hashes.len()));
+    Ok(())
+}
+
+/// "@", "current", "@bad-..." or a snapshot in @snapshots, below the mounted top level
+pub(crate) fn locate(deployment: &str) -> PathBuf {
+    let top = pool::top_level();
+    match deployment {
+        "current" | "@" => top.join("@"),
+        d if d.starts_with('@') => top.join(d),
+        d => top.join("@snapshots").join(d),
+    }
+}
+
+/// Recomputes and compares the hash database of a deployment. Snapshots without
+/// their own database are checked against the deployment they were taken from.
+pub fn handle_verify(deployment: &str, deep: bool, record_only: bool) -> Result<()> {
+    Logger::section("VERIFY DEPLOYMENT");
+    mount_btrfs_root()?;
+    let result = verify(deployment, deep, record_only);
+    umount_btrfs_root()?;
+    Logger::end_section();
+    result
+}
+
+fn verify(deployment: &str, deep: bool, record_only: bool) -> Result<()> {
+    let root = locate(deployment);
+    if !root.exists() {
+        return Err(HammerError::ConfigError(format!("No deployment '{}'", deployment)).into());
+    }
+
+    if record_only {
+        return record(&root);
+    }
+    if !deep {
+        // dpkg's own md5sums; conffiles that differ are reported too
+        let out = run_command("dpkg", &["--root", &root.to_string_lossy(), "--verify"], "Verify Packages")?;
+        if out.trim().is_empty() {
+            Logger::success("dpkg --verify found no changed files.");
+            return Ok(());
+        }
+        for line in out.lines() {
+            Logger::warn(line);
+        }
+        return Err(HammerError::CommandFailed("dpkg --verify found changed files".into()).into());
+    }
+
+    let uuid = subvolume_field(&root, "UUID:").unwrap_or_default();
+    let parent = subvolume_field(&root, "Parent UUID:");
+    let (source, (recorded, expected)) = match load_db(&uuid) {
+        Some(db) => ("its own", db),
+        None => match parent.as_deref().and_then(load_db) {
+            Some(db) => ("its parent deployment's", db),
+            None => {
+                return Err(HammerError::ConfigError(format!(
+                    "No hash database for {}. Create one with 'hammer verify --record {}'.", deployment, deployment
+                )).into())
+            }
+        },
+    };
+    Logger::info(&format!("Comparing {} files against {} hashes from {}...", expected.len(), source, recorded));
+
+    let actual = hash_all(&root, expected.keys().cloned().collect());
+    let mut modified = Vec::new();
+    let mut missing = Vec::new();
+    for (path, hash) in &expected {
+        match actual.get(path) {
+            Some(h) if h == hash => {}
+            Some(_) => modified.push(path),
+            None => missing.push(path),
+        }
+    }
+
+    for path in modified.iter().take(SHOW_LIMIT) {
+        Logger::warn(&format!("modified: {}", path));
+    }
+    for path in missing.iter().take(SHOW_LIMIT) {
+        Logger::warn(&format!("missing:  {}", path));
+    }
+    if modified.is_empty() && missing.is_empty() {
+        Logger::success(&format!("All {} files match.", expected.len()));
+        return Ok(());
+    }
+    Err(HammerError::BtrfsError(format!(
+        "{} modified and {} missing files in {}", modified.len(), missing.len(), deployment
+    )).into())
+}
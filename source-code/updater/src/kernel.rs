@@ -0,0 +1,271 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::{
+    btrfs_list_atomic_snapshots, mount_btrfs_root, output, pool, run_change, run_command, storage,
+    umount_btrfs_root, HammerError, Logger,
+};
+use hammer_core::exec::Exec;
+use hammer_core::output::Tone;
+use std::cmp::Ordering;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::Path;
+
+use crate::create_snapshot_name;
+
+/// Everything we know about one kernel version
+#[derive(Default)]
+struct KernelInfo {
+    in_boot: bool,
+    package: Option<String>,
+    in_grub: bool,
+    snapshots: Vec<String>,
+}
+
+/// Orders "6.1.0-13-amd64" style versions numerically
+fn compare_versions(a: &str, b: &str) -> Ordering {
+    let nums = |v: &str| -> Vec<u64> {
+        v.split(|c: char| !c.is_ascii_digit())
+        .filter(|p| !p.is_empty())
+        .filter_map(|p| p.parse().ok())
+        .collect()
+    };
+    nums(a).cmp(&nums(b)).then_with(|| a.cmp(b))
+}
+
+pub(crate) fn running_kernel() -> String {
+    run_command("uname", &["-r"], "Running Kernel").unwrap_or_default().trim().to_string()
+}
+
+fn boot_kernels() -> Vec<String> {
+    let mut versions = Vec::new();
+    if let Ok(entries) = fs::read_dir("/boot") {
+        for entry in entries.flatten() {
+            let name = entry.file_name().to_string_lossy().to_string();
+            if let Some(ver) = name.strip_prefix("vmlinuz-") {
+                versions.push(ver.to_string());
+            }
+        }
+    }
+    versions
+}
+
+/// Kernel version -> linux-image package name
+fn installed_kernel_packages() -> BTreeMap<String, String> {
+    let output = run_command(
+        "dpkg-query",
+        &["-W", "-f", "${Package} ${Status}\n", "linux-image-[0-9]*"],
+        "Query Kernel Packages",
+    ).unwrap_or_default();
+
+    output
+    .lines()
+    .filter(|l| l.ends_with("install ok installed"))
+    .filter_map(|l| l.split_whitespace().next())
+    .filter_map(|pkg| pkg.strip_prefix("linux-image-").map(|v| (v.to_string(), pkg.to_string())))
+    .collect()
+}
+
+/// Versions referenced by "linux /vmlinuz-..." lines in the generated grub.cfg
+fn grub_kernels() -> BTreeSet<String> {
+    let content = fs::read_to_string("/boot/grub/grub.cfg").unwrap_or_default();
+    content
+    .lines()
+    .map(|l| l.trim())
+    .filter(|l| l.starts_with("linux"))
+    .filter_map(|l| l.split_whitespace().nth(1))
+    .filter_map(|path| path.split_once("vmlinuz-").map(|(_, v)| v.to_string()))
+    .collect()
+}
+
+/// Newest kernel with modules installed in `root`
+pub(crate) fn newest_in(root: &Path) -> Option<String> {
+    let mut versions = modules_in(root);
+    versions.sort_by(|a, b| compare_versions(a, b));
+    versions.pop()
+}
+
+fn modules_in(root: &Path) -> Vec<String> {
+    let mut versions = Vec::new();
+    for dir in ["usr/lib/modules", "lib/modules"] {
+        if let Ok(entries) = fs::read_dir(root.join(dir)) {
+            for entry in entries.flatten() {
+                let ver = entry.file_name().to_string_lossy().to_string();
+                if !versions.contains(&ver) {
+                    versions.push(ver);
+                }
+            }
+        }
+        if !versions.is_empty() {
+            break;
+        }
+    }
+    versions
+}
+
+/// Kernels each snapshot would boot with after a rollback
+fn snapshot_kernels() -> Result<BTreeMap<String, Vec<String>>> {
+    let snapshots = btrfs_list_atomic_snapshots()?;
+    mount_btrfs_root()?;
+    let snap_dir = pool::top_level().join("@snapshots");
+
+    let mut map = BTreeMap::new();
+    for snap in snapshots {
+        map.insert(snap.clone(), modules_in(&snap_dir.join(&snap)));
+    }
+    umount_btrfs_root()?;
+    Ok(map)
+}
+
+fn inventory() -> Result<BTreeMap<String, KernelInfo>> {
+    let mut kernels: BTreeMap<String, KernelInfo> = BTreeMap::new();
+
+    for ver in boot_kernels() {
+        kernels.entry(ver).or_default().in_boot = true;
+    }
+    for (ver, pkg) in installed_kernel_packages() {
+        kernels.entry(ver).or_default().package = Some(pkg);
+    }
+    for ver in grub_kernels() {
+        kernels.entry(ver).or_default().in_grub = true;
+    }
+    for (snap, versions) in snapshot_kernels()? {
+        for ver in versions {
+            kernels.entry(ver).or_default().snapshots.push(snap.clone());
+        }
+    }
+    Ok(kernels)
+}
+
+fn sorted_versions(kernels: &BTreeMap<String, KernelInfo>) -> Vec<String> {
+    let mut versions: Vec<String> = kernels.keys().cloned().collect();
+    versions.sort_by(|a, b| compare_versions(a, b));
+    versions
+}
+
+pub fn handle_list() -> Result<()> {
+    Logger::section("KERNELS");
+    let kernels = inventory()?;
+    let running = running_kernel();
+
+    if kernels.is_empty() {
+        Logger::info("No kernels found.");
+    }
+
+    for ver in sorted_versions(&kernels) {
+        let info = &kernels[&ver];
+        let mut tags = Vec::new();
+        if ver == running {
+            tags.push(output::paint("running", Tone::Good));
+        }
+        if info.in_boot {
+            tags.push(output::paint("/boot", Tone::Accent));
+        }
+        if info.in_grub {
+            tags.push(output::paint("boot entry", Tone::Accent));
+        }
+        if info.package.is_none() {
+            tags.push(output::paint("no package", Tone::Muted));
+        }
+        if !info.snapshots.is_empty() {
+            tags.push(output::paint(format!("{} snapshot(s)", info.snapshots.len()), Tone::Warn));
+        }
+        Logger::info(&format!("{: <28} {}", ver, tags.join(", ")));
+    }
+
+    Logger::end_section();
+    Ok(())
+}
+
+pub fn handle_remove(versions: Vec<String>, old: bool, force: bool) -> Result<()> {
+    Logger::section("KERNEL REMOVAL");
+    let kernels = inventory()?;
+    let running = running_kernel();
+
+    // The newest installed kernel is what the next boot uses
+    let newest = sorted_versions(&kernels)
+    .into_iter()
+    .filter(|v| kernels[v].package.is_some())
+    .last()
+    .unwrap_or_default();
+
+    let targets: Vec<String> = if old {
+        sorted_versions(&kernels)
+        .into_iter()
+        .filter(|v| kernels[v].package.is_some() && *v != running && *v != newest)
+        .filter(|v| force || kernels[v].snapshots.is_empty())
+        .collect()
+    } else {
+        versions
+    };
+
+    if targets.is_empty() {
+        Logger::info("No kernels eligible for removal.");
+        Logger::end_section();
+        return Ok(());
+    }
+
+    let mut packages = Vec::new();
+    for ver in &targets {
+        let info = match kernels.get(ver) {
+            Some(i) => i,
+            None => return Err(HammerError::ConfigError(format!("Unknown kernel version: {}", ver)).into()),
+        };
+        if *ver == running {
+            return Err(HammerError::ConfigError(format!("Refusing to remove the running kernel {}", ver)).into());
+        }
+        if *ver == newest {
+            return Err(HammerError::ConfigError(format!("Refusing to remove the newest kernel {}", ver)).into());
+        }
+        if !info.snapshots.is_empty() && !force {
+            return Err(HammerError::ConfigError(format!(
+                "Kernel {} is needed to boot snapshot(s): {}. Use --force to remove it anyway.",
+                ver, info.snapshots.join(", ")
+            )).into());
+        }
+        match &info.package {
+            Some(pkg) => {
+                packages.push(pkg.clone());
+                // Headers are useless without the image
+                packages.push(format!("linux-headers-{}", ver));
+            }
+            None => Logger::warn(&format!("{} has no package; only leftover files in /boot will be removed.", ver)),
+        }
+    }
+
+    run_change("mount", &["-o", "remount,rw", "/"], "Remount RW")?;
+    storage::driver()?.snapshot(&create_snapshot_name("pre-kernel-remove"))?;
+
+    if !packages.is_empty() {
+        // Headers may not be installed; let apt skip unknown ones
+        let installed: Vec<String> = packages
+        .into_iter()
+        .filter(|p| run_command("dpkg-query", &["-W", p], "Check Package").is_ok())
+        .collect();
+
+        let mut args = vec!["purge", "-y"];
+        args.extend(installed.iter().map(|s| s.as_str()));
+
+        let status = Exec::new("apt-get", &args, "Purge Kernels").changes_system().status()?;
+
+        if !status.success() {
+            Logger::error("Kernel purge failed.");
+            Logger::end_section();
+            return Ok(());
+        }
+    }
+
+    // Leftovers from kernels installed outside dpkg
+    for ver in &targets {
+        for prefix in ["vmlinuz-", "initrd.img-", "System.map-", "config-"] {
+            let path = Path::new("/boot").join(format!("{}{}", prefix, ver));
+            if path.exists() {
+                fs::remove_file(&path).into_diagnostic()?;
+            }
+        }
+    }
+
+    let _ = run_change("update-grub", &[], "Update GRUB");
+    Logger::success(&format!("Removed kernel(s): {}", targets.join(", ")));
+    Logger::end_section();
+    Ok(())
+}
@@ -0,0 +1,319 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::config::{self, Executor, UpdateConfig};
+use hammer_core::{journal, packages, run_command, state, HammerError, Logger};
+use sha2::{Digest, Sha256};
+use std::fs::{self, File};
+use std::io;
+use std::path::{Path, PathBuf};
+
+use crate::{executor, staged};
+
+// Packages installed on top of the distribution's base. `hammer layer PKG` installs once;
+// `hammer layer add` also records the package in the persistent layer (state::layered_packages),
+// which every staged update and release upgrade installs again and `hammer import` applies
+// to a base deployment received from the fleet server or the builder, so local additions
+// survive a base that does not ship them. Local .deb files cannot be fetched again and are
+// never part of the persistent layer.
+//
+// Every change to the layer is a journal transaction of its own that records the layer it
+// left ("layer" attachment). `hammer layer rollback` stages an earlier one of those sets on
+// top of the base that is current, so going back on the layer keeps a newer base image.
+
+/// Where local .deb files are copied inside @update; removed again after apt ran
+const DEB_DIR: &str = "var/cache/hammer-debs";
+/// Journal attachment holding the layer a transaction left, one package per line
+const LAYER_ATTACHMENT: &str = "layer";
+
+/// A local package file to install
+pub struct LocalDeb {
+    pub path: PathBuf,
+    pub package: String,
+    pub sha256: String,
+}
+
+impl LocalDeb {
+    pub fn open(file: &str) -> Result<LocalDeb> {
+        let path = fs::canonicalize(file)
+        .map_err(|e| HammerError::IoError(format!("{}: {}", file, e)))?;
+        let package = run_command("dpkg-deb", &["-f", &path.to_string_lossy(), "Package"], "Read Package Name")
+        .map_err(|_| HammerError::ConfigError(format!("{} is not a .deb package", file)))?
+        .trim()
+        .to_string();
+        let mut hasher = Sha256::new();
+        io::copy(&mut File::open(&path).into_diagnostic()?, &mut hasher).into_diagnostic()?;
+        let sha256 = hasher.finalize().iter().map(|b| format!("{:02x}", b)).collect();
+        Ok(LocalDeb { path, package, sha256 })
+    }
+
+    fn file_name(&self) -> String {
+        self.path.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default()
+    }
+}
+
+/// "pkg=1.2", "pkg/bookworm-backports" and "pkg:i386" name the package "pkg"
+fn package_name(spec: &str) -> &str {
+    spec.split(['=', '/', ':']).next().unwrap_or(spec)
+}
+
+/// "sha256  file (package)" lines for the journal
+fn manifest(debs: &[LocalDeb]) -> String {
+    debs.iter()
+    .map(|d| format!("{}  {} ({})\n", d.sha256, d.file_name(), d.package))
+    .collect()
+}
+
+fn layer_manifest(layered: &[String]) -> String {
+    layered.iter().map(|p| format!("{}\n", p)).collect()
+}
+
+/// Installs repository packages and local .deb files into @update and stages the result;
+/// the running system is not touched. The checksums of the .deb files go to the journal.
+/// Returns whether the result was staged.
+pub fn handle_atomic_layer(cfg: UpdateConfig, names: Vec<String>, debs: Vec<LocalDeb>) -> Result<bool> {
+    stage(cfg, names, debs, None)
+}
+
+/// `handle_atomic_layer`, recording `layer` as the persistent layer the transaction leaves
+fn stage(mut cfg: UpdateConfig, names: Vec<String>, debs: Vec<LocalDeb>, layer: Option<&[String]>) -> Result<bool> {
+    if cfg.executor == Executor::Live {
+        cfg.executor = Executor::Chroot;
+    }
+    for deb in &debs {
+        Logger::info(&format!("{} ({}) sha256 {}", deb.file_name(), deb.package, deb.sha256));
+    }
+
+    let in_root: Vec<String> = debs.iter().map(|d| format!("/{}/{}", DEB_DIR, d.file_name())).collect();
+    let mut install = vec!["apt-get", "install", "-y"];
+    install.extend(in_root.iter().map(|s| s.as_str()));
+    install.extend(names.iter().map(|s| s.as_str()));
+
+    let wanted: Vec<&str> = debs
+    .iter()
+    .map(|d| d.package.as_str())
+    .chain(names.iter().map(|s| package_name(s)))
+    .collect();
+    staged::run(&cfg, staged::Plan {
+        title: "STAGED PACKAGE LAYERING",
+        kind: "layer",
+        steps: vec![vec!["apt-get", "update"], install],
+        prepare: Box::new(|root| {
+            let dir = root.join(DEB_DIR);
+            fs::create_dir_all(&dir).into_diagnostic()?;
+            for deb in &debs {
+                fs::copy(&deb.path, dir.join(deb.file_name())).into_diagnostic()?;
+            }
+            Ok(())
+        }),
+        verify: Box::new(|root| {
+            let _ = fs::remove_dir_all(root.join(DEB_DIR));
+            let installed = packages::installed_packages(root);
+            let missing: Vec<&str> = wanted.iter().copied().filter(|p| !installed.contains_key(*p)).collect();
+            if !missing.is_empty() {
+                return Err(HammerError::CommandFailed(format!("Not installed in @update: {}", missing.join(", "))).into());
+            }
+            Ok(())
+        }),
+        attachments: debs
+        .first()
+        .map(|_| ("debs", manifest(&debs)))
+        .into_iter()
+        .chain(layer.map(|l| (LAYER_ATTACHMENT, layer_manifest(l))))
+        .collect(),
+    })
+}
+
+/// The apt step installing the persistent layer again, for plans that change the base;
+/// None while the layer is empty
+pub fn reapply_step(layered: &[String]) -> Option<Vec<&str>> {
+    if layered.is_empty() {
+        return None;
+    }
+    let mut step = vec!["apt-get", "install", "-y"];
+    step.extend(layered.iter().map(String::as_str));
+    Some(step)
+}
+
+/// Installs what `root`, a base deployment built elsewhere, lacks of the persistent layer
+pub fn reapply(root: &Path) -> Result<()> {
+    let installed = packages::installed_packages(root);
+    let layered = state::layered_packages();
+    let missing: Vec<&str> = layered.iter().map(String::as_str).filter(|p| !installed.contains_key(*p)).collect();
+    if missing.is_empty() {
+        return Ok(());
+    }
+    let mut cfg = config::load()?.update;
+    if cfg.executor == Executor::Live {
+        cfg.executor = Executor::Chroot;
+    }
+    Logger::info(&format!("Applying the package layer to {}: {}", root.display(), missing.join(", ")));
+    let mut install = vec!["apt-get", "install", "-y"];
+    install.extend(missing);
+    for step in [vec!["apt-get", "update"], install] {
+        if !executor::run_in_root(&cfg, root, &step)? {
+            return Err(HammerError::CommandFailed(format!("{} failed in {}", step.join(" "), root.display())).into());
+        }
+    }
+    staged::clean_apt_cache(root);
+    Ok(())
+}
+
+/// `hammer layer add`: installs `specs` in a staged deployment and keeps them in the layer
+pub fn handle_add(cfg: UpdateConfig, specs: Vec<String>) -> Result<()> {
+    let previous = state::layered_packages();
+    let mut layered = previous.clone();
+    layered.extend(specs.iter().map(|s| package_name(s).to_string()));
+    // Recorded first so the staged deployment carries the layer over; taken back if staging fails
+    state::set_layered(&layered)?;
+    let staged = stage(cfg, specs, Vec::new(), Some(&state::layered_packages()));
+    if !matches!(staged, Ok(true)) {
+        state::set_layered(&previous)?;
+        return staged.map(|_| ());
+    }
+    Logger::info("The layer is installed again on every new base; see: hammer layer list");
+    Ok(())
+}
+
+/// `hammer layer remove`: removes `names` from the layer and from a staged deployment
+pub fn handle_remove(mut cfg: UpdateConfig, names: Vec<String>) -> Result<()> {
+    let previous = state::layered_packages();
+    let unknown: Vec<&str> = names.iter().map(String::as_str).filter(|n| !previous.iter().any(|p| p == n)).collect();
+    if !unknown.is_empty() {
+        return Err(HammerError::ConfigError(format!(
+            "Not in the package layer: {}. Layered packages: hammer layer list", unknown.join(", ")
+        )).into());
+    }
+    if cfg.executor == Executor::Live {
+        cfg.executor = Executor::Chroot;
+    }
+    let layered: Vec<String> = previous.iter().filter(|p| !names.contains(p)).cloned().collect();
+    state::set_layered(&layered)?;
+
+    let mut remove = vec!["apt-get", "remove", "-y"];
+    remove.extend(names.iter().map(String::as_str));
+    let staged = staged::run(&cfg, staged::Plan {
+        title: "STAGED PACKAGE LAYER REMOVAL",
+        kind: "layer",
+        steps: vec![remove],
+        prepare: Box::new(|_| Ok(())),
+        verify: Box::new(|root| {
+            let installed = packages::installed_packages(root);
+            let left: Vec<&str> = names.iter().map(String::as_str).filter(|n| installed.contains_key(*n)).collect();
+            if !left.is_empty() {
+                return Err(HammerError::CommandFailed(format!("Still installed in @update: {}", left.join(", "))).into());
+            }
+            Ok(())
+        }),
+        attachments: vec![(LAYER_ATTACHMENT, layer_manifest(&layered))],
+    });
+    if !matches!(staged, Ok(true)) {
+        state::set_layered(&previous)?;
+    }
+    staged.map(|_| ())
+}
+
+/// Layers recorded by layer transactions that went through, newest first: (transaction, layer)
+fn recorded_layers() -> Vec<(String, Vec<String>)> {
+    journal::list()
+    .into_iter()
+    .rev()
+    .filter(|tx| tx.result == "success" || tx.result == "unchanged")
+    .filter_map(|tx| {
+        let layer = journal::read_attachment(&tx.id, LAYER_ATTACHMENT)?;
+        Some((tx.id, layer.lines().map(str::to_string).filter(|l| !l.is_empty()).collect()))
+    })
+    .collect()
+}
+
+/// `hammer layer rollback`: stages the layer as transaction `to` left it, by default the
+/// last one that differs from the current layer, on top of the current base
+pub fn handle_rollback(mut cfg: UpdateConfig, to: Option<String>) -> Result<()> {
+    let current = state::layered_packages();
+    let recorded = recorded_layers();
+    let (from_tx, target) = match &to {
+        Some(id) => recorded
+        .into_iter()
+        .find(|(tx, _)| tx == id)
+        .map(|(tx, layer)| (Some(tx), layer))
+        .ok_or_else(|| HammerError::ConfigError(format!("{} is not a layer transaction; see: hammer history", id)))?,
+        // Before the first recorded change the layer was empty
+        None => recorded
+        .into_iter()
+        .find(|(_, layer)| *layer != current)
+        .map(|(tx, layer)| (Some(tx), layer))
+        .unwrap_or((None, Vec::new())),
+    };
+    let remove: Vec<&str> = current.iter().map(String::as_str).filter(|p| !target.iter().any(|t| t == p)).collect();
+    let install: Vec<&str> = target.iter().map(String::as_str).filter(|p| !current.iter().any(|c| c == p)).collect();
+    if remove.is_empty() && install.is_empty() {
+        Logger::info("The package layer is already as that transaction left it.");
+        return Ok(());
+    }
+    match &from_tx {
+        Some(tx) => Logger::info(&format!("Rolling the package layer back to {}", tx)),
+        None => Logger::info("Rolling the package layer back to before its first package"),
+    }
+    if !remove.is_empty() {
+        Logger::info(&format!("Removing: {}", remove.join(", ")));
+    }
+    if !install.is_empty() {
+        Logger::info(&format!("Installing: {}", install.join(", ")));
+    }
+    if cfg.executor == Executor::Live {
+        cfg.executor = Executor::Chroot;
+    }
+
+    let mut steps = Vec::new();
+    if !remove.is_empty() {
+        let mut step = vec!["apt-get", "remove", "-y"];
+        step.extend(remove.iter().copied());
+        steps.push(step);
+    }
+    if !install.is_empty() {
+        let mut step = vec!["apt-get", "install", "-y"];
+        step.extend(install.iter().copied());
+        steps.push(vec!["apt-get", "update"]);
+        steps.push(step);
+    }
+    state::set_layered(&target)?;
+    let staged = staged::run(&cfg, staged::Plan {
+        title: "STAGED PACKAGE LAYER ROLLBACK",
+        kind: "layer-rollback",
+        steps,
+        prepare: Box::new(|_| Ok(())),
+        verify: Box::new(|root| {
+            let installed = packages::installed_packages(root);
+            let wrong: Vec<&str> = remove
+            .iter()
+            .filter(|p| installed.contains_key(**p))
+            .chain(install.iter().filter(|p| !installed.contains_key(**p)))
+            .copied()
+            .collect();
+            if !wrong.is_empty() {
+                return Err(HammerError::CommandFailed(format!("Layer not rolled back in @update: {}", wrong.join(", "))).into());
+            }
+            Ok(())
+        }),
+        attachments: vec![(LAYER_ATTACHMENT, layer_manifest(&target))],
+    });
+    if !matches!(staged, Ok(true)) {
+        state::set_layered(&current)?;
+    }
+    staged.map(|_| ())
+}
+
+/// `hammer layer list`: the layer and what the running deployment has of it
+pub fn handle_list() -> Result<()> {
+    let layered = state::layered_packages();
+    if layered.is_empty() {
+        Logger::info("The package layer is empty. Add to it with: hammer layer add <pkg>");
+        return Ok(());
+    }
+    let installed = packages::installed_packages(Path::new("/"));
+    for name in &layered {
+        match installed.get(name) {
+            Some(version) => println!("{:<32} {}", name, version),
+            None => println!("{:<32} not installed; the next update installs it", name),
+        }
+    }
+    Ok(())
+}
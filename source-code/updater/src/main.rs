@@ -1,14 +1,68 @@
 use miette::{IntoDiagnostic, Result};
-use clap::{Parser, Subcommand};
+use clap::{Parser, Subcommand, ValueEnum};
+use hammer_core::i18n::{tr, tr_fmt};
 use hammer_core::{
-    btrfs_delete_atomic_snapshot, btrfs_list_atomic_snapshots, btrfs_snapshot_atomic,
-    create_spinner, create_progress_bar, run_command, Logger,
+    boot_assets, caps, config, create_spinner, create_progress_bar, events, exec, grub_btrfs, is_root,
+    journal, lsm, output, overrides, packages, run_change, run_command, state, storage, store, swap, HammerError, Logger,
 };
-use owo_colors::OwoColorize;
-use dialoguer::{Select, Confirm};
-use std::process::{Command, Stdio};
+use hammer_core::output::Tone;
+use dialoguer::Confirm;
+use std::path::Path;
+use std::time::Instant;
 use indicatif::ProgressBar;
 
+mod adopt;
+mod api;
+mod apply;
+mod autosnap;
+mod backup;
+mod boot;
+mod cache;
+mod changelog;
+mod check;
+mod composefs;
+mod compression;
+mod conffiles;
+mod correlate;
+mod dedupe;
+mod deviations;
+mod dkms;
+mod emergency;
+mod ensure;
+mod environment;
+mod executor;
+mod explain;
+mod export;
+mod guards;
+mod health;
+mod integrity;
+mod kernel;
+mod layer;
+mod migrate;
+mod migrations;
+mod os;
+mod plumbing;
+mod protect;
+mod reboot;
+mod recover;
+mod release;
+mod report;
+mod rescue;
+mod rings;
+mod s3;
+mod security;
+mod simulate;
+mod snapper;
+mod snapshots;
+mod sources;
+mod staged;
+mod stats;
+mod status;
+mod telemetry;
+mod timeshift;
+mod transfer;
+mod web;
+
 #[derive(Parser)]
 #[command(name = "hammer-updater")]
 struct Cli {
@@ -18,30 +72,963 @@ struct Cli {
 
 #[derive(Subcommand)]
 enum Commands {
-    Update,
-    Layer { packages: Vec<String> },
-    Clean,
-    Rollback,
+    Update {
+        /// Override the configured executor (live, chroot, nspawn, podman)
+        #[arg(long)]
+        executor: Option<config::Executor>,
+        /// Unattended run: skip on low battery or a metered connection
+        #[arg(long)]
+        auto: bool,
+        /// Install the package set of this snapshot.debian.org time (20251130T200000Z or YYYY-MM-DD, UTC)
+        #[arg(long)]
+        pin_mirror: Option<String>,
+        /// Use apt full-upgrade, which may remove packages (the default unless safe_upgrade is set)
+        #[arg(long, conflicts_with = "safe")]
+        full: bool,
+        /// Use apt upgrade --with-new-pkgs, which never removes packages
+        #[arg(long)]
+        safe: bool,
+        /// DEBIAN_FRONTEND for apt and maintainer scripts (default noninteractive)
+        #[arg(long)]
+        frontend: Option<String>,
+        /// Load debconf selections from this file first (repeatable)
+        #[arg(long)]
+        preseed: Vec<String>,
+        /// Changed conffiles: keep the local version (old), take the package's (new) or ask
+        #[arg(long)]
+        conffiles: Option<config::ConffilePolicy>,
+        /// Extra apt option, passed as -o OPTION (repeatable)
+        #[arg(long = "apt-option")]
+        apt_options: Vec<String>,
+        /// Run apt autoremove --purge afterwards and report the removed orphans
+        #[arg(long)]
+        autoremove: bool,
+        /// Only report the packages and download size the update would bring; nothing changes
+        #[arg(long, conflicts_with = "auto")]
+        simulate: bool,
+    },
+    /// Upgrade to another Debian release in a staged deployment
+    ReleaseUpgrade {
+        /// Target codename, e.g. trixie
+        #[arg(long)]
+        to: String,
+        /// Do not ask for confirmation
+        #[arg(short, long)]
+        yes: bool,
+    },
+    /// Install packages; add, remove and list manage the layer kept on every new base
+    #[command(args_conflicts_with_subcommands = true)]
+    Layer {
+        #[command(subcommand)]
+        action: Option<LayerAction>,
+        packages: Vec<String>,
+        /// Local .deb file to install (repeatable); its SHA-256 is recorded with --atomic
+        #[arg(long)]
+        deb: Vec<String>,
+        /// Install into a staged deployment and switch to it on reboot
+        #[arg(long)]
+        atomic: bool,
+    },
+    Clean {
+        /// Only empty the apt cache of this deployment (@, @update, ...) instead of pruning snapshots
+        #[arg(long)]
+        deployment: Option<String>,
+    },
+    /// Show root subvolumes and their state
+    Status {
+        #[arg(short = 'o', long = "output", value_enum, default_value = "table")]
+        output: status::OutputFormat,
+        #[arg(long, value_enum, default_value = "created")]
+        sort: status::SortKey,
+        #[arg(long)]
+        reverse: bool,
+        /// Refresh every SECS seconds (default 2) and on every hammer event
+        #[arg(long, value_name = "SECS", num_args = 0..=1, default_missing_value = "2")]
+        watch: Option<u64>,
+    },
+    /// Show snapshot history
+    History {
+        #[command(subcommand)]
+        action: Option<HistoryAction>,
+        #[arg(short = 'o', long = "output", value_enum, default_value = "table")]
+        output: status::OutputFormat,
+        #[arg(long, value_enum, default_value = "created")]
+        sort: status::SortKey,
+        #[arg(long)]
+        reverse: bool,
+    },
+    /// Clean up after an update, layer or rollback that was interrupted
+    Recover {
+        /// Then start an interrupted update again
+        #[arg(long)]
+        resume: bool,
+        /// Do not ask for confirmation
+        #[arg(short, long)]
+        yes: bool,
+    },
+    /// Restore a snapshot (interactive picker when no name is given)
+    Rollback {
+        /// Full or partial snapshot name
+        snapshot: Option<String>,
+        /// Newest snapshot taken before this date ("2025-11-30 20:00")
+        #[arg(long)]
+        before: Option<String>,
+    },
+    /// Show package changes between a snapshot and the running system (or another snapshot)
+    Diff {
+        from: Option<String>,
+        to: Option<String>,
+        #[arg(long)]
+        before: Option<String>,
+        /// Annotate upgraded packages with the CVEs they fix
+        #[arg(long)]
+        security: bool,
+        /// Query the Debian Security Tracker instead of only local changelogs
+        #[arg(long, requires = "security")]
+        tracker: bool,
+        /// Use the package lists cached by the last root run (default without root)
+        #[arg(long)]
+        cached: bool,
+    },
+    /// Show what was added or changed since the image this system was installed from
+    Deviations {
+        /// Also list packages at another version than the image shipped, mostly updates
+        #[arg(long)]
+        updates: bool,
+        #[arg(long)]
+        json: bool,
+    },
+    /// Plumbing: snapshots as name<TAB>created (RFC 3339, UTC)<TAB>kind<TAB>states, oldest first
+    ListSnapshots {
+        /// Only the names
+        #[arg(long)]
+        names_only: bool,
+        /// Only snapshots of this kind (pre-update, manual, ...)
+        #[arg(long)]
+        kind: Option<String>,
+        /// Only pinned snapshots
+        #[arg(long)]
+        pinned: bool,
+    },
+    /// Plumbing: the subvolume the next boot uses
+    CurrentDefault {
+        /// Print the subvolume ID instead of its path
+        #[arg(long)]
+        id: bool,
+    },
+    /// Plumbing: the subvolume the running system booted from
+    CurrentBooted {
+        /// Print the subvolume ID instead of its path
+        #[arg(long)]
+        id: bool,
+    },
+    /// Plumbing: APT hook (DPkg::Pre-Install-Pkgs) snapshotting before package changes
+    #[command(hide = true)]
+    AutoSnapshot,
+    /// Plumbing: APT hook (DPkg::Post-Invoke) recording an apt-external run in the journal
+    #[command(hide = true)]
+    AptFinished,
+    /// Plumbing: run the new migration scripts of this deployment (hammer-first-boot.service)
+    #[command(hide = true)]
+    FirstBoot,
+    /// Average duration of each update phase and how it trends
+    Stats {
+        /// Transaction kind: update, release-upgrade, layer, ...
+        #[arg(long, default_value = "update")]
+        kind: String,
+        /// Only the most recent N transactions
+        #[arg(long, default_value_t = 20)]
+        last: usize,
+        #[arg(short = 'o', long = "output", value_enum, default_value = "table")]
+        output: status::OutputFormat,
+    },
+    /// Show available updates, the last update and pending reboots (no root needed)
+    Check,
+    /// Resolve configuration files an update kept in their local version
+    Conffiles {
+        /// A top-level deployment such as @update instead of the running system
+        #[arg(long)]
+        deployment: Option<String>,
+        /// Only print the conflicts (local file, package's version)
+        #[arg(long)]
+        list: bool,
+    },
+    /// Delete a snapshot
+    Delete {
+        snapshot: Option<String>,
+        #[arg(long)]
+        before: Option<String>,
+        /// Also delete the rollback target of the last update while it is protected
+        #[arg(long)]
+        force: bool,
+    },
+    /// Snapshot the running root
+    Snapshot {
+        /// Kind part of the name, e.g. manual or apt-external
+        #[arg(long, default_value = "manual")]
+        kind: String,
+        /// Run as the DPkg::Pre-Invoke hook: skipped for apt started by hammer, never fails
+        #[arg(long, hide = true)]
+        apt_hook: bool,
+    },
+    /// Protect a snapshot from cleanup
+    Pin { snapshot: String },
+    /// Remove cleanup protection from a snapshot
+    Unpin { snapshot: String },
+    /// Names for snapshots, accepted wherever a snapshot name is
+    Alias {
+        #[command(subcommand)]
+        action: AliasAction,
+    },
+    /// Reboot to activate a pending update or rollback
+    Reboot {
+        /// now, idle (after all sessions end) or HH:MM
+        #[arg(long, default_value = "now")]
+        when: String,
+        /// Reboot even if nothing is pending
+        #[arg(long)]
+        force: bool,
+    },
+    /// Activate pending changes (full reboot unless a faster mode is chosen)
+    Apply {
+        /// Use systemd soft-reboot when the kernel is unchanged
+        #[arg(long, conflicts_with = "kexec")]
+        soft_reboot: bool,
+        /// kexec into the new root's kernel, skipping firmware
+        #[arg(long, conflicts_with = "live")]
+        kexec: bool,
+        /// Sync the new root into the running system without rebooting (kernel, libc and systemd excluded)
+        #[arg(long, conflicts_with = "soft_reboot")]
+        live: bool,
+    },
+    /// Inspect and purge kernels across snapshots and /boot
+    Kernel {
+        #[command(subcommand)]
+        action: KernelAction,
+    },
+    /// Rollback from the initramfs shell with the static build; needs no other tools
+    Emergency {
+        #[command(subcommand)]
+        action: EmergencyAction,
+        /// Root device ("UUID=...", "/dev/sda2"); default: root= from the kernel command line
+        #[arg(long, global = true)]
+        device: Option<String>,
+    },
+    /// Recovery boot entry that can repair the default subvolume
+    Rescue {
+        #[command(subcommand)]
+        action: RescueAction,
+    },
+    /// Experimental: deployments sealed into composefs images that share file contents
+    Composefs {
+        #[command(subcommand)]
+        action: ComposefsAction,
+    },
+    /// Several operating systems (e.g. stable and testing) on one filesystem, each with its own boot entry
+    Os {
+        #[command(subcommand)]
+        action: OsAction,
+    },
+    /// Default GRUB entry and menu timeout, kept in a drop-in and grubenv
+    Boot {
+        #[command(subcommand)]
+        action: BootAction,
+    },
+    /// Boot asset accounting on the EFI system partition
+    Esp {
+        #[command(subcommand)]
+        action: EspAction,
+    },
+    /// Script hooks and systemd targets emitted around hammer operations
+    Events {
+        #[command(subcommand)]
+        action: EventsAction,
+    },
+    /// Manage swapfiles that block root snapshots
+    Swap {
+        #[command(subcommand)]
+        action: SwapAction,
+    },
+    /// Collect a sanitized bug report tarball
+    Report {
+        /// Output file (default hammer-report-<date>.tar.gz)
+        #[arg(short, long)]
+        output: Option<String>,
+        /// Send it to [report] upload_url
+        #[arg(long)]
+        upload: bool,
+    },
+    /// Opt-in anonymous statistics on how updates and rollbacks end
+    Telemetry {
+        #[command(subcommand)]
+        action: TelemetryAction,
+    },
+    /// Move hammer config, journal and pins between machines
+    State {
+        #[command(subcommand)]
+        action: StateAction,
+    },
+    /// Incremental backups of the running root to local, SSH or S3 targets
+    Backup {
+        #[command(subcommand)]
+        action: BackupAction,
+    },
+    /// Stream a snapshot to a file, compressed and optionally encrypted
+    Export {
+        snapshot: String,
+        /// Output file or s3:// URL (default <snapshot>.btrfs.zst|.gz[.age|.gpg])
+        #[arg(short, long)]
+        output: Option<String>,
+        /// Encrypt to this age recipient (repeatable)
+        #[arg(long, conflicts_with = "gpg")]
+        age: Vec<String>,
+        /// Encrypt to this GPG key
+        #[arg(long)]
+        gpg: Option<String>,
+        /// Skip compression
+        #[arg(long)]
+        no_compress: bool,
+    },
+    /// Receive a snapshot from 'hammer export' (file or s3:// URL) into @snapshots
+    Import {
+        source: String,
+        /// age identity file for .age exports
+        #[arg(short, long)]
+        identity: Option<String>,
+    },
+    /// Check a deployment's files: dpkg md5sums, or the stage-time hash database with --deep
+    Verify {
+        /// "current", "@bad-<date>" or a snapshot name
+        #[arg(default_value = "current")]
+        deployment: String,
+        /// Recompute all file hashes and compare them with the database
+        #[arg(long)]
+        deep: bool,
+        /// (Re)create the hash database from the deployment as it is now
+        #[arg(long, conflicts_with = "deep")]
+        record: bool,
+    },
+    /// Share identical file extents between a deployment and its parent (duperemove)
+    Dedupe {
+        /// "@update", "current", "@bad-<date>" or a snapshot name (default: @update if staged, else @)
+        #[arg(long)]
+        deployment: Option<String>,
+        /// Deployment to share extents with (default: @ for @update, the newest snapshot for @)
+        #[arg(long)]
+        against: Option<String>,
+    },
+    /// Filesystem properties of deployments
+    Fs {
+        #[command(subcommand)]
+        action: FsAction,
+    },
+    /// Register an existing root subvolume as a hammer deployment
+    Adopt {
+        /// Subvolume path, absolute or relative to the Btrfs top level (e.g. @rootfs)
+        subvolume: String,
+        /// Kind part of the new snapshot name
+        #[arg(long, default_value = "adopted")]
+        kind: String,
+        /// Skip the root filesystem checks
+        #[arg(long)]
+        force: bool,
+    },
+    /// Adopt snapshots from another tool's layout, or publish hammer's to it
+    Migrate {
+        /// Import snapshots from this tool
+        #[arg(long, value_enum, required_unless_present = "to", conflicts_with = "to")]
+        from: Option<MigrateTool>,
+        /// Export hammer snapshots to this tool
+        #[arg(long, value_enum)]
+        to: Option<MigrateTool>,
+        /// snapper's snapshot directory
+        #[arg(long, default_value = "/.snapshots")]
+        path: String,
+        /// Only show what would be copied
+        #[arg(long)]
+        dry_run: bool,
+    },
+    /// Idempotently bring the system to a desired state; prints JSON with "changed"
+    Ensure {
+        /// Packages are up to date (see --max-age)
+        #[arg(long)]
+        updated: bool,
+        /// The newest deployment is the running one (reboots if needed)
+        #[arg(long)]
+        switched: bool,
+        /// Skip --updated when the last update is younger than this (30m, 12h, 7d, 2w)
+        #[arg(long, requires = "updated")]
+        max_age: Option<String>,
+    },
+    /// Serve the local REST API on a unix socket
+    Serve {
+        #[arg(long, default_value = api::SOCKET_PATH)]
+        socket: String,
+    },
+    /// Print the commands, mounts and writes a hammer command would run on this machine, without running them
+    Explain {
+        /// The command to explain, e.g. update --safe
+        #[arg(trailing_var_arg = true, allow_hyphen_values = true, required = true)]
+        command: Vec<String>,
+    },
+    /// Browser dashboard backed by the local API
+    Web {
+        #[arg(long, default_value = "127.0.0.1:8080")]
+        listen: String,
+        #[arg(long, default_value = api::SOCKET_PATH)]
+        socket: String,
+    },
+}
+
+impl Commands {
+    /// Least privilege each command runs with; see caps::Profile
+    fn profile(&self) -> caps::Profile {
+        use caps::Profile;
+        match self {
+            Commands::Diff { cached: true, .. }
+            | Commands::Telemetry { action: TelemetryAction::Status }
+            | Commands::Layer { action: Some(LayerAction::List), .. } => Profile::None,
+            Commands::Check
+            | Commands::Status { .. }
+            | Commands::History { .. }
+            | Commands::ListSnapshots { .. }
+            | Commands::CurrentDefault { .. }
+            | Commands::CurrentBooted { .. }
+            | Commands::Diff { .. }
+            | Commands::Deviations { .. }
+            | Commands::Verify { .. }
+            | Commands::Stats { .. }
+            | Commands::Explain { .. }
+            | Commands::Kernel { action: KernelAction::List }
+            | Commands::Os { action: OsAction::List }
+            | Commands::Boot { action: BootAction::Show } => Profile::Inspect,
+            Commands::Delete { .. }
+            | Commands::Pin { .. }
+            | Commands::Unpin { .. }
+            | Commands::Alias { .. }
+            | Commands::AutoSnapshot
+            | Commands::AptFinished
+            | Commands::Snapshot { .. }
+            | Commands::Export { .. }
+            | Commands::Import { .. }
+            | Commands::Backup { .. }
+            | Commands::Dedupe { .. }
+            | Commands::Fs { .. }
+            | Commands::Adopt { .. }
+            | Commands::Migrate { .. }
+            | Commands::Telemetry { .. }
+            // Writes the bundle where it is asked to, e.g. a user's home directory, which
+            // takes CAP_DAC_OVERRIDE
+            | Commands::Report { .. } => Profile::Snapshot,
+            // apt, dpkg scripts, chroots, the bootloader, or other hammer commands on request
+            _ => Profile::Full,
+        }
+    }
+
+    /// -o json for the commands that have an output format (HAMMER_JSON)
+    fn use_json_output(&mut self) {
+        match self {
+            Commands::Status { output, .. } | Commands::History { output, .. } | Commands::Stats { output, .. } => {
+                *output = status::OutputFormat::Json;
+            }
+            Commands::Deviations { json, .. } => *json = true,
+            _ => {}
+        }
+    }
+
+    /// `cfg` with the flags of an update command applied; other commands leave it as is
+    fn update_config(&self, mut cfg: config::UpdateConfig) -> config::UpdateConfig {
+        if let Commands::Update { executor, pin_mirror, full, safe, frontend, preseed, conffiles, apt_options, autoremove, .. } = self {
+            if let Some(e) = executor {
+                cfg.executor = *e;
+            }
+            if *full || *safe {
+                cfg.safe_upgrade = *safe;
+            }
+            if let Some(f) = frontend {
+                cfg.apt.frontend = f.clone();
+            }
+            if let Some(c) = conffiles {
+                cfg.apt.conffiles = *c;
+            }
+            cfg.apt.preseed.extend(preseed.iter().cloned());
+            cfg.apt.options.extend(apt_options.iter().cloned());
+            cfg.autoremove |= *autoremove;
+            if pin_mirror.is_some() {
+                cfg.pin_mirror = pin_mirror.clone();
+            }
+        }
+        cfg
+    }
+}
+
+/// Parses a command line without the program name, as `hammer explain` receives it
+fn parse_command(args: &[String]) -> Result<Commands> {
+    let cli = Cli::try_parse_from(std::iter::once("hammer").chain(args.iter().map(|a| a.as_str())))
+    .map_err(|e| HammerError::ConfigError(e.to_string().trim_end().to_string()))?;
+    Ok(cli.command)
+}
+
+#[derive(Subcommand)]
+enum LayerAction {
+    /// Install packages in a staged deployment and keep them on every new base
+    Add {
+        #[arg(required = true)]
+        packages: Vec<String>,
+    },
+    /// Remove layered packages in a staged deployment
+    Remove {
+        #[arg(required = true)]
+        packages: Vec<String>,
+    },
+    /// Layered packages and their versions in the running system
+    List,
+    /// Stage an earlier package layer on top of the current base
+    Rollback {
+        /// Layer transaction whose result to go back to (default: the last different layer)
+        #[arg(long)]
+        to: Option<String>,
+    },
+}
+
+#[derive(Subcommand)]
+enum HistoryAction {
+    /// Show the journal entry of one transaction
+    Show {
+        id: String,
+        /// Include NEWS and changelog entries of upgraded packages
+        #[arg(long)]
+        changelog: bool,
+        /// Include the apt sources the transaction used
+        #[arg(long)]
+        sources: bool,
+        /// Include the environment of the apt run: source hashes, pins, holds, architectures, hammer.toml
+        #[arg(long)]
+        env: bool,
+    },
+    /// Line up the apt and dpkg logs of all deployments with snapshots and transactions
+    Correlate {
+        /// Only changes from this date on ("2025-11-30 20:00")
+        #[arg(long)]
+        since: Option<String>,
+        /// Only changes hammer did not make
+        #[arg(long)]
+        outside: bool,
+    },
+}
+
+#[derive(Subcommand)]
+enum AliasAction {
+    /// Point an alias at a snapshot, e.g. alias set golden 2025-11-30-201300-pre-update
+    Set { alias: String, snapshot: String },
+    /// Forget an alias; the snapshot stays
+    Remove { alias: String },
+    /// Aliases and their snapshots
+    List,
+}
+
+#[derive(Subcommand)]
+enum KernelAction {
+    /// List kernels in /boot, installed packages and snapshots
+    List,
+    /// Purge kernels from the live system and /boot
+    Remove {
+        versions: Vec<String>,
+        /// Remove every kernel except the running and the newest one
+        #[arg(long)]
+        old: bool,
+        /// Also remove kernels that snapshots still need to boot
+        #[arg(long)]
+        force: bool,
+    },
+}
+
+#[derive(Subcommand)]
+enum EmergencyAction {
+    /// Root subvolumes with their IDs
+    List,
+    /// Replace @ with a copy of a snapshot, keeping the old one as @bad-<date>
+    Rollback { snapshot: String },
+    /// Make "@", "@snapshots/NAME" or an ID the default subvolume
+    SetDefault { subvolume: String },
+}
+
+#[derive(Subcommand)]
+enum RescueAction {
+    /// Create @rescue and its GRUB entry from the running kernel
+    Prepare {
+        /// Kernel version from /boot to use instead of the running one
+        #[arg(long)]
+        kernel: Option<String>,
+    },
+    /// Delete @rescue and its GRUB entry
+    Remove,
+}
+
+#[derive(Subcommand)]
+enum ComposefsAction {
+    /// Seal a snapshot, or the current @, into an image with its own GRUB entry
+    Seal { snapshot: Option<String> },
+    /// Images, their kernels and the space they take
+    List,
+    /// Delete an image, its writable layer and the objects only it used
+    Remove { image: String },
+}
+
+#[derive(Subcommand)]
+enum BootAction {
+    /// Boot a deployment by default: "current", "@rescue", a parked OS or a composefs image
+    SetDefault { deployment: String },
+    /// Seconds the menu waits before booting the default (0: no wait)
+    SetTimeout { seconds: u32 },
+    /// Boot entries, the default one and the timeout
+    Show,
+}
+
+#[derive(Subcommand)]
+enum OsAction {
+    /// Add an OS copied from the running system, a snapshot or a root subvolume
+    Add {
+        name: String,
+        /// "current", a snapshot name, or a subvolume path ("@debian", "/mnt/root")
+        #[arg(long)]
+        from: Option<String>,
+        /// Debian suite its apt sources follow from now on (e.g. testing)
+        #[arg(long)]
+        suite: Option<String>,
+    },
+    /// The primary OS and the parked ones
+    List,
+    /// Make a parked OS the primary one from the next boot on
+    Switch {
+        name: String,
+        #[arg(short, long)]
+        yes: bool,
+    },
+}
+
+#[derive(Subcommand)]
+enum FsAction {
+    /// Show or set the compression property of a deployment (zstd, lzo, zlib, none)
+    Compression {
+        /// "current", "@update", "@bad-<date>" or a snapshot name
+        deployment: String,
+        algorithm: Option<String>,
+    },
+    /// Compress the existing data of a deployment (btrfs defragment)
+    Recompress {
+        /// "current", "@update", "@bad-<date>" or a snapshot name
+        deployment: String,
+        /// Algorithm (default: [compression] algorithm, else zstd)
+        #[arg(long)]
+        algorithm: Option<String>,
+        /// Compression level (default: [compression] level)
+        #[arg(long)]
+        level: Option<u32>,
+    },
+}
+
+#[derive(Subcommand)]
+enum EspAction {
+    /// Show ESP free space and per-snapshot boot assets
+    Status,
+    /// Remove boot assets of deleted snapshots
+    Gc,
+}
+
+#[derive(Subcommand)]
+enum EventsAction {
+    /// List events with their hook directories and targets
+    List,
+    /// Install hammer-<event>.target units and hook directories
+    Install,
+}
+
+#[derive(Subcommand)]
+enum StateAction {
+    /// Bundle /etc/hammer and /var/lib/hammer into a tarball
+    Export {
+        #[arg(default_value = "hammer-state.tar.gz")]
+        file: String,
+    },
+    /// Restore a bundle; the journal is merged, config kept unless --force
+    Import {
+        file: String,
+        /// Overwrite existing config files and hooks
+        #[arg(long)]
+        force: bool,
+    },
+}
+
+#[derive(Subcommand)]
+enum BackupAction {
+    /// Register a target: /path (Btrfs), ssh://user@host/path or s3://bucket/prefix
+    Add {
+        target: String,
+        #[arg(long)]
+        name: Option<String>,
+        /// Backups kept on the target
+        #[arg(long, default_value_t = 7)]
+        keep: usize,
+    },
+    /// Forget a target; its backups stay where they are
+    Remove { name: String },
+    /// Show targets and their newest backup
+    List,
+    /// Back up now (all targets unless one is named)
+    Run { name: Option<String> },
+    /// Receive a backup into @snapshots (newest unless one is named)
+    Restore { name: String, snapshot: Option<String> },
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum MigrateTool {
+    Snapper,
+}
+
+#[derive(Subcommand)]
+enum TelemetryAction {
+    /// Whether telemetry is on, where it goes, what is queued and what an event holds
+    Status,
+    /// Start recording and sending update and rollback results (needs [telemetry] endpoint)
+    Enable,
+    /// Stop, and drop the events not sent yet
+    Disable,
+}
+
+#[derive(Subcommand)]
+enum SwapAction {
+    /// Show active swapfiles and whether they block snapshots
+    Status,
+    /// Move swapfiles out of @ into a dedicated NOCOW @swap subvolume
+    Relocate,
 }
 
 fn main() -> Result<()> {
-    let cli = Cli::parse();
+    let mut cli = Cli::parse();
+    if overrides::dry_run() {
+        exec::set_dry_run();
+    }
+    if overrides::json() {
+        cli.command.use_json_output();
+        Logger::use_json();
+    }
+    // Everything else reads or writes the top level; these fall back to the cache
+    let unprivileged = matches!(
+        cli.command,
+        Commands::Status { .. }
+        | Commands::History { action: None, .. }
+        | Commands::Diff { .. }
+        | Commands::Deviations { .. }
+        | Commands::Check
+        | Commands::ListSnapshots { .. }
+        | Commands::CurrentDefault { .. }
+        | Commands::CurrentBooted { .. }
+        | Commands::Alias { action: AliasAction::List }
+        | Commands::Update { simulate: true, .. }
+        | Commands::Telemetry { action: TelemetryAction::Status }
+        | Commands::Layer { action: Some(LayerAction::List), .. }
+    );
+    if !unprivileged {
+        let invocation = format!("hammer {}", std::env::args().skip(1).collect::<Vec<_>>().join(" "));
+        if let Some(problem) = caps::explain(cli.command.profile(), &invocation, None) {
+            Logger::error(&problem);
+            Logger::info("Without root, status, history, diff, check, alias list, update --simulate and the plumbing commands work read-only from the cached state.");
+            std::process::exit(1);
+        }
+    }
+    if config::load().map(|c| c.general.drop_capabilities).unwrap_or(true) {
+        caps::restrict(cli.command.profile())?;
+    }
+    if is_root() && !exec::dry_run() {
+        // State from an older hammer, or writes a crash cut short, are dealt with before anything reads them
+        store::upgrade()?;
+    }
+    let is_hook = matches!(cli.command, Commands::AutoSnapshot | Commands::AptFinished | Commands::Snapshot { apt_hook: true, .. });
+    if is_root() && !is_hook && !matches!(cli.command, Commands::Recover { .. }) {
+        recover::warn_interrupted();
+    }
+    if !is_hook {
+        // apt started by hammer must not trigger the automatic snapshot hook
+        std::env::set_var(autosnap::TRANSACTION_ENV, "1");
+    }
+    let changes_deployments = matches!(
+        cli.command,
+        Commands::Update { simulate: false, .. }
+        | Commands::ReleaseUpgrade { .. }
+        | Commands::Layer { action: None | Some(LayerAction::Add { .. } | LayerAction::Remove { .. } | LayerAction::Rollback { .. }), .. }
+        | Commands::Clean { .. }
+        | Commands::Rollback { .. }
+        | Commands::Delete { .. }
+        | Commands::Pin { .. }
+        | Commands::Unpin { .. }
+        | Commands::AutoSnapshot
+        | Commands::Snapshot { .. }
+        | Commands::Adopt { .. }
+        | Commands::Import { .. }
+        | Commands::Migrate { .. }
+        | Commands::Backup { action: BackupAction::Restore { .. } }
+        | Commands::Os { action: OsAction::Add { .. } | OsAction::Switch { .. } }
+    );
+    if changes_deployments && !is_hook {
+        // A parked OS shares the top level with the primary one; @ and @snapshots are not its own
+        os::ensure_primary()?;
+    }
     match cli.command {
-        Commands::Update => handle_update()?,
-        Commands::Layer { packages } => handle_layer(packages)?,
-        Commands::Clean => handle_clean()?,
-        Commands::Rollback => handle_rollback()?,
+        command @ Commands::Update { simulate: true, .. } => {
+            simulate::handle_simulate(&command.update_config(config::load()?.update))?
+        }
+        command @ Commands::Update { auto, .. } => {
+            let config = config::load()?;
+            if auto {
+                if let Some(reason) = guards::skip_reason(&config.auto) {
+                    Logger::info(&format!("Skipping automatic update: {}.", reason));
+                    return Ok(());
+                }
+            }
+            let mut cfg = command.update_config(config.update);
+            if auto && !matches!(command, Commands::Update { pin_mirror: Some(_), .. }) {
+                // Fleet machines only take releases open to their ring
+                match rings::resolve(&config.fleet)? {
+                    rings::Rollout::Pin(ts) => cfg.pin_mirror = Some(ts),
+                    rings::Rollout::Unmanaged => {}
+                    rings::Rollout::Wait => return Ok(()),
+                }
+            }
+            if cfg.executor.is_staged() {
+                staged::handle_staged_update(&cfg)?
+            } else {
+                handle_update(&cfg)?
+            }
+        }
+        Commands::ReleaseUpgrade { to, yes } => release::handle_release_upgrade(config::load()?.update, &to, yes)?,
+        Commands::Layer { action: Some(LayerAction::Add { packages }), .. } => layer::handle_add(config::load()?.update, packages)?,
+        Commands::Layer { action: Some(LayerAction::Remove { packages }), .. } => layer::handle_remove(config::load()?.update, packages)?,
+        Commands::Layer { action: Some(LayerAction::List), .. } => layer::handle_list()?,
+        Commands::Layer { action: Some(LayerAction::Rollback { to }), .. } => layer::handle_rollback(config::load()?.update, to)?,
+        Commands::Layer { action: None, packages, deb, atomic } => {
+            let debs = deb.iter().map(|d| layer::LocalDeb::open(d)).collect::<Result<Vec<_>>>()?;
+            if atomic {
+                layer::handle_atomic_layer(config::load()?.update, packages, debs)?;
+            } else {
+                handle_layer(packages, debs)?
+            }
+        }
+        Commands::Clean { deployment: Some(deployment) } => handle_clean_deployment(&deployment)?,
+        Commands::Clean { deployment: None } => handle_clean(&config::load()?.clean)?,
+        Commands::Status { sort, reverse, watch: Some(secs), .. } => status::handle_watch(secs.max(1), sort, reverse, &config::load()?)?,
+        Commands::Status { output, sort, reverse, .. } => status::handle_status(output, sort, reverse, &config::load()?)?,
+        Commands::History { action: Some(HistoryAction::Show { id, changelog, sources, env }), .. } => handle_history_show(id, changelog, sources, env)?,
+        Commands::History { action: Some(HistoryAction::Correlate { since, outside }), .. } => correlate::handle_correlate(since, outside)?,
+        Commands::History { action: None, output, sort, reverse } => status::handle_history(output, sort, reverse)?,
+        Commands::Rollback { snapshot, before } => handle_rollback(snapshot, before)?,
+        Commands::Recover { resume, yes } => recover::handle_recover(resume, yes)?,
+        Commands::Diff { from, to, before, security, tracker, cached } if cached || !is_root() => {
+            if before.is_some() || tracker {
+                return Err(HammerError::ConfigError("--before and --tracker need root (not available with cached data)".into()).into());
+            }
+            handle_diff_cached(from, to, security)?
+        }
+        Commands::Diff { from, to, before, security, tracker, .. } => handle_diff(from, to, before, security, tracker)?,
+        Commands::Deviations { updates, json } => deviations::handle_deviations(json, updates)?,
+        Commands::Check => check::handle_check()?,
+        Commands::ListSnapshots { names_only, kind, pinned } => plumbing::list_snapshots(names_only, kind, pinned)?,
+        Commands::CurrentDefault { id } => plumbing::current_default(id)?,
+        Commands::CurrentBooted { id } => plumbing::current_booted(id)?,
+        Commands::AutoSnapshot => autosnap::handle_hook()?,
+        Commands::AptFinished => autosnap::handle_apt_finished()?,
+        Commands::FirstBoot => migrations::handle_first_boot()?,
+        Commands::Snapshot { kind, apt_hook } => autosnap::handle_snapshot(&kind, apt_hook)?,
+        Commands::Stats { kind, last, output } => stats::handle_stats(&kind, last, output)?,
+        Commands::Conffiles { deployment, list } => conffiles::handle_conffiles(deployment, list)?,
+        Commands::Delete { snapshot, before, force } => handle_delete(snapshot, before, force)?,
+        Commands::Pin { snapshot } => handle_pin(snapshot, true)?,
+        Commands::Unpin { snapshot } => handle_pin(snapshot, false)?,
+        Commands::Alias { action } => handle_alias(action)?,
+        Commands::Reboot { when, force } => reboot::handle_reboot(reboot::parse_when(&when)?, force)?,
+        Commands::Apply { soft_reboot, kexec, live } => apply::handle_apply(soft_reboot, kexec, live)?,
+        Commands::Kernel { action } => match action {
+            KernelAction::List => kernel::handle_list()?,
+            KernelAction::Remove { versions, old, force } => kernel::handle_remove(versions, old, force)?,
+        },
+        Commands::Emergency { action: EmergencyAction::List, device } => emergency::handle_list(device)?,
+        Commands::Emergency { action: EmergencyAction::Rollback { snapshot }, device } => emergency::handle_rollback(&snapshot, device)?,
+        Commands::Emergency { action: EmergencyAction::SetDefault { subvolume }, device } => emergency::handle_set_default(&subvolume, device)?,
+        Commands::Rescue { action: RescueAction::Prepare { kernel } } => rescue::handle_prepare(kernel)?,
+        Commands::Rescue { action: RescueAction::Remove } => rescue::handle_remove()?,
+        Commands::Composefs { action } => match action {
+            ComposefsAction::Seal { snapshot } => composefs::handle_seal(snapshot)?,
+            ComposefsAction::List => composefs::handle_list()?,
+            ComposefsAction::Remove { image } => composefs::handle_remove(&image)?,
+        },
+        Commands::Boot { action } => match action {
+            BootAction::SetDefault { deployment } => boot::handle_set_default(&deployment)?,
+            BootAction::SetTimeout { seconds } => boot::handle_set_timeout(seconds)?,
+            BootAction::Show => boot::handle_show()?,
+        },
+        Commands::Os { action } => match action {
+            OsAction::Add { name, from, suite } => os::handle_add(&name, from, suite)?,
+            OsAction::List => os::handle_list()?,
+            OsAction::Switch { name, yes } => os::handle_switch(config::load()?.update, &name, yes)?,
+        },
+        Commands::Esp { action } => handle_esp(action)?,
+        Commands::Events { action } => handle_events(action)?,
+        Commands::Swap { action } => handle_swap(action)?,
+        Commands::Report { output, upload } => report::handle_report(output, upload)?,
+        Commands::Telemetry { action } => match action {
+            TelemetryAction::Status => telemetry::handle_status()?,
+            TelemetryAction::Enable => telemetry::handle_enable()?,
+            TelemetryAction::Disable => telemetry::handle_disable()?,
+        },
+        Commands::State { action: StateAction::Export { file } } => migrate::handle_export(&file)?,
+        Commands::State { action: StateAction::Import { file, force } } => migrate::handle_import(&file, force)?,
+        Commands::Backup { action } => match action {
+            BackupAction::Add { target, name, keep } => backup::handle_add(&target, name, keep)?,
+            BackupAction::Remove { name } => backup::handle_remove(&name)?,
+            BackupAction::List => backup::handle_list()?,
+            BackupAction::Run { name } => backup::handle_run(name)?,
+            BackupAction::Restore { name, snapshot } => backup::handle_restore(&name, snapshot)?,
+        },
+        Commands::Export { snapshot, output, age, gpg, no_compress } => {
+            let encryption = match (gpg, age.is_empty()) {
+                (Some(key), _) => export::Encryption::Gpg(key),
+                (None, false) => export::Encryption::Age(age),
+                (None, true) => export::Encryption::None,
+            };
+            export::handle_export(&snapshot, output, !no_compress, encryption)?
+        }
+        Commands::Import { source, identity } => export::handle_import(&source, identity)?,
+        Commands::Verify { deployment, deep, record } => integrity::handle_verify(&deployment, deep, record)?,
+        Commands::Dedupe { deployment, against } => dedupe::handle_dedupe(deployment, against)?,
+        Commands::Fs { action: FsAction::Compression { deployment, algorithm } } => {
+            compression::handle_compression(&deployment, algorithm)?
+        }
+        Commands::Fs { action: FsAction::Recompress { deployment, algorithm, level } } => {
+            compression::handle_recompress(&deployment, algorithm, level)?
+        }
+        Commands::Adopt { subvolume, kind, force } => adopt::handle_adopt(&subvolume, &kind, force)?,
+        Commands::Migrate { from: Some(MigrateTool::Snapper), path, dry_run, .. } => snapper::handle_import(&path, dry_run)?,
+        Commands::Migrate { to: Some(MigrateTool::Snapper), path, dry_run, .. } => snapper::handle_export(&path, dry_run)?,
+        Commands::Migrate { .. } => unreachable!("clap requires --from or --to"),
+        Commands::Ensure { updated, switched, max_age } => ensure::handle_ensure(updated, switched, max_age)?,
+        Commands::Serve { socket } => api::handle_serve(&socket)?,
+        Commands::Explain { command } => explain::handle_explain(command)?,
+        Commands::Web { listen, socket } => web::handle_web(&listen, &socket)?,
+    }
+    if changes_deployments {
+        // A stale cache only makes unprivileged output older; never fail the command for it
+        let _ = cache::refresh();
     }
     Ok(())
 }
 
-fn create_snapshot_name(suffix: &str) -> String {
-    let timestamp = chrono::Local::now().format("%Y-%m-%d-%H%M%S");
-    format!("{}-{}", timestamp, suffix)
+pub(crate) fn create_snapshot_name(suffix: &str) -> String {
+    snapshots::name_at(chrono::Utc::now(), suffix)
 }
 
-fn handle_update() -> Result<()> {
-    Logger::section("ATOMIC SYSTEM UPDATE");
+fn handle_update(cfg: &config::UpdateConfig) -> Result<()> {
+    Logger::section(tr("update.title"));
+    events::emit(events::Event::PreUpdate, None);
 
     // Initialize global progress bar for steps
     let steps = 4;
@@ -53,16 +1040,23 @@ fn handle_update() -> Result<()> {
 
     // Ensure RW
     Logger::info("Remounting Root as RW...");
-    run_command("mount", &["-o", "remount,rw", "/"], "Remount RW")?;
+    run_change("mount", &["-o", "remount,rw", "/"], "Remount RW")?;
+
+    // The new snapshot needs its own kernel/initrd copy on the ESP
+    let started = Instant::now();
+    boot_assets::preflight()?;
+    let bootloader = started.elapsed();
 
     // Step 2: Snapshot
     main_pb.set_message("Step 2/4: Creating Snapshot...");
     main_pb.set_position(2);
 
+    let started = Instant::now();
     let snap_name = create_snapshot_name("pre-update");
-    let spinner = create_spinner("Snapshotting @ subvolume...");
-    btrfs_snapshot_atomic(&snap_name)?;
-    spinner.finish_with_message("Snapshot created in @snapshots");
+    let spinner = create_spinner("Snapshotting the root...");
+    storage::driver()?.snapshot(&snap_name)?;
+    spinner.finish_with_message("Snapshot created");
+    let snapshot = started.elapsed();
 
     // Step 3: APT Update
     main_pb.set_message("Step 3/4: Downloading Updates...");
@@ -70,45 +1064,117 @@ fn handle_update() -> Result<()> {
 
     Logger::info("Running apt update & upgrade (Logs below)...");
 
+    let lsms = lsm::active_lsms();
+    let policy_before = lsm::capture_policy(Path::new("/"), &lsms);
+
+    let root = Path::new("/");
+    let packages_before = packages::installed_packages(root);
+    let mut tx = journal::Transaction::begin(&snap_name, "update");
+    tx.phases.push(("bootloader".to_string(), bootloader.as_secs_f64()));
+    tx.phases.push(("snapshot".to_string(), snapshot.as_secs_f64()));
+    let pinned = cfg.pin_mirror.as_deref().map(sources::parse_timestamp).transpose()?;
+    let mut apt_options = match &pinned {
+        Some(ts) => sources::pin(root, ts)?,
+        None => Vec::new(),
+    };
+    apt_options.extend(cfg.apt.apt_args());
+    tx.mirror_snapshot = Some(pinned.unwrap_or_else(sources::current_timestamp));
+    journal::save(&tx)?;
+    journal::attach(&snap_name, "sources", &sources::capture(root))?;
+
     // We pause the main PB briefly or let logs flow under it?
     // indicatif output handles this if configured, but mixing streams is hard.
     // We will just let logs print.
 
-    let status = Command::new("apt")
-    .args(&["update"])
-    .stdout(Stdio::inherit())
-    .stderr(Stdio::inherit())
-    .status()
-    .into_diagnostic()?;
-
-    if !status.success() {
-        Logger::error("apt update failed.");
+    let apt_update = sources::with_options(&["apt", "update"], &apt_options);
+    let mut upgrade = vec!["apt"];
+    upgrade.extend(cfg.upgrade_args());
+    let apt_upgrade = sources::with_options(&upgrade, &apt_options);
+    let started = Instant::now();
+    let updated = executor::preseed(cfg, root)? && executor::run_in_root(cfg, root, &apt_update)?;
+    tx.phase("apt update", started);
+    if !updated {
+        sources::release(root);
+        Logger::error(tr("update.apt-update-failed"));
+        tx.finish("failed")?;
+        telemetry::record_transaction(&tx);
+        events::emit(events::Event::UpdateFailed, Some(&snap_name));
         return Ok(());
     }
 
-    let status = Command::new("apt")
-    .args(&["full-upgrade", "-y"])
-    .stdout(Stdio::inherit())
-    .stderr(Stdio::inherit())
-    .status()
-    .into_diagnostic()?;
-
-    if status.success() {
+    let started = Instant::now();
+    let mut upgraded = executor::run_in_root(cfg, root, &apt_upgrade)?;
+    tx.phase(&executor::phase_name(&apt_upgrade), started);
+    let layered = state::layered_packages();
+    if let Some(step) = layer::reapply_step(&layered).filter(|_| upgraded) {
+        let reapply = sources::with_options(&step, &apt_options);
+        let started = Instant::now();
+        upgraded = executor::run_in_root(cfg, root, &reapply)?;
+        tx.phase("layer", started);
+    }
+    if upgraded && cfg.autoremove {
+        let started = Instant::now();
+        upgraded = executor::autoremove(cfg, root, &apt_options, &snap_name)?;
+        tx.phase("apt autoremove", started);
+    }
+    sources::release(root);
+    if upgraded {
         // Step 4: Finalize
         main_pb.set_message("Step 4/4: Finalizing...");
         main_pb.set_position(4);
 
         run_command("sync", &[], "Sync Filesystem")?;
 
+        if cfg.apt.conffiles == config::ConffilePolicy::Ask {
+            conffiles::resolve(Path::new("/"))?;
+        }
+
+        // Too late to stop a live update; make sure nobody reboots into a kernel without its drivers
+        if let Some((kernel, failures)) = dkms::check(Path::new("/")).filter(|(_, f)| !f.is_empty()) {
+            dkms::report(Path::new("/"), &kernel, &failures);
+            Logger::warn(&format!("Do not reboot into {} yet. Undo the update with: hammer rollback {}", kernel, snap_name));
+            dkms::offer_kernel_hold()?;
+        }
+
+        if !lsms.is_empty() {
+            let policy_after = lsm::capture_policy(Path::new("/"), &lsms);
+            let changes = lsm::diff_policy(&policy_before, &policy_after);
+            lsm::report_changes(&changes);
+            lsm::reload_policy(&lsms, &changes);
+        }
+
+        let diff = packages::diff(&packages_before, &packages::installed_packages(Path::new("/")));
+        tx.set_packages(&diff);
+        if !diff.changed.is_empty() {
+            journal::attach(&snap_name, "changelog", &changelog::collect(Path::new("/"), &diff))?;
+            Logger::info(&format!("Changelog saved. View with: hammer history show {} --changelog", snap_name));
+        }
+        if !diff.is_empty() {
+            let started = Instant::now();
+            if let Err(e) = integrity::record(Path::new("/")) {
+                Logger::warn(&format!("Hash database not recorded: {}", e));
+            }
+            tx.phase("hashes", started);
+        }
+        tx.finish(if diff.is_empty() { "unchanged" } else { "success" })?;
+        telemetry::record_transaction(&tx);
+        if !diff.is_empty() {
+            protect::record(&snap_name)?;
+        }
+
         main_pb.finish_with_message("Update Complete!");
-        Logger::success("System successfully updated.");
+        Logger::success(tr("update.success"));
+        events::emit(events::Event::UpdateStaged, Some(&snap_name));
     } else {
         main_pb.abandon_with_message("Update Failed");
-        Logger::error("APT Upgrade failed.");
+        Logger::error(tr("update.upgrade-failed"));
+        tx.finish("failed")?;
+        telemetry::record_transaction(&tx);
+        events::emit(events::Event::UpdateFailed, Some(&snap_name));
 
-        if Confirm::new().with_prompt("Rollback now?").interact().into_diagnostic()? {
+        if overrides::assume_yes() || Confirm::new().with_prompt(tr("prompt.rollback-now")).interact().into_diagnostic()? {
             // Rollback logic here (complex on live system)
-            Logger::warn("Please run 'hammer rollback' or select snapshot at boot.");
+            Logger::warn(tr("update.rollback-hint"));
         }
     }
 
@@ -116,28 +1182,78 @@ fn handle_update() -> Result<()> {
     Ok(())
 }
 
-fn handle_layer(packages: Vec<String>) -> Result<()> {
-    if packages.is_empty() { return Ok(()); }
+fn handle_history_show(id: String, changelog: bool, sources: bool, env: bool) -> Result<()> {
+    // Partial names work while the snapshot exists; the journal outlives it
+    let id = snapshots::resolve(Some(&id), None).ok().flatten().unwrap_or(id);
+    let tx = journal::load(&id)?;
+
+    Logger::section(&format!("TRANSACTION {}", tx.id));
+    Logger::info(&format!("Kind:     {}", tx.kind));
+    Logger::info(&format!("Started:  {}", tx.started));
+    Logger::info(&format!("Finished: {}", tx.finished.as_deref().unwrap_or("-")));
+    Logger::info(&format!("Result:   {}", tx.result));
+    if let Some(ts) = &tx.mirror_snapshot {
+        Logger::info(&format!("Mirror:   {} (reproduce: hammer update --pin-mirror {})", ts, ts));
+    }
+    Logger::info(&format!("Packages: +{} ~{} -{}", tx.added.len(), tx.changed.len(), tx.removed.len()));
+    for (name, old, new) in &tx.changed {
+        Logger::info(&format!("  {} {} -> {}", name, output::paint(old, Tone::Muted), new));
+    }
+
+    if sources {
+        match journal::read_attachment(&tx.id, "sources") {
+            Some(text) => println!("\n{}", text),
+            None => Logger::info("No apt sources recorded for this transaction."),
+        }
+    }
+    if env {
+        match journal::read_attachment(&tx.id, "env") {
+            Some(text) => println!("\n{}", text),
+            None => Logger::info("No environment recorded for this transaction (staged updates record it)."),
+        }
+    }
+    if let Some(orphans) = journal::read_attachment(&tx.id, "orphans") {
+        Logger::info(&format!("Autoremoved: {}", orphans.lines().count()));
+        for line in orphans.lines() {
+            Logger::info(&format!("  {}", line));
+        }
+    }
+    if let Some(debs) = journal::read_attachment(&tx.id, "debs") {
+        Logger::info("Local packages (sha256):");
+        for line in debs.lines() {
+            Logger::info(&format!("  {}", line));
+        }
+    }
+
+    if changelog {
+        match journal::read_attachment(&tx.id, "changelog") {
+            Some(text) => println!("\n{}", text),
+            None => Logger::info("No changelog recorded for this transaction."),
+        }
+    }
+    Logger::end_section();
+    Ok(())
+}
+
+fn handle_layer(packages: Vec<String>, debs: Vec<layer::LocalDeb>) -> Result<()> {
+    if packages.is_empty() && debs.is_empty() { return Ok(()); }
 
     Logger::section("PACKAGE LAYERING");
-    run_command("mount", &["-o", "remount,rw", "/"], "Remount RW")?;
+    run_change("mount", &["-o", "remount,rw", "/"], "Remount RW")?;
 
     let snap_name = create_snapshot_name("pre-layer");
     let spinner = create_spinner("Safety Snapshot...");
-    btrfs_snapshot_atomic(&snap_name)?;
+    storage::driver()?.snapshot(&snap_name)?;
     spinner.finish_with_message("Snapshot created.");
 
     let mut args = vec!["install", "-y"];
     let pkgs_refs: Vec<&str> = packages.iter().map(|s| s.as_str()).collect();
     args.extend(pkgs_refs);
+    // apt treats absolute paths as local package files
+    let deb_paths: Vec<String> = debs.iter().map(|d| d.path.to_string_lossy().to_string()).collect();
+    args.extend(deb_paths.iter().map(|s| s.as_str()));
 
-    let status = Command::new("apt")
-    .args(&args)
-    .stdin(Stdio::inherit())
-    .stdout(Stdio::inherit())
-    .stderr(Stdio::inherit())
-    .status()
-    .into_diagnostic()?;
+    let status = exec::Exec::new("apt", &args, "Install Packages").changes_system().status()?;
 
     if status.success() {
         run_command("sync", &[], "Sync")?;
@@ -149,79 +1265,427 @@ fn handle_layer(packages: Vec<String>) -> Result<()> {
     Ok(())
 }
 
-fn handle_clean() -> Result<()> {
+/// Empties the apt cache of a top-level deployment, e.g. a staged @update before it is switched to
+fn handle_clean_deployment(deployment: &str) -> Result<()> {
+    use hammer_core::{ensure_root_subvolume, mount_btrfs_root, pool, umount_btrfs_root};
+
+    if !deployment.starts_with('@') || deployment.contains('/') {
+        return Err(HammerError::ConfigError(format!("'{}' is not a top-level deployment like @ or @update", deployment)).into());
+    }
+    Logger::section(&format!("CLEANING {}", deployment));
+    mount_btrfs_root()?;
+    let root = pool::top_level().join(deployment);
+    let checked = if root.exists() { ensure_root_subvolume(&root).map(|_| true) } else { Ok(false) };
+    let freed = match checked {
+        Ok(true) => Some(staged::clean_apt_cache(&root)),
+        _ => None,
+    };
+    umount_btrfs_root()?;
+    checked?;
+    match freed {
+        Some(bytes) => Logger::success(&format!("Cleared {} MiB of apt cache from {}.", bytes / 1024 / 1024, deployment)),
+        None => Logger::info(&format!("No deployment {}.", deployment)),
+    }
+    Logger::end_section();
+    Ok(())
+}
+
+/// Unpinned, unprotected snapshots kept by `hammer clean`
+const CLEAN_KEEP: usize = 3;
+
+/// Snapshots `hammer clean` deletes, oldest first, and the protected rollback target it skips
+pub(crate) fn clean_candidates(cfg: &config::CleanConfig) -> Result<(Vec<String>, Option<protect::Protection>)> {
+    let pinned = state::pinned_snapshots();
+    let protection = protect::protected(cfg);
+    let mut snapshots: Vec<String> = storage::driver()?.list()?
+    .into_iter()
+    .filter(|s| !pinned.contains(s))
+    .filter(|s| protection.as_ref().is_none_or(|p| p.snapshot != *s))
+    .collect();
+    snapshots.truncate(snapshots.len().saturating_sub(CLEAN_KEEP));
+    Ok((snapshots, protection))
+}
+
+fn handle_clean(cfg: &config::CleanConfig) -> Result<()> {
     Logger::section("CLEANING SNAPSHOTS");
-    let snapshots = btrfs_list_atomic_snapshots()?;
+    let (to_delete, protection) = clean_candidates(cfg)?;
+    if let Some(p) = &protection {
+        Logger::info(&format!("Protected: {} (rollback target of the last update; {})", p.snapshot, p.reason));
+    }
 
-    if snapshots.len() <= 3 {
+    if to_delete.is_empty() {
         Logger::info("Nothing to clean.");
     } else {
-        let to_delete = &snapshots[0..(snapshots.len() - 3)];
-        for snap in to_delete {
+        let driver = storage::driver()?;
+        for snap in &to_delete {
             Logger::info(&format!("Deleting {}", snap));
-            btrfs_delete_atomic_snapshot(snap)?;
+            driver.delete(snap)?;
         }
         Logger::success("Cleanup done.");
     }
+
+    let remaining = storage::driver()?.list()?;
+    let freed = boot_assets::gc(&remaining)?;
+    if freed > 0 {
+        Logger::info(&format!("Freed {} MiB of orphaned boot assets on the ESP.", freed / 1024 / 1024));
+    }
     Logger::end_section();
     Ok(())
 }
 
-fn handle_rollback() -> Result<()> {
-    Logger::section("SYSTEM ROLLBACK");
-    let snapshots = btrfs_list_atomic_snapshots()?;
+fn handle_rollback(target: Option<String>, before: Option<String>) -> Result<()> {
+    Logger::section(tr("rollback.title"));
 
-    if snapshots.is_empty() {
-        Logger::error("No snapshots found in @snapshots.");
-        return Ok(());
+    let target = match snapshots::resolve(target.as_deref(), before.as_deref())? {
+        Some(name) => name,
+        None => {
+            let entries = snapshots::load_entries(true)?;
+            match snapshots::pick(tr("prompt.restore-snapshot"), &entries)? {
+                Some(i) => entries[i].name.clone(),
+                None => {
+                    Logger::error(tr("snapshots.none"));
+                    Logger::end_section();
+                    return Ok(());
+                }
+            }
+        }
+    };
+    let target = &target;
+
+    let driver = storage::driver()?;
+    Logger::warn(&tr_fmt("rollback.target", &[target]));
+    match driver {
+        storage::Driver::Btrfs => Logger::warn("To restore: The system will rename current '@' to '@bad-date' and restore snapshot to '@'."),
+        _ => Logger::warn(&format!("To restore: {} will boot the snapshot next time ({} driver, experimental).", target, driver.name())),
+    }
+    Logger::warn(tr("rollback.reboot-required"));
+
+    if overrides::assume_yes() || Confirm::new().with_prompt(tr("prompt.proceed")).interact().into_diagnostic()? {
+        if driver.replaces_root() {
+            // Nothing else keeps the current root around
+            driver.snapshot(&create_snapshot_name("pre-rollback"))?;
+        }
+        let spinner = create_spinner(tr("rollback.running"));
+        let started = Instant::now();
+        // Queued ahead: the rollback carries /var/lib/hammer into the restored root, and an
+        // event queued afterwards would stay behind in the replaced one
+        let queued = telemetry::queue("rollback", "success", 0.0);
+        if let Err(e) = driver.rollback(target) {
+            spinner.finish_and_clear();
+            if queued {
+                telemetry::unqueue_last();
+            }
+            telemetry::record("rollback", "failed", started.elapsed().as_secs_f64());
+            return Err(e);
+        }
+        spinner.finish_with_message(tr("rollback.applied"));
+        telemetry::send();
+
+        Logger::success(tr("rollback.success"));
+        events::emit(events::Event::Switched, Some(target));
+    }
+
+    Logger::end_section();
+    Ok(())
+}
+
+fn handle_diff(
+    from: Option<String>,
+    to: Option<String>,
+    before: Option<String>,
+    security: bool,
+    tracker: bool,
+) -> Result<()> {
+    use hammer_core::{mount_btrfs_root, pool, umount_btrfs_root};
+    use std::io::IsTerminal;
+
+    let from = match snapshots::resolve(from.as_deref(), before.as_deref())? {
+        Some(name) => name,
+        None => {
+            let entries = snapshots::load_entries(false)?;
+            // Scripts and the TUI get the newest snapshot instead of a prompt
+            let picked = if std::io::stdin().is_terminal() {
+                snapshots::pick(tr("prompt.compare-snapshot"), &entries)?
+            } else if entries.is_empty() {
+                None
+            } else {
+                Some(0)
+            };
+            match picked {
+                Some(i) => entries[i].name.clone(),
+                None => {
+                    Logger::error(tr("snapshots.none"));
+                    return Ok(());
+                }
+            }
+        }
+    };
+    let to = snapshots::resolve(to.as_deref(), None)?;
+
+    Logger::section(&format!("PACKAGE DIFF {} -> {}", from, to.as_deref().unwrap_or("current")));
+    mount_btrfs_root()?;
+    let snap_dir = pool::top_level().join("@snapshots");
+    let old = packages::installed_packages(&snap_dir.join(&from));
+    let to_root = match &to {
+        Some(name) => snap_dir.join(name),
+        None => Path::new("/").to_path_buf(),
+    };
+    let new = packages::installed_packages(&to_root);
+    let diff = packages::diff(&old, &new);
+
+    // Changelogs of the newer root are needed while it is still mounted
+    let advisories = if security {
+        let mut found = security::from_changelogs(&to_root, &diff);
+        if tracker {
+            for (pkg, cves) in security::from_tracker(&to_root, &diff)? {
+                found.entry(pkg).or_default().extend(cves);
+            }
+        }
+        Some(found)
+    } else {
+        None
+    };
+    umount_btrfs_root()?;
+
+    print_diff(&diff, advisories);
+    Logger::end_section();
+    Ok(())
+}
+
+fn print_diff(diff: &packages::PackageDiff, advisories: Option<std::collections::BTreeMap<String, std::collections::BTreeSet<String>>>) {
+    if diff.is_empty() {
+        Logger::info("No package changes.");
     }
+    for (name, version) in &diff.added {
+        Logger::info(&format!("{} {} {}", output::paint("+", Tone::Good), name, output::paint(version, Tone::Muted)));
+    }
+    for (name, old_ver, new_ver) in &diff.changed {
+        Logger::info(&format!("{} {} {} -> {}", output::paint("~", Tone::Warn), name, output::paint(old_ver, Tone::Muted), new_ver));
+    }
+    for (name, version) in &diff.removed {
+        Logger::info(&format!("{} {} {}", output::paint("-", Tone::Bad), name, output::paint(version, Tone::Muted)));
+    }
+    Logger::info(&format!("Summary: {}", diff.summary()));
 
-    let selection = Select::new()
-    .with_prompt("Select snapshot to restore")
-    .items(&snapshots)
-    .default(snapshots.len() - 1)
-    .interact()
-    .into_diagnostic()?;
+    if let Some(advisories) = advisories {
+        security::print_report(diff, &advisories);
+    }
+}
 
-    let target = &snapshots[selection];
+/// Package diff from the lists cached by the last root run; works without privileges.
+/// Comparing against the running system reads the live dpkg database, which is world-readable.
+fn handle_diff_cached(from: Option<String>, to: Option<String>, security: bool) -> Result<()> {
+    let from = cache::resolve(from.as_deref())?;
+    let to = to.map(|t| cache::resolve(Some(&t))).transpose()?;
 
-    Logger::warn(&format!("Target: {}", target.yellow()));
-    Logger::warn("To restore: The system will rename current '@' to '@bad-date' and restore snapshot to '@'.");
-    Logger::warn("REBOOT IS REQUIRED IMMEDIATELY AFTER.");
+    Logger::section(&format!("PACKAGE DIFF {} -> {} (cached)", from, to.as_deref().unwrap_or("current")));
+    let missing = |name: &str| HammerError::ConfigError(format!(
+        "No cached package list for {}. Run 'sudo hammer status' to refresh the cache.", name
+    ));
+    let old = cache::read_packages(&from).ok_or_else(|| missing(&from))?;
+    let new = match &to {
+        Some(name) => cache::read_packages(name).ok_or_else(|| missing(name))?,
+        None => packages::installed_packages(Path::new("/")),
+    };
+    let diff = packages::diff(&old, &new);
 
-    if Confirm::new().with_prompt("Proceed?").interact().into_diagnostic()? {
-        use hammer_core::{mount_btrfs_root, umount_btrfs_root, MOUNT_POINT};
-        use std::path::Path;
+    // Changelogs are only readable for the running system
+    let advisories = match (&to, security) {
+        (None, true) => Some(security::from_changelogs(Path::new("/"), &diff)),
+        (Some(_), true) => {
+            Logger::warn("--security needs root when comparing two snapshots; skipping.");
+            None
+        }
+        _ => None,
+    };
+    print_diff(&diff, advisories);
+    Logger::end_section();
+    Ok(())
+}
 
-        let spinner = create_spinner("Performing rollback...");
-        mount_btrfs_root()?;
+fn handle_delete(target: Option<String>, before: Option<String>, force: bool) -> Result<()> {
+    let name = match snapshots::resolve(target.as_deref(), before.as_deref())? {
+        Some(name) => name,
+        None => {
+            let entries = snapshots::load_entries(false)?;
+            match snapshots::pick(tr("prompt.delete-which"), &entries)? {
+                Some(i) => entries[i].name.clone(),
+                None => {
+                    Logger::error(tr("snapshots.none"));
+                    return Ok(());
+                }
+            }
+        }
+    };
 
-        // 1. Rename current @
-        let timestamp = chrono::Local::now().format("%Y%m%d-%H%M%S");
-        let bad_name = format!("@bad-{}", timestamp);
-        let root = Path::new(MOUNT_POINT);
+    if state::is_pinned(&name) {
+        Logger::error(&format!("{} is pinned. Run 'hammer unpin {}' first.", name, name));
+        return Ok(());
+    }
+    if let Some(p) = protect::protected(&config::load()?.clean).filter(|p| p.snapshot == name) {
+        if !force {
+            Logger::error(&format!("{} is the rollback target of the last update ({}). Use --force to delete it anyway.", name, p.reason));
+            return Ok(());
+        }
+        Logger::warn(&format!("{} is the rollback target of the last update; deleting it anyway.", name));
+    }
 
-        run_command("mv", &[
-            &root.join("@").to_string_lossy(),
-                    &root.join(&bad_name).to_string_lossy()
-        ], "Rename current @")?;
+    if overrides::assume_yes() || Confirm::new().with_prompt(tr_fmt("prompt.delete-snapshot", &[&name])).interact().into_diagnostic()? {
+        storage::driver()?.delete(&name)?;
+        Logger::success(&format!("Deleted {}", name));
+    }
+    Ok(())
+}
 
-        // 2. Snapshot target to @
-        let snap_src = root.join("@snapshots").join(target);
-        let new_root = root.join("@");
+fn handle_pin(query: String, pinned: bool) -> Result<()> {
+    let name = match snapshots::resolve(Some(&query), None)? {
+        Some(name) => name,
+        None => return Ok(()),
+    };
+    state::set_pinned(&name, pinned)?;
+    if pinned {
+        Logger::success(&format!("{} pinned. It will never be cleaned.", name));
+    } else {
+        Logger::success(&format!("{} unpinned.", name));
+    }
+    Ok(())
+}
+
+fn handle_alias(action: AliasAction) -> Result<()> {
+    match action {
+        AliasAction::Set { alias, snapshot } => {
+            let valid = alias.chars().all(|c| c.is_ascii_alphanumeric() || "-_.".contains(c));
+            if alias.is_empty() || !valid || alias.starts_with(['-', '.']) {
+                return Err(HammerError::ConfigError(format!("Alias '{}' may only use letters, digits, '-', '_' and '.'", alias)).into());
+            }
+            if storage::driver()?.list()?.contains(&alias) {
+                return Err(HammerError::ConfigError(format!("'{}' is already the name of a snapshot", alias)).into());
+            }
+            let name = match snapshots::resolve(Some(&snapshot), None)? {
+                Some(name) => name,
+                None => return Ok(()),
+            };
+            let previous = state::aliases().get(&alias).cloned();
+            state::set_alias(&alias, Some(&name))?;
+            match previous {
+                Some(old) if old != name => Logger::success(&format!("{} now points to {} (was {}).", alias, name, old)),
+                _ => Logger::success(&format!("{} points to {}.", alias, name)),
+            }
+        }
+        AliasAction::Remove { alias } => {
+            if !state::aliases().contains_key(&alias) {
+                return Err(HammerError::ConfigError(format!("No alias '{}'", alias)).into());
+            }
+            state::set_alias(&alias, None)?;
+            Logger::success(&format!("Alias {} removed.", alias));
+        }
+        AliasAction::List => {
+            let aliases = state::aliases();
+            if aliases.is_empty() {
+                Logger::info("No aliases. Add one with: hammer alias set NAME SNAPSHOT");
+                return Ok(());
+            }
+            // The cache keeps this working without root
+            let existing: Vec<String> = status::load_rows()
+            .map(|(rows, _)| rows.into_iter().map(|r| r.name).collect())
+            .unwrap_or_default();
+            let mut rows = vec![vec!["ALIAS".to_string(), "SNAPSHOT".to_string()]];
+            for (alias, snapshot) in aliases {
+                let shown = if existing.contains(&snapshot) {
+                    snapshot
+                } else {
+                    format!("{} {}", snapshot, output::paint("(missing)", Tone::Bad))
+                };
+                rows.push(vec![alias, shown]);
+            }
+            output::print_table(&rows);
+        }
+    }
+    Ok(())
+}
 
-        run_command("btrfs", &[
-            "subvolume", "snapshot",
-            &snap_src.to_string_lossy(),
-                    &new_root.to_string_lossy()
-        ], "Restore Snapshot to @")?;
+fn handle_swap(action: SwapAction) -> Result<()> {
+    Logger::section("SWAP");
+    match action {
+        SwapAction::Status => {
+            let active = swap::active_swapfiles();
+            if active.is_empty() {
+                Logger::info("No active swapfiles.");
+            }
+            let blocking = swap::blocking_swapfiles();
+            for file in &active {
+                if blocking.contains(file) {
+                    Logger::warn(&format!("{} (inside @, disabled during snapshots)", file));
+                } else {
+                    Logger::info(&format!("{} {}", file, output::paint("(ok)", Tone::Good)));
+                }
+            }
+            if !blocking.is_empty() {
+                Logger::info("Run 'hammer swap relocate' to move it to a dedicated @swap subvolume.");
+            }
+        }
+        SwapAction::Relocate => swap::relocate_swapfiles()?,
+    }
+    Logger::end_section();
+    Ok(())
+}
 
-        umount_btrfs_root()?;
-        spinner.finish_with_message("Rollback applied.");
+fn handle_esp(action: EspAction) -> Result<()> {
+    Logger::section("ESP BOOT ASSETS");
+    let esp = match boot_assets::esp_mount() {
+        Some(esp) => esp,
+        None => {
+            Logger::info("No EFI system partition mounted.");
+            Logger::end_section();
+            return Ok(());
+        }
+    };
 
-        Logger::success("Rollback successful. Please REBOOT now.");
+    match action {
+        EspAction::Status => {
+            let free = boot_assets::free_bytes(&esp)?;
+            Logger::info(&format!("ESP: {} ({} MiB free)", esp.display(), free / 1024 / 1024));
+            if grub_btrfs::enabled() {
+                Logger::info("grub-btrfs mode: snapshots boot with their own /boot, no ESP copies are made.");
+            } else if !boot_assets::enabled() {
+                Logger::info(&format!("Per-snapshot boot assets disabled (create {}/{} to enable).", esp.display(), boot_assets::ASSET_SUBDIR));
+            }
+            let snapshots = storage::driver()?.list()?;
+            for (name, size) in boot_assets::usage() {
+                let marker = if snapshots.contains(&name) { "" } else { " (orphaned)" };
+                Logger::info(&format!("{: <40} {: >6} MiB{}", name, size / 1024 / 1024, output::paint(marker, Tone::Warn)));
+            }
+            let needed = boot_assets::required_bytes();
+            if free < needed {
+                Logger::warn(&format!("Not enough room for the next snapshot ({} MiB needed).", needed / 1024 / 1024));
+            }
+        }
+        EspAction::Gc => {
+            let snapshots = storage::driver()?.list()?;
+            let freed = boot_assets::gc(&snapshots)?;
+            Logger::success(&format!("Freed {} MiB.", freed / 1024 / 1024));
+        }
     }
+    Logger::end_section();
+    Ok(())
+}
 
+fn handle_events(action: EventsAction) -> Result<()> {
+    Logger::section("EVENTS");
+    match action {
+        EventsAction::List => {
+            for event in events::Event::ALL {
+                Logger::info(&format!(
+                    "{: <18} {}/{}.d  {}",
+                    output::paint(event.name(), Tone::Accent), events::HOOKS_DIR, event.name(), event.target()
+                ));
+            }
+        }
+        EventsAction::Install => {
+            events::install_targets()?;
+            Logger::success("Event targets installed. Order units with After=/WantedBy= hammer-<event>.target.");
+        }
+    }
     Logger::end_section();
     Ok(())
 }
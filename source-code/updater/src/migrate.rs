@@ -0,0 +1,118 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::state::{self, STATE_DIR};
+use hammer_core::{btrfs_list_atomic_snapshots, journal, run_change, run_command, HammerError, Logger};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::Path;
+
+const CONFIG_DIR: &str = "/etc/hammer";
+const MANIFEST: &str = "hammer-state.json";
+const FORMAT_VERSION: u32 = 1;
+
+/// Describes a state bundle; stored next to the copied trees
+#[derive(Serialize, Deserialize)]
+struct Manifest {
+    format: u32,
+    hammer_version: String,
+    exported: String,
+    hostname: String,
+    pinned: Vec<String>,
+    transactions: usize,
+}
+
+fn hostname() -> String {
+    fs::read_to_string("/etc/hostname").unwrap_or_default().trim().to_string()
+}
+
+/// Bundles /etc/hammer and /var/lib/hammer into a tarball
+pub fn handle_export(file: &str) -> Result<()> {
+    Logger::section("STATE EXPORT");
+
+    let manifest = Manifest {
+        format: FORMAT_VERSION,
+        hammer_version: env!("CARGO_PKG_VERSION").to_string(),
+        exported: chrono::Local::now().format("%Y-%m-%d %H:%M:%S").to_string(),
+        hostname: hostname(),
+        pinned: state::pinned_snapshots(),
+        transactions: journal::list().len(),
+    };
+    let staging = tempfile::tempdir().into_diagnostic()?;
+    fs::write(
+        staging.path().join(MANIFEST),
+        serde_json::to_string_pretty(&manifest).into_diagnostic()?,
+    ).into_diagnostic()?;
+
+    let staging_dir = staging.path().to_string_lossy().to_string();
+    let mut args = vec!["-czf", file, "-C", &staging_dir, MANIFEST, "-C", "/"];
+    let trees: Vec<&str> = [CONFIG_DIR, STATE_DIR]
+    .into_iter()
+    .filter(|d| Path::new(d).exists())
+    .map(|d| d.trim_start_matches('/'))
+    .collect();
+    args.extend(trees.iter());
+    run_command("tar", &args, "Create State Bundle")?;
+
+    Logger::info(&format!("Config: {}", CONFIG_DIR));
+    Logger::info(&format!("Journal: {} transactions", manifest.transactions));
+    Logger::info(&format!("Pinned: {}", manifest.pinned.len()));
+    Logger::success(&format!("State exported to {}", file));
+    Logger::end_section();
+    Ok(())
+}
+
+/// Copies `src` into `dest`; existing files are only replaced with `overwrite`
+fn merge_tree(src: &Path, dest: &str, overwrite: bool) -> Result<()> {
+    if !src.exists() {
+        return Ok(());
+    }
+    fs::create_dir_all(dest).into_diagnostic()?;
+    let flags = if overwrite { "-a" } else { "-an" };
+    run_change("cp", &[flags, &format!("{}/.", src.display()), dest], "Restore State")?;
+    Ok(())
+}
+
+/// Restores a bundle from `hammer state export`. Journal entries are merged;
+/// config and hooks are only overwritten with `force`.
+pub fn handle_import(file: &str, force: bool) -> Result<()> {
+    Logger::section("STATE IMPORT");
+
+    let staging = tempfile::tempdir().into_diagnostic()?;
+    let staging_dir = staging.path().to_string_lossy().to_string();
+    run_command("tar", &["-xzf", file, "-C", &staging_dir], "Extract State Bundle")?;
+
+    let manifest: Manifest = fs::read_to_string(staging.path().join(MANIFEST))
+    .ok()
+    .and_then(|m| serde_json::from_str(&m).ok())
+    .ok_or_else(|| HammerError::ConfigError(format!("{} is not a hammer state bundle", file)))?;
+    if manifest.format > FORMAT_VERSION {
+        return Err(HammerError::ConfigError(format!(
+            "Bundle format {} is newer than this hammer supports ({})", manifest.format, FORMAT_VERSION
+        )).into());
+    }
+    Logger::info(&format!("Bundle from {} (hammer {}), exported {}", manifest.hostname, manifest.hammer_version, manifest.exported));
+
+    let pins_before = state::pinned_snapshots();
+    merge_tree(&staging.path().join(CONFIG_DIR.trim_start_matches('/')), CONFIG_DIR, force)?;
+    merge_tree(&staging.path().join(STATE_DIR.trim_start_matches('/')), STATE_DIR, false)?;
+
+    // Pins are a set: keep local ones and add the imported ones
+    for pin in pins_before.iter().chain(manifest.pinned.iter()) {
+        state::set_pinned(pin, true)?;
+    }
+    let existing = btrfs_list_atomic_snapshots().unwrap_or_default();
+    let missing: Vec<&String> = manifest.pinned.iter().filter(|p| !existing.contains(p)).collect();
+    if !missing.is_empty() {
+        Logger::warn(&format!(
+            "{} pinned snapshot(s) do not exist on this machine: {}",
+            missing.len(),
+            missing.iter().map(|s| s.as_str()).collect::<Vec<_>>().join(", ")
+        ));
+    }
+
+    if !force {
+        Logger::info("Existing config files were kept (use --force to overwrite them).");
+    }
+    Logger::success(&format!("Imported {} transactions and {} pins.", manifest.transactions, manifest.pinned.len()));
+    Logger::end_section();
+    Ok(())
+}
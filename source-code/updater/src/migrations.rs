@@ -0,0 +1,102 @@
+use miette::Result;
+use hammer_core::exec::Exec;
+use hammer_core::{state, store, HammerError, Logger};
+use std::fs;
+use std::path::Path;
+
+// Packages ship migrations that cannot run inside a chroot (a database that needs its
+// service, a config converted with the new binary, ...) as NNNN-name.sh in
+// MIGRATIONS_DIR. hammer-first-boot.service runs the new ones once, in order, on the
+// first boot of a deployment that brings them. Which ones ran is hammer state, so a
+// rollback carries it over; entries the running deployment does not ship belong to a
+// newer deployment rolled back from and are forgotten, so they run again on the way
+// forward.
+
+pub const MIGRATIONS_DIR: &str = "/usr/lib/HackerOS/hammer/migrations";
+
+/// One line per migration: name, "ok" or "failed", local time
+const RECORD: &str = "migrations";
+
+fn record_path() -> std::path::PathBuf {
+    Path::new(state::STATE_DIR).join(RECORD)
+}
+
+/// Migration scripts the running deployment ships, in the order they run
+fn shipped() -> Vec<String> {
+    let mut names: Vec<String> = fs::read_dir(MIGRATIONS_DIR)
+    .map(|entries| {
+        entries.flatten()
+        .map(|e| e.file_name().to_string_lossy().to_string())
+        .filter(|n| {
+            let (number, rest) = n.split_at(n.find('-').unwrap_or(0));
+            number.len() == 4 && number.chars().all(|c| c.is_ascii_digit()) && rest.ends_with(".sh")
+        })
+        .collect()
+    })
+    .unwrap_or_default();
+    names.sort();
+    names
+}
+
+/// (name, result, time) as recorded
+fn recorded() -> Vec<(String, String, String)> {
+    fs::read_to_string(record_path())
+    .unwrap_or_default()
+    .lines()
+    .filter_map(|l| {
+        let mut fields = l.splitn(3, '\t');
+        Some((fields.next()?.to_string(), fields.next()?.to_string(), fields.next().unwrap_or("").to_string()))
+    })
+    .collect()
+}
+
+fn save(records: &[(String, String, String)]) -> Result<()> {
+    let content: String = records.iter().map(|(n, r, t)| format!("{}\t{}\t{}\n", n, r, t)).collect();
+    store::write(&record_path(), content)
+}
+
+/// Migrations that failed on their last run; they are tried again on the next boot
+pub fn failed() -> Vec<(String, String)> {
+    let shipped = shipped();
+    recorded()
+    .into_iter()
+    .filter(|(name, result, _)| result == "failed" && shipped.contains(name))
+    .map(|(name, _, time)| (name, time))
+    .collect()
+}
+
+/// Runs the migrations that have not run yet. The first failure stops the rest, which
+/// may depend on it; it is retried on the next boot.
+pub fn handle_first_boot() -> Result<()> {
+    let shipped = shipped();
+    let mut records: Vec<(String, String, String)> = recorded()
+    .into_iter()
+    .filter(|(name, _, _)| shipped.contains(name))
+    .collect();
+    let done: Vec<String> = records.iter().filter(|(_, result, _)| result == "ok").map(|(n, _, _)| n.clone()).collect();
+
+    for name in shipped.iter().filter(|n| !done.contains(n)) {
+        Logger::info(&format!("Running migration {}", name));
+        let script = Path::new(MIGRATIONS_DIR).join(name);
+        let status = Exec::new("sh", &[&script.to_string_lossy()], "Run Migration")
+        .env("HAMMER_MIGRATION", name)
+        .changes_system()
+        .status();
+        let ok = matches!(&status, Ok(s) if s.success());
+        records.retain(|(n, _, _)| n != name);
+        records.push((
+            name.clone(),
+            if ok { "ok" } else { "failed" }.to_string(),
+            chrono::Local::now().format("%Y-%m-%d %H:%M:%S").to_string(),
+        ));
+        save(&records)?;
+        if !ok {
+            let reason = status.err().map(|e| format!(": {}", e)).unwrap_or_default();
+            return Err(HammerError::CommandFailed(format!(
+                "Migration {} failed{}; later ones wait until it succeeds on a following boot", name, reason
+            )).into());
+        }
+    }
+    // Forgets migrations of deployments rolled back from
+    save(&records)
+}
@@ -0,0 +1,344 @@
+use miette::{IntoDiagnostic, Result};
+use dialoguer::Confirm;
+use hammer_core::i18n::tr_fmt;
+use hammer_core::config::{Executor, UpdateConfig};
+use hammer_core::output::print_table;
+use hammer_core::{
+    ensure_root_subvolume, mount_btrfs_root, overrides, pool, root_device_uuid, run_change, storage, store, umount_btrfs_root, HammerError, Logger,
+};
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+
+use crate::{boot, composefs, executor, release, snapshots, staged};
+
+// Several operating systems on one Btrfs filesystem, e.g. a stable and a testing HackerOS.
+// The primary one is @ and @snapshots as always, so everything else in hammer works on it
+// unchanged. The others are parked below @os:
+//   @os/primary               name of the OS in @
+//   @os/NAME/root             its root, booted from its own GRUB entry (hammer.os=NAME)
+//   @os/NAME/snapshots        its @snapshots while it is parked
+// Each root keeps its own apt sources and hammer.toml, i.e. its own update stream.
+// `os switch` swaps a parked OS with the primary one; a parked OS is updated that way.
+
+const OS_DIR: &str = "@os";
+
+/// Adds one entry per parked OS to grub.cfg on every update-grub
+const GRUB_SCRIPT: &str = "/etc/grub.d/44_hammer_os";
+
+/// Kernel command line argument naming the parked OS that was booted
+const BOOT_ARG: &str = "hammer.os=";
+
+fn os_dir() -> PathBuf {
+    pool::top_level().join(OS_DIR)
+}
+
+/// The parked OS the running system was booted as, if any
+pub fn parked_boot() -> Option<String> {
+    fs::read_to_string("/proc/cmdline")
+    .ok()?
+    .split_whitespace()
+    .find_map(|arg| arg.strip_prefix(BOOT_ARG).map(String::from))
+}
+
+/// Fails when the running system is a parked OS; hammer would change the primary one
+pub fn ensure_primary() -> Result<()> {
+    match parked_boot() {
+        Some(name) => Err(HammerError::ConfigError(format!(
+            "Running the parked OS '{}'; its deployments are managed after 'hammer os switch {}'", name, name
+        )).into()),
+        None => Ok(()),
+    }
+}
+
+fn check_name(name: &str) -> Result<()> {
+    if name.is_empty() || name == "primary" || !name.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-') {
+        return Err(HammerError::ConfigError(format!("Invalid OS name '{}': use a-z, 0-9 and -", name)).into());
+    }
+    Ok(())
+}
+
+fn os_release(root: &Path, key: &str) -> Option<String> {
+    fs::read_to_string(root.join("etc/os-release"))
+    .ok()?
+    .lines()
+    .find_map(|l| l.strip_prefix(key)?.strip_prefix('='))
+    .map(|v| v.trim_matches('"').to_string())
+}
+
+/// Name of the OS in @: recorded by `os add`/`os switch`, else the ID from its os-release
+fn primary_name() -> String {
+    fs::read_to_string(os_dir().join("primary"))
+    .ok()
+    .map(|n| n.trim().to_string())
+    .filter(|n| !n.is_empty())
+    .or_else(|| os_release(&pool::top_level().join("@"), "ID"))
+    .unwrap_or_else(|| "hackeros".to_string())
+}
+
+/// Parked OS names, sorted
+fn parked() -> Vec<String> {
+    let mut names: Vec<String> = fs::read_dir(os_dir())
+    .map(|entries| {
+        entries.flatten()
+        .filter(|e| e.path().join("root").exists())
+        .map(|e| e.file_name().to_string_lossy().to_string())
+        .collect()
+    })
+    .unwrap_or_default();
+    names.sort();
+    names
+}
+
+/// Points the / and @snapshots mounts in the fstab of `root` at `subvol` and `snapshots`
+fn retarget_fstab(root: &Path, subvol: &str, snapshots: &str) -> Result<()> {
+    let path = root.join("etc/fstab");
+    let Ok(content) = fs::read_to_string(&path) else {
+        return Ok(());
+    };
+    let mut lines = Vec::new();
+    for line in content.lines() {
+        let fields: Vec<&str> = line.split_whitespace().collect();
+        if line.trim_start().starts_with('#') || fields.len() < 4 {
+            lines.push(line.to_string());
+            continue;
+        }
+        let options: Vec<String> = fields[3]
+        .split(',')
+        .map(|o| match o.strip_prefix("subvol=").map(|s| s.trim_start_matches('/')) {
+            Some(_) if fields[1] == "/" => format!("subvol={}", subvol),
+            Some(s) if s == "@snapshots" || s.ends_with("/snapshots") => format!("subvol={}", snapshots),
+            _ => o.to_string(),
+        })
+        .collect();
+        let options = options.join(",");
+        if options == fields[3] {
+            lines.push(line.to_string());
+        } else {
+            let mut fields = fields.clone();
+            fields[3] = &options;
+            lines.push(fields.join("\t"));
+        }
+    }
+    store::write(&path, lines.join("\n") + "\n")
+}
+
+/// The GRUB script for the parked OSes, as seen from the root it is written into
+fn write_grub_script(root: &Path, names: &[String]) -> Result<()> {
+    let script_path = root.join(GRUB_SCRIPT.trim_start_matches('/'));
+    if names.is_empty() {
+        let _ = fs::remove_file(&script_path);
+        return Ok(());
+    }
+    let uuid = root_device_uuid()?;
+    let mut script = String::from("#!/bin/sh\n# Written by hammer for its parked operating systems; see 'hammer os list'.\ncat <<'EOF'\n");
+    for name in names {
+        let subvol = format!("{}/{}/root", OS_DIR, name);
+        let kernel = match composefs::kernel_version(&os_dir().join(name).join("root")) {
+            Ok(kernel) => kernel,
+            Err(e) => {
+                Logger::warn(&format!("No boot entry for {}: {}", name, e));
+                continue;
+            }
+        };
+        let title = os_release(&os_dir().join(name).join("root"), "PRETTY_NAME").unwrap_or_else(|| "HackerOS".to_string());
+        script.push_str(&format!(
+            r#"menuentry '{title} ({name})' --class gnu-linux --id hammer-os-{name} {{
+	insmod btrfs
+	search --no-floppy --fs-uuid --set=root {uuid}
+	linux /{subvol}/boot/vmlinuz-{kernel} root=UUID={uuid} rootflags=subvol={subvol} rw {arg}{name}
+	initrd /{subvol}/boot/initrd.img-{kernel}
+}}
+"#,
+            title = title.replace('\'', ""),
+            name = name,
+            uuid = uuid,
+            subvol = subvol,
+            kernel = kernel,
+            arg = BOOT_ARG
+        ));
+    }
+    script.push_str("EOF\n");
+    if let Some(dir) = script_path.parent() {
+        fs::create_dir_all(dir).into_diagnostic()?;
+    }
+    fs::write(&script_path, script).into_diagnostic()?;
+    fs::set_permissions(&script_path, fs::Permissions::from_mode(0o755)).into_diagnostic()?;
+    Ok(())
+}
+
+fn check_btrfs() -> Result<()> {
+    if !matches!(storage::driver()?, storage::Driver::Btrfs) {
+        return Err(HammerError::ConfigError("Several operating systems need the btrfs storage driver".to_string()).into());
+    }
+    Ok(())
+}
+
+/// Adds a parked OS copied from the running system, a snapshot or any root subvolume;
+/// `suite` moves its apt sources to another Debian suite
+pub fn handle_add(name: &str, from: Option<String>, suite: Option<String>) -> Result<()> {
+    check_name(name)?;
+    ensure_primary()?;
+    check_btrfs()?;
+    Logger::section("ADD OPERATING SYSTEM");
+    // A snapshot name is looked up before the top level is mounted for good
+    let snapshot = match from.as_deref() {
+        None | Some("current") => None,
+        Some(f) if f.starts_with('/') || f.starts_with('@') => None,
+        Some(f) => snapshots::resolve(Some(f), None)?,
+    };
+    mount_btrfs_root()?;
+    let result = add(name, from.as_deref(), snapshot, suite.as_deref());
+    umount_btrfs_root()?;
+    result?;
+    run_change("update-grub", &[], "Update GRUB")?;
+    boot::reconcile();
+    Logger::success(&format!("{} added with its own GRUB entry. Make it the primary OS with: hammer os switch {}", name, name));
+    Logger::end_section();
+    Ok(())
+}
+
+fn add(name: &str, from: Option<&str>, snapshot: Option<String>, suite: Option<&str>) -> Result<()> {
+    let top = pool::top_level();
+    if name == primary_name() || os_dir().join(name).exists() {
+        return Err(HammerError::ConfigError(format!("An OS named '{}' already exists", name)).into());
+    }
+    let source = match (from, snapshot) {
+        (_, Some(snapshot)) => top.join("@snapshots").join(snapshot),
+        (None | Some("current"), None) => top.join("@"),
+        (Some(path), None) if path.starts_with('/') => PathBuf::from(path),
+        (Some(subvolume), None) => top.join(subvolume),
+    };
+    ensure_root_subvolume(&source)?;
+    if !source.join("etc/os-release").exists() {
+        return Err(HammerError::ConfigError(format!("{} is not a root filesystem", source.display())).into());
+    }
+
+    let dir = os_dir().join(name);
+    fs::create_dir_all(&dir).into_diagnostic()?;
+    if !os_dir().join("primary").exists() {
+        store::write(&os_dir().join("primary"), format!("{}\n", primary_name()))?;
+    }
+    let root = dir.join("root");
+    run_change("btrfs", &["subvolume", "snapshot", &source.to_string_lossy(), &root.to_string_lossy()], "Create OS Root")?;
+    run_change("btrfs", &["subvolume", "create", &dir.join("snapshots").to_string_lossy()], "Create OS Snapshots")?;
+
+    let prepared = prepare(name, &root, suite);
+    if prepared.is_err() {
+        let _ = run_change("btrfs", &["subvolume", "delete", &root.to_string_lossy()], "Delete OS Root");
+        let _ = run_change("btrfs", &["subvolume", "delete", &dir.join("snapshots").to_string_lossy()], "Delete OS Snapshots");
+        let _ = fs::remove_dir(&dir);
+    }
+    prepared?;
+    write_grub_script(Path::new("/"), &parked())
+}
+
+fn prepare(name: &str, root: &Path, suite: Option<&str>) -> Result<()> {
+    retarget_fstab(root, &format!("{}/{}/root", OS_DIR, name), &format!("{}/{}/snapshots", OS_DIR, name))?;
+    if let Some(suite) = suite {
+        let from = release::codename(root)
+        .ok_or_else(|| HammerError::ConfigError("No VERSION_CODENAME in its /etc/os-release".into()))?;
+        if release::rewrite_sources(root, &from, suite)? == 0 {
+            return Err(HammerError::ConfigError(format!("No apt source of {} uses {}", name, from)).into());
+        }
+        Logger::info(&format!("{} follows {}; it upgrades to it with its first 'hammer update' as the primary OS.", name, suite));
+    }
+    // A parked OS has no boot entries of its own for the primary one's snapshots
+    let _ = fs::remove_file(root.join(GRUB_SCRIPT.trim_start_matches('/')));
+    Ok(())
+}
+
+/// The primary OS and the parked ones with their release and snapshot count
+pub fn handle_list() -> Result<()> {
+    mount_btrfs_root()?;
+    let top = pool::top_level();
+    let count = |dir: &Path| fs::read_dir(dir).map(|e| e.count()).unwrap_or(0).to_string();
+    let release = |root: &Path| os_release(root, "PRETTY_NAME").unwrap_or_else(|| "-".to_string());
+    let booted = parked_boot();
+
+    let mut rows = vec![vec!["NAME".to_string(), "STATE".to_string(), "RELEASE".to_string(), "SUITE".to_string(), "SNAPSHOTS".to_string()]];
+    let primary = primary_name();
+    rows.push(vec![
+        primary.clone(),
+        if booted.is_none() { "primary, booted".to_string() } else { "primary".to_string() },
+        release(&top.join("@")),
+        release::codename(&top.join("@")).unwrap_or_else(|| "-".to_string()),
+        count(&top.join("@snapshots")),
+    ]);
+    for name in parked() {
+        let dir = os_dir().join(&name);
+        rows.push(vec![
+            name.clone(),
+            if booted.as_deref() == Some(name.as_str()) { "parked, booted".to_string() } else { "parked".to_string() },
+            release(&dir.join("root")),
+            release::codename(&dir.join("root")).unwrap_or_else(|| "-".to_string()),
+            count(&dir.join("snapshots")),
+        ]);
+    }
+    umount_btrfs_root()?;
+    print_table(&rows);
+    Ok(())
+}
+
+/// Makes a parked OS the primary one from the next boot on; the running one is parked
+pub fn handle_switch(cfg: UpdateConfig, name: &str, yes: bool) -> Result<()> {
+    check_btrfs()?;
+    Logger::section("SWITCH OPERATING SYSTEM");
+    mount_btrfs_root()?;
+    let result = switch(cfg, name, yes);
+    umount_btrfs_root()?;
+    result?;
+    Logger::end_section();
+    Ok(())
+}
+
+fn switch(mut cfg: UpdateConfig, name: &str, yes: bool) -> Result<()> {
+    let top = pool::top_level();
+    let dir = os_dir().join(name);
+    if !dir.join("root").exists() {
+        return Err(HammerError::ConfigError(format!("No parked OS '{}'; see 'hammer os list'", name)).into());
+    }
+    if top.join(staged::UPDATE_SUBVOL).exists() {
+        return Err(HammerError::ConfigError("A staged update is waiting in @update; reboot into it or discard it first".into()).into());
+    }
+    ensure_root_subvolume(&top.join("@"))?;
+    ensure_root_subvolume(&dir.join("root"))?;
+    let current = primary_name();
+    if os_dir().join(&current).exists() {
+        return Err(HammerError::ConfigError(format!("@os/{} is in the way of parking the primary OS", current)).into());
+    }
+    Logger::info(&format!("{} (now primary) is parked as @os/{}", current, current));
+    Logger::info(&format!("{} becomes @ and @snapshots on the next boot", name));
+    if !yes && !overrides::assume_yes() && !Confirm::new().with_prompt(tr_fmt("prompt.switch-to", &[&name])).default(false).interact().into_diagnostic()? {
+        return Ok(());
+    }
+
+    let mv = |from: &Path, to: &Path, what: &str| run_change("mv", &[&from.to_string_lossy(), &to.to_string_lossy()], what);
+    let parked_dir = os_dir().join(&current);
+    fs::create_dir_all(&parked_dir).into_diagnostic()?;
+    mv(&top.join("@"), &parked_dir.join("root"), "Park Primary Root")?;
+    if top.join("@snapshots").exists() {
+        mv(&top.join("@snapshots"), &parked_dir.join("snapshots"), "Park Primary Snapshots")?;
+    } else {
+        run_change("btrfs", &["subvolume", "create", &parked_dir.join("snapshots").to_string_lossy()], "Create OS Snapshots")?;
+    }
+    mv(&dir.join("root"), &top.join("@"), "Promote OS Root")?;
+    mv(&dir.join("snapshots"), &top.join("@snapshots"), "Promote OS Snapshots")?;
+    fs::remove_dir(&dir).into_diagnostic()?;
+    store::write(&os_dir().join("primary"), format!("{}\n", name))?;
+
+    retarget_fstab(&parked_dir.join("root"), &format!("{}/{}/root", OS_DIR, current), &format!("{}/{}/snapshots", OS_DIR, current))?;
+    retarget_fstab(&top.join("@"), "@", "@snapshots")?;
+    let _ = fs::remove_file(parked_dir.join("root").join(GRUB_SCRIPT.trim_start_matches('/')));
+    write_grub_script(&top.join("@"), &parked())?;
+
+    // GRUB reads grub.cfg from the new @ from now on; it has to list the parked OSes
+    if cfg.executor == Executor::Live {
+        cfg.executor = Executor::Chroot;
+    }
+    if !executor::run_in_root(&cfg, &top.join("@"), &["update-grub"])? {
+        Logger::warn(&format!("update-grub failed in {}; run it there after the reboot", name));
+    }
+    Logger::success(&format!("{} is the primary OS from the next boot on. {} stays bootable from its own GRUB entry.", name, current));
+    Ok(())
+}
@@ -0,0 +1,67 @@
+use miette::Result;
+use hammer_core::{is_root, Logger};
+use std::process;
+
+use crate::snapshots;
+use crate::status::{self, DeploymentRow};
+
+// Plumbing commands print bare values, one per line, for scripts and shell completion.
+// Their output format is stable; messages only ever go to stderr.
+
+fn rows() -> Result<Vec<DeploymentRow>> {
+    Logger::use_stderr();
+    Ok(status::load_rows()?.0)
+}
+
+/// Exits 1 without output, so `$(hammer current-default)` fails loudly in scripts
+fn not_found(what: &str) -> ! {
+    eprintln!("hammer: no {} found", what);
+    process::exit(1);
+}
+
+/// name<TAB>created<TAB>kind<TAB>state,state per snapshot, oldest first
+pub fn list_snapshots(names_only: bool, kind: Option<String>, pinned: bool) -> Result<()> {
+    let mut rows: Vec<DeploymentRow> = rows()?
+    .into_iter()
+    .filter(|r| r.path.starts_with("@snapshots/"))
+    .filter(|r| kind.as_deref().is_none_or(|k| r.kind == k))
+    .filter(|r| !pinned || r.state.iter().any(|s| s == "pinned"))
+    .collect();
+    rows.sort_by(|a, b| snapshots::parse_created(&a.name).cmp(&snapshots::parse_created(&b.name)).then_with(|| a.name.cmp(&b.name)));
+
+    for row in rows {
+        if names_only {
+            println!("{}", row.name);
+        } else {
+            println!("{}\t{}\t{}\t{}", row.name, row.created.as_deref().unwrap_or("-"), row.kind, row.state.join(","));
+        }
+    }
+    Ok(())
+}
+
+/// The row carrying `state` ("default", "booted"), looked up live as root and in the cache otherwise
+fn find(state: &str, live_id: Option<u64>) -> Result<(u64, String)> {
+    let rows = rows()?;
+    let row = match live_id.filter(|_| is_root()) {
+        Some(id) => rows.into_iter().find(|r| r.id == id),
+        None => rows.into_iter().find(|r| r.state.iter().any(|s| s == state)),
+    };
+    match row {
+        Some(r) => Ok((r.id, r.path)),
+        None => not_found(&format!("{} subvolume", state)),
+    }
+}
+
+/// Subvolume the next boot mounts as /: its path below the top level, or its ID
+pub fn current_default(id: bool) -> Result<()> {
+    let (sub_id, path) = find("default", status::default_subvolume_id())?;
+    println!("{}", if id { sub_id.to_string() } else { path });
+    Ok(())
+}
+
+/// Subvolume the running system was booted from: its path below the top level, or its ID
+pub fn current_booted(id: bool) -> Result<()> {
+    let (sub_id, path) = find("booted", status::booted_subvolume_id())?;
+    println!("{}", if id { sub_id.to_string() } else { path });
+    Ok(())
+}
@@ -0,0 +1,67 @@
+use miette::Result;
+use chrono::{DateTime, Utc};
+use hammer_core::config::CleanConfig;
+use hammer_core::{run_command, store};
+use hammer_core::state::STATE_DIR;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::snapshots;
+
+/// Snapshot of the deployment the last update replaced and the time of the switch.
+/// Lives in STATE_DIR, so staged updates carry it into the new root.
+const SWITCH_FILE: &str = "last-switch";
+
+/// The rollback target `hammer clean` and `hammer delete` leave alone for now
+pub struct Protection {
+    pub snapshot: String,
+    pub reason: String,
+}
+
+pub(crate) fn switch_file() -> PathBuf {
+    Path::new(STATE_DIR).join(SWITCH_FILE)
+}
+
+/// Remembers `snapshot` as the state an update just replaced
+pub fn record(snapshot: &str) -> Result<()> {
+    store::write(&switch_file(), format!("{}\n{}\n", snapshot, snapshots::rfc3339(Utc::now())))
+}
+
+fn last_switch() -> Option<(String, DateTime<Utc>)> {
+    let content = fs::read_to_string(switch_file()).ok()?;
+    let mut lines = content.lines();
+    let snapshot = lines.next()?.trim().to_string();
+    let time = DateTime::parse_from_rfc3339(lines.next()?.trim()).ok()?;
+    Some((snapshot, time.with_timezone(&Utc)))
+}
+
+/// Boots that started after `since`; None without a persistent journal to count them in
+fn boots_since(since: DateTime<Utc>) -> Option<u32> {
+    let out = run_command("journalctl", &["--list-boots", "--output", "json", "--no-pager"], "List Boots").ok()?;
+    let boots: Vec<serde_json::Value> = serde_json::from_str(&out).ok()?;
+    let since = since.timestamp_micros();
+    Some(boots.iter().filter_map(|b| b["first_entry"].as_i64()).filter(|t| *t > since).count() as u32)
+}
+
+/// The snapshot replaced by the last update while it is still in its cool-down:
+/// until `protect_days` have passed and `protect_boots` boots happened, whichever is later
+pub fn protected(cfg: &CleanConfig) -> Option<Protection> {
+    let (snapshot, switched) = last_switch()?;
+    let mut reasons = Vec::new();
+
+    let days = (Utc::now() - switched).num_days();
+    if days < cfg.protect_days as i64 {
+        reasons.push(format!("switched {} day(s) ago, kept for {}", days, cfg.protect_days));
+    }
+    if cfg.protect_boots > 0 {
+        // Without a journal only the days count
+        if let Some(boots) = boots_since(switched).filter(|b| *b < cfg.protect_boots) {
+            reasons.push(format!("{} of {} boot(s) since the switch", boots, cfg.protect_boots));
+        }
+    }
+
+    if reasons.is_empty() {
+        return None;
+    }
+    Some(Protection { snapshot, reason: reasons.join(", ") })
+}
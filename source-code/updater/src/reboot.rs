@@ -0,0 +1,133 @@
+use miette::Result;
+use chrono::{Local, NaiveDateTime, NaiveTime, TimeZone};
+use hammer_core::{is_root, journal, mount_btrfs_root, pool, run_change, run_command, umount_btrfs_root, HammerError, Logger};
+use std::fs;
+use std::path::Path;
+use std::thread;
+use std::time::Duration;
+
+const IDLE_POLL: Duration = Duration::from_secs(60);
+
+/// When to reboot: "now", "idle" or a wall-clock time "HH:MM"
+pub enum RebootWhen {
+    Now,
+    Idle,
+    At(NaiveTime),
+}
+
+pub fn parse_when(value: &str) -> Result<RebootWhen> {
+    match value {
+        "now" => Ok(RebootWhen::Now),
+        "idle" => Ok(RebootWhen::Idle),
+        time => NaiveTime::parse_from_str(time, "%H:%M")
+        .map(RebootWhen::At)
+        .map_err(|_| HammerError::ConfigError(format!("Invalid --when '{}'. Use now, idle or HH:MM.", time)).into()),
+    }
+}
+
+fn boot_time() -> Option<NaiveDateTime> {
+    let stat = fs::read_to_string("/proc/stat").ok()?;
+    let btime: i64 = stat.lines().find_map(|l| l.strip_prefix("btime "))?.trim().parse().ok()?;
+    Local.timestamp_opt(btime, 0).single().map(|t| t.naive_local())
+}
+
+/// Reasons a reboot is needed to activate changes; empty when nothing is pending
+pub fn pending_reasons() -> Result<Vec<String>> {
+    let mut reasons = Vec::new();
+
+    if Path::new("/run/reboot-required").exists() {
+        let pkgs = fs::read_to_string("/run/reboot-required.pkgs").unwrap_or_default();
+        let pkgs: Vec<&str> = pkgs.lines().collect();
+        if pkgs.is_empty() {
+            reasons.push("packages requested a reboot".to_string());
+        } else {
+            reasons.push(format!("packages requested a reboot: {}", pkgs.join(", ")));
+        }
+    }
+
+    // A rollback replaces @ while the old root stays mounted; seeing that needs the top level
+    if is_root() {
+        let booted = run_command("btrfs", &["inspect-internal", "rootid", "/"], "Booted Subvolume")?;
+        mount_btrfs_root()?;
+        let current = run_command(
+            "btrfs",
+            &["inspect-internal", "rootid", &pool::top_level().join("@").to_string_lossy()],
+            "Current @ Subvolume",
+        );
+        umount_btrfs_root()?;
+        if let Ok(current) = current {
+            if current.trim() != booted.trim() {
+                reasons.push("rollback switched @ to another snapshot".to_string());
+            }
+        }
+    }
+
+    if let Some(boot) = boot_time() {
+        for tx in journal::list() {
+            let finished = tx.finished.as_deref().and_then(|f| NaiveDateTime::parse_from_str(f, "%Y-%m-%d %H:%M:%S").ok());
+            if tx.result == "success" && finished.map(|f| f > boot).unwrap_or(false) {
+                reasons.push(format!("{} {} finished after boot", tx.kind, tx.id));
+            }
+        }
+    }
+
+    Ok(reasons)
+}
+
+/// Interactive sessions (local and SSH) that a reboot would interrupt
+fn active_sessions() -> Vec<String> {
+    run_command("who", &[], "List Sessions")
+    .unwrap_or_default()
+    .lines()
+    .map(|l| l.to_string())
+    .filter(|l| !l.trim().is_empty())
+    .collect()
+}
+
+fn wall(message: &str) {
+    let _ = run_change("wall", &[message], "Broadcast Message");
+}
+
+pub fn handle_reboot(when: RebootWhen, force: bool) -> Result<()> {
+    Logger::section("REBOOT");
+
+    let reasons = pending_reasons()?;
+    if reasons.is_empty() && !force {
+        Logger::info("No pending switch or update. Nothing to apply (use --force to reboot anyway).");
+        Logger::end_section();
+        return Ok(());
+    }
+    for reason in &reasons {
+        Logger::info(&format!("Pending: {}", reason));
+    }
+
+    match when {
+        RebootWhen::Now => {
+            wall("hammer: rebooting now to activate the new system state.");
+        }
+        RebootWhen::At(time) => {
+            // shutdown schedules the reboot and warns logged-in users itself
+            let at = time.format("%H:%M").to_string();
+            run_change("shutdown", &["-r", &at, "hammer: rebooting to activate the new system state."], "Schedule Reboot")?;
+            Logger::success(&format!("Reboot scheduled at {}. Cancel with 'shutdown -c'.", at));
+            Logger::end_section();
+            return Ok(());
+        }
+        RebootWhen::Idle => {
+            wall("hammer: a system update is pending. The machine reboots once all sessions have ended.");
+            loop {
+                let sessions = active_sessions();
+                if sessions.is_empty() {
+                    break;
+                }
+                Logger::info(&format!("Waiting for {} session(s) to end...", sessions.len()));
+                thread::sleep(IDLE_POLL);
+            }
+        }
+    }
+
+    Logger::success("Rebooting...");
+    Logger::end_section();
+    run_change("systemctl", &["reboot"], "Reboot")?;
+    Ok(())
+}
@@ -0,0 +1,158 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::i18n::tr;
+use hammer_core::exec::Exec;
+use hammer_core::journal::{self, Transaction};
+use hammer_core::{mount_btrfs_root, overrides, pool, run_change, run_command, storage, umount_btrfs_root, Logger};
+use dialoguer::Confirm;
+use std::fs;
+
+use crate::{autosnap, boot, staged, telemetry};
+
+// What an update, layer or rollback killed half-way (power cut, OOM killer, a closed
+// terminal) leaves behind: its journal entry still "running", mounts of the staged root,
+// a partial @update, dpkg packages left unconfigured by a live update, or, when it died
+// between the two renames of a switch or rollback, no @ at all. `hammer recover` cleans
+// that up; --resume then starts an interrupted update again.
+
+/// Kinds --resume can start again, with the arguments that do it
+const RESUMABLE: &[(&str, &[&str])] = &[("update", &["update"])];
+
+/// Journal entries of transactions whose process is gone; apt runs in progress excluded
+pub fn interrupted() -> Vec<Transaction> {
+    let external = autosnap::external_in_progress();
+    journal::list()
+    .into_iter()
+    .filter(|tx| tx.interrupted() && Some(&tx.id) != external.as_ref())
+    .collect()
+}
+
+/// Where a transaction stopped: after its last recorded phase
+fn stopped_at(tx: &Transaction) -> String {
+    match tx.phases.last() {
+        Some((phase, _)) => format!("after {}", phase),
+        None => "before its first phase".to_string(),
+    }
+}
+
+/// Points at `hammer recover` when an earlier transaction was interrupted
+pub fn warn_interrupted() {
+    for tx in interrupted() {
+        Logger::warn(&format!(
+            "The {} started {} ({}) was interrupted {}. Clean up with: hammer recover",
+            tx.kind, tx.started, tx.id, stopped_at(&tx)
+        ));
+    }
+}
+
+/// Mounts of staged roots that outlived hammer, deepest first
+fn leftover_mounts() -> Vec<String> {
+    let staged = pool::top_level().join(staged::UPDATE_SUBVOL);
+    let staged = staged.to_string_lossy();
+    let mut mounts: Vec<String> = run_command("findmnt", &["-rn", "-o", "TARGET"], "List Mounts")
+    .unwrap_or_default()
+    .lines()
+    .map(|l| l.replace("\\x20", " "))
+    .filter(|m| m.starts_with("/run/hammer/") || m.starts_with(staged.as_ref()))
+    .collect();
+    mounts.sort_by_key(|m| std::cmp::Reverse(m.len()));
+    mounts
+}
+
+/// Repairs the Btrfs layout: @ back in place, no partial @update. Returns what was done.
+fn repair_layout() -> Result<Vec<String>> {
+    let mut done = Vec::new();
+    mount_btrfs_root()?;
+    let top = pool::top_level();
+    if !top.join("@").exists() {
+        // Killed between renaming @ away and putting its replacement in place
+        let mut bad: Vec<String> = fs::read_dir(top)
+        .into_iter()
+        .flatten()
+        .flatten()
+        .map(|e| e.file_name().to_string_lossy().to_string())
+        .filter(|n| n.starts_with("@bad-"))
+        .collect();
+        bad.sort();
+        if let Some(previous) = bad.last() {
+            run_change("mv", &[&top.join(previous).to_string_lossy(), &top.join("@").to_string_lossy()], "Restore @")?;
+            done.push(format!("restored @ from {}, the root before the interrupted switch", previous));
+        } else {
+            Logger::error("There is no @ and no @bad-* to restore it from; see: hammer emergency list");
+        }
+    }
+    let staged = top.join(staged::UPDATE_SUBVOL);
+    if staged.exists() {
+        run_change("btrfs", &["subvolume", "delete", &staged.to_string_lossy()], "Delete Staged Subvolume")?;
+        done.push(format!("deleted the partial {}", staged::UPDATE_SUBVOL));
+    }
+    umount_btrfs_root()?;
+    Ok(done)
+}
+
+pub fn handle_recover(resume: bool, yes: bool) -> Result<()> {
+    Logger::section("RECOVER INTERRUPTED TRANSACTIONS");
+    let interrupted = interrupted();
+    for tx in &interrupted {
+        Logger::warn(&format!("{} {} (started {}) stopped {}", tx.kind, tx.id, tx.started, stopped_at(tx)));
+    }
+    let mounts = leftover_mounts();
+    let dpkg_audit = run_command("dpkg", &["--audit"], "Audit dpkg").unwrap_or_default();
+    if interrupted.is_empty() && mounts.is_empty() && dpkg_audit.trim().is_empty() {
+        Logger::info("No interrupted transaction found; checking the layout anyway.");
+    }
+    if !(yes || overrides::assume_yes() || Confirm::new().with_prompt(tr("prompt.clean-up")).interact().into_diagnostic()?) {
+        Logger::end_section();
+        return Ok(());
+    }
+
+    let mut done = Vec::new();
+    for mount in &mounts {
+        run_change("umount", &["--lazy", mount], "Unmount Leftover")?;
+        done.push(format!("unmounted {}", mount));
+    }
+    let driver = storage::driver()?;
+    match driver {
+        storage::Driver::Btrfs => done.extend(repair_layout()?),
+        _ if driver.supports_staging() && !interrupted.is_empty() => {
+            driver.discard_staged()?;
+            done.push("discarded the staged layer".to_string());
+        }
+        _ => {}
+    }
+    if !dpkg_audit.trim().is_empty() {
+        // A live update stopped inside dpkg; finish configuring what it unpacked
+        run_change("dpkg", &["--configure", "-a"], "Configure Pending Packages")?;
+        done.push("configured the packages dpkg had left half-installed".to_string());
+    }
+    boot::reconcile();
+    for mut tx in interrupted.iter().cloned() {
+        tx.finish("interrupted")?;
+        telemetry::record_transaction(&tx);
+    }
+
+    for line in &done {
+        Logger::success(&format!("Recovered: {}", line));
+    }
+    if done.is_empty() && interrupted.is_empty() {
+        Logger::success("Nothing to recover.");
+    }
+    Logger::end_section();
+
+    if resume {
+        for tx in &interrupted {
+            let Some((_, args)) = RESUMABLE.iter().find(|(kind, _)| *kind == tx.kind) else {
+                Logger::info(&format!("A {} cannot be resumed; run it again if it is still wanted.", tx.kind));
+                continue;
+            };
+            Logger::info(&format!("Resuming the {} interrupted {}", tx.kind, stopped_at(tx)));
+            let exe = std::env::current_exe().into_diagnostic()?.to_string_lossy().to_string();
+            let status = Exec::new(&exe, args, "Resume Transaction").status()?;
+            if !status.success() {
+                std::process::exit(status.code().unwrap_or(1));
+            }
+            // One update brings the system up to date, however many were interrupted
+            break;
+        }
+    }
+    Ok(())
+}
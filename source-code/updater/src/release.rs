@@ -0,0 +1,109 @@
+use miette::{IntoDiagnostic, Result};
+use dialoguer::Confirm;
+use hammer_core::i18n::tr_fmt;
+use hammer_core::config::{Executor, UpdateConfig};
+use hammer_core::{overrides, state, HammerError, Logger};
+use regex::Regex;
+use std::fs;
+use std::path::Path;
+
+use crate::{layer, sources, staged};
+
+pub(crate) fn codename(root: &Path) -> Option<String> {
+    fs::read_to_string(root.join("etc/os-release"))
+    .ok()?
+    .lines()
+    .find_map(|l| l.strip_prefix("VERSION_CODENAME="))
+    .map(|v| v.trim_matches('"').to_string())
+    .filter(|v| !v.is_empty())
+}
+
+/// Replaces the suite name in every apt source of `root` ("bookworm-security" included).
+/// Returns how many files changed.
+pub(crate) fn rewrite_sources(root: &Path, from: &str, to: &str) -> Result<usize> {
+    let re = Regex::new(&format!(r"\b{}\b", regex::escape(from))).into_diagnostic()?;
+    let mut changed = 0;
+    for file in sources::source_files(root) {
+        let content = fs::read_to_string(&file).into_diagnostic()?;
+        let rewritten = re.replace_all(&content, to);
+        if rewritten != content {
+            fs::write(&file, rewritten.as_ref()).into_diagnostic()?;
+            Logger::info(&format!("  {} -> {}: /{}", from, to, file.strip_prefix(root).unwrap_or(&file).display()));
+            changed += 1;
+        }
+    }
+    Ok(changed)
+}
+
+/// Upgrades to another Debian release inside @update: the sources are rewritten there, the
+/// dist-upgrade runs there, and the result is switched to on reboot. The running system and
+/// its sources stay as they are, so `hammer rollback` returns to the old release.
+pub fn handle_release_upgrade(mut cfg: UpdateConfig, to: &str, yes: bool) -> Result<()> {
+    if to.is_empty() || !to.chars().all(|c| c.is_ascii_lowercase()) {
+        return Err(HammerError::ConfigError(format!("'{}' is not a Debian codename (e.g. trixie)", to)).into());
+    }
+    let from = codename(Path::new("/"))
+    .ok_or_else(|| HammerError::ConfigError("No VERSION_CODENAME in /etc/os-release".into()))?;
+    if from == to {
+        return Err(HammerError::ConfigError(format!("Already running {}.", to)).into());
+    }
+
+    Logger::section("RELEASE UPGRADE");
+    Logger::info(&format!("{} -> {}", from, to));
+    Logger::info("1. Snapshot the running system and stage a copy in @update");
+    Logger::info(&format!("2. Rewrite {} to {} in the staged apt sources", from, to));
+    Logger::info("3. apt-get update, upgrade --without-new-pkgs, full-upgrade");
+    Logger::info("4. Switch to the upgraded deployment on the next reboot");
+    let untouched = sources::source_files(Path::new("/"))
+    .into_iter()
+    .filter(|f| !fs::read_to_string(f).unwrap_or_default().contains(&from))
+    .collect::<Vec<_>>();
+    for file in &untouched {
+        Logger::warn(&format!("{} does not mention {} and is left as it is.", file.display(), from));
+    }
+    Logger::end_section();
+
+    if !yes && !overrides::assume_yes() && !Confirm::new().with_prompt(tr_fmt("prompt.upgrade-to", &[&to])).default(false).interact().into_diagnostic()? {
+        return Ok(());
+    }
+
+    // The running system never takes a release upgrade in place
+    if cfg.executor == Executor::Live {
+        cfg.executor = Executor::Chroot;
+    }
+
+    let upgrade_step = |args: &[&'static str]| {
+        let mut step = vec!["apt-get"];
+        step.extend(args);
+        step.push("-y");
+        step
+    };
+    let mut steps = vec![
+        vec!["apt-get", "update"],
+        upgrade_step(&["upgrade", "--without-new-pkgs"]),
+        upgrade_step(&["full-upgrade"]),
+    ];
+    // full-upgrade removes what conflicts with the new release; the layer is asked for again
+    let layered = state::layered_packages();
+    steps.extend(layer::reapply_step(&layered));
+    let (from_ref, to_ref) = (from.as_str(), to);
+    staged::run(&cfg, staged::Plan {
+        title: "STAGED RELEASE UPGRADE",
+        kind: "release-upgrade",
+        steps,
+        prepare: Box::new(move |root| {
+            if rewrite_sources(root, from_ref, to_ref)? == 0 {
+                return Err(HammerError::ConfigError(format!("No apt source uses {}; nothing to upgrade.", from_ref)).into());
+            }
+            Ok(())
+        }),
+        verify: Box::new(move |root| match codename(root) {
+            Some(c) if c == to_ref => Ok(()),
+            other => Err(HammerError::CommandFailed(format!(
+                "The staged system reports {} instead of {}.", other.unwrap_or_else(|| "no release".into()), to_ref
+            )).into()),
+        }),
+        attachments: Vec::new(),
+    })
+    .map(|_| ())
+}
@@ -0,0 +1,141 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::{config, overrides};
+use hammer_core::{journal, mount_btrfs_root, run_change, run_command, umount_btrfs_root, HammerError, Logger, LOG_DIR};
+use regex::Regex;
+use std::fs;
+use std::path::Path;
+
+/// Last lines of hammer.log that go into a report
+const LOG_LINES: usize = 2000;
+
+/// Replaces host-identifying data with placeholders
+struct Sanitizer {
+    rules: Vec<(Regex, String)>,
+}
+
+impl Sanitizer {
+    fn new() -> Self {
+        let mut rules = vec![
+            (Regex::new(r"\b(?:\d{1,3}\.){3}\d{1,3}\b").unwrap(), "<ipv4>".to_string()),
+            // Ahead of the IPv6 rules, which would take a MAC for an address
+            (Regex::new(r"\b(?:[0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}\b").unwrap(), "<mac>".to_string()),
+            // Compressed forms such as fe80::1 and ::1; the separators around them keep
+            // Rust paths like hammer_core::config out
+            (
+                Regex::new(r"(?m)(^|[^\w:])((?:[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{1,4})*::(?:[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{1,4})*)?|::[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{1,4})*))($|[^\w:])").unwrap(),
+                "${1}<ipv6>${3}".to_string(),
+            ),
+            (Regex::new(r"\b(?:[0-9a-fA-F]{1,4}:){3,7}[0-9a-fA-F]{1,4}\b").unwrap(), "<ipv6>".to_string()),
+            (Regex::new(r"/home/[^/\s]+").unwrap(), "/home/<user>".to_string()),
+            (Regex::new(r#"(?i)(\w*(?:token|password|secret)\w*\s*=\s*)"[^"]*""#).unwrap(), r#"$1"<redacted>""#.to_string()),
+            (Regex::new(r"(?i)(https?://)[^/@\s]+@").unwrap(), "$1<credentials>@".to_string()),
+        ];
+        let host = fs::read_to_string("/etc/hostname").unwrap_or_default().trim().to_string();
+        if !host.is_empty() {
+            rules.push((Regex::new(&format!(r"\b{}\b", regex::escape(&host))).unwrap(), "<hostname>".to_string()));
+        }
+        Sanitizer { rules }
+    }
+
+    fn clean(&self, text: &str) -> String {
+        self.rules
+        .iter()
+        .fold(text.to_string(), |acc, (re, replacement)| re.replace_all(&acc, replacement.as_str()).to_string())
+    }
+}
+
+fn command_output(cmd: &str, args: &[&str]) -> String {
+    match run_command(cmd, args, "Collect Report Data") {
+        Ok(out) => out,
+        Err(e) => format!("<{} {} failed: {}>", cmd, args.join(" "), e),
+    }
+}
+
+fn tail(path: &Path, lines: usize) -> String {
+    let content = fs::read_to_string(path).unwrap_or_default();
+    let all: Vec<&str> = content.lines().collect();
+    all[all.len().saturating_sub(lines)..].join("\n")
+}
+
+/// (file name in the bundle, content) for everything the report contains
+fn collect() -> Result<Vec<(String, String)>> {
+    let mut files = vec![
+        ("hammer.log".to_string(), tail(&Path::new(LOG_DIR).join("hammer.log"), LOG_LINES)),
+        ("version.txt".to_string(), format!(
+            "hammer-updater {}\n{}",
+            env!("CARGO_PKG_VERSION"),
+            command_output("uname", &["-srvm"])
+        )),
+        ("os-release.txt".to_string(), fs::read_to_string("/etc/os-release").unwrap_or_default()),
+        ("hammer.toml".to_string(), fs::read_to_string(overrides::config_path()).unwrap_or_default()),
+        ("mounts.txt".to_string(), command_output("findmnt", &["-l", "-o", "TARGET,SOURCE,FSTYPE,OPTIONS"])),
+        ("df.txt".to_string(), command_output("df", &["-h"])),
+        ("btrfs-usage.txt".to_string(), command_output("btrfs", &["filesystem", "usage", "/"])),
+    ];
+
+    // A report is most needed when the layout is broken, so a failed mount is recorded, not fatal
+    match mount_btrfs_root() {
+        Ok(top) => {
+            files.push(("subvolumes.txt".to_string(), command_output("btrfs", &["subvolume", "list", &top])));
+            files.push(("qgroups.txt".to_string(), command_output("btrfs", &["qgroup", "show", &top])));
+            let _ = umount_btrfs_root();
+        }
+        Err(e) => files.push(("subvolumes.txt".to_string(), format!("<cannot mount the btrfs top level: {}>", e))),
+    }
+
+    let transactions = journal::list();
+    files.push(("journal.json".to_string(), serde_json::to_string_pretty(&transactions).into_diagnostic()?));
+    if let Some(failed) = transactions.iter().rev().find(|tx| tx.result == "failed") {
+        files.push(("last-failed.json".to_string(), serde_json::to_string_pretty(failed).into_diagnostic()?));
+        for name in ["sources", "changelog"] {
+            if let Some(text) = journal::read_attachment(&failed.id, name) {
+                files.push((format!("last-failed-{}.txt", name), text));
+            }
+        }
+    }
+    Ok(files)
+}
+
+fn upload(file: &str, url: &str) -> Result<()> {
+    Logger::info(&format!("Uploading to {}...", url));
+    let response = run_change("curl", &["-fsS", "-F", &format!("report=@{}", file), url], "Upload Report")?;
+    Logger::success("Report uploaded.");
+    if !response.trim().is_empty() {
+        Logger::info(&format!("Server response: {}", response.trim()));
+    }
+    Ok(())
+}
+
+/// Writes a sanitized tarball for bug reports; uploads only when asked and configured
+pub fn handle_report(output: Option<String>, do_upload: bool) -> Result<()> {
+    Logger::section("FAILURE REPORT");
+
+    let upload_url = config::load()?.report.upload_url;
+    if do_upload && upload_url.is_none() {
+        return Err(HammerError::ConfigError("--upload needs [report] upload_url in hammer.toml".into()).into());
+    }
+
+    let sanitizer = Sanitizer::new();
+    let staging = tempfile::tempdir().into_diagnostic()?;
+    let dir_name = format!("hammer-report-{}", chrono::Local::now().format("%Y%m%d-%H%M%S"));
+    let dir = staging.path().join(&dir_name);
+    fs::create_dir_all(&dir).into_diagnostic()?;
+
+    let files = collect()?;
+    for (name, content) in &files {
+        fs::write(dir.join(name), sanitizer.clean(content)).into_diagnostic()?;
+    }
+
+    let output = output.unwrap_or_else(|| format!("{}.tar.gz", dir_name));
+    run_command("tar", &["-czf", &output, "-C", &staging.path().to_string_lossy(), &dir_name], "Create Report")?;
+    Logger::info(&format!("{} files collected; hostnames, addresses, user names and secrets were redacted.", files.len()));
+    Logger::success(&format!("Report written to {}", output));
+
+    if do_upload {
+        upload(&output, upload_url.as_deref().unwrap_or_default())?;
+    } else {
+        Logger::info("Review the contents before attaching it to a bug report.");
+    }
+    Logger::end_section();
+    Ok(())
+}
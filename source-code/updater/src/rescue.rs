@@ -0,0 +1,227 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::{ensure_root_subvolume, mount_btrfs_root, pool, root_device_uuid, run_change, run_command, store, umount_btrfs_root, HammerError, Logger};
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+
+use crate::{boot, kernel};
+
+/// Read-only subvolume below the top level holding the rescue kernel, its initrd and
+/// the hammer overlay. GRUB loads it by path from the top level, so a wrong
+/// `btrfs subvolume set-default` or a broken @ does not take it down.
+pub(crate) const RESCUE_SUBVOL: &str = "@rescue";
+
+/// Adds the rescue entry to grub.cfg on every update-grub
+pub(crate) const GRUB_SCRIPT: &str = "/etc/grub.d/42_hammer_rescue";
+
+/// Work directory for the overlay archive
+const OVERLAY_DIR: &str = "/run/hammer/rescue-overlay";
+
+/// Static build of hammer-updater (build.hl); `hammer emergency` works from it
+const STATIC_BINARY: &str = "/usr/lib/HackerOS/hammer/bin/hammer-static";
+
+/// Replaces the initramfs init: the entry boots straight into a shell
+const RESCUE_INIT: &str = r#"#!/bin/sh
+# Init of the hammer rescue entry: sets up the basics and opens a shell.
+mkdir -p /proc /sys /dev /run /mnt
+mount -t proc proc /proc
+mount -t sysfs sysfs /sys
+mount -t devtmpfs devtmpfs /dev
+modprobe btrfs 2>/dev/null
+btrfs device scan >/dev/null 2>&1
+cat /etc/hammer-rescue.txt
+if command -v setsid >/dev/null && command -v cttyhack >/dev/null; then
+    exec setsid cttyhack sh
+fi
+exec sh
+"#;
+
+/// Repairs the default subvolume from the rescue shell
+const RESCUE_TOOL: &str = r#"#!/bin/sh
+# hammer-rescue: inspect and repair which subvolume boots
+top=/mnt/top
+uuid=$(sed -n 's/.*hammer\.rescue=\([^ ]*\).*/\1/p' /proc/cmdline)
+dev=$(findfs "UUID=$uuid" 2>/dev/null || blkid -U "$uuid" 2>/dev/null)
+if [ -z "$dev" ]; then
+    echo "hammer-rescue: no device with UUID $uuid" >&2
+    exit 1
+fi
+mkdir -p "$top"
+grep -q " $top " /proc/mounts || mount -t btrfs -o subvolid=5 "$dev" "$top" || exit 1
+
+case "$1" in
+    list)
+        btrfs subvolume list "$top"
+        echo
+        echo "default: $(btrfs subvolume get-default "$top")"
+        ;;
+    default)
+        [ -n "$2" ] || { echo "usage: hammer-rescue default <ID|@|@snapshots/NAME>" >&2; exit 2; }
+        case "$2" in
+            *[!0-9]*) id=$(btrfs subvolume show "$top/$2" | sed -n 's/^[[:space:]]*Subvolume ID:[[:space:]]*//p') ;;
+            *) id=$2 ;;
+        esac
+        btrfs subvolume set-default "$id" "$top" && echo "Default subvolume is now $id. Reboot with: reboot -f"
+        ;;
+    shell)
+        echo "Top level mounted at $top"
+        ;;
+    *)
+        echo "usage: hammer-rescue list | default <ID|@|@snapshots/NAME> | shell" >&2
+        exit 2
+        ;;
+esac
+"#;
+
+const RESCUE_MOTD: &str = "
+hammer rescue shell
+  hammer-rescue list                   subvolumes and the current default
+  hammer-rescue default @              boot @ again
+  hammer-rescue default @snapshots/N   boot a snapshot
+  hammer emergency rollback NAME       replace @ with a snapshot (static hammer only)
+  reboot -f                            restart
+";
+
+/// Files the initrd has to bring for the rescue tools to work
+const REQUIRED_IN_INITRD: &[&str] = &["bin/btrfs", "bin/sh"];
+
+fn grub_script(uuid: &str) -> String {
+    format!(
+        r#"#!/bin/sh
+# Written by 'hammer rescue prepare'; remove with 'hammer rescue remove'.
+cat <<'EOF'
+menuentry 'hammer rescue shell' --class recovery --id hammer-rescue {{
+	insmod btrfs
+	search --no-floppy --fs-uuid --set=root {uuid}
+	linux /{subvol}/vmlinuz rdinit=/hammer-rescue-init hammer.rescue={uuid}
+	initrd /{subvol}/initrd.img /{subvol}/overlay.cpio
+}}
+EOF
+"#,
+        uuid = uuid,
+        subvol = RESCUE_SUBVOL
+    )
+}
+
+/// True for executables that run without a dynamic loader, i.e. inside any initrd
+fn is_static(path: &Path) -> bool {
+    run_command("file", &["-b", &path.to_string_lossy()], "Inspect Binary")
+    .map(|out| out.contains("statically linked") || out.contains("static-pie"))
+    .unwrap_or(false)
+}
+
+/// Writes the overlay archive that GRUB loads after the initrd
+fn build_overlay(dest: &Path) -> Result<Vec<String>> {
+    let dir = Path::new(OVERLAY_DIR);
+    if dir.exists() {
+        fs::remove_dir_all(dir).into_diagnostic()?;
+    }
+    fs::create_dir_all(dir.join("bin")).into_diagnostic()?;
+    fs::create_dir_all(dir.join("etc")).into_diagnostic()?;
+
+    let mut extras = Vec::new();
+    for (name, content) in [("hammer-rescue-init", RESCUE_INIT), ("bin/hammer-rescue", RESCUE_TOOL)] {
+        let path = dir.join(name);
+        fs::write(&path, content).into_diagnostic()?;
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o755)).into_diagnostic()?;
+    }
+    fs::write(dir.join("etc/hammer-rescue.txt"), RESCUE_MOTD).into_diagnostic()?;
+
+    // Static tools work whatever the initrd was built with
+    let mut candidates = vec![
+        (PathBuf::from("/usr/bin/btrfs.static"), "bin/btrfs"),
+        (PathBuf::from("/bin/btrfs.static"), "bin/btrfs"),
+        (PathBuf::from(STATIC_BINARY), "bin/hammer"),
+    ];
+    if let Ok(exe) = std::env::current_exe() {
+        candidates.push((exe, "bin/hammer"));
+    }
+    for (src, name) in candidates {
+        if src.exists() && is_static(&src) && !dir.join(name).exists() {
+            fs::copy(&src, dir.join(name)).into_diagnostic()?;
+            extras.push(name.to_string());
+        }
+    }
+
+    run_change(
+        "sh",
+        &["-c", "cd \"$1\" && find . | cpio -o -H newc --quiet > \"$2\"", "sh", OVERLAY_DIR, &dest.to_string_lossy()],
+        "Build Rescue Overlay",
+    )?;
+    fs::remove_dir_all(dir).into_diagnostic()?;
+    Ok(extras)
+}
+
+fn delete_subvolume(path: &Path) -> Result<()> {
+    ensure_root_subvolume(path)?;
+    let path = path.to_string_lossy();
+    run_change("btrfs", &["property", "set", "-ts", &path, "ro", "false"], "Unlock Rescue Subvolume")?;
+    run_change("btrfs", &["subvolume", "delete", &path], "Delete Rescue Subvolume")?;
+    Ok(())
+}
+
+/// Creates @rescue with the running kernel and a GRUB entry that boots it into a repair shell
+pub fn handle_prepare(kernel_version: Option<String>) -> Result<()> {
+    Logger::section("PREPARE RESCUE ENTRY");
+    let version = kernel_version.unwrap_or_else(kernel::running_kernel);
+    let vmlinuz = Path::new("/boot").join(format!("vmlinuz-{}", version));
+    let initrd = Path::new("/boot").join(format!("initrd.img-{}", version));
+    if !vmlinuz.exists() || !initrd.exists() {
+        return Err(HammerError::ConfigError(format!("No kernel and initrd for {} in /boot", version)).into());
+    }
+
+    let contents = run_command("lsinitramfs", &[&initrd.to_string_lossy()], "List Initrd").unwrap_or_default();
+    for file in REQUIRED_IN_INITRD {
+        if !contents.lines().any(|l| l.ends_with(file)) {
+            Logger::warn(&format!("{} has no {}; the rescue shell may lack it.", initrd.display(), file));
+        }
+    }
+
+    let uuid = root_device_uuid()?;
+    mount_btrfs_root()?;
+    let result = populate(&vmlinuz, &initrd);
+    umount_btrfs_root()?;
+    let extras = result?;
+
+    store::write_mode(Path::new(GRUB_SCRIPT), grub_script(&uuid), 0o755)?;
+    run_change("update-grub", &[], "Update GRUB")?;
+
+    if !extras.is_empty() {
+        Logger::info(&format!("Static tools added: {}", extras.join(", ")));
+    }
+    Logger::success(&format!("Rescue entry ready with kernel {}. Pick 'hammer rescue shell' in the GRUB menu.", version));
+    Logger::info("Run 'hammer rescue prepare' again after a rollback: the GRUB script lives in @.");
+    Logger::end_section();
+    Ok(())
+}
+
+fn populate(vmlinuz: &Path, initrd: &Path) -> Result<Vec<String>> {
+    let dir = pool::top_level().join(RESCUE_SUBVOL);
+    if dir.exists() {
+        delete_subvolume(&dir)?;
+    }
+    run_change("btrfs", &["subvolume", "create", &dir.to_string_lossy()], "Create Rescue Subvolume")?;
+    fs::copy(vmlinuz, dir.join("vmlinuz")).into_diagnostic()?;
+    fs::copy(initrd, dir.join("initrd.img")).into_diagnostic()?;
+    let extras = build_overlay(&dir.join("overlay.cpio"))?;
+    run_change("btrfs", &["property", "set", "-ts", &dir.to_string_lossy(), "ro", "true"], "Lock Rescue Subvolume")?;
+    Ok(extras)
+}
+
+/// Deletes @rescue and its GRUB entry
+pub fn handle_remove() -> Result<()> {
+    Logger::section("REMOVE RESCUE ENTRY");
+    if Path::new(GRUB_SCRIPT).exists() {
+        fs::remove_file(GRUB_SCRIPT).into_diagnostic()?;
+        run_change("update-grub", &[], "Update GRUB")?;
+        boot::reconcile();
+    }
+    mount_btrfs_root()?;
+    let dir = pool::top_level().join(RESCUE_SUBVOL);
+    let result = if dir.exists() { delete_subvolume(&dir) } else { Ok(()) };
+    umount_btrfs_root()?;
+    result?;
+    Logger::success("Rescue entry removed.");
+    Logger::end_section();
+    Ok(())
+}
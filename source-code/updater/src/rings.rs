@@ -0,0 +1,107 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::{Local, NaiveDate, NaiveDateTime};
+use hammer_core::config::{FleetConfig, Ring};
+use hammer_core::{run_command, HammerError, Logger};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::fs;
+
+use crate::{s3, snapshots};
+
+/// Server manifest, e.g.
+/// {"releases": [{"id": "2025.12", "mirror_snapshot": "20251201T000000Z",
+///   "rings": {"canary": "2025-12-01", "early": "2025-12-04", "broad": "2025-12-10"}}]}
+#[derive(Deserialize)]
+pub struct Manifest {
+    pub releases: Vec<Release>,
+}
+
+#[derive(Deserialize)]
+pub struct Release {
+    pub id: String,
+    /// snapshot.debian.org timestamp the release was tested with
+    pub mirror_snapshot: String,
+    /// Ring name -> date ("2025-12-04") or time ("2025-12-04 18:00") it becomes available
+    pub rings: HashMap<String, String>,
+}
+
+impl Release {
+    fn available_from(&self, ring: Ring) -> Option<NaiveDateTime> {
+        let value = self.rings.get(ring.name())?;
+        snapshots::parse_date_expr(value)
+        .ok()
+        .or_else(|| NaiveDate::parse_from_str(value, "%Y-%m-%d").ok().and_then(|d| d.and_hms_opt(0, 0, 0)))
+    }
+}
+
+fn download(url: &str) -> Result<String> {
+    if s3::is_s3(url) {
+        s3::Client::load()?.get(url)
+    } else {
+        run_command("curl", &["-fsSL", url], "Download Release Manifest")
+    }
+}
+
+/// Checks the detached signature URL.asc of `body` against `keyring`, e.g. the
+/// releases.json.asc hammer-builder index writes
+fn verify(url: &str, body: &str, keyring: &str) -> Result<()> {
+    let signature = download(&format!("{}.asc", url))
+    .map_err(|_| HammerError::ConfigError(format!("Release manifest {} is not signed ({}.asc missing)", url, url)))?;
+    let dir = tempfile::tempdir().into_diagnostic()?;
+    let (data, sig) = (dir.path().join("manifest"), dir.path().join("manifest.asc"));
+    fs::write(&data, body).into_diagnostic()?;
+    fs::write(&sig, signature).into_diagnostic()?;
+    run_command("gpgv", &["--keyring", keyring, &sig.to_string_lossy(), &data.to_string_lossy()], "Verify Release Manifest")
+    .map_err(|_| HammerError::ConfigError(format!("Release manifest {} has no valid signature from {}", url, keyring)))?;
+    Ok(())
+}
+
+pub fn fetch_manifest(url: &str, keyring: Option<&str>) -> Result<Manifest> {
+    let body = download(url)?;
+    if let Some(keyring) = keyring {
+        verify(url, &body, keyring)?;
+    }
+    serde_json::from_str(&body)
+    .into_diagnostic()
+    .map_err(|e| HammerError::ConfigError(format!("Invalid release manifest {}: {}", url, e)).into())
+}
+
+/// Newest release already open to `ring`
+pub fn available_release(manifest: &Manifest, ring: Ring) -> Option<&Release> {
+    let now = Local::now().naive_local();
+    manifest
+    .releases
+    .iter()
+    .filter_map(|r| r.available_from(ring).filter(|from| *from <= now).map(|from| (from, r)))
+    .max_by_key(|(from, _)| *from)
+    .map(|(_, r)| r)
+}
+
+/// What an unattended update should do according to the fleet manifest
+pub enum Rollout {
+    /// No manifest configured: update normally
+    Unmanaged,
+    /// Install the release tested against this mirror snapshot
+    Pin(String),
+    /// Nothing open to this ring yet
+    Wait,
+}
+
+pub fn resolve(fleet: &FleetConfig) -> Result<Rollout> {
+    let url = match &fleet.manifest_url {
+        Some(url) => url,
+        None => return Ok(Rollout::Unmanaged),
+    };
+    let ring = fleet.ring.unwrap_or(Ring::Broad);
+    let manifest = fetch_manifest(url, fleet.keyring.as_deref())?;
+    match available_release(&manifest, ring) {
+        Some(release) => {
+            Logger::info(&format!("Ring {}: release {} ({})", ring.name(), release.id, release.mirror_snapshot));
+            Ok(Rollout::Pin(release.mirror_snapshot.clone()))
+        }
+        None => {
+            Logger::info(&format!("Ring {}: no release available yet.", ring.name()));
+            Ok(Rollout::Wait)
+        }
+    }
+}
@@ -0,0 +1,110 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::config::{self, S3Config};
+use hammer_core::{run_change, run_command, HammerError};
+use std::env;
+use std::fs;
+
+/// `aws s3 cp` uploads at most 10000 parts and sizes them from --expected-size
+const MAX_PARTS: u64 = 10_000;
+
+pub fn is_s3(url: &str) -> bool {
+    url.starts_with("s3://")
+}
+
+/// Object storage through the aws CLI, with the [s3] settings applied
+pub struct Client {
+    cfg: S3Config,
+}
+
+impl Client {
+    /// Reads [s3]; configured credentials are handed to aws via its environment
+    pub fn load() -> Result<Self> {
+        let cfg = config::load()?.s3;
+        if cfg.access_key_id.is_some() != cfg.secret_access_key.is_some() {
+            return Err(HammerError::ConfigError(
+                "[s3] needs both access_key_id and secret_access_key, or neither".into()
+            ).into());
+        }
+        if let (Some(id), Some(secret)) = (&cfg.access_key_id, &cfg.secret_access_key) {
+            env::set_var("AWS_ACCESS_KEY_ID", id);
+            env::set_var("AWS_SECRET_ACCESS_KEY", secret);
+        }
+        if let Some(profile) = &cfg.profile {
+            env::set_var("AWS_PROFILE", profile);
+        }
+        Ok(Client { cfg })
+    }
+
+    fn args(&self, command: &[&str]) -> Vec<String> {
+        let mut args: Vec<String> = vec!["s3".into()];
+        args.extend(command.iter().map(|s| s.to_string()));
+        if let Some(endpoint) = &self.cfg.endpoint_url {
+            args.extend(["--endpoint-url".into(), endpoint.clone()]);
+        }
+        if let Some(region) = &self.cfg.region {
+            args.extend(["--region".into(), region.clone()]);
+        }
+        args.push("--only-show-errors".into());
+        args
+    }
+
+    fn upload_args(&self, src: &str, url: &str) -> Vec<String> {
+        let mut args = self.args(&["cp", src, url]);
+        if let Some(sse) = &self.cfg.sse {
+            args.extend(["--sse".into(), sse.clone()]);
+        }
+        if let Some(key) = &self.cfg.sse_kms_key_id {
+            args.extend(["--sse-kms-key-id".into(), key.clone()]);
+        }
+        args
+    }
+
+    /// Pipeline stage that uploads its stdin to `url` as a multipart upload
+    pub fn upload_stage(&self, url: &str) -> (&'static str, Vec<String>) {
+        let mut args = self.upload_args("-", url);
+        // Streams have no known size; announce the largest one the part size allows
+        let expected = self.cfg.part_size_mib.max(5) * 1024 * 1024 * MAX_PARTS;
+        args.extend(["--expected-size".into(), expected.to_string()]);
+        ("aws", args)
+    }
+
+    /// Pipeline stage that writes the object at `url` to stdout
+    pub fn download_stage(&self, url: &str) -> (&'static str, Vec<String>) {
+        ("aws", self.args(&["cp", url, "-"]))
+    }
+
+    /// Object names directly below `prefix_url`
+    pub fn list(&self, prefix_url: &str) -> Result<Vec<String>> {
+        let prefix = format!("{}/", prefix_url.trim_end_matches('/'));
+        let out = run_command("aws", &as_refs(&self.args(&["ls", &prefix])), "List S3 Objects")?;
+        // "2025-11-30 20:13:00  1234 name"; "PRE dir/" lines are prefixes, not objects
+        Ok(out
+        .lines()
+        .filter(|l| !l.trim_start().starts_with("PRE "))
+        .filter_map(|l| l.split_whitespace().nth(3))
+        .map(|s| s.to_string())
+        .collect())
+    }
+
+    pub fn delete(&self, url: &str) -> Result<()> {
+        run_change("aws", &as_refs(&self.args(&["rm", url])), "Delete S3 Object")?;
+        Ok(())
+    }
+
+    /// Small text objects such as manifests and checksums
+    pub fn get(&self, url: &str) -> Result<String> {
+        run_command("aws", &as_refs(&self.args(&["cp", url, "-"])), "Download S3 Object")
+    }
+
+    pub fn put(&self, url: &str, content: &str) -> Result<()> {
+        let file = tempfile::NamedTempFile::new().into_diagnostic()?;
+        fs::write(file.path(), content).into_diagnostic()?;
+        let args = self.upload_args(&file.path().to_string_lossy(), url);
+        run_change("aws", &as_refs(&args), "Upload S3 Object")?;
+        Ok(())
+    }
+}
+
+fn as_refs(args: &[String]) -> Vec<&str> {
+    args.iter().map(|s| s.as_str()).collect()
+}
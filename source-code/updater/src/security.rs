@@ -0,0 +1,121 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::packages::PackageDiff;
+use hammer_core::output::{self, Tone};
+use hammer_core::{run_command, Logger};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::Path;
+
+use crate::changelog;
+
+const TRACKER_URL: &str = "https://security-tracker.debian.org/tracker/data/json";
+const TRACKER_CACHE: &str = "/var/cache/hammer/security-tracker.json";
+
+/// Extracts "CVE-2024-12345" style identifiers from free text
+fn find_cves(text: &str) -> BTreeSet<String> {
+    let mut cves = BTreeSet::new();
+    let mut rest = text;
+    while let Some(pos) = rest.find("CVE-") {
+        let candidate: String = rest[pos..]
+        .chars()
+        .take_while(|c| c.is_ascii_alphanumeric() || *c == '-')
+        .collect();
+        let parts: Vec<&str> = candidate.split('-').collect();
+        if parts.len() >= 3 && parts[1].len() == 4 && parts[2].len() >= 4
+        && parts[1].chars().all(|c| c.is_ascii_digit())
+        && parts[2].chars().all(|c| c.is_ascii_digit())
+        {
+            cves.insert(format!("CVE-{}-{}", parts[1], parts[2]));
+        }
+        rest = &rest[pos + 4..];
+    }
+    cves
+}
+
+/// CVEs mentioned in the changelog entries between the old and new version (offline)
+pub fn from_changelogs(root: &Path, diff: &PackageDiff) -> BTreeMap<String, BTreeSet<String>> {
+    diff.changed
+    .iter()
+    .map(|(name, old, _)| (name.clone(), find_cves(&changelog::changelog_since(root, name, old))))
+    .filter(|(_, cves)| !cves.is_empty())
+    .collect()
+}
+
+fn version_lt(a: &str, b: &str) -> bool {
+    run_command("dpkg", &["--compare-versions", a, "lt", b], "Compare Versions").is_ok()
+}
+
+fn release_codename() -> String {
+    fs::read_to_string("/etc/os-release")
+    .unwrap_or_default()
+    .lines()
+    .find_map(|l| l.strip_prefix("VERSION_CODENAME=").map(|v| v.trim_matches('"').to_string()))
+    .unwrap_or_else(|| "stable".to_string())
+}
+
+fn source_package(root: &Path, package: &str) -> String {
+    let admindir = root.join("var/lib/dpkg");
+    run_command(
+        "dpkg-query",
+        &["--admindir", &admindir.to_string_lossy(), "-W", "-f", "${source:Package}", package],
+        "Query Source Package",
+    )
+    .map(|s| s.trim().to_string())
+    .ok()
+    .filter(|s| !s.is_empty())
+    .unwrap_or_else(|| package.to_string())
+}
+
+/// CVEs whose fixed version lies in (old, new] according to the Debian Security Tracker
+pub fn from_tracker(root: &Path, diff: &PackageDiff) -> Result<BTreeMap<String, BTreeSet<String>>> {
+    if let Some(dir) = Path::new(TRACKER_CACHE).parent() {
+        fs::create_dir_all(dir).into_diagnostic()?;
+    }
+    Logger::info("Downloading Debian Security Tracker data...");
+    run_command("curl", &["-fsSL", "-o", TRACKER_CACHE, TRACKER_URL], "Download Security Tracker")?;
+
+    let data: serde_json::Value = serde_json::from_str(&fs::read_to_string(TRACKER_CACHE).into_diagnostic()?).into_diagnostic()?;
+    let codename = release_codename();
+
+    let mut result = BTreeMap::new();
+    for (name, old, new) in &diff.changed {
+        let source = source_package(root, name);
+        let cves = match data.get(&source).and_then(|v| v.as_object()) {
+            Some(c) => c,
+            None => continue,
+        };
+        let mut fixed = BTreeSet::new();
+        for (cve, info) in cves {
+            let release = &info["releases"][&codename];
+            if release["status"] != "resolved" {
+                continue;
+            }
+            if let Some(fixed_version) = release["fixed_version"].as_str() {
+                if version_lt(old, fixed_version) && !version_lt(new, fixed_version) {
+                    fixed.insert(cve.clone());
+                }
+            }
+        }
+        if !fixed.is_empty() {
+            result.insert(name.clone(), fixed);
+        }
+    }
+    Ok(result)
+}
+
+pub fn print_report(diff: &PackageDiff, advisories: &BTreeMap<String, BTreeSet<String>>) {
+    let total: usize = advisories.values().map(|c| c.len()).sum();
+    if total == 0 {
+        Logger::info("No fixed CVEs found for the changed packages.");
+        return;
+    }
+    Logger::warn(&format!("{} CVE(s) fixed in {} package(s). Reboot soon to apply them.", total, advisories.len()));
+    for (name, old, new) in &diff.changed {
+        if let Some(cves) = advisories.get(name) {
+            Logger::info(&format!("{} {} -> {}", output::paint(name, Tone::Strong), output::paint(old, Tone::Muted), new));
+            for cve in cves {
+                Logger::info(&format!("    {}", output::paint(cve, Tone::Bad)));
+            }
+        }
+    }
+}
@@ -0,0 +1,181 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::config::UpdateConfig;
+use hammer_core::output::print_table;
+use hammer_core::{is_root, run_command, HammerError, Logger};
+use std::collections::HashMap;
+use std::fs;
+use std::path::Path;
+
+use crate::{sources, status};
+
+/// Copy of the apt lists that a simulation refreshes, so the system's own stay as they are
+const LISTS_DIR: &str = "/run/hammer/simulate-lists";
+
+/// Where apt keeps downloaded packages; those need no download
+const ARCHIVES_DIR: &str = "/var/cache/apt/archives";
+
+pub(crate) struct Change {
+    /// "upgrade", "install" or "remove"
+    pub action: &'static str,
+    pub name: String,
+    /// "-" when the package is new
+    pub old: String,
+    /// "-" when the package is removed
+    pub new: String,
+}
+
+/// The Inst and Remv lines of `apt-get -s` output, in apt's order
+pub(crate) fn parse(out: &str) -> Vec<Change> {
+    // "Inst libc6 [2.36-9] (2.36-9+deb12u4 Debian:12.5/stable [amd64])"; new packages have no [old]
+    // "Remv libfoo1 [1.2-3]"
+    out.lines()
+    .filter_map(|line| {
+        let (removing, rest) = match line.strip_prefix("Inst ") {
+            Some(rest) => (false, rest),
+            None => (true, line.strip_prefix("Remv ")?),
+        };
+        let mut parts = rest.split_whitespace();
+        let name = parts.next()?.to_string();
+        let next = parts.next();
+        let old = next.and_then(|p| p.strip_prefix('[')).map(|v| v.trim_end_matches(']').to_string());
+        if removing {
+            return Some(Change { action: "remove", name, old: old.unwrap_or_else(|| "-".to_string()), new: "-".to_string() });
+        }
+        let new = if old.is_some() { parts.next()? } else { next? };
+        Some(Change {
+            action: if old.is_some() { "upgrade" } else { "install" },
+            name,
+            old: old.unwrap_or_else(|| "-".to_string()),
+            new: new.trim_start_matches('(').to_string(),
+        })
+    })
+    .collect()
+}
+
+/// (Size, Installed-Size in KiB) of package=version, from the lists `options` select
+fn sizes(changes: &[Change], options: &[String]) -> HashMap<String, (u64, u64)> {
+    let wanted: Vec<String> = changes.iter().filter(|c| c.new != "-").map(|c| format!("{}={}", c.name, c.new)).collect();
+    if wanted.is_empty() {
+        return HashMap::new();
+    }
+    let mut args: Vec<&str> = options.iter().map(|o| o.as_str()).collect();
+    args.extend(["show", "--no-all-versions"]);
+    args.extend(wanted.iter().map(|w| w.as_str()));
+    let out = run_command("apt-cache", &args, "Read Package Sizes").unwrap_or_default();
+
+    let mut sizes = HashMap::new();
+    for stanza in out.split("\n\n") {
+        let field = |key: &str| stanza.lines().find_map(|l| l.strip_prefix(key)).map(|v| v.trim().to_string());
+        if let (Some(name), Some(size)) = (field("Package:"), field("Size:").and_then(|s| s.parse().ok())) {
+            let installed = field("Installed-Size:").and_then(|s| s.parse().ok()).unwrap_or(0);
+            sizes.insert(name, (size, installed));
+        }
+    }
+    sizes
+}
+
+/// Installed-Size in KiB of an installed package
+fn installed_size(name: &str) -> u64 {
+    run_command("dpkg-query", &["-W", "-f", "${Installed-Size}", name], "Query Installed Size")
+    .ok()
+    .and_then(|s| s.trim().parse().ok())
+    .unwrap_or(0)
+}
+
+/// Whether package_version is already in apt's cache
+fn cached(change: &Change) -> bool {
+    let name = change.name.split(':').next().unwrap_or(&change.name);
+    let prefix = format!("{}_{}_", name, change.new.replace(':', "%3a"));
+    fs::read_dir(ARCHIVES_DIR)
+    .map(|entries| entries.flatten().any(|e| e.file_name().to_string_lossy().starts_with(&prefix)))
+    .unwrap_or(false)
+}
+
+/// Runs the upgrade step of `hammer update` with apt-get -s and reports the transaction
+/// it would perform. Nothing is installed and no snapshot or subvolume is created.
+pub fn handle_simulate(cfg: &UpdateConfig) -> Result<()> {
+    Logger::section("UPDATE SIMULATION");
+    let mut options = vec!["-o".to_string(), "Debug::NoLocking=1".to_string()];
+    options.extend(cfg.apt.options.iter().flat_map(|o| ["-o".to_string(), o.clone()]));
+    let pinned = cfg.pin_mirror.as_deref().map(sources::parse_timestamp).transpose()?;
+    if pinned.is_some() && !is_root() {
+        return Err(HammerError::ConfigError("Simulating a pinned mirror needs root".to_string()).into());
+    }
+
+    let result = if is_root() {
+        refresh(pinned.as_deref(), &mut options).and_then(|_| simulate(cfg, &options))
+    } else {
+        Logger::info("Using the package lists as they are; as root they are refreshed first.");
+        simulate(cfg, &options)
+    };
+    if pinned.is_some() {
+        sources::release(Path::new("/"));
+    }
+    let _ = fs::remove_dir_all(LISTS_DIR);
+    Logger::end_section();
+    result
+}
+
+/// Fetches current package lists into LISTS_DIR, starting from a copy of the system's
+fn refresh(pinned: Option<&str>, options: &mut Vec<String>) -> Result<()> {
+    let _ = fs::remove_dir_all(LISTS_DIR);
+    fs::create_dir_all(Path::new(LISTS_DIR).join("partial")).into_diagnostic()?;
+    run_command("cp", &["-a", "/var/lib/apt/lists/.", LISTS_DIR], "Copy Package Lists")?;
+    let _ = fs::remove_file(Path::new(LISTS_DIR).join("lock"));
+    options.extend(["-o".to_string(), format!("Dir::State::Lists={}", LISTS_DIR)]);
+    if let Some(ts) = pinned {
+        options.extend(sources::pin(Path::new("/"), ts)?);
+    }
+
+    let mut args: Vec<&str> = options.iter().map(|o| o.as_str()).collect();
+    args.extend(["update", "-q"]);
+    run_command("apt-get", &args, "Refresh Package Lists")?;
+    Ok(())
+}
+
+fn simulate(cfg: &UpdateConfig, options: &[String]) -> Result<()> {
+    let mut args: Vec<&str> = options.iter().map(|o| o.as_str()).collect();
+    args.push("-s");
+    args.extend(cfg.upgrade_args());
+    let changes = parse(&run_command("apt-get", &args, "Simulate Upgrade")?);
+    if changes.is_empty() {
+        Logger::success("Nothing to do: the system is up to date.");
+        return Ok(());
+    }
+
+    let sizes = sizes(&changes, options);
+    let mut rows = vec![vec!["ACTION".to_string(), "PACKAGE".to_string(), "FROM".to_string(), "TO".to_string(), "DOWNLOAD".to_string()]];
+    let (mut download, mut growth) = (0u64, 0i64);
+    for change in &changes {
+        let short = change.name.split(':').next().unwrap_or(&change.name);
+        let (size, installed) = sizes.get(short).copied().unwrap_or((0, 0));
+        let fetch = if change.new == "-" || cached(change) { 0 } else { size };
+        download += fetch;
+        growth += installed as i64;
+        if change.old != "-" {
+            growth -= installed_size(&change.name) as i64;
+        }
+        rows.push(vec![
+            change.action.to_string(),
+            change.name.clone(),
+            change.old.clone(),
+            change.new.clone(),
+            if change.new == "-" { "-".to_string() } else { status::human_size(Some(fetch)) },
+        ]);
+    }
+    print_table(&rows);
+
+    let count = |action: &str| changes.iter().filter(|c| c.action == action).count();
+    println!();
+    Logger::info(&format!(
+        "{} upgraded, {} newly installed, {} removed ({}).",
+        count("upgrade"), count("install"), count("remove"), cfg.upgrade_args()[0]
+    ));
+    Logger::info(&format!(
+        "Download: {}. Disk: {}{} after installation.",
+        status::human_size(Some(download)),
+        if growth < 0 { "-" } else { "+" },
+        status::human_size(Some(growth.unsigned_abs() * 1024))
+    ));
+    Ok(())
+}
@@ -0,0 +1,231 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::{NaiveDateTime, TimeZone, Utc};
+use hammer_core::{
+    btrfs_list_atomic_snapshots, mount_btrfs_root, pool, run_change, state, umount_btrfs_root, HammerError, Logger,
+};
+use regex::Regex;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::snapshots;
+
+/// snapper writes info.xml dates in UTC with this format
+const DATE_FORMAT: &str = "%Y-%m-%d %H:%M:%S";
+
+/// userdata key that marks snapper entries created from hammer snapshots
+const ORIGIN_KEY: &str = "hammer";
+
+/// Kind of hammer snapshots adopted from snapper, followed by the snapper number
+const IMPORT_KIND: &str = "snapper";
+
+/// One numbered snapshot of a snapper config, as described by its info.xml
+struct Info {
+    num: u32,
+    kind: String,
+    date: Option<NaiveDateTime>,
+    description: String,
+    userdata: Vec<(String, String)>,
+}
+
+impl Info {
+    fn userdata(&self, key: &str) -> Option<&str> {
+        self.userdata.iter().find(|(k, _)| k == key).map(|(_, v)| v.as_str())
+    }
+}
+
+fn unescape(text: &str) -> String {
+    text.replace("&lt;", "<")
+    .replace("&gt;", ">")
+    .replace("&quot;", "\"")
+    .replace("&apos;", "'")
+    .replace("&amp;", "&")
+}
+
+fn escape(text: &str) -> String {
+    text.replace('&', "&amp;").replace('<', "&lt;").replace('>', "&gt;")
+}
+
+fn tag(xml: &str, name: &str) -> Option<String> {
+    let re = Regex::new(&format!(r"(?s)<{0}>(.*?)</{0}>", name)).unwrap();
+    re.captures(xml).map(|c| unescape(c[1].trim()))
+}
+
+fn parse_info(xml: &str) -> Option<Info> {
+    let userdata_re = Regex::new(r"(?s)<userdata>\s*<key>(.*?)</key>\s*<value>(.*?)</value>\s*</userdata>").unwrap();
+    Some(Info {
+        num: tag(xml, "num")?.parse().ok()?,
+        kind: tag(xml, "type").unwrap_or_else(|| "single".to_string()),
+        date: tag(xml, "date").and_then(|d| NaiveDateTime::parse_from_str(&d, DATE_FORMAT).ok()),
+        description: tag(xml, "description").unwrap_or_default(),
+        userdata: userdata_re
+        .captures_iter(xml)
+        .map(|c| (unescape(c[1].trim()), unescape(c[2].trim())))
+        .collect(),
+    })
+}
+
+fn render_info(info: &Info) -> String {
+    let mut xml = String::from("<?xml version=\"1.0\"?>\n<snapshot>\n");
+    xml.push_str(&format!("  <type>{}</type>\n", info.kind));
+    xml.push_str(&format!("  <num>{}</num>\n", info.num));
+    if let Some(date) = info.date {
+        xml.push_str(&format!("  <date>{}</date>\n", date.format(DATE_FORMAT)));
+    }
+    xml.push_str(&format!("  <description>{}</description>\n", escape(&info.description)));
+    for (key, value) in &info.userdata {
+        xml.push_str(&format!(
+            "  <userdata>\n    <key>{}</key>\n    <value>{}</value>\n  </userdata>\n",
+            escape(key), escape(value)
+        ));
+    }
+    xml.push_str("</snapshot>\n");
+    xml
+}
+
+/// Numbered snapshots under a snapper .snapshots directory, oldest first.
+/// Number 0 is snapper's placeholder for the live system and never has a subvolume.
+fn read_layout(dir: &Path) -> Result<Vec<Info>> {
+    let entries = fs::read_dir(dir)
+    .map_err(|e| HammerError::IoError(format!("Cannot read {}: {}", dir.display(), e)))?;
+
+    let mut infos: Vec<Info> = entries
+    .flatten()
+    .filter_map(|e| fs::read_to_string(e.path().join("info.xml")).ok())
+    .filter_map(|xml| parse_info(&xml))
+    .filter(|info| info.num > 0 && dir.join(info.num.to_string()).join("snapshot").exists())
+    .collect();
+    infos.sort_by_key(|i| i.num);
+    Ok(infos)
+}
+
+/// Adopts snapper snapshots as hammer snapshots in @snapshots
+pub fn handle_import(dir: &str, dry_run: bool) -> Result<()> {
+    Logger::section("MIGRATE FROM SNAPPER");
+    let dir = Path::new(dir);
+    let infos = read_layout(dir)?;
+    let existing = btrfs_list_atomic_snapshots()?;
+
+    let mut plan: Vec<(&Info, String)> = Vec::new();
+    for info in &infos {
+        if let Some(origin) = info.userdata(ORIGIN_KEY) {
+            Logger::info(&format!("#{} is hammer snapshot {}, skipped", info.num, origin));
+            continue;
+        }
+        let date = info.date.map(|d| Utc.from_utc_datetime(&d)).unwrap_or_else(Utc::now);
+        let name = snapshots::name_at(date, &format!("{}-{}", IMPORT_KIND, info.num));
+        if existing.contains(&name) {
+            Logger::info(&format!("#{} already imported as {}", info.num, name));
+            continue;
+        }
+        plan.push((info, name));
+    }
+
+    if plan.is_empty() {
+        Logger::success("Nothing to import.");
+        Logger::end_section();
+        return Ok(());
+    }
+    for (info, name) in &plan {
+        Logger::info(&format!("#{} ({}, \"{}\") -> {}", info.num, info.kind, info.description, name));
+    }
+    if dry_run {
+        Logger::info(&format!("Dry run: {} snapshots would be imported.", plan.len()));
+        Logger::end_section();
+        return Ok(());
+    }
+
+    mount_btrfs_root()?;
+    let snap_dir = pool::top_level().join("@snapshots");
+    let result = (|| -> Result<()> {
+        fs::create_dir_all(&snap_dir).into_diagnostic()?;
+        for (info, name) in &plan {
+            let src = dir.join(info.num.to_string()).join("snapshot");
+            let dest = snap_dir.join(name);
+            // Writable copy: hammer rolls back by booting snapshots directly
+            run_change(
+                "btrfs",
+                &["subvolume", "snapshot", &src.to_string_lossy(), &dest.to_string_lossy()],
+                "Import Snapshot",
+            )?;
+            if info.userdata("important") == Some("yes") {
+                state::set_pinned(name, true)?;
+            }
+        }
+        Ok(())
+    })();
+    umount_btrfs_root()?;
+    result?;
+
+    Logger::success(&format!("Imported {} snapshots. Snapper's copies are untouched.", plan.len()));
+    Logger::info("Snapshots marked important in snapper were pinned.");
+    Logger::end_section();
+    Ok(())
+}
+
+/// Publishes hammer snapshots as numbered snapper snapshots
+pub fn handle_export(dir: &str, dry_run: bool) -> Result<()> {
+    Logger::section("MIGRATE TO SNAPPER");
+    let dir = PathBuf::from(dir);
+    if !dir.exists() {
+        return Err(HammerError::ConfigError(format!(
+            "{} does not exist. Create the snapper config first ('snapper -c root create-config /').",
+            dir.display()
+        )).into());
+    }
+    let infos = read_layout(&dir)?;
+    let exported: Vec<&str> = infos.iter().filter_map(|i| i.userdata(ORIGIN_KEY)).collect();
+    let mut next = infos.iter().map(|i| i.num).max().unwrap_or(0) + 1;
+
+    let plan: Vec<String> = btrfs_list_atomic_snapshots()?
+    .into_iter()
+    .filter(|name| !exported.contains(&name.as_str()))
+    .filter(|name| !snapshots::kind_of(name).starts_with(IMPORT_KIND))
+    .collect();
+
+    if plan.is_empty() {
+        Logger::success("Nothing to export.");
+        Logger::end_section();
+        return Ok(());
+    }
+    for (i, name) in plan.iter().enumerate() {
+        Logger::info(&format!("{} -> #{}", name, next + i as u32));
+    }
+    if dry_run {
+        Logger::info(&format!("Dry run: {} snapshots would be exported.", plan.len()));
+        Logger::end_section();
+        return Ok(());
+    }
+
+    mount_btrfs_root()?;
+    let snap_dir = pool::top_level().join("@snapshots");
+    let result = (|| -> Result<()> {
+        for name in &plan {
+            let target = dir.join(next.to_string());
+            fs::create_dir(&target).into_diagnostic()?;
+            // snapper expects read-only snapshots
+            run_change(
+                "btrfs",
+                &["subvolume", "snapshot", "-r", &snap_dir.join(name).to_string_lossy(), &target.join("snapshot").to_string_lossy()],
+                "Export Snapshot",
+            )?;
+            let kind = snapshots::kind_of(name);
+            let info = Info {
+                num: next,
+                kind: "single".to_string(),
+                date: Some(snapshots::parse_created(name).unwrap_or_else(Utc::now).naive_utc()),
+                description: format!("hammer {}", if kind.is_empty() { name.as_str() } else { kind.as_str() }),
+                userdata: vec![(ORIGIN_KEY.to_string(), name.clone())],
+            };
+            fs::write(target.join("info.xml"), render_info(&info)).into_diagnostic()?;
+            next += 1;
+        }
+        Ok(())
+    })();
+    umount_btrfs_root()?;
+    result?;
+
+    // No <cleanup> algorithm: snapper's timers leave exported snapshots alone
+    Logger::success(&format!("Exported {} snapshots to {}.", plan.len(), dir.display()));
+    Logger::end_section();
+    Ok(())
+}
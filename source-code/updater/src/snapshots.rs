@@ -0,0 +1,210 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::{DateTime, Local, NaiveDate, NaiveDateTime, SecondsFormat, TimeZone, Utc};
+use dialoguer::Select;
+use hammer_core::i18n::tr;
+use hammer_core::config::{self, NameClock};
+use hammer_core::{
+    mount_btrfs_root, packages, pool, state, storage, umount_btrfs_root, HammerError,
+};
+use std::io::IsTerminal;
+use std::path::Path;
+
+/// A snapshot in @snapshots with the metadata shown to users
+pub struct SnapshotEntry {
+    pub name: String,
+    pub created: Option<DateTime<Utc>>,
+    pub kind: String,
+    pub pinned: bool,
+    /// Package changes from this snapshot to the running system
+    pub diff: Option<packages::PackageDiff>,
+}
+
+/// Snapshot names look like "2025-11-30-201300-pre-update" (local time)
+/// or "2025-11-30-191300Z-pre-update" ([snapshots] name_clock = "utc")
+const NAME_TIME_FORMAT: &str = "%Y-%m-%d-%H%M%S";
+const NAME_TIME_LEN: usize = 17;
+
+/// Length of the timestamp at the start of `name` and the time it stands for
+fn split_created(name: &str) -> Option<(usize, DateTime<Utc>)> {
+    let time = NaiveDateTime::parse_from_str(name.get(..NAME_TIME_LEN)?, NAME_TIME_FORMAT).ok()?;
+    if name[NAME_TIME_LEN..].starts_with('Z') {
+        return Some((NAME_TIME_LEN + 1, Utc.from_utc_datetime(&time)));
+    }
+    Some((NAME_TIME_LEN, local_to_utc(time)))
+}
+
+pub fn parse_created(name: &str) -> Option<DateTime<Utc>> {
+    split_created(name).map(|(_, time)| time)
+}
+
+pub fn kind_of(name: &str) -> String {
+    match split_created(name) {
+        Some((len, _)) => name.get(len + 1..).unwrap_or("").to_string(),
+        None => String::new(),
+    }
+}
+
+/// Wall-clock time of this machine in UTC; the earlier one when the clock was turned back
+pub fn local_to_utc(time: NaiveDateTime) -> DateTime<Utc> {
+    Local
+    .from_local_datetime(&time)
+    .earliest()
+    .map(|t| t.with_timezone(&Utc))
+    .unwrap_or_else(|| Utc.from_utc_datetime(&time))
+}
+
+/// Name of a snapshot of `kind` taken at `time`, stamped with the clock from [snapshots] name_clock
+pub fn name_at(time: DateTime<Utc>, kind: &str) -> String {
+    match config::load().map(|c| c.snapshots.name_clock).unwrap_or_default() {
+        NameClock::Local => format!("{}-{}", time.with_timezone(&Local).format(NAME_TIME_FORMAT), kind),
+        NameClock::Utc => format!("{}Z-{}", time.format(NAME_TIME_FORMAT), kind),
+    }
+}
+
+/// "2025-11-30 20:13" in the local timezone, for people
+pub fn display_time(time: DateTime<Utc>) -> String {
+    time.with_timezone(&Local).format("%Y-%m-%d %H:%M").to_string()
+}
+
+/// "2025-11-30T19:13:00Z", for JSON, YAML, caches and scripts
+pub fn rfc3339(time: DateTime<Utc>) -> String {
+    time.to_rfc3339_opts(SecondsFormat::Secs, true)
+}
+
+/// All snapshots, newest first. Package diffs need the top-level mount and are optional.
+pub fn load_entries(with_diff: bool) -> Result<Vec<SnapshotEntry>> {
+    let driver = storage::driver()?;
+    let names = driver.list()?;
+    let pins = state::pinned_snapshots();
+
+    let mut entries: Vec<SnapshotEntry> = names
+    .iter()
+    .map(|name| SnapshotEntry {
+        name: name.clone(),
+        created: parse_created(name),
+        kind: kind_of(name),
+        pinned: pins.contains(name),
+        diff: None,
+    })
+    .collect();
+
+    // Only Btrfs snapshots can be read without mounting each one
+    if with_diff && !entries.is_empty() && matches!(driver, storage::Driver::Btrfs) {
+        let current = packages::installed_packages(Path::new("/"));
+        mount_btrfs_root()?;
+        let snap_dir = pool::top_level().join("@snapshots");
+        for entry in entries.iter_mut() {
+            let old = packages::installed_packages(&snap_dir.join(&entry.name));
+            if !old.is_empty() {
+                entry.diff = Some(packages::diff(&old, &current));
+            }
+        }
+        umount_btrfs_root()?;
+    }
+
+    entries.sort_by(|a, b| b.created.cmp(&a.created).then_with(|| b.name.cmp(&a.name)));
+    Ok(entries)
+}
+
+pub fn format_created(entry: &SnapshotEntry) -> String {
+    entry.created.map(display_time).unwrap_or_else(|| "-".to_string())
+}
+
+/// Numbered one-line description used by the picker
+pub fn describe(index: usize, entry: &SnapshotEntry) -> String {
+    let kind = if entry.kind.is_empty() { entry.name.as_str() } else { entry.kind.as_str() };
+    let diff = entry.diff.as_ref().map(|d| d.summary()).unwrap_or_else(|| "?".to_string());
+    let pin = if entry.pinned { " [pinned]" } else { "" };
+    format!("{: >3}. {}  {: <24} {: <14}{}", index + 1, format_created(entry), kind, diff, pin)
+}
+
+/// Lets the user choose a snapshot; None when there is nothing to choose
+pub fn pick(prompt: &str, entries: &[SnapshotEntry]) -> Result<Option<usize>> {
+    if entries.is_empty() {
+        return Ok(None);
+    }
+    let items: Vec<String> = entries.iter().enumerate().map(|(i, e)| describe(i, e)).collect();
+    let selection = Select::new()
+    .with_prompt(prompt)
+    .items(&items)
+    .default(0)
+    .interact()
+    .into_diagnostic()?;
+    Ok(Some(selection))
+}
+
+/// Accepts "2025-11-30 20:00", "2025-11-30 20:00:15", "2025-11-30T20:00" and "2025-11-30"
+pub fn parse_date_expr(expr: &str) -> Result<NaiveDateTime> {
+    let expr = expr.trim();
+    for format in ["%Y-%m-%d %H:%M:%S", "%Y-%m-%d %H:%M", "%Y-%m-%dT%H:%M:%S", "%Y-%m-%dT%H:%M"] {
+        if let Ok(t) = NaiveDateTime::parse_from_str(expr, format) {
+            return Ok(t);
+        }
+    }
+    if let Ok(d) = NaiveDate::parse_from_str(expr, "%Y-%m-%d") {
+        return Ok(d.and_hms_opt(0, 0, 0).unwrap());
+    }
+    Err(HammerError::ConfigError(format!("Cannot parse date '{}'. Use YYYY-MM-DD [HH:MM[:SS]].", expr)).into())
+}
+
+/// Every dash-separated part of the query must appear in the name,
+/// so "pre-update-2025" matches "2025-11-30-201300-pre-update".
+pub fn fuzzy_match(name: &str, query: &str) -> bool {
+    let name = name.to_lowercase();
+    query
+    .to_lowercase()
+    .split(|c: char| c == '-' || c == '_' || c.is_whitespace())
+    .filter(|t| !t.is_empty())
+    .all(|token| name.contains(token))
+}
+
+/// Resolves a partial name and/or a --before date to exactly one snapshot.
+/// Ambiguous matches are offered interactively on a terminal, otherwise listed in the error.
+pub fn resolve(query: Option<&str>, before: Option<&str>) -> Result<Option<String>> {
+    if query.is_none() && before.is_none() {
+        return Ok(None);
+    }
+
+    let mut entries = load_entries(false)?;
+
+    if let Some(q) = query {
+        if let Some(exact) = entries.iter().find(|e| e.name == q) {
+            return Ok(Some(exact.name.clone()));
+        }
+        if let Some(target) = state::aliases().get(q) {
+            return match entries.iter().find(|e| &e.name == target) {
+                Some(e) => Ok(Some(e.name.clone())),
+                None => Err(HammerError::ConfigError(format!("Alias '{}' points to {}, which no longer exists", q, target)).into()),
+            };
+        }
+        entries.retain(|e| fuzzy_match(&e.name, q));
+    }
+
+    if let Some(expr) = before {
+        let limit = local_to_utc(parse_date_expr(expr)?);
+        entries.retain(|e| e.created.map(|t| t < limit).unwrap_or(false));
+        // The newest snapshot before the date is the state "just before" it
+        entries.truncate(1);
+    }
+
+    match entries.len() {
+        0 => Err(HammerError::ConfigError(format!(
+            "No snapshot matches{}{}",
+            query.map(|q| format!(" '{}'", q)).unwrap_or_default(),
+            before.map(|b| format!(" before {}", b)).unwrap_or_default()
+        )).into()),
+        1 => Ok(Some(entries.remove(0).name)),
+        _ if std::io::stdin().is_terminal() => {
+            let picked = pick(tr("prompt.choose-snapshot"), &entries)?;
+            Ok(picked.map(|i| entries[i].name.clone()))
+        }
+        _ => {
+            let names: Vec<String> = entries.iter().map(|e| e.name.clone()).collect();
+            Err(HammerError::ConfigError(format!(
+                "'{}' is ambiguous. Candidates:\n  {}",
+                query.unwrap_or_default(),
+                names.join("\n  ")
+            )).into())
+        }
+    }
+}
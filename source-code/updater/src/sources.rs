@@ -0,0 +1,143 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::{NaiveDateTime, Utc};
+use hammer_core::{HammerError, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::snapshots;
+
+/// snapshot.debian.org timestamp format, always UTC
+const SNAPSHOT_FORMAT: &str = "%Y%m%dT%H%M%SZ";
+const SNAPSHOT_ARCHIVE: &str = "https://snapshot.debian.org/archive";
+
+/// Rewritten sources for a pinned update, relative to the target root
+const PINNED_DIR: &str = "etc/apt/hammer-pinned";
+
+/// (URL prefix, snapshot.debian.org archive)
+const DEBIAN_MIRRORS: &[(&str, &str)] = &[
+    ("deb.debian.org/debian-security", "debian-security"),
+    ("security.debian.org/debian-security", "debian-security"),
+    ("deb.debian.org/debian", "debian"),
+    ("ftp.debian.org/debian", "debian"),
+];
+
+/// Normalizes "20251130T200000Z", "2025-11-30" or "2025-11-30 20:00" (UTC)
+pub fn parse_timestamp(value: &str) -> Result<String> {
+    if NaiveDateTime::parse_from_str(value, SNAPSHOT_FORMAT).is_ok() {
+        return Ok(value.to_string());
+    }
+    let time = snapshots::parse_date_expr(value)
+    .map_err(|_| HammerError::ConfigError(format!(
+        "Invalid mirror timestamp '{}'. Use 20251130T200000Z or YYYY-MM-DD [HH:MM] (UTC).", value
+    )))?;
+    Ok(time.format(SNAPSHOT_FORMAT).to_string())
+}
+
+/// The snapshot.debian.org point that matches an update running now
+pub fn current_timestamp() -> String {
+    Utc::now().format(SNAPSHOT_FORMAT).to_string()
+}
+
+pub(crate) fn source_files(root: &Path) -> Vec<PathBuf> {
+    let apt = root.join("etc/apt");
+    let mut files = vec![apt.join("sources.list")];
+    if let Ok(entries) = fs::read_dir(apt.join("sources.list.d")) {
+        let mut parts: Vec<PathBuf> = entries
+        .flatten()
+        .map(|e| e.path())
+        .filter(|p| matches!(p.extension().and_then(|e| e.to_str()), Some("list") | Some("sources")))
+        .collect();
+        parts.sort();
+        files.extend(parts);
+    }
+    files.into_iter().filter(|f| f.exists()).collect()
+}
+
+/// All apt sources of a root as one text, for the journal
+pub fn capture(root: &Path) -> String {
+    source_files(root)
+    .iter()
+    .map(|f| {
+        let rel = f.strip_prefix(root).unwrap_or(f);
+        format!("# /{}\n{}", rel.display(), fs::read_to_string(f).unwrap_or_default().trim_end())
+    })
+    .collect::<Vec<_>>()
+    .join("\n\n")
+}
+
+/// Points Debian mirror URLs in one line at the snapshot archive
+fn rewrite_line(line: &str, timestamp: &str) -> (String, bool) {
+    let mut out = line.to_string();
+    for scheme in ["https://", "http://"] {
+        for (prefix, archive) in DEBIAN_MIRRORS {
+            let from = format!("{}{}", scheme, prefix);
+            let Some(pos) = out.find(&from) else { continue };
+            // Only whole path segments: ".../debian" but not ".../debian-security"
+            let rest = &out[pos + from.len()..];
+            if !(rest.is_empty() || rest.starts_with('/') || rest.starts_with(char::is_whitespace)) {
+                continue;
+            }
+            let rest = rest.trim_start_matches('/');
+            out = format!("{}{}/{}/{}/{}", &out[..pos], SNAPSHOT_ARCHIVE, archive, timestamp, rest);
+            return (out, true);
+        }
+    }
+    (out, false)
+}
+
+/// Writes the root's sources with Debian mirrors pinned to `timestamp`
+/// and returns the apt options that select them. Call `release` afterwards.
+pub fn pin(root: &Path, timestamp: &str) -> Result<Vec<String>> {
+    let dir = root.join(PINNED_DIR);
+    let _ = fs::remove_dir_all(&dir);
+    fs::create_dir_all(dir.join("sources.list.d")).into_diagnostic()?;
+
+    let mut unpinned = Vec::new();
+    for file in source_files(root) {
+        let mut pinned_any = false;
+        let content: Vec<String> = fs::read_to_string(&file)
+        .unwrap_or_default()
+        .lines()
+        .map(|line| {
+            let (line, changed) = rewrite_line(line, timestamp);
+            pinned_any |= changed;
+            line
+        })
+        .collect();
+
+        let name = file.file_name().unwrap_or_default();
+        if !pinned_any && content.iter().any(|l| !l.trim().is_empty() && !l.trim_start().starts_with('#')) {
+            unpinned.push(name.to_string_lossy().to_string());
+        }
+        let dest = if name == "sources.list" { dir.join(name) } else { dir.join("sources.list.d").join(name) };
+        fs::write(dest, content.join("\n") + "\n").into_diagnostic()?;
+    }
+
+    if !dir.join("sources.list").exists() {
+        fs::write(dir.join("sources.list"), "").into_diagnostic()?;
+    }
+    if !unpinned.is_empty() {
+        Logger::warn(&format!("Not on a Debian mirror, left unpinned: {}", unpinned.join(", ")));
+    }
+    Logger::info(&format!("Debian mirrors pinned to snapshot {}", timestamp));
+
+    // Paths as seen from inside the root
+    Ok(vec![
+        "-o".into(), format!("Dir::Etc::SourceList=/{}/sources.list", PINNED_DIR),
+        "-o".into(), format!("Dir::Etc::SourceParts=/{}/sources.list.d", PINNED_DIR),
+        // Snapshot Release files are past their Valid-Until date
+        "-o".into(), "Acquire::Check-Valid-Until=false".into(),
+    ])
+}
+
+/// apt command line with the pin options inserted after the program name
+pub fn with_options<'a>(command: &[&'a str], options: &'a [String]) -> Vec<&'a str> {
+    let mut args = vec![command[0]];
+    args.extend(options.iter().map(|o| o.as_str()));
+    args.extend(&command[1..]);
+    args
+}
+
+pub fn release(root: &Path) {
+    let _ = fs::remove_dir_all(root.join(PINNED_DIR));
+}
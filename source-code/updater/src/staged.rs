@@ -0,0 +1,374 @@
+use miette::Result;
+use hammer_core::i18n::{tr, tr_fmt};
+use hammer_core::config::{ConffilePolicy, UpdateConfig};
+use hammer_core::{
+    boot_assets, ensure_root_subvolume, events, journal, lsm, mount_btrfs_root, packages, pool,
+    run_change, state, storage, swap, umount_btrfs_root, HammerError, Logger,
+};
+use hammer_core::packages::PackageDiff;
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::Path;
+use std::time::Instant;
+
+use crate::{
+    changelog, composefs, compression, conffiles, create_snapshot_name, dedupe, dkms, environment, executor, integrity, layer, protect, sources, telemetry,
+};
+
+/// Working copy of @ that the update is applied to
+pub const UPDATE_SUBVOL: &str = "@update";
+
+fn delete_staged(staged: &Path) {
+    if staged.exists() {
+        let _ = run_change("btrfs", &["subvolume", "delete", &staged.to_string_lossy()], "Delete Staged Subvolume");
+    }
+}
+
+/// Creates a fresh @update from the running @ (a leftover one is discarded)
+fn create_staged(top: &Path) -> Result<std::path::PathBuf> {
+    let staged = top.join(UPDATE_SUBVOL);
+    if staged.exists() {
+        ensure_root_subvolume(&staged)?;
+    }
+    delete_staged(&staged);
+
+    let _swap = swap::suspend_blocking_swapfiles()?;
+    run_change("btrfs", &[
+        "subvolume", "snapshot",
+        &top.join("@").to_string_lossy(),
+        &staged.to_string_lossy(),
+    ], "Create Staged Subvolume")?;
+    if let Err(e) = compression::apply_to_new(&staged) {
+        Logger::warn(&format!("Compression property not set on @update: {}", e));
+    }
+    Ok(staged)
+}
+
+/// Makes @update the root used on next boot; the running root is kept as @bad-<date>
+fn switch_to_staged(top: &Path, staged: &Path) -> Result<()> {
+    ensure_root_subvolume(&top.join("@"))?;
+    ensure_root_subvolume(staged)?;
+    let timestamp = chrono::Local::now().format("%Y%m%d-%H%M%S");
+    let old_root = top.join(format!("@bad-{}", timestamp));
+    run_change("mv", &[&top.join("@").to_string_lossy(), &old_root.to_string_lossy()], "Rename current @")?;
+    run_change("mv", &[&staged.to_string_lossy(), &top.join("@").to_string_lossy()], "Promote @update")?;
+    Ok(())
+}
+
+/// The root the update is built in: @update, or the driver's own (overlay)
+fn stage(driver: &storage::Driver) -> Result<std::path::PathBuf> {
+    match driver {
+        storage::Driver::Btrfs => {
+            mount_btrfs_root()?;
+            create_staged(pool::top_level())
+        }
+        _ => driver.stage(),
+    }
+}
+
+fn discard(driver: &storage::Driver, staged: &Path) -> Result<()> {
+    match driver {
+        storage::Driver::Btrfs => {
+            delete_staged(staged);
+            umount_btrfs_root()
+        }
+        _ => driver.discard_staged(),
+    }
+}
+
+fn promote(driver: &storage::Driver, staged: &Path) -> Result<()> {
+    match driver {
+        storage::Driver::Btrfs => {
+            switch_to_staged(pool::top_level(), staged)?;
+            umount_btrfs_root()
+        }
+        _ => driver.promote_staged(),
+    }
+}
+
+/// Downloaded packages and apt's binary caches; what apt-get clean deletes
+const APT_CACHE: &[&str] = &["var/cache/apt/archives", "var/cache/apt/archives/partial", "var/cache/apt"];
+
+/// Empties the apt cache of a root without running apt in it. Returns the bytes freed.
+pub fn clean_apt_cache(root: &Path) -> u64 {
+    let mut freed = 0;
+    for dir in APT_CACHE {
+        for entry in fs::read_dir(root.join(dir)).into_iter().flatten().flatten() {
+            let path = entry.path();
+            let name = entry.file_name().to_string_lossy().to_string();
+            let cached = name.ends_with(".deb") || (*dir == "var/cache/apt" && name.ends_with(".bin"));
+            if !cached || !path.is_file() {
+                continue;
+            }
+            let size = entry.metadata().map(|m| m.len()).unwrap_or(0);
+            if fs::remove_file(&path).is_ok() {
+                freed += size;
+            }
+        }
+    }
+    freed
+}
+
+/// What runs in @update. `prepare` edits the staged root before apt (after it, for mirror
+/// pinning), `verify` checks it afterwards; an error from either discards @update.
+pub struct Plan<'a> {
+    pub title: &'a str,
+    /// Journal kind; the pre-snapshot is named pre-<kind>
+    pub kind: &'a str,
+    /// apt-get invocations; pin options are inserted after the program name
+    pub steps: Vec<Vec<&'a str>>,
+    pub prepare: Box<dyn Fn(&Path) -> Result<()> + 'a>,
+    pub verify: Box<dyn Fn(&Path) -> Result<()> + 'a>,
+    /// Journal attachments (name, content) recorded with the transaction
+    pub attachments: Vec<(&'a str, String)>,
+}
+
+impl<'a> Plan<'a> {
+    /// A regular update: apt-get update, the configured upgrade and the persistent
+    /// package layer (`state::layered_packages`), should the new base have dropped any of it
+    pub fn update(cfg: &'a UpdateConfig, layered: &'a [String]) -> Self {
+        let mut upgrade = vec!["apt-get"];
+        upgrade.extend(cfg.upgrade_args());
+        let mut steps = vec![vec!["apt-get", "update"], upgrade];
+        steps.extend(layer::reapply_step(layered));
+        Plan {
+            title: "STAGED SYSTEM UPDATE",
+            kind: "update",
+            steps,
+            prepare: Box::new(|_| Ok(())),
+            verify: Box::new(|_| Ok(())),
+            attachments: Vec::new(),
+        }
+    }
+}
+
+/// Runs the whole apt transaction in @update and switches to it for the next boot.
+/// The running system is never modified.
+pub fn handle_staged_update(cfg: &UpdateConfig) -> Result<()> {
+    let layered = state::layered_packages();
+    if run(cfg, Plan::update(cfg, &layered))? {
+        Ok(())
+    } else {
+        Err(HammerError::CommandFailed("Staged update failed; the running system is unchanged".to_string()).into())
+    }
+}
+
+/// Runs `plan`; true when the result was staged or there was nothing to change
+pub fn run(cfg: &UpdateConfig, plan: Plan) -> Result<bool> {
+    let executor = cfg.executor;
+    let driver = storage::driver()?;
+    if !driver.supports_staging() {
+        return Err(HammerError::ConfigError(format!(
+            "The {} storage driver has no staged deployments; use the live executor", driver.name()
+        )).into());
+    }
+    Logger::section(plan.title);
+    Logger::info(&format!("Executor: {}", executor.name()));
+    events::emit(events::Event::PreUpdate, None);
+
+    let started = Instant::now();
+    boot_assets::preflight()?;
+    let bootloader = started.elapsed();
+
+    let started = Instant::now();
+    let snap_name = create_snapshot_name(&format!("pre-{}", plan.kind));
+    driver.snapshot(&snap_name)?;
+    let snapshot = started.elapsed();
+
+    let packages_before = packages::installed_packages(Path::new("/"));
+    let mut tx = journal::Transaction::begin(&snap_name, plan.kind);
+    tx.phases.push(("bootloader".to_string(), bootloader.as_secs_f64()));
+    tx.phases.push(("snapshot".to_string(), snapshot.as_secs_f64()));
+    journal::save(&tx)?;
+    for (name, content) in &plan.attachments {
+        journal::attach(&snap_name, name, content)?;
+    }
+
+    let started = Instant::now();
+    let staged = stage(&driver)?;
+    tx.phase("stage", started);
+
+    // From here on @update exists and the pool is mounted: every way out promotes or
+    // discards it, and the transaction is never left running
+    let diff = match build(cfg, &plan, &driver, &staged, &snap_name, &mut tx, &packages_before) {
+        Ok(Built::Ready(diff)) => diff,
+        Ok(Built::Unchanged) => {
+            Logger::info(tr("update.up-to-date"));
+            discard(&driver, &staged)?;
+            tx.finish("unchanged")?;
+            telemetry::record_transaction(&tx);
+            Logger::end_section();
+            return Ok(true);
+        }
+        Ok(Built::Failed { dkms_failed }) => {
+            fail(&driver, &staged, &mut tx, &snap_name)?;
+            if dkms_failed {
+                dkms::offer_kernel_hold()?;
+            }
+            Logger::end_section();
+            return Ok(false);
+        }
+        Err(e) => {
+            if let Err(cleanup) = fail(&driver, &staged, &mut tx, &snap_name) {
+                Logger::warn(&format!("Cleanup after the failed update: {}", cleanup));
+            }
+            Logger::end_section();
+            return Err(e);
+        }
+    };
+
+    if let Err(e) = promote(&driver, &staged) {
+        tx.finish("failed")?;
+        telemetry::record_transaction(&tx);
+        events::emit(events::Event::UpdateFailed, Some(&snap_name));
+        if matches!(driver, storage::Driver::Btrfs) {
+            let _ = umount_btrfs_root();
+        }
+        Logger::error("Switching to @update failed. Check the subvolumes with: hammer recover");
+        Logger::end_section();
+        return Err(e);
+    }
+    tx.finish("success")?;
+    telemetry::record_transaction(&tx);
+
+    events::emit(events::Event::UpdateStaged, Some(&snap_name));
+    events::emit(events::Event::Switched, Some(&snap_name));
+    Logger::success(&tr_fmt("update.staged", &[&diff.summary()]));
+    Logger::end_section();
+    Ok(true)
+}
+
+enum Built {
+    /// @update is ready to be promoted
+    Ready(PackageDiff),
+    /// Nothing changed; @update can go
+    Unchanged,
+    /// The update failed inside @update; the cause is already reported
+    Failed { dkms_failed: bool },
+}
+
+/// Applies `plan` to `staged`, checks the result and prepares it for the next boot
+fn build(
+    cfg: &UpdateConfig,
+    plan: &Plan,
+    driver: &storage::Driver,
+    staged: &Path,
+    snap_name: &str,
+    tx: &mut journal::Transaction,
+    packages_before: &BTreeMap<String, String>,
+) -> Result<Built> {
+    let ok = match (plan.prepare)(staged) {
+        Ok(()) => apply(cfg, plan, staged, snap_name, tx)?,
+        Err(e) => {
+            Logger::error(&format!("{}", e));
+            false
+        }
+    };
+    let ok = ok && match (plan.verify)(staged) {
+        Ok(()) => true,
+        Err(e) => {
+            Logger::error(&format!("{}", e));
+            false
+        }
+    };
+    if !ok {
+        return Ok(Built::Failed { dkms_failed: false });
+    }
+
+    // An out-of-tree driver that stops building is the usual way an update breaks a machine
+    let started = Instant::now();
+    let checked = dkms::check(staged);
+    tx.phase("dkms check", started);
+    if let Some((kernel, failures)) = checked.filter(|(_, f)| !f.is_empty()) {
+        dkms::report(staged, &kernel, &failures);
+        if cfg.allow_dkms_failures {
+            Logger::warn("Switching anyway (allow_dkms_failures).");
+        } else {
+            return Ok(Built::Failed { dkms_failed: true });
+        }
+    }
+
+    let diff = packages::diff(packages_before, &packages::installed_packages(staged));
+    tx.set_packages(&diff);
+    if !diff.changed.is_empty() {
+        journal::attach(snap_name, "changelog", &changelog::collect(staged, &diff))?;
+    }
+
+    let lsms = lsm::active_lsms();
+    if !lsms.is_empty() {
+        let changes = lsm::diff_policy(&lsm::capture_policy(Path::new("/"), &lsms), &lsm::capture_policy(staged, &lsms));
+        lsm::report_changes(&changes);
+        lsm::prepare_first_boot(staged, &lsms);
+    }
+
+    if diff.is_empty() {
+        return Ok(Built::Unchanged);
+    }
+
+    if cfg.apt.conffiles == ConffilePolicy::Ask {
+        conffiles::resolve(staged)?;
+    }
+    if cfg.clean_cache {
+        let freed = clean_apt_cache(staged);
+        Logger::info(&format!("Cleared {} MiB of apt cache from @update.", freed / 1024 / 1024));
+    }
+    if cfg.dedupe && matches!(driver, storage::Driver::Btrfs) {
+        let started = Instant::now();
+        match dedupe::run(staged, &pool::top_level().join("@")) {
+            Ok(reclaimed) => Logger::info(&format!("Deduplicated @update against @: {} MiB shared.", reclaimed / 1024 / 1024)),
+            Err(e) => Logger::warn(&format!("Deduplication skipped: {}", e)),
+        }
+        tx.phase("dedupe", started);
+    }
+    let started = Instant::now();
+    if let Err(e) = integrity::record(staged) {
+        Logger::warn(&format!("Hash database not recorded: {}", e));
+    }
+    tx.phase("hashes", started);
+    protect::record(snap_name)?;
+    state::carry_over(staged)?;
+    if matches!(driver, storage::Driver::Btrfs) {
+        composefs::seal_deployment(staged, plan.kind);
+    }
+    Ok(Built::Ready(diff))
+}
+
+/// Throws @update away after a failed build and closes the transaction as failed
+fn fail(driver: &storage::Driver, staged: &Path, tx: &mut journal::Transaction, snap_name: &str) -> Result<()> {
+    Logger::error(tr("update.staged-failed"));
+    let discarded = discard(driver, staged);
+    tx.finish("failed")?;
+    telemetry::record_transaction(tx);
+    events::emit(events::Event::UpdateFailed, Some(snap_name));
+    discarded
+}
+
+/// Pins mirrors, records the sources and runs the plan's apt steps. Returns success.
+fn apply(cfg: &UpdateConfig, plan: &Plan, staged: &Path, snap_name: &str, tx: &mut journal::Transaction) -> Result<bool> {
+    let pinned = cfg.pin_mirror.as_deref().map(sources::parse_timestamp).transpose()?;
+    let mut apt_options = match &pinned {
+        Some(ts) => sources::pin(staged, ts)?,
+        None => Vec::new(),
+    };
+    apt_options.extend(cfg.apt.apt_args());
+    tx.mirror_snapshot = Some(pinned.unwrap_or_else(sources::current_timestamp));
+    journal::attach(snap_name, "sources", &sources::capture(staged))?;
+    journal::attach(snap_name, "env", &environment::capture(staged, &apt_options))?;
+
+    let mut ok = executor::preseed(cfg, staged)?;
+    for step in &plan.steps {
+        if !ok {
+            break;
+        }
+        let started = Instant::now();
+        ok = executor::run_in_root(cfg, staged, &sources::with_options(step, &apt_options))?;
+        tx.phase(&executor::phase_name(step), started);
+    }
+    if ok && cfg.autoremove {
+        let started = Instant::now();
+        ok = executor::autoremove(cfg, staged, &apt_options, snap_name)?;
+        tx.phase("apt autoremove", started);
+    }
+    sources::release(staged);
+    Ok(ok)
+}
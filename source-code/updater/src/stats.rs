@@ -0,0 +1,141 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::NaiveDateTime;
+use hammer_core::{journal, output, Logger};
+use serde::Serialize;
+
+use crate::status::{self, OutputFormat};
+
+/// A phase this much slower than its earlier average is reported
+const REGRESSION_FACTOR: f64 = 1.5;
+
+/// Phases shorter than this are too noisy to call a regression
+const REGRESSION_MIN_SECS: f64 = 5.0;
+
+/// Timing of one phase over the selected transactions
+#[derive(Serialize)]
+pub struct PhaseStats {
+    pub phase: String,
+    pub runs: usize,
+    pub average: f64,
+    pub min: f64,
+    pub max: f64,
+    pub last: f64,
+    /// Change of the newer half's average against the older half's, in percent
+    pub trend: Option<f64>,
+}
+
+fn mean(values: &[f64]) -> f64 {
+    values.iter().sum::<f64>() / values.len().max(1) as f64
+}
+
+fn summarize(phase: &str, values: &[f64]) -> PhaseStats {
+    let (older, newer) = values.split_at(values.len() / 2);
+    PhaseStats {
+        phase: phase.to_string(),
+        runs: values.len(),
+        average: mean(values),
+        min: values.iter().copied().fold(f64::INFINITY, f64::min),
+        max: values.iter().copied().fold(0.0, f64::max),
+        last: *values.last().unwrap_or(&0.0),
+        trend: (!older.is_empty() && mean(older) > 0.0).then(|| (mean(newer) / mean(older) - 1.0) * 100.0),
+    }
+}
+
+fn duration(tx: &journal::Transaction) -> Option<f64> {
+    let parse = |t: &str| NaiveDateTime::parse_from_str(t, "%Y-%m-%d %H:%M:%S").ok();
+    let secs = (parse(tx.finished.as_deref()?)? - parse(&tx.started)?).num_seconds();
+    Some(secs as f64)
+}
+
+fn human(secs: f64) -> String {
+    if secs >= 60.0 {
+        format!("{}m{:02}s", (secs / 60.0) as u64, (secs % 60.0) as u64)
+    } else {
+        format!("{:.1}s", secs)
+    }
+}
+
+/// Phase timings of the last `last` transactions of `kind`, in the order the phases run
+pub fn collect(kind: &str, last: usize) -> Vec<PhaseStats> {
+    let txs: Vec<journal::Transaction> = journal::list()
+    .into_iter()
+    .filter(|tx| tx.kind == kind && !tx.phases.is_empty() && tx.finished.is_some())
+    .collect();
+    let txs = &txs[txs.len().saturating_sub(last)..];
+
+    let mut order: Vec<String> = Vec::new();
+    for tx in txs {
+        for (phase, _) in &tx.phases {
+            if !order.contains(phase) {
+                order.push(phase.clone());
+            }
+        }
+    }
+    let mut stats: Vec<PhaseStats> = order
+    .iter()
+    .map(|phase| {
+        let values: Vec<f64> = txs
+        .iter()
+        .flat_map(|tx| tx.phases.iter().filter(|(p, _)| p == phase).map(|(_, s)| *s))
+        .collect();
+        summarize(phase, &values)
+    })
+    .collect();
+    let totals: Vec<f64> = txs.iter().filter_map(duration).collect();
+    if !totals.is_empty() {
+        stats.push(summarize("total", &totals));
+    }
+    stats
+}
+
+pub fn handle_stats(kind: &str, last: usize, format: OutputFormat) -> Result<()> {
+    let stats = collect(kind, last);
+    match format {
+        OutputFormat::Json => {
+            println!("{}", serde_json::to_string_pretty(&stats).into_diagnostic()?);
+            return Ok(());
+        }
+        OutputFormat::Yaml => {
+            for s in &stats {
+                println!("- phase: {}", status::yaml_string(&s.phase));
+                println!("  runs: {}", s.runs);
+                println!("  average: {:.1}", s.average);
+                println!("  min: {:.1}", s.min);
+                println!("  max: {:.1}", s.max);
+                println!("  last: {:.1}", s.last);
+                println!("  trend: {}", s.trend.map(|t| format!("{:.0}", t)).unwrap_or_else(|| "null".to_string()));
+            }
+            return Ok(());
+        }
+        OutputFormat::Table | OutputFormat::Wide => {}
+    }
+
+    if stats.is_empty() {
+        Logger::info(&format!("No timed '{}' transactions in the journal yet.", kind));
+        return Ok(());
+    }
+    let mut rows = vec![["PHASE", "RUNS", "AVERAGE", "MIN", "MAX", "LAST", "TREND"].map(String::from).to_vec()];
+    for s in &stats {
+        rows.push(vec![
+            s.phase.clone(),
+            s.runs.to_string(),
+            human(s.average),
+            human(s.min),
+            human(s.max),
+            human(s.last),
+            s.trend.map(|t| format!("{:+.0}%", t)).unwrap_or_else(|| "-".to_string()),
+        ]);
+    }
+    output::print_table(&rows);
+
+    for s in stats.iter().filter(|s| s.runs > 1) {
+        let earlier = (s.average * s.runs as f64 - s.last) / (s.runs - 1) as f64;
+        if s.last > REGRESSION_MIN_SECS && s.last > earlier * REGRESSION_FACTOR {
+            Logger::warn(&format!(
+                "{} took {} last time, {:.1}x its earlier average of {}.",
+                s.phase, human(s.last), s.last / earlier, human(earlier)
+            ));
+        }
+    }
+    Ok(())
+}
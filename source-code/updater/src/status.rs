@@ -0,0 +1,477 @@
+use miette::{IntoDiagnostic, Result};
+use chrono::{DateTime, Utc};
+use clap::ValueEnum;
+use hammer_core::config::Config;
+use hammer_core::{events, is_root, journal, mount_btrfs_root, output, pool, run_command, state, umount_btrfs_root, usage, HammerError, Logger};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::Path;
+use std::sync::mpsc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use crate::cache;
+use crate::health;
+use crate::snapshots;
+use crate::staged;
+use crate::timeshift;
+
+#[derive(Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum OutputFormat {
+    Table,
+    Wide,
+    Json,
+    Yaml,
+}
+
+#[derive(Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum SortKey {
+    Id,
+    Name,
+    Created,
+    Size,
+}
+
+/// One root subvolume: @, a snapshot, or a root replaced by a rollback (@bad-*)
+#[derive(Serialize, Deserialize, Clone)]
+pub struct DeploymentRow {
+    pub id: u64,
+    pub name: String,
+    pub path: String,
+    /// RFC 3339 in UTC; shown in the local timezone
+    pub created: Option<String>,
+    pub kind: String,
+    pub exclusive_bytes: Option<u64>,
+    pub state: Vec<String>,
+}
+
+/// "ID 257 gen 42 top level 5 path @snapshots/foo" -> (257, "@snapshots/foo")
+fn parse_subvolume_line(line: &str) -> Option<(u64, String)> {
+    let parts: Vec<&str> = line.split_whitespace().collect();
+    let id = parts.get(1)?.parse().ok()?;
+    let path_pos = parts.iter().position(|p| *p == "path")?;
+    Some((id, parts[path_pos + 1..].join(" ")))
+}
+
+/// Exclusive bytes per subvolume ID; empty when quotas are disabled
+fn qgroup_exclusive() -> HashMap<u64, u64> {
+    let top = pool::top_level().to_string_lossy();
+    let output = run_command("btrfs", &["qgroup", "show", "--raw", &top], "Query Qgroups").unwrap_or_default();
+    output
+    .lines()
+    .filter_map(|line| {
+        let parts: Vec<&str> = line.split_whitespace().collect();
+        let id = parts.first()?.strip_prefix("0/")?.parse().ok()?;
+        let excl = parts.get(2)?.parse().ok()?;
+        Some((id, excl))
+    })
+    .collect()
+}
+
+pub(crate) fn default_subvolume_id() -> Option<u64> {
+    let output = run_command("btrfs", &["subvolume", "get-default", "/"], "Get Default Subvolume").ok()?;
+    parse_subvolume_line(output.trim()).map(|(id, _)| id)
+}
+
+pub(crate) fn booted_subvolume_id() -> Option<u64> {
+    run_command("btrfs", &["inspect-internal", "rootid", "/"], "Booted Subvolume")
+    .ok()
+    .and_then(|s| s.trim().parse().ok())
+}
+
+/// Creation time for subvolumes whose name carries no timestamp ("2025-11-30 20:13:00 +0100")
+fn creation_time(path: &Path) -> Option<DateTime<Utc>> {
+    let output = run_command("btrfs", &["subvolume", "show", &path.to_string_lossy()], "Show Subvolume").ok()?;
+    output
+    .lines()
+    .find_map(|l| l.trim().strip_prefix("Creation time:"))
+    .and_then(|t| DateTime::parse_from_str(t.trim(), "%Y-%m-%d %H:%M:%S %z").ok())
+    .map(|t| t.with_timezone(&Utc))
+}
+
+/// `created` of a row in the local timezone; caches written by older versions hold local time already
+pub(crate) fn display_created(created: &str) -> String {
+    DateTime::parse_from_rfc3339(created)
+    .map(|t| snapshots::display_time(t.with_timezone(&Utc)))
+    .unwrap_or_else(|_| created.to_string())
+}
+
+fn is_root_subvolume(path: &str) -> bool {
+    path == "@" || path == staged::UPDATE_SUBVOL || path.starts_with("@bad-") || (path.starts_with("@snapshots/") && !path[11..].contains('/'))
+}
+
+/// Budget shared by the btrfs queries behind one status; optional ones that miss it are left out
+const COLLECT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// A query running on its own thread
+struct Pending<T>(mpsc::Receiver<T>);
+
+fn spawn<T: Send + 'static>(query: impl FnOnce() -> T + Send + 'static) -> Pending<T> {
+    let (tx, rx) = mpsc::channel();
+    thread::spawn(move || {
+        let _ = tx.send(query());
+    });
+    Pending(rx)
+}
+
+impl<T> Pending<T> {
+    /// The result, or None once `deadline` has passed
+    fn wait(self, deadline: Instant) -> Option<T> {
+        self.0.recv_timeout(deadline.saturating_duration_since(Instant::now())).ok()
+    }
+}
+
+/// Runs the subvolume list, default and booted IDs, qgroups and creation times
+/// side by side, so status takes as long as the slowest of them rather than their sum
+pub fn collect() -> Result<Vec<DeploymentRow>> {
+    let deadline = Instant::now() + COLLECT_TIMEOUT;
+    let booted = spawn(booted_subvolume_id);
+    let default = spawn(default_subvolume_id);
+    let top = mount_btrfs_root()?;
+    let list = spawn(move || run_command("btrfs", &["subvolume", "list", &top], "List Subvolumes"));
+    let exclusive = spawn(qgroup_exclusive);
+    let pins = state::pinned_snapshots();
+
+    let list = match list.wait(deadline) {
+        Some(Ok(list)) => list,
+        Some(Err(e)) => {
+            umount_btrfs_root()?;
+            return Err(e);
+        }
+        None => {
+            umount_btrfs_root()?;
+            return Err(HammerError::BtrfsError(format!(
+                "btrfs subvolume list did not finish within {}s", COLLECT_TIMEOUT.as_secs()
+            )).into());
+        }
+    };
+    let subvolumes: Vec<(u64, String)> = list.lines().filter_map(parse_subvolume_line).collect();
+
+    // Only @, @update and @bad-* carry no time in their name
+    let mut created_at: HashMap<u64, Pending<Option<DateTime<Utc>>>> = HashMap::new();
+    for (id, path) in &subvolumes {
+        if is_root_subvolume(path) && !path.starts_with("@snapshots/") {
+            let full = pool::top_level().join(path);
+            created_at.insert(*id, spawn(move || creation_time(&full)));
+        }
+    }
+
+    let mut missing = Vec::new();
+    let mut wait = |what: &'static str, pending: Pending<Option<u64>>| {
+        pending.wait(deadline).unwrap_or_else(|| {
+            missing.push(what);
+            None
+        })
+    };
+    let booted = wait("booted", booted);
+    let default = wait("default", default);
+    let exclusive = exclusive.wait(deadline).unwrap_or_else(|| {
+        missing.push("sizes");
+        HashMap::new()
+    });
+
+    let mut rows = Vec::new();
+    for (id, path) in subvolumes {
+        // Listed read-only; callers drop them unless [timeshift] adopt is set
+        if timeshift::is_root_snapshot(&path) {
+            if let Some((name, created, kind)) = timeshift::describe(&path, pool::top_level()) {
+                rows.push(DeploymentRow {
+                    id,
+                    name,
+                    path,
+                    created,
+                    kind,
+                    exclusive_bytes: exclusive.get(&id).copied(),
+                    state: vec!["read-only".to_string()],
+                });
+            }
+            continue;
+        }
+        if !is_root_subvolume(&path) {
+            continue;
+        }
+        let name = path.strip_prefix("@snapshots/").unwrap_or(&path).to_string();
+        let is_snapshot = path.starts_with("@snapshots/");
+
+        let created = match created_at.remove(&id) {
+            Some(pending) => pending.wait(deadline).unwrap_or_else(|| {
+                missing.push("creation times");
+                None
+            }),
+            None => snapshots::parse_created(&name),
+        }
+        .map(snapshots::rfc3339);
+        let kind = if is_snapshot {
+            snapshots::kind_of(&name)
+        } else if path == "@" {
+            "root".to_string()
+        } else if path == staged::UPDATE_SUBVOL {
+            "staged".to_string()
+        } else {
+            "replaced".to_string()
+        };
+
+        let mut row_state = Vec::new();
+        if Some(id) == booted {
+            row_state.push("booted".to_string());
+        }
+        if Some(id) == default {
+            row_state.push("default".to_string());
+        }
+        if pins.contains(&name) {
+            row_state.push("pinned".to_string());
+        }
+
+        rows.push(DeploymentRow {
+            id,
+            name,
+            path,
+            created,
+            kind,
+            exclusive_bytes: exclusive.get(&id).copied(),
+            state: row_state,
+        });
+    }
+    umount_btrfs_root()?;
+    if !missing.is_empty() {
+        missing.dedup();
+        Logger::warn(&format!("Left out after {}s: {}.", COLLECT_TIMEOUT.as_secs(), missing.join(", ")));
+    }
+    Ok(rows)
+}
+
+pub fn sort_rows(rows: &mut [DeploymentRow], key: SortKey, reverse: bool) {
+    match key {
+        SortKey::Id => rows.sort_by_key(|r| r.id),
+        SortKey::Name => rows.sort_by(|a, b| a.name.cmp(&b.name)),
+        SortKey::Created => rows.sort_by(|a, b| a.created.cmp(&b.created)),
+        SortKey::Size => rows.sort_by_key(|r| r.exclusive_bytes),
+    }
+    if reverse {
+        rows.reverse();
+    }
+}
+
+pub(crate) fn human_size(bytes: Option<u64>) -> String {
+    match bytes {
+        None => "-".to_string(),
+        Some(b) if b >= 1 << 30 => format!("{:.1}G", b as f64 / (1u64 << 30) as f64),
+        Some(b) if b >= 1 << 20 => format!("{:.1}M", b as f64 / (1u64 << 20) as f64),
+        Some(b) => format!("{}K", b / 1024),
+    }
+}
+
+/// Prints rows as aligned columns; the first row is the header
+pub(crate) fn yaml_string(s: &str) -> String {
+    // JSON strings are valid YAML scalars
+    serde_json::to_string(s).unwrap_or_default()
+}
+
+fn print_yaml(rows: &[DeploymentRow]) {
+    if rows.is_empty() {
+        println!("[]");
+    }
+    for row in rows {
+        println!("- id: {}", row.id);
+        println!("  name: {}", yaml_string(&row.name));
+        println!("  path: {}", yaml_string(&row.path));
+        println!("  created: {}", row.created.as_deref().map(yaml_string).unwrap_or_else(|| "null".to_string()));
+        println!("  kind: {}", yaml_string(&row.kind));
+        println!("  exclusive_bytes: {}", row.exclusive_bytes.map(|b| b.to_string()).unwrap_or_else(|| "null".to_string()));
+        println!("  state: [{}]", row.state.join(", "));
+    }
+}
+
+pub fn print_rows(rows: &[DeploymentRow], format: OutputFormat) -> Result<()> {
+    match format {
+        OutputFormat::Json => println!("{}", serde_json::to_string_pretty(rows).into_diagnostic()?),
+        OutputFormat::Yaml => print_yaml(rows),
+        OutputFormat::Table | OutputFormat::Wide => {
+            let wide = format == OutputFormat::Wide;
+            let mut table = vec![if wide {
+                vec!["ID", "NAME", "CREATED", "KIND", "EXCL", "STATE", "PATH"]
+            } else {
+                vec!["ID", "NAME", "CREATED", "STATE"]
+            }
+            .into_iter()
+            .map(String::from)
+            .collect::<Vec<String>>()];
+
+            for row in rows {
+                let created = row.created.as_deref().map(display_created).unwrap_or_else(|| "-".to_string());
+                let row_state = if row.state.is_empty() {
+                    "-".to_string()
+                } else {
+                    row.state.iter().map(|st| output::paint(st, output::state_tone(st))).collect::<Vec<_>>().join(",")
+                };
+                table.push(if wide {
+                    vec![
+                        row.id.to_string(), row.name.clone(), created, row.kind.clone(),
+                        human_size(row.exclusive_bytes), row_state, row.path.clone(),
+                    ]
+                } else {
+                    vec![row.id.to_string(), row.name.clone(), created, row_state]
+                });
+            }
+            output::print_table(&table);
+        }
+    }
+    Ok(())
+}
+
+fn prepare_output(format: OutputFormat) {
+    if matches!(format, OutputFormat::Json | OutputFormat::Yaml) {
+        Logger::use_stderr();
+    }
+}
+
+/// Warns when, at the recent growth rate, / fills up within `warn_days`
+fn check_forecast(warn_days: u32, format: OutputFormat) {
+    // Only root can append to the usage history
+    let sample = if is_root() { usage::record_throttled() } else { usage::current() };
+    let latest = match sample {
+        Ok(s) => s,
+        Err(_) => return,
+    };
+    let forecast = match usage::forecast(&usage::history(), &latest) {
+        Some(f) => f,
+        None => return,
+    };
+    let rate = human_size(Some(forecast.bytes_per_day.abs() as u64));
+    if format == OutputFormat::Wide {
+        let sign = if forecast.bytes_per_day < 0.0 { "-" } else { "+" };
+        println!("\nDisk: {} used of {}, {}{}/day", human_size(Some(latest.used)), human_size(Some(latest.size)), sign, rate);
+    }
+    if let Some(days) = forecast.days_until_full {
+        if days < warn_days as f64 {
+            Logger::warn(&format!(
+                "At the current rate (+{}/day) the filesystem is full in about {:.0} days. \
+                 Snapshots keep deleted data; free space with 'hammer clean' or 'hammer delete'.",
+                rate, days
+            ));
+        }
+    }
+}
+
+/// Live rows for root (refreshing the cache), cached rows and their age for everyone else
+pub(crate) fn load_rows() -> Result<(Vec<DeploymentRow>, Option<String>)> {
+    if is_root() {
+        let rows = collect()?;
+        let _ = cache::write_deployments(&rows);
+        return Ok((rows, None));
+    }
+    let cached = cache::read_deployments()?;
+    Ok((cached.rows, Some(cached.updated)))
+}
+
+fn note_cached(updated: &Option<String>, format: OutputFormat) {
+    if let (Some(updated), OutputFormat::Table | OutputFormat::Wide) = (updated, format) {
+        println!("\n{}", output::paint(format!("(cached {}; run as root for live data)", updated), output::Tone::Muted));
+    }
+}
+
+pub fn handle_status(format: OutputFormat, sort: SortKey, reverse: bool, cfg: &Config) -> Result<()> {
+    prepare_output(format);
+    if let (Some(ring), OutputFormat::Table | OutputFormat::Wide) = (cfg.fleet.ring, format) {
+        println!("Ring: {}\n", ring.name());
+    }
+    let (mut rows, updated) = load_rows()?;
+    let foreign = rows.iter().filter(|r| timeshift::is_managed(&r.path)).count();
+    if !cfg.timeshift.adopt {
+        rows.retain(|r| !timeshift::is_managed(&r.path));
+    }
+    sort_rows(&mut rows, sort, reverse);
+    print_rows(&rows, format)?;
+    note_cached(&updated, format);
+    if foreign > 0 && !cfg.timeshift.adopt {
+        Logger::info(&format!(
+            "{} Timeshift snapshots are left to Timeshift; set [timeshift] adopt = true to list them.",
+            foreign
+        ));
+    }
+    check_forecast(cfg.status.forecast_warn_days, format);
+    health::report(cfg.status.smart);
+    Ok(())
+}
+
+/// Snapshots only, oldest first by default
+pub fn handle_history(format: OutputFormat, sort: SortKey, reverse: bool) -> Result<()> {
+    prepare_output(format);
+    let (rows, updated) = load_rows()?;
+    let mut rows: Vec<DeploymentRow> = rows.into_iter().filter(|r| r.path.starts_with("@snapshots/")).collect();
+    sort_rows(&mut rows, sort, reverse);
+    print_rows(&rows, format)?;
+    note_cached(&updated, format);
+    Ok(())
+}
+
+/// Events shown below the table in watch mode
+const WATCH_EVENTS: usize = 5;
+
+/// Redraws status every `interval` seconds, or as soon as hammer emits an event
+pub fn handle_watch(interval: u64, sort: SortKey, reverse: bool, cfg: &Config) -> Result<()> {
+    loop {
+        let (mut rows, updated) = load_rows()?;
+        if !cfg.timeshift.adopt {
+            rows.retain(|r| !timeshift::is_managed(&r.path));
+        }
+        sort_rows(&mut rows, sort, reverse);
+
+        // Piped watch output becomes a log of snapshots instead of a redrawn screen
+        if output::fancy() {
+            print!("\x1b[2J\x1b[H");
+        } else {
+            println!("----");
+        }
+        println!(
+            "hammer status, every {}s: {} (Ctrl-C to quit)\n",
+            interval,
+            chrono::Local::now().format("%Y-%m-%d %H:%M:%S")
+        );
+        match journal::list().into_iter().rev().find(|tx| tx.finished.is_none()) {
+            Some(tx) => println!("{} {} {} since {}", output::paint("Running:", output::Tone::Warn), tx.kind, tx.id, tx.started),
+            None => println!("{}", output::paint("Idle", output::Tone::Good)),
+        }
+        if rows.iter().any(|r| r.path == staged::UPDATE_SUBVOL) {
+            println!(
+                "{} {} is being prepared or waits for its switch",
+                output::paint("Staged:", output::Tone::Accent),
+                staged::UPDATE_SUBVOL
+            );
+        }
+        println!();
+        print_rows(&rows, OutputFormat::Table)?;
+        note_cached(&updated, OutputFormat::Table);
+        if let Ok(disk) = usage::current() {
+            println!(
+                "\nDisk: {} used of {} ({} available)",
+                human_size(Some(disk.used)),
+                human_size(Some(disk.size)),
+                human_size(Some(disk.available))
+            );
+        }
+        let recent = events::recent(WATCH_EVENTS);
+        if !recent.is_empty() {
+            println!("\nRecent events:");
+            for line in recent {
+                println!("  {}", line);
+            }
+        }
+
+        wait_for_event(Duration::from_secs(interval));
+    }
+}
+
+/// Sleeps up to `timeout`, returning early when the event log changes
+fn wait_for_event(timeout: Duration) {
+    let modified = || fs::metadata(events::EVENT_LOG).and_then(|m| m.modified()).ok();
+    let start = modified();
+    let deadline = Instant::now() + timeout;
+    while Instant::now() < deadline {
+        thread::sleep(Duration::from_millis(250));
+        if modified() != start {
+            return;
+        }
+    }
+}
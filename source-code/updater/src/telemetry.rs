@@ -0,0 +1,168 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::exec::{self, Exec};
+use hammer_core::journal::Transaction;
+use hammer_core::state::STATE_DIR;
+use hammer_core::{config, store, HammerError, Logger};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use crate::release;
+
+// Opt-in update statistics, so the distribution learns how reliable updates are in the
+// field. Nothing is recorded or sent until an administrator runs `hammer telemetry enable`.
+// From then on every update and rollback queues one event saying how it ended, and the
+// queue is posted to [telemetry] endpoint; machines that are offline keep their events
+// until a later post gets through. An event names no host, machine ID, user or package:
+//
+//   {"kind": "update", "result": "failed", "seconds": 312, "day": "2026-10-15",
+//    "hammer": "0.4.0", "release": "trixie"}
+
+/// Events kept while the endpoint cannot be reached; the oldest are dropped first
+const QUEUE_LIMIT: usize = 200;
+const SEND_TIMEOUT: Duration = Duration::from_secs(15);
+
+fn enabled_file() -> PathBuf {
+    Path::new(STATE_DIR).join("telemetry-enabled")
+}
+
+fn queue_file() -> PathBuf {
+    Path::new(STATE_DIR).join("telemetry-queue.jsonl")
+}
+
+pub fn enabled() -> bool {
+    enabled_file().exists()
+}
+
+/// Events waiting to be sent, one JSON object per line
+fn queued() -> Vec<String> {
+    fs::read_to_string(queue_file())
+    .unwrap_or_default()
+    .lines()
+    .filter(|l| !l.trim().is_empty())
+    .map(str::to_string)
+    .collect()
+}
+
+fn event(kind: &str, result: &str, seconds: f64) -> serde_json::Value {
+    serde_json::json!({
+        "kind": kind,
+        "result": result,
+        "seconds": seconds.round() as u64,
+        "day": chrono::Utc::now().format("%Y-%m-%d").to_string(),
+        "hammer": env!("CARGO_PKG_VERSION"),
+        "release": release::codename(Path::new("/")),
+    })
+}
+
+fn endpoint() -> Result<String> {
+    config::load()?
+    .telemetry
+    .endpoint
+    .filter(|e| !e.is_empty())
+    .ok_or_else(|| HammerError::ConfigError("Telemetry needs [telemetry] endpoint in hammer.toml".into()).into())
+}
+
+/// Posts the queue as {"events": [...]} and empties it once the endpoint took it
+fn flush() -> Result<usize> {
+    let queue = queued();
+    if queue.is_empty() {
+        return Ok(0);
+    }
+    let body = format!("{{\"events\": [{}]}}", queue.join(", "));
+    let endpoint = endpoint()?;
+    Exec::new("curl", &["-fsS", "-H", "Content-Type: application/json", "--data-binary", &body, &endpoint], "Send Telemetry")
+    .timeout(SEND_TIMEOUT)
+    .output()?;
+    fs::remove_file(queue_file()).into_diagnostic()?;
+    Ok(queue.len())
+}
+
+fn write_queue(queue: &[String]) -> Result<()> {
+    store::write(&queue_file(), queue.join("\n") + "\n")
+}
+
+/// Adds an event to the queue without sending it; false when telemetry is off or the
+/// queue cannot be written
+pub fn queue(kind: &str, result: &str, seconds: f64) -> bool {
+    if !enabled() || exec::dry_run() {
+        return false;
+    }
+    let mut queue = queued();
+    queue.push(event(kind, result, seconds).to_string());
+    if queue.len() > QUEUE_LIMIT {
+        queue.drain(..queue.len() - QUEUE_LIMIT);
+    }
+    match write_queue(&queue) {
+        Ok(()) => true,
+        Err(e) => {
+            Logger::log(&format!("Telemetry event not queued: {}", e));
+            false
+        }
+    }
+}
+
+/// Takes back the newest queued event, one queued ahead of an outcome that turned out otherwise
+pub fn unqueue_last() {
+    let mut queue = queued();
+    if queue.pop().is_some() {
+        let _ = write_queue(&queue);
+    }
+}
+
+/// Sends the queue; what cannot be sent waits for the next event
+pub fn send() {
+    if !enabled() || exec::dry_run() {
+        return;
+    }
+    if let Err(e) = flush() {
+        Logger::log(&format!("Telemetry kept in the queue ({} events): {}", queued().len(), e));
+    }
+}
+
+/// Queues how an update or rollback ended and sends the queue. Telemetry must never
+/// fail or hold up the operation it describes, so problems only go to hammer.log.
+pub fn record(kind: &str, result: &str, seconds: f64) {
+    if queue(kind, result, seconds) {
+        send();
+    }
+}
+
+/// `record` for a finished journal transaction, timed by its phases
+pub fn record_transaction(tx: &Transaction) {
+    record(&tx.kind, &tx.result, tx.phases.iter().map(|(_, secs)| secs).sum());
+}
+
+pub fn handle_status() -> Result<()> {
+    let endpoint = config::load()?.telemetry.endpoint.filter(|e| !e.is_empty());
+    let queue = queued();
+    println!("Telemetry: {}", if enabled() { "enabled" } else { "disabled" });
+    println!("Endpoint:  {}", endpoint.as_deref().unwrap_or("not configured ([telemetry] endpoint)"));
+    println!("Queued:    {} event(s)", queue.len());
+    println!();
+    println!("An event, as sent:");
+    println!("  {}", queue.last().cloned().unwrap_or_else(|| event("update", "success", 312.0).to_string()));
+    Ok(())
+}
+
+pub fn handle_enable() -> Result<()> {
+    let endpoint = endpoint()?;
+    store::write(&enabled_file(), format!("{}\n", chrono::Utc::now().to_rfc3339()))?;
+    Logger::success(&format!("Telemetry enabled: the result of every update and rollback goes to {}.", endpoint));
+    Logger::info("Events name no host, user or package; see them with: hammer telemetry status");
+    Ok(())
+}
+
+pub fn handle_disable() -> Result<()> {
+    let dropped = queued().len();
+    for file in [enabled_file(), queue_file()] {
+        if file.exists() {
+            fs::remove_file(&file).into_diagnostic()?;
+        }
+    }
+    Logger::success("Telemetry disabled; nothing more is recorded or sent.");
+    if dropped > 0 {
+        Logger::info(&format!("Dropped {} unsent event(s).", dropped));
+    }
+    Ok(())
+}
@@ -0,0 +1,52 @@
+use chrono::NaiveDateTime;
+use serde::Deserialize;
+use std::fs;
+use std::path::Path;
+
+use crate::snapshots;
+
+/// Timeshift's btrfs snapshots, relative to the top-level subvolume:
+/// timeshift-btrfs/snapshots/<2025-11-30_20-13-01>/{@,@home}
+const PREFIX: &str = "timeshift-btrfs/";
+const SNAPSHOT_DIR: &str = "timeshift-btrfs/snapshots";
+const NAME_TIME_FORMAT: &str = "%Y-%m-%d_%H-%M-%S";
+
+#[derive(Deserialize, Default)]
+#[serde(default)]
+struct Info {
+    /// O(n demand), B(oot), H(ourly), D(aily), W(eekly), M(onthly), space separated
+    tags: String,
+    comments: String,
+}
+
+/// Subvolumes below timeshift-btrfs/ belong to Timeshift; hammer never changes them
+pub fn is_managed(path: &str) -> bool {
+    path.starts_with(PREFIX)
+}
+
+/// A Timeshift copy of @ (its @home copies are not deployments)
+pub fn is_root_snapshot(path: &str) -> bool {
+    is_managed(path) && path.ends_with("/@")
+}
+
+/// Name, creation time and kind shown for a Timeshift root snapshot
+pub fn describe(path: &str, top: &Path) -> Option<(String, Option<String>, String)> {
+    let dir = path.strip_prefix(SNAPSHOT_DIR)?.trim_start_matches('/').strip_suffix("/@")?;
+    let created = NaiveDateTime::parse_from_str(dir, NAME_TIME_FORMAT)
+    .ok()
+    .map(|t| snapshots::rfc3339(snapshots::local_to_utc(t)));
+
+    let info: Info = fs::read_to_string(top.join(SNAPSHOT_DIR).join(dir).join("info.json"))
+    .ok()
+    .and_then(|s| serde_json::from_str(&s).ok())
+    .unwrap_or_default();
+    let mut kind = String::from("timeshift");
+    let tags = info.tags.split_whitespace().collect::<Vec<_>>().join("");
+    if !tags.is_empty() {
+        kind = format!("{}-{}", kind, tags);
+    }
+    if !info.comments.trim().is_empty() {
+        kind = format!("{} ({})", kind, info.comments.trim());
+    }
+    Some((format!("timeshift/{}", dir), created, kind))
+}
@@ -0,0 +1,81 @@
+use hammer_core::config::{self, TransferConfig};
+use std::env;
+
+/// One pipeline stage: program and arguments
+pub type Stage = (&'static str, Vec<String>);
+
+fn on_path(program: &str) -> bool {
+    env::var_os("PATH")
+    .map(|path| env::split_paths(&path).any(|dir| dir.join(program).is_file()))
+    .unwrap_or(false)
+}
+
+/// Compression and buffering for send/receive streams, from [transfer]
+pub struct Transfer {
+    cfg: TransferConfig,
+}
+
+impl Transfer {
+    pub fn load() -> Self {
+        Transfer { cfg: config::load().map(|c| c.transfer).unwrap_or_default() }
+    }
+
+    fn pigz(&self) -> bool {
+        self.cfg.compressor == "pigz"
+    }
+
+    /// File extension of the configured compressor
+    pub fn extension(&self) -> &'static str {
+        if self.pigz() { ".gz" } else { ".zst" }
+    }
+
+    pub fn compress(&self) -> Stage {
+        if self.pigz() {
+            let mut args = vec!["-c".to_string()];
+            if self.cfg.threads > 0 {
+                args.extend(["-p".to_string(), self.cfg.threads.to_string()]);
+            }
+            if let Some(level) = self.cfg.level {
+                args.push(format!("-{}", level.min(9)));
+            }
+            ("pigz", args)
+        } else {
+            self.zstd()
+        }
+    }
+
+    /// zstd whatever the compressor setting, for streams whose format is fixed
+    pub fn zstd(&self) -> Stage {
+        let mut args = vec!["-q".to_string(), "-c".to_string(), format!("-T{}", self.cfg.threads)];
+        if let Some(level) = self.cfg.level {
+            // Levels above 19 need --ultra
+            if level > 19 {
+                args.push("--ultra".to_string());
+            }
+            args.push(format!("-{}", level.min(22)));
+        }
+        ("zstd", args)
+    }
+
+    /// Decompressor for a file name, if it is compressed
+    pub fn decompress(&self, name: &str) -> Option<Stage> {
+        if name.ends_with(".zst") {
+            // Decompression is single-threaded in zstd; -T is accepted for symmetry
+            Some(("zstd", vec!["-q".into(), "-d".into(), "-c".into()]))
+        } else if name.ends_with(".gz") {
+            // pigz decompresses on one core but reads, writes and checks on others
+            let program = if on_path("pigz") { "pigz" } else { "gzip" };
+            Some((program, vec!["-d".into(), "-c".into()]))
+        } else {
+            None
+        }
+    }
+
+    /// In-memory buffer that decouples bursty btrfs send/receive from the compressor
+    pub fn buffer(&self) -> Option<Stage> {
+        if self.cfg.buffer_mib == 0 || !on_path("mbuffer") {
+            return None;
+        }
+        Some(("mbuffer", vec!["-q".into(), "-m".into(), format!("{}M", self.cfg.buffer_mib)]))
+    }
+}
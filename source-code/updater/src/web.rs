@@ -0,0 +1,121 @@
+use miette::{IntoDiagnostic, Result};
+use hammer_core::config;
+use hammer_core::state::STATE_DIR;
+use hammer_core::{store, HammerError, Logger};
+use std::fs;
+use std::io::{self, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::os::unix::net::UnixStream;
+use std::path::Path;
+use std::thread;
+
+use crate::api::{self, RawRequest};
+
+const INDEX_HTML: &str = include_str!("../web/index.html");
+
+/// Generated on first start unless `[web] token` is set
+const TOKEN_FILE: &str = "web-token";
+
+/// Bearer token every /api request has to carry
+fn load_token() -> Result<String> {
+    let configured = config::load()?.web.token;
+    if !configured.is_empty() {
+        return Ok(configured);
+    }
+
+    let path = Path::new(STATE_DIR).join(TOKEN_FILE);
+    if let Ok(token) = fs::read_to_string(&path) {
+        if !token.trim().is_empty() {
+            return Ok(token.trim().to_string());
+        }
+    }
+
+    let mut bytes = [0u8; 24];
+    fs::File::open("/dev/urandom").into_diagnostic()?.read_exact(&mut bytes).into_diagnostic()?;
+    let token: String = bytes.iter().map(|b| format!("{:02x}", b)).collect();
+    store::write_mode(&path, &token, 0o600)?;
+    Logger::info(&format!("Generated web token in {}", path.display()));
+    Ok(token)
+}
+
+fn respond(stream: &mut TcpStream, status: &str, content_type: &str, body: &str) {
+    let _ = write!(
+        stream,
+        "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nX-Frame-Options: DENY\r\nConnection: close\r\n\r\n{}",
+        status, content_type, body.len(), body
+    );
+}
+
+/// Forwards an /api request to the API socket and copies the response back as-is
+fn proxy(stream: &mut TcpStream, request: &RawRequest, socket: &str) -> io::Result<()> {
+    let path = request.path.strip_prefix("/api").unwrap_or(&request.path);
+    let mut upstream = UnixStream::connect(socket)?;
+    write!(
+        upstream,
+        "{} {} HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        request.method, path, request.body.len()
+    )?;
+    upstream.write_all(&request.body)?;
+    io::copy(&mut upstream, stream)?;
+    Ok(())
+}
+
+/// Compares every byte whatever the first difference, so the time taken does not reveal the token
+fn token_matches(given: &str, token: &str) -> bool {
+    given.len() == token.len() && given.bytes().zip(token.bytes()).fold(0, |diff, (a, b)| diff | (a ^ b)) == 0
+}
+
+fn handle_connection(mut stream: TcpStream, token: &str, socket: &str) {
+    if stream.set_read_timeout(Some(api::READ_TIMEOUT)).is_err() {
+        return;
+    }
+    let request = match api::read_raw(&stream) {
+        Some(r) => r,
+        None => return respond(&mut stream, "400 Bad Request", "text/plain", "malformed request"),
+    };
+
+    if request.method == "GET" && (request.path == "/" || request.path == "/index.html") {
+        return respond(&mut stream, "200 OK", "text/html; charset=utf-8", INDEX_HTML);
+    }
+    if !request.path.starts_with("/api/") {
+        return respond(&mut stream, "404 Not Found", "text/plain", "not found");
+    }
+
+    let authorized = request
+    .header("authorization")
+    .and_then(|h| h.strip_prefix("Bearer "))
+    .is_some_and(|given| token_matches(given, token));
+    if !authorized {
+        return respond(&mut stream, "401 Unauthorized", "application/json", r#"{"error":"invalid token"}"#);
+    }
+    if let Err(e) = proxy(&mut stream, &request, socket) {
+        respond(&mut stream, "502 Bad Gateway", "application/json", &format!(r#"{{"error":"API unavailable: {}"}}"#, e));
+    }
+}
+
+/// Serves the browser UI and proxies its calls to the local API socket
+pub fn handle_web(listen: &str, socket: &str) -> Result<()> {
+    let token = load_token()?;
+    if !Path::new(socket).exists() {
+        Logger::warn(&format!("{} does not exist yet. Start the API with 'hammer serve'.", socket));
+    }
+
+    let listener = TcpListener::bind(listen)
+    .map_err(|e| HammerError::IoError(format!("Cannot listen on {}: {}", listen, e)))?;
+    Logger::info(&format!("Web dashboard on http://{}/", listen));
+    if !listener.local_addr().map(|a| a.ip().is_loopback()).unwrap_or(false) {
+        Logger::warn("Not listening on loopback: the token and every API call cross the network unencrypted. Put a TLS proxy in front or use an SSH tunnel.");
+    }
+
+    for stream in listener.incoming() {
+        match stream {
+            Ok(stream) => {
+                let token = token.clone();
+                let socket = socket.to_string();
+                thread::spawn(move || handle_connection(stream, &token, &socket));
+            }
+            Err(e) => Logger::warn(&format!("Web connection failed: {}", e)),
+        }
+    }
+    Ok(())
+}